@@ -0,0 +1,472 @@
+// Package client is a small Go SDK for go-chat bots and tools. It speaks
+// the server's newline-delimited JSON protocol: Connect authenticates and
+// joins, callbacks receive typed events, and methods send messages and
+// commands.
+//
+//	c := client.New(client.Config{Addr: "chat.example.com:8080", Username: "deploybot", Token: token})
+//	c.OnMessage(func(m client.Message) {
+//		if m.Text == "!status" {
+//			c.Send("all green")
+//		}
+//	})
+//	if err := c.Connect(ctx); err != nil {
+//		log.Fatal(err)
+//	}
+//	c.Join("ops", "")
+//	log.Fatal(c.Wait())
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"chat-server/server/models"
+)
+
+// DefaultKeepAlive is how often an idle connection is kept open, well
+// inside the server's default ten minute read timeout
+const DefaultKeepAlive = time.Minute
+
+// ErrClosed is returned by methods called after the connection ended
+var ErrClosed = errors.New("client: connection closed")
+
+// Who may join a lobby, as reported in Lobby.Access
+const (
+	AccessPublic     = models.AccessPublic
+	AccessPrivate    = models.AccessPrivate // needs a password
+	AccessInviteOnly = models.AccessInviteOnly
+	AccessArchived   = models.AccessArchived
+)
+
+// Config says where to connect and who as
+type Config struct {
+	Addr     string
+	Username string
+	Token    string      // a bot token from /bot create
+	Password string      // the password of a registered account, for non-bots
+	TLS      *tls.Config // nil connects without TLS
+
+	// KeepAlive is how often to write to an idle connection so the server
+	// doesn't time it out. Zero means DefaultKeepAlive; negative disables it.
+	KeepAlive time.Duration
+}
+
+// Message is a lobby message, private message, AI response or topic change
+type Message struct {
+	ID    uint64 // 0 for private messages, topics and AI responses
+	Lobby string
+	From  string
+	To    string // the recipient of a private message
+	Text  string
+	Time  time.Time
+}
+
+// Presence is a user joining or leaving a lobby
+type Presence struct {
+	Lobby string
+	User  string
+	Time  time.Time
+}
+
+// Lobby is one entry of a lobby list
+type Lobby struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Owner       string `json:"owner"`
+	Access      string `json:"access"` // AccessPublic, AccessPrivate, AccessInviteOnly or AccessArchived
+	Users       int    `json:"users"`
+}
+
+// User is one entry of a user list
+type User struct {
+	Username string `json:"username"`
+	Profile  string `json:"profile"`
+	Role     string `json:"role"`
+	Bot      bool   `json:"bot"`
+}
+
+// event is one line from the server
+type event struct {
+	Type      string    `json:"type"`
+	Lobby     string    `json:"lobby"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	ID        uint64    `json:"id"`
+	Text      string    `json:"text"`
+	Lobbies   []Lobby   `json:"lobbies"`
+	Users     []User    `json:"users"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// command is one line to the server
+type command struct {
+	Type     string `json:"type"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Lobby    string `json:"lobby,omitempty"`
+	To       string `json:"to,omitempty"`
+	Text     string `json:"text,omitempty"`
+}
+
+type callbacks struct {
+	message    func(Message)
+	dm         func(Message)
+	aiResponse func(Message)
+	topic      func(Message)
+	join       func(Presence)
+	leave      func(Presence)
+	notice     func(string)
+	error      func(string)
+	lobbies    func([]Lobby)
+	users      func(string, []User)
+}
+
+// Client is a connection to a chat server. Set callbacks before Connect;
+// they run one at a time on the goroutine reading from the server, so a
+// slow callback holds up the events after it.
+type Client struct {
+	cfg Config
+
+	mu      sync.Mutex // guards cb, conn writes and lobby
+	cb      callbacks
+	conn    net.Conn
+	scanner *bufio.Scanner
+	lobby   string
+	closing bool
+
+	done chan struct{}
+	err  error // why the connection ended; read after done is closed
+}
+
+// New returns a client for cfg. Nothing happens until Connect.
+func New(cfg Config) *Client {
+	if cfg.KeepAlive == 0 {
+		cfg.KeepAlive = DefaultKeepAlive
+	}
+	return &Client{cfg: cfg, done: make(chan struct{})}
+}
+
+// OnMessage is called for each message posted in the client's lobby
+func (c *Client) OnMessage(fn func(Message)) { c.set(func(cb *callbacks) { cb.message = fn }) }
+
+// OnDM is called for private messages the client sends or receives
+func (c *Client) OnDM(fn func(Message)) { c.set(func(cb *callbacks) { cb.dm = fn }) }
+
+// OnAIResponse is called with each AI answer in the client's lobby
+func (c *Client) OnAIResponse(fn func(Message)) { c.set(func(cb *callbacks) { cb.aiResponse = fn }) }
+
+// OnTopic is called when the description of the client's lobby changes
+func (c *Client) OnTopic(fn func(Message)) { c.set(func(cb *callbacks) { cb.topic = fn }) }
+
+// OnJoin is called when a user, the client included, joins its lobby
+func (c *Client) OnJoin(fn func(Presence)) { c.set(func(cb *callbacks) { cb.join = fn }) }
+
+// OnLeave is called when a user leaves the client's lobby
+func (c *Client) OnLeave(fn func(Presence)) { c.set(func(cb *callbacks) { cb.leave = fn }) }
+
+// OnNotice is called with any other server output, such as command results
+func (c *Client) OnNotice(fn func(string)) { c.set(func(cb *callbacks) { cb.notice = fn }) }
+
+// OnError is called when the server refuses something the client sent
+func (c *Client) OnError(fn func(string)) { c.set(func(cb *callbacks) { cb.error = fn }) }
+
+// OnLobbies is called with the answer to Lobbies
+func (c *Client) OnLobbies(fn func([]Lobby)) { c.set(func(cb *callbacks) { cb.lobbies = fn }) }
+
+// OnUsers is called with the answer to Users
+func (c *Client) OnUsers(fn func(lobby string, users []User)) {
+	c.set(func(cb *callbacks) { cb.users = fn })
+}
+
+func (c *Client) set(change func(*callbacks)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	change(&c.cb)
+}
+
+// Connect dials the server, switches to the JSON protocol and joins as
+// the configured user, returning once it is in the general lobby and,
+// with a password, logged in. Cancelling ctx aborts the handshake. If
+// Connect fails, the client is done: Wait returns the same error.
+func (c *Client) Connect(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			c.err = err
+			close(c.done)
+		}
+	}()
+
+	var conn net.Conn
+	if c.cfg.TLS != nil {
+		dialer := &tls.Dialer{Config: c.cfg.TLS}
+		conn, err = dialer.DialContext(ctx, "tcp", c.cfg.Addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", c.cfg.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("client: dial %s: %w", c.cfg.Addr, err)
+	}
+
+	// Unblock reads and writes if ctx ends during the handshake
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	if err := c.handshake(conn); err != nil {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if !stop() {
+		conn.Close()
+		return ctx.Err()
+	}
+
+	go c.read()
+	if c.cfg.KeepAlive > 0 {
+		go c.keepAlive()
+	}
+	return nil
+}
+
+func (c *Client) handshake(conn net.Conn) error {
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	c.scanner = bufio.NewScanner(conn)
+	c.scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	if _, err := conn.Write([]byte("PROTO json\n")); err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	// The welcome banner comes before the protocol switches
+	if _, err := c.next(func(ev event) bool { return ev.Type == "hello" }); err != nil {
+		return err
+	}
+
+	hello := command{Type: "hello", Username: c.cfg.Username, Token: c.cfg.Token}
+	if c.cfg.Token == "" {
+		hello.Password = c.cfg.Password
+	}
+	if err := c.send(hello); err != nil {
+		return err
+	}
+	joined, err := c.next(func(ev event) bool { return ev.Type == "join" && ev.From == c.cfg.Username })
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.lobby = joined.Lobby
+	c.mu.Unlock()
+	c.dispatch(joined)
+
+	if hello.Password != "" {
+		loggedIn := "Logged in as '" + c.cfg.Username + "'"
+		if _, err := c.next(func(ev event) bool { return strings.HasPrefix(ev.Text, loggedIn) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next reads events until one matches, failing on an error event. Events
+// that arrive after the client joined are passed to the callbacks.
+func (c *Client) next(match func(event) bool) (event, error) {
+	for c.scanner.Scan() {
+		var ev event
+		if json.Unmarshal(c.scanner.Bytes(), &ev) != nil || ev.Type == "" {
+			continue
+		}
+		switch {
+		case match(ev):
+			return ev, nil
+		case ev.Type == "error":
+			return ev, fmt.Errorf("client: server refused: %s", ev.Text)
+		}
+		c.mu.Lock()
+		joined := c.lobby != ""
+		c.mu.Unlock()
+		if joined {
+			c.dispatch(ev)
+		}
+	}
+	if err := c.scanner.Err(); err != nil {
+		return event{}, fmt.Errorf("client: %w", err)
+	}
+	return event{}, ErrClosed
+}
+
+// read passes events to the callbacks until the connection ends
+func (c *Client) read() {
+	for c.scanner.Scan() {
+		var ev event
+		if json.Unmarshal(c.scanner.Bytes(), &ev) == nil {
+			c.dispatch(ev)
+		}
+	}
+	err := c.scanner.Err()
+	c.mu.Lock()
+	closing := c.closing
+	c.mu.Unlock()
+	switch {
+	case closing:
+		c.err = nil
+	case err == nil:
+		c.err = ErrClosed
+	default:
+		c.err = fmt.Errorf("client: %w", err)
+	}
+	close(c.done)
+}
+
+// keepAlive writes an empty line whenever the connection has been quiet
+// for a while; the server skips it but counts it as activity
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(c.cfg.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			c.conn.Write([]byte("\n"))
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *Client) dispatch(ev event) {
+	c.mu.Lock()
+	cb := c.cb
+	if ev.Type == "join" && ev.From == c.cfg.Username {
+		c.lobby = ev.Lobby
+	}
+	c.mu.Unlock()
+
+	msg := Message{ID: ev.ID, Lobby: ev.Lobby, From: ev.From, To: ev.To, Text: ev.Text, Time: ev.Timestamp}
+	presence := Presence{Lobby: ev.Lobby, User: ev.From, Time: ev.Timestamp}
+	switch {
+	case ev.Type == "message" && cb.message != nil:
+		cb.message(msg)
+	case ev.Type == "dm" && cb.dm != nil:
+		cb.dm(msg)
+	case ev.Type == "ai_response" && cb.aiResponse != nil:
+		cb.aiResponse(msg)
+	case ev.Type == "topic" && cb.topic != nil:
+		cb.topic(msg)
+	case ev.Type == "join" && cb.join != nil:
+		cb.join(presence)
+	case ev.Type == "leave" && cb.leave != nil:
+		cb.leave(presence)
+	case ev.Type == "notice" && cb.notice != nil:
+		cb.notice(ev.Text)
+	case ev.Type == "error" && cb.error != nil:
+		cb.error(ev.Text)
+	case ev.Type == "lobby_list" && cb.lobbies != nil:
+		cb.lobbies(ev.Lobbies)
+	case ev.Type == "user_list" && cb.users != nil:
+		cb.users(ev.Lobby, ev.Users)
+	}
+}
+
+func (c *Client) send(cmd command) error {
+	line, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return ErrClosed
+	}
+	if _, err := c.conn.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	return nil
+}
+
+// Lobby returns the lobby the client is in
+func (c *Client) Lobby() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lobby
+}
+
+// Send posts text to the client's lobby
+func (c *Client) Send(text string) error {
+	return c.send(command{Type: "message", Text: text})
+}
+
+// DM sends a private message
+func (c *Client) DM(to, text string) error {
+	return c.send(command{Type: "dm", To: to, Text: text})
+}
+
+// Join moves the client to another lobby; password is only needed for a
+// password-protected one
+func (c *Client) Join(lobby, password string) error {
+	return c.send(command{Type: "join", Lobby: lobby, Password: password})
+}
+
+// JoinWithInvite moves the client to an invite-only lobby using the token
+// of an invitation
+func (c *Client) JoinWithInvite(lobby, token string) error {
+	return c.send(command{Type: "join", Lobby: lobby, Token: token})
+}
+
+// Ask puts a question to the AI in the client's lobby; the answer arrives
+// through OnAIResponse
+func (c *Client) Ask(question string) error {
+	return c.send(command{Type: "ai", Text: question})
+}
+
+// Command runs a chat command such as "/history 20". Its output arrives
+// through OnNotice and OnError.
+func (c *Client) Command(line string) error {
+	return c.send(command{Type: "command", Text: line})
+}
+
+// Lobbies asks for the lobby list, which arrives through OnLobbies
+func (c *Client) Lobbies() error {
+	return c.send(command{Type: "lobbies"})
+}
+
+// Users asks for the users of the client's lobby, which arrive through
+// OnUsers
+func (c *Client) Users() error {
+	return c.send(command{Type: "users"})
+}
+
+// Wait blocks until the connection ends, returning why, or nil after Close
+func (c *Client) Wait() error {
+	<-c.done
+	return c.err
+}
+
+// Done is closed when the connection ends
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close says goodbye and disconnects
+func (c *Client) Close() error {
+	c.send(command{Type: "quit"})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closing = true
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
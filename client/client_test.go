@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-server/server"
+	"chat-server/server/config"
+	"chat-server/server/handlers"
+	"chat-server/server/storage"
+)
+
+// startServer runs a chat server on a loopback port and returns its
+// address and a bot token for "deploybot"
+func startServer(t *testing.T) (string, string) {
+	t.Helper()
+	store := storage.NewMemoryStore()
+	token, err := handlers.NewAccountManager(store).CreateBot("deploybot", "root")
+	if err != nil {
+		t.Fatalf("CreateBot: %v", err)
+	}
+	s := server.NewServer(config.Default(), store)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		s.Shutdown()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.HandleConnection(conn)
+		}
+	}()
+	return listener.Addr().String(), token
+}
+
+// unissuedToken looks like a bot token but was never issued
+const unissuedToken = handlers.BotTokenPrefix + "0123456789abcdef"
+
+func connect(t *testing.T, c *Client) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect as %s: %v", c.cfg.Username, err)
+	}
+	t.Cleanup(func() { c.Close() })
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected event never arrived")
+		panic("unreachable")
+	}
+}
+
+func TestClient(t *testing.T) {
+	addr, token := startServer(t)
+
+	alice := New(Config{Addr: addr, Username: "alice"})
+	aliceMessages := make(chan Message, 10)
+	aliceDMs := make(chan Message, 10)
+	aliceUsers := make(chan []User, 1)
+	aliceLeaves := make(chan Presence, 10)
+	alice.OnMessage(func(m Message) { aliceMessages <- m })
+	alice.OnDM(func(m Message) { aliceDMs <- m })
+	alice.OnUsers(func(_ string, users []User) { aliceUsers <- users })
+	alice.OnLeave(func(p Presence) { aliceLeaves <- p })
+	connect(t, alice)
+	if alice.Lobby() != "general" {
+		t.Errorf("alice is in %q; want general", alice.Lobby())
+	}
+
+	bot := New(Config{Addr: addr, Username: "deploybot", Token: token})
+	bot.OnMessage(func(m Message) {
+		if m.Text == "!status" {
+			bot.Send("all green, " + m.From)
+		}
+	})
+	connect(t, bot)
+
+	alice.Send("!status")
+	if m := receive(t, aliceMessages); m.From != "alice" || m.Text != "!status" {
+		t.Errorf("first message = %+v", m)
+	}
+	if m := receive(t, aliceMessages); m.From != "deploybot" || m.Text != "all green, alice" || m.ID == 0 {
+		t.Errorf("bot reply = %+v", m)
+	}
+
+	bot.DM("alice", "deploy finished")
+	if m := receive(t, aliceDMs); m.From != "deploybot" || m.To != "alice" || m.Text != "deploy finished" {
+		t.Errorf("dm = %+v", m)
+	}
+
+	alice.Users()
+	users := receive(t, aliceUsers)
+	if len(users) != 2 || users[0].Username != "alice" || users[0].Bot || !users[1].Bot {
+		t.Errorf("users = %+v", users)
+	}
+
+	bot.Close()
+	if err := bot.Wait(); err != nil {
+		t.Errorf("Wait after Close = %v", err)
+	}
+	if p := receive(t, aliceLeaves); p.User != "deploybot" {
+		t.Errorf("leave = %+v", p)
+	}
+}
+
+func TestClientRefused(t *testing.T) {
+	addr, _ := startServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := New(Config{Addr: addr, Username: "deploybot", Token: unissuedToken}).Connect(ctx)
+	if err == nil || !strings.Contains(err.Error(), "Invalid bot name or token") {
+		t.Errorf("Connect with a wrong token = %v", err)
+	}
+
+	c := New(Config{Addr: addr, Username: "AI"})
+	err = c.Connect(ctx)
+	if err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Errorf("Connect as AI = %v", err)
+	}
+	select {
+	case <-c.Done():
+		if waitErr := c.Wait(); waitErr != err {
+			t.Errorf("Wait after a failed Connect = %v; want %v", waitErr, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Wait blocks after a failed Connect")
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,12 +16,29 @@ import (
 
 	"chat-server/server"
 	"chat-server/server/ai"
+	"chat-server/server/config"
+	"chat-server/server/metrics"
+	"chat-server/server/middleware"
+	"chat-server/server/storage"
 	"chat-server/server/utils"
+	"chat-server/server/web"
+	"github.com/joho/godotenv"
 )
 
 func main() {
-	port := ":8080"
-	tlsPort := ":8443"
+	// .env may hold CHAT_* overrides as well as the AI key
+	godotenv.Load()
+
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	applyRuntimeSettings(cfg)
+
+	port := cfg.Server.Addr
 
 	// Context for graceful shutdown
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
@@ -31,38 +51,47 @@ func main() {
 	}
 	defer listener.Close()
 
-	// Optional TLS listener
+	// Optional TLS listener; the certificate is re-read on SIGHUP
 	var tlsListener net.Listener
+	var certs *config.CertReloader
 	hasTLS := false
-	if fileExists("server.crt") && fileExists("server.key") {
-		cert, err := tls.LoadX509KeyPair("server.crt", "server.key")
+	if cfg.Server.TLSAddr != "" && fileExists(cfg.Server.CertFile) && fileExists(cfg.Server.KeyFile) {
+		certs, err = config.NewCertReloader(cfg.Server.CertFile, cfg.Server.KeyFile)
 		if err != nil {
 			log.Println("Failed to load TLS certificate:", err)
 		} else {
-			config := &tls.Config{Certificates: []tls.Certificate{cert}}
-			tlsListener, err = tls.Listen("tcp", tlsPort, config)
+			tlsListener, err = tls.Listen("tcp", cfg.Server.TLSAddr, certs.TLSConfig())
 			if err != nil {
 				log.Println("Failed to listen on TLS port:", err)
 			} else {
 				hasTLS = true
 				defer tlsListener.Close()
-				fmt.Println(utils.ColorGreen + "TLS enabled on port 8443" + utils.ColorReset)
+				fmt.Println(utils.ColorGreen + "TLS enabled on " + cfg.Server.TLSAddr + utils.ColorReset)
 			}
 		}
 	}
 
-	// Initialize server
-	srv := server.NewServer()
-	srv.Start()
+	// Persistent storage for lobbies, history and profiles
+	store, err := storage.OpenBolt(cfg.Server.StorePath)
+	if err != nil {
+		log.Fatal("Error opening store:", err)
+	}
+	defer store.Close()
+
+	// Initialize server and restore saved state before accepting connections
+	srv := server.NewServer(cfg, store)
+	if err := srv.Start(); err != nil {
+		log.Fatal("Error restoring server state:", err)
+	}
 
 	// Display startup banner
 	displayStartupBanner(port)
 
 	// Initialize AI (optional)
 	if err := ai.InitAI(); err != nil {
-		fmt.Println(utils.ColorYellow + "    [!] AI features disabled (no API key)" + utils.ColorReset)
+		fmt.Println(utils.ColorYellow + "    [!] AI features disabled (" + err.Error() + ")" + utils.ColorReset)
 	} else {
-		fmt.Println(utils.ColorGreen + "    [✓] AI features enabled" + utils.ColorReset)
+		fmt.Println(utils.ColorGreen + "    [✓] AI features enabled (" + cfg.AI.Provider + ")" + utils.ColorReset)
 	}
 
 	fmt.Println(utils.ColorCyan + "\n    >> Server ready - Waiting for connections...\n" + utils.ColorReset)
@@ -86,7 +115,7 @@ func main() {
 
 	// TLS accept loop (if enabled)
 	if hasTLS {
-		fmt.Println(utils.ColorGreen + "TLS listener successfully started on 8443" + utils.ColorReset)
+		fmt.Println(utils.ColorGreen + "TLS listener successfully started on " + cfg.Server.TLSAddr + utils.ColorReset)
 		go func() {
 			for {
 				conn, err := tlsListener.Accept()
@@ -104,6 +133,99 @@ func main() {
 		}()
 	}
 
+	// WebSocket gateway and browser client (optional)
+	var webServer *http.Server
+	if cfg.Server.WebAddr != "" {
+		webServer = &http.Server{Addr: cfg.Server.WebAddr, Handler: web.NewHandler(srv.HandleConnection)}
+		go func() {
+			if err := webServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Println("Failed to start WebSocket gateway:", err)
+			}
+		}()
+		fmt.Println(utils.ColorGreen + "WebSocket gateway listening on " + cfg.Server.WebAddr + utils.ColorReset)
+	}
+
+	// IRC gateway (optional)
+	var ircListener net.Listener
+	if cfg.Server.IRCAddr != "" {
+		ircListener, err = net.Listen("tcp", cfg.Server.IRCAddr)
+		if err != nil {
+			log.Println("Failed to start IRC gateway:", err)
+		} else {
+			defer ircListener.Close()
+			fmt.Println(utils.ColorGreen + "IRC gateway listening on " + cfg.Server.IRCAddr + utils.ColorReset)
+			go func() {
+				for {
+					conn, err := ircListener.Accept()
+					if err != nil {
+						select {
+						case <-ctx.Done():
+							return
+						default:
+							log.Println("Failed to accept IRC connection:", err)
+							continue
+						}
+					}
+					go srv.HandleIRCConnection(conn)
+				}
+			}()
+		}
+	}
+
+	// SSH frontend (optional)
+	var sshListener net.Listener
+	if cfg.Server.SSHAddr != "" {
+		sshConfig, err := srv.NewSSHConfig(cfg.Server.SSHHostKey)
+		if err == nil {
+			sshListener, err = net.Listen("tcp", cfg.Server.SSHAddr)
+		}
+		if err != nil {
+			log.Println("Failed to start SSH frontend:", err)
+		} else {
+			defer sshListener.Close()
+			fmt.Println(utils.ColorGreen + "SSH frontend listening on " + cfg.Server.SSHAddr + utils.ColorReset)
+			go func() {
+				for {
+					conn, err := sshListener.Accept()
+					if err != nil {
+						select {
+						case <-ctx.Done():
+							return
+						default:
+							log.Println("Failed to accept SSH connection:", err)
+							continue
+						}
+					}
+					go srv.HandleSSHConnection(conn, sshConfig)
+				}
+			}()
+		}
+	}
+
+	// Prometheus metrics (optional)
+	var metricsServer *http.Server
+	if cfg.Server.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{Addr: cfg.Server.MetricsAddr, Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Println("Failed to start metrics listener:", err)
+			}
+		}()
+		fmt.Println(utils.ColorGreen + "Metrics available on " + cfg.Server.MetricsAddr + "/metrics" + utils.ColorReset)
+	}
+
+	// Reload configuration and certificates on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			cfg = reload(cfg, srv, certs)
+		}
+	}()
+
 	// Wait for shutdown signal
 	<-ctx.Done()
 	fmt.Println(utils.ColorYellow + "Server is shutting down..." + utils.ColorReset)
@@ -112,11 +234,77 @@ func main() {
 	if hasTLS {
 		tlsListener.Close()
 	}
+	if webServer != nil {
+		webServer.Close()
+	}
+	if ircListener != nil {
+		ircListener.Close()
+	}
+	if sshListener != nil {
+		sshListener.Close()
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
 	srv.Shutdown()
 
 	fmt.Println(utils.ColorGreen + "GoodBye" + utils.ColorReset)
 }
 
+// applyRuntimeSettings pushes configured limits into the packages that enforce them
+func applyRuntimeSettings(cfg *config.Config) {
+	middleware.Configure(middleware.Limits{
+		MaxMessagesPerWindow:    cfg.Limits.MaxMessagesPerWindow,
+		BotMaxMessagesPerWindow: cfg.Limits.BotMaxMessagesPerWindow,
+		RateLimitWindow:         cfg.Limits.RateLimitWindow,
+		MaxConnectionsPerIP:     cfg.Limits.MaxConnectionsPerIP,
+	})
+	utils.SetLimits(cfg.Limits.MaxUsernameLength, cfg.Limits.MaxMessageLength)
+	ai.Configure(ai.Settings{
+		Provider:           cfg.AI.Provider,
+		BaseURL:            cfg.AI.BaseURL,
+		Model:              cfg.AI.Model,
+		ContextTimeout:     cfg.AI.ContextTimeout,
+		MaxContextMessages: cfg.AI.MaxContextMessages,
+		RequestTimeout:     cfg.AI.RequestTimeout,
+	})
+}
+
+// reload re-reads the configuration and applies what can change without a
+// restart. It returns the configuration now in effect; on error the
+// current one is kept.
+func reload(current *config.Config, srv *server.Server, certs *config.CertReloader) *config.Config {
+	log.Println("SIGHUP received, reloading configuration")
+	next, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Println("Reload failed, keeping current configuration:", err)
+		return current
+	}
+
+	for _, name := range current.RestartRequired(next) {
+		log.Printf("Setting %s changed but cannot be reloaded; restart the server to apply it", name)
+	}
+
+	applyRuntimeSettings(next)
+	srv.Reload(next)
+	if err := ai.InitAI(); err != nil {
+		log.Println("AI features disabled:", err)
+	}
+
+	if certs != nil {
+		if err := certs.Reload(next.Server.CertFile, next.Server.KeyFile); err != nil {
+			log.Println("Keeping current TLS certificate:", err)
+		} else {
+			log.Println("TLS certificate reloaded from", next.Server.CertFile)
+		}
+	} else if next.Server.TLSAddr != "" && fileExists(next.Server.CertFile) && fileExists(next.Server.KeyFile) {
+		log.Println("TLS is not running; restart the server to enable it")
+	}
+
+	log.Println("Configuration reloaded")
+	return next
+}
+
 func displayStartupBanner(port string) {
 	bannerLines := []string{
 		"",
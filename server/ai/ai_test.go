@@ -1,8 +1,17 @@
 package ai
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestFormatAIError(t *testing.T) {
@@ -26,3 +35,266 @@ func TestFormatAIError(t *testing.T) {
 		})
 	}
 }
+
+func newConversations() (map[string]*ConversationHistory, *sync.Mutex) {
+	return make(map[string]*ConversationHistory), &sync.Mutex{}
+}
+
+func noLobbyContext(string) string { return "" }
+
+func TestHandleAIChatWithMockProvider(t *testing.T) {
+	SetProvider(MockProvider{})
+	defer SetProvider(nil)
+	convs, mu := newConversations()
+
+	reply, err := HandleAIChat(context.Background(), "hello", "general", "bob", convs, mu, noLobbyContext)
+	if err != nil || reply != "mock reply #1: bob asked: hello" {
+		t.Fatalf("first reply = %q, %v", reply, err)
+	}
+	reply, _ = HandleAIChat(context.Background(), "again", "general", "alice", convs, mu, noLobbyContext)
+	if reply != "mock reply #2: alice asked: again" {
+		t.Errorf("second reply = %q; want the mock to see both turns", reply)
+	}
+
+	want := []Message{
+		{RoleUser, "bob asked: hello"},
+		{RoleAssistant, "mock reply #1: bob asked: hello"},
+		{RoleUser, "alice asked: again"},
+		{RoleAssistant, "mock reply #2: alice asked: again"},
+	}
+	if got := convs["general"].Messages; !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %+v; want %+v", got, want)
+	}
+}
+
+type failingProvider struct{}
+
+func (failingProvider) Name() string { return "failing" }
+func (failingProvider) Generate(context.Context, string, []Message, Options) (string, error) {
+	return "", errors.New("quota exceeded")
+}
+
+func TestHandleAIChatErrors(t *testing.T) {
+	convs, mu := newConversations()
+
+	SetProvider(nil)
+	if _, err := HandleAIChat(context.Background(), "hi", "general", "bob", convs, mu, noLobbyContext); err == nil {
+		t.Error("HandleAIChat without a provider succeeded")
+	}
+
+	SetProvider(failingProvider{})
+	defer SetProvider(nil)
+	if _, err := HandleAIChat(context.Background(), "hi", "general", "bob", convs, mu, noLobbyContext); err == nil {
+		t.Error("provider error was not returned")
+	}
+	if n := len(convs["general"].Messages); n != 0 {
+		t.Errorf("failed question left %d messages in the history", n)
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	messages := []Message{
+		{RoleUser, "1"}, {RoleAssistant, "2"}, {RoleUser, "3"}, {RoleAssistant, "4"}, {RoleUser, "5"},
+	}
+	got := trimHistory(messages, 4)
+	if len(got) != 3 || got[0].Text != "3" {
+		t.Errorf("trimHistory = %+v; want it to start at the user turn \"3\"", got)
+	}
+}
+
+func TestMessageDecodesLegacyFormat(t *testing.T) {
+	var got []Message
+	data := `[{"role":"user","parts":[{"text":"hi"}]},{"role":"model","parts":[{"text":"hey"}]},{"role":"user","text":"new"}]`
+	if err := json.Unmarshal([]byte(data), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []Message{{RoleUser, "hi"}, {RoleAssistant, "hey"}, {RoleUser, "new"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v; want %+v", got, want)
+	}
+}
+
+// recordingServer answers every request with reply and keeps the last request
+func recordingServer(t *testing.T, reply string) (*httptest.Server, *http.Request, *map[string]interface{}) {
+	t.Helper()
+	var lastReq http.Request
+	var lastBody map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastReq = *r
+		json.NewDecoder(r.Body).Decode(&lastBody)
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &lastReq, &lastBody
+}
+
+var conversation = []Message{{RoleUser, "hi"}, {RoleAssistant, "hey"}, {RoleUser, "how are you?"}}
+
+func TestGeminiProvider(t *testing.T) {
+	srv, req, body := recordingServer(t, `{"candidates":[{"content":{"parts":[{"text":"fine"}]}}]}`)
+	p := &GeminiProvider{APIKey: "k", BaseURL: srv.URL}
+
+	reply, err := p.Generate(context.Background(), "be nice", conversation, Options{Model: "gemini-test"})
+	if err != nil || reply != "fine" {
+		t.Fatalf("Generate = %q, %v", reply, err)
+	}
+	if req.URL.Path != "/models/gemini-test:generateContent" || req.Header.Get("x-goog-api-key") != "k" {
+		t.Errorf("request went to %s with key %q", req.URL.Path, req.Header.Get("x-goog-api-key"))
+	}
+	encoded, _ := json.Marshal(*body)
+	for _, want := range []string{`"systemInstruction":{"parts":[{"text":"be nice"}]}`, `"role":"model"`} {
+		if !strings.Contains(string(encoded), want) {
+			t.Errorf("request body %s missing %s", encoded, want)
+		}
+	}
+}
+
+func TestOpenAIProvider(t *testing.T) {
+	srv, req, body := recordingServer(t, `{"choices":[{"message":{"role":"assistant","content":"fine"}}]}`)
+	p := &OpenAIProvider{APIKey: "k", BaseURL: srv.URL + "/v1/"}
+
+	reply, err := p.Generate(context.Background(), "be nice", conversation, Options{Model: "llama3"})
+	if err != nil || reply != "fine" {
+		t.Fatalf("Generate = %q, %v", reply, err)
+	}
+	if req.URL.Path != "/v1/chat/completions" || req.Header.Get("Authorization") != "Bearer k" {
+		t.Errorf("request went to %s with auth %q", req.URL.Path, req.Header.Get("Authorization"))
+	}
+	messages := (*body)["messages"].([]interface{})
+	if len(messages) != 4 || messages[0].(map[string]interface{})["role"] != "system" {
+		t.Errorf("messages = %v; want the system prompt first", messages)
+	}
+	if (*body)["model"] != "llama3" {
+		t.Errorf("model = %v; want llama3", (*body)["model"])
+	}
+}
+
+func TestProviderAPIError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	for _, p := range []Provider{&GeminiProvider{BaseURL: srv.URL}, &OpenAIProvider{BaseURL: srv.URL}} {
+		_, err := p.Generate(context.Background(), "", conversation, Options{})
+		if got := FormatAIError(err); got != "AI Error: Rate limit reached. Please wait and try again." {
+			t.Errorf("%s: FormatAIError(%v) = %q", p.Name(), err, got)
+		}
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(k string) string { return vars[k] }
+	}
+	tests := []struct {
+		settings Settings
+		env      map[string]string
+		want     string
+	}{
+		{Settings{Provider: ProviderGemini}, map[string]string{"GEMINI_API_KEY": "k"}, ProviderGemini},
+		{Settings{Provider: ProviderGemini}, nil, ""},
+		{Settings{Provider: ProviderOpenAI, BaseURL: "http://localhost:11434/v1"}, nil, ProviderOpenAI},
+		{Settings{Provider: ProviderOpenAI}, nil, ""},
+		{Settings{Provider: ProviderMock}, nil, ProviderMock},
+		{Settings{Provider: "skynet"}, nil, ""},
+	}
+	for _, tc := range tests {
+		p, err := NewProvider(tc.settings, env(tc.env))
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("NewProvider(%+v) succeeded; want error", tc.settings)
+		case tc.want != "" && (err != nil || p.Name() != tc.want):
+			t.Errorf("NewProvider(%+v) = %v, %v; want %s", tc.settings, p, err, tc.want)
+		}
+	}
+}
+
+// sseServer replies with the given data lines as a server-sent event stream
+func sseServer(t *testing.T, lines ...string) (*httptest.Server, *http.Request) {
+	t.Helper()
+	var lastReq http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastReq = *r
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, line := range lines {
+			io.WriteString(w, "data: "+line+"\n\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &lastReq
+}
+
+func collect(t *testing.T, s Streamer) ([]string, string) {
+	t.Helper()
+	var chunks []string
+	reply, err := s.Stream(context.Background(), "", conversation, Options{Model: "m"}, func(c string) {
+		chunks = append(chunks, c)
+	})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	return chunks, reply
+}
+
+func TestGeminiStream(t *testing.T) {
+	srv, req := sseServer(t,
+		`{"candidates":[{"content":{"parts":[{"text":"Hel"}]}}]}`,
+		`{"candidates":[{"content":{"parts":[{"text":"lo"}]}}]}`,
+	)
+	chunks, reply := collect(t, &GeminiProvider{BaseURL: srv.URL})
+	if !reflect.DeepEqual(chunks, []string{"Hel", "lo"}) || reply != "Hello" {
+		t.Errorf("chunks %q, reply %q; want [Hel lo], Hello", chunks, reply)
+	}
+	if req.URL.Path != "/models/m:streamGenerateContent" || req.URL.Query().Get("alt") != "sse" {
+		t.Errorf("request went to %s", req.URL)
+	}
+}
+
+func TestOpenAIStream(t *testing.T) {
+	srv, _ := sseServer(t,
+		`{"choices":[{"delta":{"role":"assistant"}}]}`,
+		`{"choices":[{"delta":{"content":"Hel"}}]}`,
+		`{"choices":[{"delta":{"content":"lo"}}]}`,
+		`[DONE]`,
+	)
+	chunks, reply := collect(t, &OpenAIProvider{BaseURL: srv.URL})
+	if !reflect.DeepEqual(chunks, []string{"Hel", "lo"}) || reply != "Hello" {
+		t.Errorf("chunks %q, reply %q; want [Hel lo], Hello", chunks, reply)
+	}
+}
+
+func TestMockStreamMatchesGenerate(t *testing.T) {
+	chunks, reply := collect(t, MockProvider{})
+	if strings.Join(chunks, "") != reply || len(chunks) < 2 {
+		t.Errorf("chunks %q do not add up to %q", chunks, reply)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := (MockProvider{Delay: time.Millisecond}).Stream(ctx, "", conversation, Options{}, func(string) {}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Stream on a cancelled context = %v; want context.Canceled", err)
+	}
+}
+
+// wholeProvider only implements Generate
+type wholeProvider struct{}
+
+func (wholeProvider) Name() string { return "whole" }
+func (wholeProvider) Generate(context.Context, string, []Message, Options) (string, error) {
+	return "all at once", nil
+}
+
+func TestStreamAIChatFallsBackToGenerate(t *testing.T) {
+	SetProvider(wholeProvider{})
+	defer SetProvider(nil)
+	convs, mu := newConversations()
+
+	var chunks []string
+	reply, err := StreamAIChat(context.Background(), "hi", "general", "bob", convs, mu, noLobbyContext,
+		func(c string) { chunks = append(chunks, c) })
+	if err != nil || reply != "all at once" || !reflect.DeepEqual(chunks, []string{"all at once"}) {
+		t.Errorf("StreamAIChat = %q, %v with chunks %q", reply, err, chunks)
+	}
+}
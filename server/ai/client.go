@@ -1,35 +1,78 @@
 package ai
 
 import (
-	"bytes"
+	"chat-server/server/metrics"
 	"context"
-	"encoding/json"
 	"fmt"
-	"github.com/joho/godotenv"
-	"io"
-	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
-var geminiAPIKey string
+var (
+	provider      Provider
+	providerMutex sync.RWMutex
 
-// InitAI initializes the AI client with API key from environment
-func InitAI() error {
-	if err := godotenv.Load(); err != nil {
-		return fmt.Errorf("Warning: .env file not found.")
-	}
-	geminiAPIKey = os.Getenv("GEMINI_API_KEY")
-	if geminiAPIKey == "" {
-		return fmt.Errorf("GEMINI_API_KEY environment variable not set")
+	settings = Settings{
+		Provider:           ProviderGemini,
+		Model:              GeminiModel,
+		ContextTimeout:     AIContextTimeout,
+		MaxContextMessages: MaxAIContextMessages,
+		RequestTimeout:     AIRequestTimeout,
 	}
-	return nil
+	settingsMutex sync.RWMutex
+
+	requestsTotal = metrics.NewCounterVec("chat_ai_requests_total",
+		"AI requests, by result.", "result")
+	requestDuration = metrics.NewHistogram("chat_ai_request_duration_seconds",
+		"Time taken to answer an AI request, including failures.", metrics.DefaultBuckets)
+)
+
+// Configure replaces the active AI settings. A change of provider or base
+// URL takes effect on the next InitAI.
+func Configure(s Settings) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	settings = s
+}
+
+func currentSettings() Settings {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return settings
+}
+
+// RequestTimeout returns how long a single AI request may take
+func RequestTimeout() time.Duration {
+	return currentSettings().RequestTimeout
+}
+
+// InitAI selects the configured provider, reading API keys from the
+// environment. On error AI features stay disabled.
+func InitAI() error {
+	p, err := NewProvider(currentSettings(), os.Getenv)
+	SetProvider(p)
+	return err
+}
+
+// SetProvider replaces the provider used by HandleAIChat; nil disables AI
+func SetProvider(p Provider) {
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+	provider = p
 }
 
-// GetAPIKey returns the current API key (for internal use)
-func GetAPIKey() string {
-	return geminiAPIKey
+// CurrentProvider returns the active provider, or nil if AI is disabled
+func CurrentProvider() Provider {
+	providerMutex.RLock()
+	defer providerMutex.RUnlock()
+	return provider
+}
+
+// Available reports whether AI features are enabled
+func Available() bool {
+	return CurrentProvider() != nil
 }
 
 // HandleAIChat processes AI requests with conversation context
@@ -38,11 +81,41 @@ func HandleAIChat(ctx context.Context, userPrompt, lobbyName, username string,
 	convMutex interface{},
 	getLobbyContextFn func(string) string) (string, error) {
 
-	if geminiAPIKey == "" {
-		return "", fmt.Errorf("AI not initialized")
+	return StreamAIChat(ctx, userPrompt, lobbyName, username, conversations, convMutex, getLobbyContextFn, nil)
+}
+
+// StreamAIChat is HandleAIChat with incremental delivery: onChunk receives
+// each piece of the reply as the provider produces it. Providers that
+// cannot stream deliver the whole reply in one chunk. The conversation is
+// only updated once the reply is complete.
+func StreamAIChat(ctx context.Context, userPrompt, lobbyName, username string,
+	conversations map[string]*ConversationHistory,
+	convMutex interface{},
+	getLobbyContextFn func(string) string,
+	onChunk func(string)) (string, error) {
+
+	start := time.Now()
+	reply, err := chat(ctx, userPrompt, lobbyName, username, conversations, convMutex, getLobbyContextFn, onChunk)
+	requestDuration.ObserveSince(start)
+	if err != nil {
+		requestsTotal.Inc("error")
+	} else {
+		requestsTotal.Inc("ok")
 	}
+	return reply, err
+}
 
-	guideline := GetAIPromptForLobby(lobbyName)
+func chat(ctx context.Context, userPrompt, lobbyName, username string,
+	conversations map[string]*ConversationHistory,
+	convMutex interface{},
+	getLobbyContextFn func(string) string,
+	onChunk func(string)) (string, error) {
+
+	p := CurrentProvider()
+	if p == nil {
+		return "", fmt.Errorf("AI not initialized")
+	}
+	cfg := currentSettings()
 
 	// Type assertion for mutex (passed as interface{} to avoid circular import)
 	mutex, ok := convMutex.(interface {
@@ -56,10 +129,7 @@ func HandleAIChat(ctx context.Context, userPrompt, lobbyName, username string,
 	mutex.Lock()
 	conv, exists := conversations[lobbyName]
 	if !exists {
-		conv = &ConversationHistory{
-			Messages:   []map[string]interface{}{},
-			LastActive: time.Now(),
-		}
+		conv = &ConversationHistory{LastActive: time.Now()}
 		conversations[lobbyName] = conv
 	}
 	mutex.Unlock()
@@ -68,103 +138,54 @@ func HandleAIChat(ctx context.Context, userPrompt, lobbyName, username string,
 	defer conv.Mu.Unlock()
 
 	// Clear old conversations
-	if time.Since(conv.LastActive) > AIContextTimeout {
-		conv.Messages = []map[string]interface{}{}
+	if time.Since(conv.LastActive) > cfg.ContextTimeout {
+		conv.Messages = nil
 	}
 	conv.LastActive = time.Now()
 
-	if len(conv.Messages) == 0 {
-		systemPrompt := guideline
-		lobbyContext := getLobbyContextFn(lobbyName)
-		if lobbyContext != "" {
-			systemPrompt += "\n\n" + lobbyContext
-		}
-
-		conv.Messages = append(conv.Messages, map[string]interface{}{
-			"role": "user",
-			"parts": []map[string]string{
-				{"text": systemPrompt},
-			},
-		})
-		conv.Messages = append(conv.Messages, map[string]interface{}{
-			"role": "model",
-			"parts": []map[string]string{
-				{"text": "Understood! I'm ready to assist. Beep-boop!"},
-			},
-		})
-	}
-
-	fullPrompt := userPrompt
-	lobbyContext := getLobbyContextFn(lobbyName)
-	if lobbyContext != "" {
-		fullPrompt = lobbyContext + "\n" + username + " asked: " + userPrompt
-	} else {
-		fullPrompt = username + " asked: " + userPrompt
-	}
-
-	conv.Messages = append(conv.Messages, map[string]interface{}{
-		"role": "user",
-		"parts": []map[string]string{
-			{"text": fullPrompt},
-		},
-	})
-
-	if len(conv.Messages) > MaxAIContextMessages {
-		conv.Messages = conv.Messages[len(conv.Messages)-20:]
+	system := GetAIPromptForLobby(lobbyName)
+	if lobbyContext := getLobbyContextFn(lobbyName); lobbyContext != "" {
+		system += "\n\n" + lobbyContext
 	}
 
-	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent?key=%s",
-		GeminiModel, geminiAPIKey)
-
-	payload := map[string]interface{}{
-		"contents": conv.Messages,
-	}
+	conv.Messages = append(conv.Messages, Message{Role: RoleUser, Text: username + " asked: " + userPrompt})
+	conv.Messages = trimHistory(conv.Messages, cfg.MaxContextMessages)
 
-	jsonData, err := json.Marshal(payload)
+	reply, err := generate(ctx, p, system, conv.Messages, Options{Model: cfg.Model}, onChunk)
 	if err != nil {
+		// Drop the unanswered question so the history keeps alternating
+		conv.Messages = conv.Messages[:len(conv.Messages)-1]
 		return "", err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json")
+	conv.Messages = append(conv.Messages, Message{Role: RoleAssistant, Text: reply})
+	return reply, nil
+}
 
-	httpClient := &http.Client{Timeout: 30 * time.Second}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", err
+// generate asks p for a reply, streaming it to onChunk when one is given
+func generate(ctx context.Context, p Provider, system string, messages []Message, opts Options, onChunk func(string)) (string, error) {
+	if onChunk == nil {
+		return p.Generate(ctx, system, messages, opts)
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	if s, ok := p.(Streamer); ok {
+		return s.Stream(ctx, system, messages, opts, onChunk)
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API error (%d): %s", resp.StatusCode, string(body))
+	reply, err := p.Generate(ctx, system, messages, opts)
+	if err == nil {
+		onChunk(reply)
 	}
+	return reply, err
+}
 
-	var result Response
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
+// trimHistory keeps at most max messages, always starting on a user turn
+func trimHistory(messages []Message, max int) []Message {
+	if len(messages) > max {
+		messages = messages[len(messages)-max:]
 	}
-
-	if len(result.Candidates) > 0 && len(result.Candidates[0].Content.Parts) > 0 {
-		aiResponse := result.Candidates[0].Content.Parts[0].Text
-
-		conv.Messages = append(conv.Messages, map[string]interface{}{
-			"role": "model",
-			"parts": []map[string]string{
-				{"text": aiResponse},
-			},
-		})
-
-		return aiResponse, nil
+	for len(messages) > 1 && messages[0].Role != RoleUser {
+		messages = messages[1:]
 	}
-	return "", fmt.Errorf("no text in response")
+	return messages
 }
 
 // FormatAIError formats AI errors for user display
@@ -0,0 +1,143 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultGeminiURL is the Gemini REST endpoint used when no base URL is set
+const DefaultGeminiURL = "https://generativelanguage.googleapis.com/v1beta"
+
+// GeminiProvider talks to Google's Gemini generateContent API
+type GeminiProvider struct {
+	APIKey  string
+	BaseURL string
+	Client  *http.Client
+}
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiRequest struct {
+	SystemInstruction *geminiContent  `json:"systemInstruction,omitempty"`
+	Contents          []geminiContent `json:"contents"`
+}
+
+// Name implements Provider
+func (p *GeminiProvider) Name() string { return ProviderGemini }
+
+// Generate implements Provider
+func (p *GeminiProvider) Generate(ctx context.Context, system string, messages []Message, opts Options) (string, error) {
+	resp, err := p.post(ctx, opts.Model+":generateContent", system, messages)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var result Response
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	if text := result.text(); text != "" {
+		return text, nil
+	}
+	return "", fmt.Errorf("no text in response")
+}
+
+// Stream implements Streamer using streamGenerateContent with server-sent events
+func (p *GeminiProvider) Stream(ctx context.Context, system string, messages []Message, opts Options, onChunk func(string)) (string, error) {
+	resp, err := p.post(ctx, opts.Model+":streamGenerateContent?alt=sse", system, messages)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var reply strings.Builder
+	err = readSSE(resp.Body, func(data []byte) error {
+		var chunk Response
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return err
+		}
+		if text := chunk.text(); text != "" {
+			reply.WriteString(text)
+			onChunk(text)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if reply.Len() == 0 {
+		return "", fmt.Errorf("no text in response")
+	}
+	return reply.String(), nil
+}
+
+// post sends the conversation to method and returns the response if it succeeded
+func (p *GeminiProvider) post(ctx context.Context, method, system string, messages []Message) (*http.Response, error) {
+	payload := geminiRequest{Contents: make([]geminiContent, 0, len(messages))}
+	if system != "" {
+		payload.SystemInstruction = &geminiContent{Parts: []geminiPart{{Text: system}}}
+	}
+	for _, m := range messages {
+		role := "user"
+		if m.Role == RoleAssistant {
+			role = "model"
+		}
+		payload.Contents = append(payload.Contents, geminiContent{Role: role, Parts: []geminiPart{{Text: m.Text}}})
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/models/%s", p.baseURL(), method)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", p.APIKey)
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, apiError(resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+func (p *GeminiProvider) baseURL() string {
+	if p.BaseURL == "" {
+		return DefaultGeminiURL
+	}
+	return strings.TrimRight(p.BaseURL, "/")
+}
+
+func (p *GeminiProvider) client() *http.Client {
+	if p.Client == nil {
+		return http.DefaultClient
+	}
+	return p.Client
+}
@@ -0,0 +1,62 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MockProvider answers without any network access. The reply depends only
+// on the conversation, so tests and air-gapped deployments get the same
+// output every time.
+type MockProvider struct {
+	// Delay is the pause between streamed words, to imitate a slow model
+	Delay time.Duration
+}
+
+// Name implements Provider
+func (m MockProvider) Name() string { return ProviderMock }
+
+// Generate implements Provider. It echoes the last user message, prefixed
+// with how many user turns the conversation holds.
+func (m MockProvider) Generate(ctx context.Context, system string, messages []Message, opts Options) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	turns := 0
+	last := ""
+	for _, m := range messages {
+		if m.Role == RoleUser {
+			turns++
+			last = m.Text
+		}
+	}
+	if turns == 0 {
+		return "", fmt.Errorf("invalid prompt: no user message")
+	}
+	return fmt.Sprintf("mock reply #%d: %s", turns, last), nil
+}
+
+// Stream implements Streamer, delivering the Generate reply one word at a time
+func (m MockProvider) Stream(ctx context.Context, system string, messages []Message, opts Options, onChunk func(string)) (string, error) {
+	reply, err := m.Generate(ctx, system, messages, opts)
+	if err != nil {
+		return "", err
+	}
+	words := strings.SplitAfter(reply, " ")
+	for _, word := range words {
+		if m.Delay > 0 {
+			select {
+			case <-time.After(m.Delay):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		} else if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		onChunk(word)
+	}
+	return reply, nil
+}
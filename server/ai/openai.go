@@ -0,0 +1,138 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// OpenAIProvider talks to any server implementing the OpenAI chat
+// completions API, such as llama.cpp's server, Ollama or vLLM. BaseURL
+// includes the version prefix, e.g. http://localhost:11434/v1.
+type OpenAIProvider struct {
+	APIKey  string
+	BaseURL string
+	Client  *http.Client
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIRequest struct {
+	Model    string          `json:"model"`
+	Messages []openAIMessage `json:"messages"`
+	Stream   bool            `json:"stream,omitempty"`
+}
+
+// openAIResponse covers both complete replies and streamed deltas
+type openAIResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+		Delta   openAIMessage `json:"delta"`
+	} `json:"choices"`
+}
+
+// Name implements Provider
+func (p *OpenAIProvider) Name() string { return ProviderOpenAI }
+
+// Generate implements Provider
+func (p *OpenAIProvider) Generate(ctx context.Context, system string, messages []Message, opts Options) (string, error) {
+	resp, err := p.post(ctx, system, messages, opts, false)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var result openAIResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	if len(result.Choices) > 0 && result.Choices[0].Message.Content != "" {
+		return result.Choices[0].Message.Content, nil
+	}
+	return "", fmt.Errorf("no text in response")
+}
+
+// Stream implements Streamer using the server-sent events of "stream": true
+func (p *OpenAIProvider) Stream(ctx context.Context, system string, messages []Message, opts Options, onChunk func(string)) (string, error) {
+	resp, err := p.post(ctx, system, messages, opts, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var reply strings.Builder
+	err = readSSE(resp.Body, func(data []byte) error {
+		if string(data) == "[DONE]" {
+			return errStreamDone
+		}
+		var chunk openAIResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return err
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			reply.WriteString(chunk.Choices[0].Delta.Content)
+			onChunk(chunk.Choices[0].Delta.Content)
+		}
+		return nil
+	})
+	if err != nil && err != errStreamDone {
+		return "", err
+	}
+	if reply.Len() == 0 {
+		return "", fmt.Errorf("no text in response")
+	}
+	return reply.String(), nil
+}
+
+// post sends the conversation and returns the response if it succeeded
+func (p *OpenAIProvider) post(ctx context.Context, system string, messages []Message, opts Options, stream bool) (*http.Response, error) {
+	payload := openAIRequest{Model: opts.Model, Stream: stream, Messages: make([]openAIMessage, 0, len(messages)+1)}
+	if system != "" {
+		payload.Messages = append(payload.Messages, openAIMessage{Role: "system", Content: system})
+	}
+	for _, m := range messages {
+		payload.Messages = append(payload.Messages, openAIMessage{Role: m.Role, Content: m.Text})
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimRight(p.BaseURL, "/") + "/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, apiError(resp.StatusCode, body)
+	}
+	return resp, nil
+}
@@ -0,0 +1,129 @@
+package ai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Conversation roles
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Message is one turn of a conversation, independent of any provider's wire format
+type Message struct {
+	Role string `json:"role"`
+	Text string `json:"text"`
+}
+
+// UnmarshalJSON also accepts the Gemini-shaped messages
+// ({"role":"model","parts":[{"text":...}]}) saved by earlier versions
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Role  string `json:"role"`
+		Text  string `json:"text"`
+		Parts []struct {
+			Text string `json:"text"`
+		} `json:"parts"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Role = raw.Role
+	if m.Role == "model" {
+		m.Role = RoleAssistant
+	}
+	m.Text = raw.Text
+	for _, part := range raw.Parts {
+		m.Text += part.Text
+	}
+	return nil
+}
+
+// Options tune a single generation request
+type Options struct {
+	Model string
+}
+
+// Provider generates a reply to a conversation
+type Provider interface {
+	// Name identifies the provider in logs and /help
+	Name() string
+	// Generate returns the next assistant message for messages, which
+	// alternate between user and assistant and end with a user turn
+	Generate(ctx context.Context, system string, messages []Message, opts Options) (string, error)
+}
+
+// Streamer is implemented by providers that can deliver a reply as it is
+// generated. Stream calls onChunk with each piece of text in order and
+// returns the complete reply.
+type Streamer interface {
+	Stream(ctx context.Context, system string, messages []Message, opts Options, onChunk func(string)) (string, error)
+}
+
+// Provider names accepted by ai.provider
+const (
+	ProviderGemini = "gemini"
+	ProviderOpenAI = "openai"
+	ProviderMock   = "mock"
+)
+
+// Providers lists the accepted values of ai.provider
+var Providers = []string{ProviderGemini, ProviderOpenAI, ProviderMock}
+
+// NewProvider builds the provider named in s. API keys are read with
+// getenv: GEMINI_API_KEY for Gemini and the optional OPENAI_API_KEY for
+// OpenAI-compatible servers.
+func NewProvider(s Settings, getenv func(string) string) (Provider, error) {
+	httpClient := &http.Client{Timeout: s.RequestTimeout}
+
+	switch s.Provider {
+	case ProviderGemini, "":
+		key := getenv("GEMINI_API_KEY")
+		if key == "" {
+			return nil, fmt.Errorf("GEMINI_API_KEY environment variable not set")
+		}
+		return &GeminiProvider{APIKey: key, BaseURL: s.BaseURL, Client: httpClient}, nil
+	case ProviderOpenAI:
+		if s.BaseURL == "" {
+			return nil, fmt.Errorf("the openai provider needs a base URL")
+		}
+		return &OpenAIProvider{APIKey: getenv("OPENAI_API_KEY"), BaseURL: s.BaseURL, Client: httpClient}, nil
+	case ProviderMock:
+		return MockProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown AI provider %q (want %s)", s.Provider, strings.Join(Providers, ", "))
+	}
+}
+
+// apiError builds the error returned for a non-200 response
+func apiError(status int, body []byte) error {
+	return fmt.Errorf("API error (%d): %s", status, strings.TrimSpace(string(body)))
+}
+
+// readSSE calls fn with the payload of every "data:" line of a server-sent
+// event stream until the stream ends or fn returns an error
+func readSSE(r io.Reader, fn func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+		if err := fn(bytes.TrimSpace(line[len("data:"):])); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// errStreamDone stops readSSE without reporting an error
+var errStreamDone = fmt.Errorf("stream done")
@@ -5,20 +5,32 @@ import (
 	"time"
 )
 
+// Default settings, used until Configure is called
 const (
 	MaxAIContextMessages = 20
 	AIContextTimeout     = 30 * time.Minute
 	GeminiModel          = "gemini-2.5-flash"
+	AIRequestTimeout     = 30 * time.Second
 )
 
+// Settings holds the tunable AI parameters
+type Settings struct {
+	Provider           string
+	BaseURL            string
+	Model              string
+	ContextTimeout     time.Duration
+	MaxContextMessages int
+	RequestTimeout     time.Duration
+}
+
 // ConversationHistory stores AI conversation state
 type ConversationHistory struct {
-	Messages   []map[string]interface{}
+	Messages   []Message
 	LastActive time.Time
 	Mu         sync.RWMutex
 }
 
-// Response struct for AI API
+// Response is the body of a Gemini generateContent reply
 type Response struct {
 	Candidates []struct {
 		Content struct {
@@ -28,3 +40,15 @@ type Response struct {
 		} `json:"content"`
 	} `json:"candidates"`
 }
+
+// text joins the parts of the first candidate
+func (r Response) text() string {
+	if len(r.Candidates) == 0 {
+		return ""
+	}
+	var text string
+	for _, part := range r.Candidates[0].Content.Parts {
+		text += part.Text
+	}
+	return text
+}
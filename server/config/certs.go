@@ -0,0 +1,49 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// CertReloader serves a TLS certificate that can be swapped while the
+// listener keeps running. New handshakes pick up the latest certificate;
+// established connections are unaffected.
+type CertReloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertReloader loads the initial certificate and key pair
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{}
+	if err := r.Reload(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the key pair again. On error the previous certificate
+// stays in use.
+func (r *CertReloader) Reload(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate %s: %w", certFile, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// TLSConfig returns a server configuration backed by the reloader
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate}
+}
@@ -0,0 +1,372 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-server/server/ai"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every tunable setting of the server binary
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	Limits   LimitsConfig   `yaml:"limits"`
+	AI       AIConfig       `yaml:"ai"`
+	Webhooks WebhooksConfig `yaml:"webhooks"`
+}
+
+// ServerConfig holds listener, storage and access settings
+type ServerConfig struct {
+	Addr        string        `yaml:"addr"`
+	TLSAddr     string        `yaml:"tls_addr"`
+	WebAddr     string        `yaml:"web_addr"`
+	IRCAddr     string        `yaml:"irc_addr"`
+	MetricsAddr string        `yaml:"metrics_addr"`
+	CertFile    string        `yaml:"cert_file"`
+	KeyFile     string        `yaml:"key_file"`
+	StorePath   string        `yaml:"store_path"`
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+	Operators   []string      `yaml:"operators"`
+	MOTD        string        `yaml:"motd"`
+
+	SSHAddr           string `yaml:"ssh_addr"`
+	SSHHostKey        string `yaml:"ssh_host_key"`
+	SSHAuthorizedKeys string `yaml:"ssh_authorized_keys"`
+}
+
+// LimitsConfig holds rate limits and input bounds
+type LimitsConfig struct {
+	MaxMessagesPerWindow    int           `yaml:"max_messages_per_window"`
+	BotMaxMessagesPerWindow int           `yaml:"bot_max_messages_per_window"`
+	RateLimitWindow         time.Duration `yaml:"rate_limit_window"`
+	MaxConnectionsPerIP     int           `yaml:"max_connections_per_ip"`
+	MaxUsernameLength       int           `yaml:"max_username_length"`
+	MaxMessageLength        int           `yaml:"max_message_length"`
+	OutboxSize              int           `yaml:"outbox_size"`
+	SlowConsumerPolicy      string        `yaml:"slow_consumer_policy"`
+	LoginGracePeriod        time.Duration `yaml:"login_grace_period"`
+	MailboxQuota            int           `yaml:"mailbox_quota"`
+}
+
+// AIConfig holds settings for the AI assistant
+type AIConfig struct {
+	Provider           string        `yaml:"provider"`
+	BaseURL            string        `yaml:"base_url"`
+	Model              string        `yaml:"model"`
+	ContextTimeout     time.Duration `yaml:"context_timeout"`
+	MaxContextMessages int           `yaml:"max_context_messages"`
+	RequestTimeout     time.Duration `yaml:"request_timeout"`
+	MaxConcurrent      int           `yaml:"max_concurrent"`
+	MaxQueue           int           `yaml:"max_queue"`
+	ThreadContext      bool          `yaml:"thread_context"`
+}
+
+// WebhooksConfig holds how outgoing webhook deliveries are retried
+type WebhooksConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	Timeout     time.Duration `yaml:"timeout"`
+	// AllowedNetworks are CIDR ranges webhooks may reach even though they
+	// are loopback, link-local or private
+	AllowedNetworks []string `yaml:"allowed_networks"`
+}
+
+// SlowConsumerPolicies lists the accepted values of limits.slow_consumer_policy
+var SlowConsumerPolicies = []string{"drop-oldest", "drop-newest", "disconnect"}
+
+// Default returns the settings the server used before it was configurable
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:        ":8080",
+			TLSAddr:     ":8443",
+			WebAddr:     ":8081",
+			IRCAddr:     "",
+			CertFile:    "server.crt",
+			KeyFile:     "server.key",
+			StorePath:   "chat.db",
+			ReadTimeout: 10 * time.Minute,
+
+			SSHAddr:    "",
+			SSHHostKey: "ssh_host_ed25519_key",
+		},
+		Limits: LimitsConfig{
+			MaxMessagesPerWindow:    5,
+			BotMaxMessagesPerWindow: 30,
+			RateLimitWindow:         10 * time.Second,
+			MaxConnectionsPerIP:     10,
+			MaxUsernameLength:       20,
+			MaxMessageLength:        1000,
+			OutboxSize:              64,
+			SlowConsumerPolicy:      "drop-oldest",
+			LoginGracePeriod:        60 * time.Second,
+			MailboxQuota:            50,
+		},
+		AI: AIConfig{
+			Provider:           "gemini",
+			Model:              "gemini-2.5-flash",
+			ContextTimeout:     30 * time.Minute,
+			MaxContextMessages: 20,
+			RequestTimeout:     30 * time.Second,
+			MaxConcurrent:      4,
+			MaxQueue:           10,
+		},
+		Webhooks: WebhooksConfig{
+			MaxAttempts: 5,
+			Backoff:     2 * time.Second,
+			Timeout:     10 * time.Second,
+		},
+	}
+}
+
+// setting is a value that can be overridden by environment and flag
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(string) error
+}
+
+func (cfg *Config) settings() []setting {
+	return []setting{
+		{"addr", "CHAT_ADDR", "plain TCP listen address", setString(&cfg.Server.Addr)},
+		{"tls-addr", "CHAT_TLS_ADDR", "TLS listen address (empty disables TLS)", setString(&cfg.Server.TLSAddr)},
+		{"web-addr", "CHAT_WEB_ADDR", "HTTP/WebSocket listen address (empty disables it)", setString(&cfg.Server.WebAddr)},
+		{"irc-addr", "CHAT_IRC_ADDR", "IRC listen address (empty disables it)", setString(&cfg.Server.IRCAddr)},
+		{"ssh-addr", "CHAT_SSH_ADDR", "SSH listen address (empty disables it)", setString(&cfg.Server.SSHAddr)},
+		{"ssh-host-key", "CHAT_SSH_HOST_KEY", "SSH host key file, generated if missing", setString(&cfg.Server.SSHHostKey)},
+		{"ssh-authorized-keys", "CHAT_SSH_AUTHORIZED_KEYS", "authorized_keys file of the only SSH keys allowed in (empty allows any key)", setString(&cfg.Server.SSHAuthorizedKeys)},
+		{"metrics-addr", "CHAT_METRICS_ADDR", "HTTP listen address for Prometheus /metrics (empty disables it)", setString(&cfg.Server.MetricsAddr)},
+		{"cert", "CHAT_CERT_FILE", "TLS certificate file", setString(&cfg.Server.CertFile)},
+		{"key", "CHAT_KEY_FILE", "TLS private key file", setString(&cfg.Server.KeyFile)},
+		{"store", "CHAT_STORE_PATH", "database file for lobbies, history and accounts", setString(&cfg.Server.StorePath)},
+		{"read-timeout", "CHAT_READ_TIMEOUT", "disconnect clients idle for this long", setDuration(&cfg.Server.ReadTimeout)},
+		{"operators", "CHAT_OPERATORS", "comma separated server operator usernames", setList(&cfg.Server.Operators)},
+		{"motd", "CHAT_MOTD", "message of the day shown after the welcome banner", setString(&cfg.Server.MOTD)},
+		{"max-messages", "CHAT_MAX_MESSAGES_PER_WINDOW", "messages allowed per rate limit window", setInt(&cfg.Limits.MaxMessagesPerWindow)},
+		{"bot-max-messages", "CHAT_BOT_MAX_MESSAGES_PER_WINDOW", "messages bots may send per rate limit window", setInt(&cfg.Limits.BotMaxMessagesPerWindow)},
+		{"rate-window", "CHAT_RATE_LIMIT_WINDOW", "rate limit window", setDuration(&cfg.Limits.RateLimitWindow)},
+		{"max-conns-per-ip", "CHAT_MAX_CONNECTIONS_PER_IP", "simultaneous connections allowed per IP", setInt(&cfg.Limits.MaxConnectionsPerIP)},
+		{"max-username-length", "CHAT_MAX_USERNAME_LENGTH", "longest allowed username", setInt(&cfg.Limits.MaxUsernameLength)},
+		{"max-message-length", "CHAT_MAX_MESSAGE_LENGTH", "longest allowed message", setInt(&cfg.Limits.MaxMessageLength)},
+		{"outbox-size", "CHAT_OUTBOX_SIZE", "messages queued per client before the slow consumer policy applies", setInt(&cfg.Limits.OutboxSize)},
+		{"slow-consumer-policy", "CHAT_SLOW_CONSUMER_POLICY", "drop-oldest, drop-newest or disconnect", setString(&cfg.Limits.SlowConsumerPolicy)},
+		{"login-grace", "CHAT_LOGIN_GRACE_PERIOD", "time to /login before a registered name is taken away", setDuration(&cfg.Limits.LoginGracePeriod)},
+		{"mailbox-quota", "CHAT_MAILBOX_QUOTA", "offline messages kept per user", setInt(&cfg.Limits.MailboxQuota)},
+		{"ai-provider", "CHAT_AI_PROVIDER", "AI backend: gemini, openai or mock", setString(&cfg.AI.Provider)},
+		{"ai-base-url", "CHAT_AI_BASE_URL", "AI API base URL (required for openai, e.g. http://localhost:11434/v1)", setString(&cfg.AI.BaseURL)},
+		{"ai-model", "CHAT_AI_MODEL", "AI model name", setString(&cfg.AI.Model)},
+		{"ai-context-timeout", "CHAT_AI_CONTEXT_TIMEOUT", "idle time after which a lobby's AI conversation resets", setDuration(&cfg.AI.ContextTimeout)},
+		{"ai-max-context", "CHAT_AI_MAX_CONTEXT_MESSAGES", "AI conversation messages kept per lobby", setInt(&cfg.AI.MaxContextMessages)},
+		{"ai-timeout", "CHAT_AI_REQUEST_TIMEOUT", "timeout for a single AI request", setDuration(&cfg.AI.RequestTimeout)},
+		{"ai-max-concurrent", "CHAT_AI_MAX_CONCURRENT", "AI requests running at once across all lobbies", setInt(&cfg.AI.MaxConcurrent)},
+		{"ai-max-queue", "CHAT_AI_MAX_QUEUE", "AI requests allowed to wait in each lobby", setInt(&cfg.AI.MaxQueue)},
+		{"ai-thread-context", "CHAT_AI_THREAD_CONTEXT", "include recent thread replies in the lobby context given to the AI", setBool(&cfg.AI.ThreadContext)},
+		{"webhook-max-attempts", "CHAT_WEBHOOK_MAX_ATTEMPTS", "webhook delivery attempts before it is dead-lettered", setInt(&cfg.Webhooks.MaxAttempts)},
+		{"webhook-backoff", "CHAT_WEBHOOK_BACKOFF", "wait before the first webhook retry; it doubles after each", setDuration(&cfg.Webhooks.Backoff)},
+		{"webhook-timeout", "CHAT_WEBHOOK_TIMEOUT", "timeout for a single webhook delivery", setDuration(&cfg.Webhooks.Timeout)},
+		{"webhook-allowed-networks", "CHAT_WEBHOOK_ALLOWED_NETWORKS", "comma separated private CIDR ranges webhooks may reach", setList(&cfg.Webhooks.AllowedNetworks)},
+	}
+}
+
+// Load builds the configuration from defaults, an optional YAML file
+// (-config or CHAT_CONFIG), environment variables and command-line flags,
+// in increasing order of precedence, and validates the result
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet("go-chat", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("CHAT_CONFIG"), "YAML configuration file")
+	flagValues := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagValues[s.flag] = fs.String(s.flag, "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && flagErr == nil {
+				if err := s.set(*flagValues[s.flag]); err != nil {
+					flagErr = fmt.Errorf("-%s: %w", s.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overlays the settings found in a YAML file. Unknown keys are
+// refused, so a misspelt setting doesn't silently keep its default.
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every setting that is out of range
+func (cfg *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(cfg.Server.Addr != "", "server.addr must not be empty")
+	check(cfg.Server.StorePath != "", "server.store_path must not be empty")
+	check(cfg.Server.SSHAddr == "" || cfg.Server.SSHHostKey != "", "server.ssh_host_key is required when ssh_addr is set")
+	check(cfg.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	check(cfg.Limits.MaxMessagesPerWindow > 0, "limits.max_messages_per_window must be positive")
+	check(cfg.Limits.BotMaxMessagesPerWindow > 0, "limits.bot_max_messages_per_window must be positive")
+	check(cfg.Limits.RateLimitWindow > 0, "limits.rate_limit_window must be positive")
+	check(cfg.Limits.MaxConnectionsPerIP > 0, "limits.max_connections_per_ip must be positive")
+	check(cfg.Limits.MaxUsernameLength >= 2, "limits.max_username_length must be at least 2")
+	check(cfg.Limits.MaxMessageLength > 0, "limits.max_message_length must be positive")
+	check(cfg.Limits.OutboxSize > 0, "limits.outbox_size must be positive")
+	check(cfg.Limits.LoginGracePeriod > 0, "limits.login_grace_period must be positive")
+	check(cfg.Limits.MailboxQuota > 0, "limits.mailbox_quota must be positive")
+	check(contains(SlowConsumerPolicies, cfg.Limits.SlowConsumerPolicy),
+		"limits.slow_consumer_policy must be one of %s", strings.Join(SlowConsumerPolicies, ", "))
+	check(contains(ai.Providers, cfg.AI.Provider),
+		"ai.provider must be one of %s", strings.Join(ai.Providers, ", "))
+	check(cfg.AI.Provider != "openai" || cfg.AI.BaseURL != "", "ai.base_url is required for the openai provider")
+	check(cfg.AI.Model != "", "ai.model must not be empty")
+	check(cfg.AI.ContextTimeout > 0, "ai.context_timeout must be positive")
+	check(cfg.AI.MaxContextMessages >= 2, "ai.max_context_messages must be at least 2")
+	check(cfg.AI.RequestTimeout > 0, "ai.request_timeout must be positive")
+	check(cfg.AI.MaxConcurrent > 0, "ai.max_concurrent must be positive")
+	check(cfg.AI.MaxQueue > 0, "ai.max_queue must be positive")
+	check(cfg.Webhooks.MaxAttempts > 0, "webhooks.max_attempts must be positive")
+	check(cfg.Webhooks.Backoff > 0, "webhooks.backoff must be positive")
+	check(cfg.Webhooks.Timeout > 0, "webhooks.timeout must be positive")
+	for _, network := range cfg.Webhooks.AllowedNetworks {
+		_, err := netip.ParsePrefix(network)
+		check(err == nil, "webhooks.allowed_networks: %q is not a CIDR range", network)
+	}
+
+	return errors.Join(errs...)
+}
+
+// RestartRequired lists the settings that differ between cfg and next but
+// only take effect when the server is restarted
+func (cfg *Config) RestartRequired(next *Config) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("server.addr", cfg.Server.Addr != next.Server.Addr)
+	check("server.tls_addr", cfg.Server.TLSAddr != next.Server.TLSAddr)
+	check("server.web_addr", cfg.Server.WebAddr != next.Server.WebAddr)
+	check("server.irc_addr", cfg.Server.IRCAddr != next.Server.IRCAddr)
+	check("server.ssh_addr", cfg.Server.SSHAddr != next.Server.SSHAddr)
+	check("server.ssh_host_key", cfg.Server.SSHHostKey != next.Server.SSHHostKey)
+	check("server.metrics_addr", cfg.Server.MetricsAddr != next.Server.MetricsAddr)
+	check("server.store_path", cfg.Server.StorePath != next.Server.StorePath)
+	return changed
+}
+
+func setString(dst *string) func(string) error {
+	return func(v string) error {
+		*dst = v
+		return nil
+	}
+}
+
+func setInt(dst *int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		*dst = n
+		return nil
+	}
+}
+
+func setDuration(dst *time.Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		*dst = d
+		return nil
+	}
+}
+
+func setBool(dst *bool) func(string) error {
+	return func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		*dst = b
+		return nil
+	}
+}
+
+func setList(dst *[]string) func(string) error {
+	return func(v string) error {
+		var items []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*dst = items
+		return nil
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
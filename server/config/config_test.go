@@ -0,0 +1,147 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envFrom(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(nil, envFrom(nil))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("Load with no input = %+v; want defaults", cfg)
+	}
+	if cfg.Server.IRCAddr != "" || cfg.Server.SSHAddr != "" || cfg.Server.MetricsAddr != "" {
+		t.Errorf("IRC, SSH or metrics listener on by default: %+v", cfg.Server)
+	}
+
+	// Turning SSH on only takes an address; the host key has a default
+	if _, err := Load([]string{"-ssh-addr", ":2222"}, envFrom(nil)); err != nil {
+		t.Errorf("Load with -ssh-addr = %v", err)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(`
+server:
+  addr: ":9000"
+  operators: [alice]
+limits:
+  max_messages_per_window: 20
+  rate_limit_window: 30s
+ai:
+  model: file-model
+`), 0600)
+
+	env := envFrom(map[string]string{
+		"CHAT_CONFIG":                  path,
+		"CHAT_MAX_MESSAGES_PER_WINDOW": "50",
+		"CHAT_AI_MODEL":                "env-model",
+		"CHAT_OPERATORS":               "bob, carol",
+	})
+	cfg, err := Load([]string{"-ai-model", "flag-model"}, env)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if cfg.Server.Addr != ":9000" {
+		t.Errorf("addr = %q; want file value :9000", cfg.Server.Addr)
+	}
+	if cfg.Limits.RateLimitWindow != 30*time.Second {
+		t.Errorf("rate window = %v; want file value 30s", cfg.Limits.RateLimitWindow)
+	}
+	if cfg.Limits.MaxMessagesPerWindow != 50 {
+		t.Errorf("max messages = %d; want env value 50", cfg.Limits.MaxMessagesPerWindow)
+	}
+	if cfg.AI.Model != "flag-model" {
+		t.Errorf("model = %q; want flag value", cfg.AI.Model)
+	}
+	if !reflect.DeepEqual(cfg.Server.Operators, []string{"bob", "carol"}) {
+		t.Errorf("operators = %v; want env value [bob carol]", cfg.Server.Operators)
+	}
+	if cfg.Limits.MaxConnectionsPerIP != 10 {
+		t.Errorf("max conns = %d; want default 10", cfg.Limits.MaxConnectionsPerIP)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"bad flag value", []string{"-max-messages", "lots"}, nil, "-max-messages"},
+		{"bad env value", nil, map[string]string{"CHAT_RATE_LIMIT_WINDOW": "soon"}, "CHAT_RATE_LIMIT_WINDOW"},
+		{"missing file", []string{"-config", "/nonexistent/config.yaml"}, nil, "read config"},
+		{"out of range", []string{"-max-conns-per-ip", "0"}, nil, "max_connections_per_ip"},
+		{"unknown policy", []string{"-slow-consumer-policy", "panic"}, nil, "slow_consumer_policy"},
+		{"unknown provider", []string{"-ai-provider", "skynet"}, nil, "ai.provider"},
+		{"openai without url", []string{"-ai-provider", "openai"}, nil, "ai.base_url"},
+		{"ssh without host key", []string{"-ssh-addr", ":2222", "-ssh-host-key", ""}, nil, "ssh_host_key"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Load(tc.args, envFrom(tc.env))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Load error = %v; want mention of %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("limits:\n  max_mesages_per_window: 10\n"), 0o600)
+	_, err := Load([]string{"-config", path}, envFrom(nil))
+	if err == nil || !strings.Contains(err.Error(), "max_mesages_per_window") {
+		t.Errorf("Load error = %v; want the unknown key named", err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.yaml")
+	os.WriteFile(empty, nil, 0o600)
+	if _, err := Load([]string{"-config", empty}, envFrom(nil)); err != nil {
+		t.Errorf("Load of an empty file = %v", err)
+	}
+}
+
+func TestExampleConfigMatchesDefaults(t *testing.T) {
+	cfg, err := Load([]string{"-config", "../../config.example.yaml"}, envFrom(nil))
+	if err != nil {
+		t.Fatalf("Load example: %v", err)
+	}
+	cfg.Server.Operators = nil
+	cfg.Webhooks.AllowedNetworks = nil
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("config.example.yaml drifted from Default():\n got %+v\nwant %+v", cfg, Default())
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := Default()
+	next := Default()
+	next.Limits.MaxMessagesPerWindow = 50
+	next.AI.Model = "other-model"
+	next.Server.MOTD = "hello"
+	if changed := old.RestartRequired(next); len(changed) != 0 {
+		t.Errorf("reloadable changes reported as needing a restart: %v", changed)
+	}
+
+	next.Server.Addr = ":9000"
+	next.Server.StorePath = "other.db"
+	want := []string{"server.addr", "server.store_path"}
+	if changed := old.RestartRequired(next); !reflect.DeepEqual(changed, want) {
+		t.Errorf("RestartRequired = %v; want %v", changed, want)
+	}
+}
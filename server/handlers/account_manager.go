@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/storage"
+	"chat-server/server/utils"
+)
+
+// MinPasswordLength is the shortest password accepted by /register
+const MinPasswordLength = 6
+
+// BotTokenPrefix starts every bot token, which makes one easy to spot in
+// a config file or a log
+const BotTokenPrefix = "bot_"
+
+// loginFailuresAllowed is how many wrong passwords in a row one address
+// may try for an account before /login from there is locked for a while
+const loginFailuresAllowed = 5
+
+// loginLockout is how long the first lockout lasts. It doubles with each
+// further failure, up to maxLoginLockout. Failures older than
+// maxLoginLockout are forgotten.
+const (
+	loginLockout    = 30 * time.Second
+	maxLoginLockout = 15 * time.Minute
+)
+
+// maxTrackedLoginFailures bounds the failure table; past it, forgotten
+// entries are swept out
+const maxTrackedLoginFailures = 10000
+
+// AccountManager manages registered user accounts
+type AccountManager struct {
+	store storage.Store
+	mu    sync.Mutex
+
+	// failures counts failed logins to an account from one address since
+	// the last success from there. Keying by address as well means a
+	// stranger's guesses don't lock the owner out.
+	failMu   sync.Mutex
+	failures map[loginSource]loginFailures
+}
+
+type loginSource struct {
+	ip       string
+	username string
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time // the latest failure
+	until time.Time // when the address can try the account again
+}
+
+// NewAccountManager creates a new account manager backed by store
+func NewAccountManager(store storage.Store) *AccountManager {
+	return &AccountManager{store: store, failures: make(map[loginSource]loginFailures)}
+}
+
+// LoginLockout returns how long logins to username from ip are refused
+// after too many wrong passwords, or 0 if they aren't
+func (am *AccountManager) LoginLockout(username, ip string) time.Duration {
+	am.failMu.Lock()
+	defer am.failMu.Unlock()
+	return max(time.Until(am.failures[loginSource{ip, username}].until), 0)
+}
+
+// LoginFailed counts a wrong password for a registered username from ip,
+// locking that address out of the account once it has had too many
+func (am *AccountManager) LoginFailed(username, ip string) {
+	if !am.IsRegistered(username) {
+		return
+	}
+	am.failMu.Lock()
+	defer am.failMu.Unlock()
+	now := time.Now()
+	if len(am.failures) >= maxTrackedLoginFailures {
+		for source, f := range am.failures {
+			if now.Sub(f.last) > maxLoginLockout && now.After(f.until) {
+				delete(am.failures, source)
+			}
+		}
+	}
+
+	source := loginSource{ip, username}
+	f := am.failures[source]
+	if now.Sub(f.last) > maxLoginLockout {
+		f = loginFailures{}
+	}
+	f.count++
+	f.last = now
+	if f.count >= loginFailuresAllowed {
+		lockout := loginLockout << (f.count - loginFailuresAllowed)
+		if lockout > maxLoginLockout || lockout <= 0 {
+			lockout = maxLoginLockout
+		}
+		f.until = now.Add(lockout)
+	}
+	am.failures[source] = f
+}
+
+// LoginSucceeded clears the failed logins to an account from ip
+func (am *AccountManager) LoginSucceeded(username, ip string) {
+	am.failMu.Lock()
+	defer am.failMu.Unlock()
+	delete(am.failures, loginSource{ip, username})
+}
+
+// IsRegistered reports whether a username belongs to a registered account,
+// either with a password, locked to an SSH key or a bot
+func (am *AccountManager) IsRegistered(username string) bool {
+	return am.HasPassword(username) || am.KeyFingerprint(username) != "" || am.IsBot(username)
+}
+
+// HasPassword reports whether a username can log in with /login
+func (am *AccountManager) HasPassword(username string) bool {
+	hash, err := am.store.LoadAccount(username)
+	if err != nil {
+		log.Printf("Failed to load account %s: %v", username, err)
+		return false
+	}
+	return hash != ""
+}
+
+// KeyFingerprint returns the fingerprint of the SSH key username is locked
+// to, or "" if it isn't locked to one
+func (am *AccountManager) KeyFingerprint(username string) string {
+	fingerprint, err := am.store.LoadSSHKey(username)
+	if err != nil {
+		log.Printf("Failed to load SSH key of %s: %v", username, err)
+		return ""
+	}
+	return fingerprint
+}
+
+// ClaimKey reports whether the SSH key with fingerprint owns username.
+// A name that is neither registered nor locked is locked to the key on
+// its first use.
+func (am *AccountManager) ClaimKey(username, fingerprint string) bool {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if bound := am.KeyFingerprint(username); bound != "" {
+		return bound == fingerprint
+	}
+	if am.HasPassword(username) || am.IsBot(username) {
+		return false
+	}
+	return am.saveKey(username, fingerprint)
+}
+
+// LinkKey locks username to the SSH key with fingerprint if it isn't
+// locked to one yet. Its holder must already have proved they own it.
+func (am *AccountManager) LinkKey(username, fingerprint string) bool {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if am.KeyFingerprint(username) != "" {
+		return false
+	}
+	return am.saveKey(username, fingerprint)
+}
+
+func (am *AccountManager) saveKey(username, fingerprint string) bool {
+	if err := am.store.SaveSSHKey(username, fingerprint); err != nil {
+		log.Printf("Failed to save SSH key of %s: %v", username, err)
+		return false
+	}
+	return true
+}
+
+// Register creates an account for username with the given password.
+// A name locked to an SSH key may get a password too; the caller must
+// check that the client registering it is its owner.
+func (am *AccountManager) Register(username, password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("password too short (min %d characters)", MinPasswordLength)
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if am.HasPassword(username) || am.IsBot(username) {
+		return fmt.Errorf("username is already registered")
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to secure password")
+	}
+	if err := am.store.SaveAccount(username, hashedPassword); err != nil {
+		log.Printf("Failed to save account %s: %v", username, err)
+		return fmt.Errorf("failed to save account")
+	}
+	return nil
+}
+
+// Authenticate verifies a username and password against the stored account
+func (am *AccountManager) Authenticate(username, password string) bool {
+	hash, err := am.store.LoadAccount(username)
+	if err != nil {
+		log.Printf("Failed to load account %s: %v", username, err)
+		return false
+	}
+	if hash == "" || password == "" {
+		return false
+	}
+	return checkPassword(hash, password)
+}
+
+// IsBot reports whether username belongs to a bot account
+func (am *AccountManager) IsBot(username string) bool {
+	return am.loadBot(username) != nil
+}
+
+func (am *AccountManager) loadBot(name string) *models.Bot {
+	bot, err := am.store.LoadBot(name)
+	if err != nil {
+		log.Printf("Failed to load bot %s: %v", name, err)
+		return nil
+	}
+	return bot
+}
+
+// Bots returns every bot account, sorted by name
+func (am *AccountManager) Bots() []*models.Bot {
+	bots, err := am.store.LoadBots()
+	if err != nil {
+		log.Printf("Failed to load bots: %v", err)
+		return nil
+	}
+	sort.Slice(bots, func(i, j int) bool { return bots[i].Name < bots[j].Name })
+	return bots
+}
+
+// CreateBot creates a bot account called name and returns its token.
+// Only the token's hash is kept, so it can't be shown again.
+func (am *AccountManager) CreateBot(name, createdBy string) (string, error) {
+	if valid, errMsg := utils.IsValidUsername(name); !valid {
+		return "", fmt.Errorf("%s", errMsg)
+	}
+	if strings.HasPrefix(name, GuestPrefix) || strings.EqualFold(name, AIUsername) {
+		return "", fmt.Errorf("that name is reserved")
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if am.IsRegistered(name) {
+		return "", fmt.Errorf("%s is already registered", name)
+	}
+	return am.saveBot(&models.Bot{Name: name, CreatedBy: createdBy, Created: time.Now()})
+}
+
+// RotateBotToken gives a bot a new token; the old one stops working
+func (am *AccountManager) RotateBotToken(name string) (string, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	bot := am.loadBot(name)
+	if bot == nil {
+		return "", fmt.Errorf("no bot called %s", name)
+	}
+	return am.saveBot(bot)
+}
+
+// saveBot stores bot with a new token, which it returns
+func (am *AccountManager) saveBot(bot *models.Bot) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate a token")
+	}
+	token := BotTokenPrefix + hex.EncodeToString(b)
+	bot.TokenHash = hashToken(token)
+	if err := am.store.SaveBot(bot); err != nil {
+		log.Printf("Failed to save bot %s: %v", bot.Name, err)
+		return "", fmt.Errorf("failed to save bot")
+	}
+	return token, nil
+}
+
+// DeleteBot removes a bot account, freeing its name
+func (am *AccountManager) DeleteBot(name string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if am.loadBot(name) == nil {
+		return fmt.Errorf("no bot called %s", name)
+	}
+	if err := am.store.DeleteBot(name); err != nil {
+		log.Printf("Failed to delete bot %s: %v", name, err)
+		return fmt.Errorf("failed to delete bot")
+	}
+	return nil
+}
+
+// AuthenticateBot verifies a bot's token
+func (am *AccountManager) AuthenticateBot(name, token string) bool {
+	bot := am.loadBot(name)
+	if bot == nil || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(bot.TokenHash), []byte(hashToken(token))) == 1
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"chat-server/server/models"
+)
+
+// DefaultLoginGracePeriod is how long a connection may hold a registered
+// username before it has to /login, unless configured otherwise
+const DefaultLoginGracePeriod = 60 * time.Second
+
+// GuestPrefix starts every name handed out to evicted connections
+const GuestPrefix = "guest-"
+
+func (h *CommandHandler) handleRegister(conn net.Conn, client *models.Client, cmd string) {
+	password := strings.TrimSpace(strings.TrimPrefix(cmd, "/register "))
+	if password == "" || strings.Contains(password, " ") {
+		conn.Write([]byte(ColorRed + "Usage: /register <password>\n" + ColorReset))
+		return
+	}
+
+	if strings.HasPrefix(client.Username, GuestPrefix) {
+		conn.Write([]byte(ColorRed + "Guest names cannot be registered. Reconnect with another username.\n" + ColorReset))
+		return
+	}
+
+	if client.Bot {
+		conn.Write([]byte(ColorRed + "Bots log in with their token and can't have a password.\n" + ColorReset))
+		return
+	}
+
+	username, authenticated := h.ClientManager.Identity(client)
+	if !authenticated && h.Accounts.IsRegistered(username) {
+		conn.Write([]byte(ColorRed + "username is already registered\n" + ColorReset))
+		return
+	}
+
+	if err := h.Accounts.Register(username, password); err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+
+	h.ClientManager.SetAuthenticated(client)
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("Registered '%s'. Use /login %s <password> next time you connect.\n",
+		username, username) + ColorReset))
+}
+
+func (h *CommandHandler) handleLogin(conn net.Conn, client *models.Client, cmd string) {
+	parts := strings.Fields(strings.TrimPrefix(cmd, "/login "))
+	if len(parts) != 2 {
+		conn.Write([]byte(ColorRed + "Usage: /login <username> <password>\n" + ColorReset))
+		return
+	}
+	username, password := parts[0], parts[1]
+
+	current, authenticated := h.ClientManager.Identity(client)
+	if authenticated && current == username {
+		conn.Write([]byte(ColorYellow + "You are already logged in.\n" + ColorReset))
+		return
+	}
+
+	if wait := h.Accounts.LoginLockout(username, client.IP); wait > 0 {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("Too many failed logins for '%s'. Try again in %s.\n",
+			username, wait.Round(time.Second)) + ColorReset))
+		return
+	}
+
+	// A bot's password is its token
+	bot := h.Accounts.IsBot(username)
+	if bot && !h.Accounts.AuthenticateBot(username, password) || !bot && !h.Accounts.Authenticate(username, password) {
+		h.Accounts.LoginFailed(username, client.IP)
+		conn.Write([]byte(ColorRed + "Invalid username or password.\n" + ColorReset))
+		return
+	}
+	h.Accounts.LoginSucceeded(username, client.IP)
+
+	if ban := h.Moderation.FindBan("", username, ""); ban != nil {
+		conn.Write([]byte(ColorRed + "That account is banned from this server" + describeBan(ban) + "\n" + ColorReset))
+		return
+	}
+
+	profile := ""
+	if username != current {
+		if holder := h.ClientManager.GetClientByUsername(username); holder != nil && !h.evictToGuest(holder, username) {
+			if _, loggedIn := h.ClientManager.Identity(holder); loggedIn {
+				conn.Write([]byte(ColorRed + "That account is already logged in elsewhere.\n" + ColorReset))
+				return
+			}
+		}
+		profile = h.ClientManager.LoadProfile(username)
+	}
+	if err := h.ClientManager.LogIn(client, username, bot, profile); err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+	if username != current {
+		h.ClientManager.BroadcastToLobby(client.CurrentLobby,
+			fmt.Sprintf("%s%s%s is now known as %s%s%s", ColorYellow, current, ColorReset, ColorCyan, username, ColorReset))
+	}
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("Logged in as '%s'.\n", username) + ColorReset))
+	if client.KeyFingerprint != "" && !bot && h.Accounts.LinkKey(username, client.KeyFingerprint) {
+		conn.Write([]byte(ColorGreen + fmt.Sprintf("Your SSH key now logs you in as '%s' without a password.\n", username) + ColorReset))
+	}
+	h.DeliverMail(client)
+	h.DeliverInvites(client)
+}
+
+// ReserveUsername gives a client that picked a registered name
+// the login grace period to log in before it is renamed to a guest name
+func (h *CommandHandler) ReserveUsername(client *models.Client) {
+	username, authenticated := h.ClientManager.Identity(client)
+	if authenticated || !h.Accounts.IsRegistered(username) {
+		return
+	}
+
+	grace := time.Duration(h.loginGrace.Load())
+	if h.Accounts.IsBot(client.Username) {
+		h.ClientManager.Send(client, ColorYellow+fmt.Sprintf(
+			"'%s' is a bot account. Use /login %s <token> within %d seconds or you will be renamed.\n",
+			client.Username, client.Username, int(grace.Seconds()))+ColorReset)
+	} else if h.Accounts.HasPassword(client.Username) {
+		h.ClientManager.Send(client, ColorYellow+fmt.Sprintf(
+			"'%s' is a registered name. Use /login %s <password> within %d seconds or you will be renamed.\n",
+			client.Username, client.Username, int(grace.Seconds()))+ColorReset)
+	} else {
+		h.ClientManager.Send(client, ColorYellow+fmt.Sprintf(
+			"'%s' is locked to an SSH key. You will be renamed in %d seconds; connect over SSH with that key to use it.\n",
+			client.Username, int(grace.Seconds()))+ColorReset)
+	}
+
+	time.AfterFunc(grace, func() {
+		h.evictToGuest(client, username)
+	})
+}
+
+// evictToGuest renames a client off the reserved name username unless
+// they have logged in to it or left it in the meantime, and reports
+// whether it did
+func (h *CommandHandler) evictToGuest(client *models.Client, username string) bool {
+	guestName := h.newGuestName()
+	if !h.ClientManager.RenameUnauthenticated(client, username, guestName) {
+		return false
+	}
+
+	h.ClientManager.Send(client, ColorRed+fmt.Sprintf("'%s' is reserved by a registered user. You are now %s.\n",
+		username, guestName)+ColorReset)
+	h.ClientManager.BroadcastToLobby(h.ClientManager.CurrentLobby(client),
+		fmt.Sprintf("%s%s%s is now known as %s%s%s", ColorYellow, username, ColorReset, ColorCyan, guestName, ColorReset))
+	return true
+}
+
+// newGuestName picks an unused, unregistered guest name
+func (h *CommandHandler) newGuestName() string {
+	for {
+		name := fmt.Sprintf("%s%04d", GuestPrefix, rand.Intn(10000))
+		if !h.ClientManager.IsUsernameTaken(name) && !h.Accounts.IsRegistered(name) {
+			return name
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterAndLogin(t *testing.T) {
+	h := newTestHandler(t)
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+
+	h.HandleCommand(alice.Conn, "/register secret-pass", alice)
+	aliceOut.waitFor(t, "Registered 'alice'.")
+	if !h.Accounts.IsRegistered("alice") || !h.isVerified(alice) {
+		t.Fatal("/register did not register and log in alice")
+	}
+	h.HandleCommand(alice.Conn, "/login alice secret-pass", alice)
+	aliceOut.waitFor(t, "You are already logged in.")
+
+	// A second connection under another name logs in with the password
+	otherOut := record(addPipeClient(t, h.ClientManager, "newcomer", false))
+	other := h.ClientManager.GetClientByUsername("newcomer")
+	h.HandleCommand(other.Conn, "/login alice wrong-pass", other)
+	otherOut.waitFor(t, "Invalid username or password.")
+	h.HandleCommand(other.Conn, "/login alice secret-pass", other)
+	otherOut.waitFor(t, "That account is already logged in elsewhere.")
+	if name, loggedIn := h.ClientManager.Identity(other); name != "newcomer" || loggedIn {
+		t.Errorf("refused login left the client as %q, logged in %v", name, loggedIn)
+	}
+}
+
+func TestLoginEvictsUnauthenticatedHolder(t *testing.T) {
+	h := newTestHandler(t)
+	if err := h.Accounts.Register("alice", "secret-pass"); err != nil {
+		t.Fatal(err)
+	}
+	squatterOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	squatter := h.ClientManager.GetClientByUsername("alice")
+	ownerOut := record(addPipeClient(t, h.ClientManager, "owner", false))
+	owner := h.ClientManager.GetClientByUsername("owner")
+
+	h.HandleCommand(owner.Conn, "/login alice secret-pass", owner)
+	ownerOut.waitFor(t, "Logged in as 'alice'.")
+	squatterOut.waitFor(t, "'alice' is reserved by a registered user. You are now "+GuestPrefix)
+	if h.ClientManager.GetClientByUsername("alice") != owner || !h.isVerified(owner) {
+		t.Error("alice is not held by the logged in client")
+	}
+	if name, _ := h.ClientManager.Identity(squatter); !strings.HasPrefix(name, GuestPrefix) {
+		t.Errorf("squatter is now %q; want a guest name", name)
+	}
+}
+
+func TestLoginGracePeriod(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetLoginGracePeriod(20 * time.Millisecond)
+	logIn(t, h, "alice", "bob")
+
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	h.ReserveUsername(alice)
+	aliceOut.waitFor(t, "You are now "+GuestPrefix)
+	if h.ClientManager.GetClientByUsername("alice") != nil {
+		t.Error("alice is still held after the grace period")
+	}
+
+	// Logging in within the grace period keeps the name: the timer's
+	// eviction finds bob logged in and leaves them be
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	bob := h.ClientManager.GetClientByUsername("bob")
+	h.HandleCommand(bob.Conn, "/login bob secret-pass", bob)
+	bobOut.waitFor(t, "Logged in as 'bob'.")
+	if h.evictToGuest(bob, "bob") || h.ClientManager.GetClientByUsername("bob") != bob {
+		t.Error("bob was evicted after logging in")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	h := newTestHandler(t)
+	if err := h.Accounts.Register("alice", "secret-pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	const guesserIP, ownerIP = "203.0.113.9", "198.51.100.7"
+
+	// Spread the attempts over connections from one address, as the rate
+	// limiter would otherwise stop a single one first
+	for i := range loginFailuresAllowed + 1 {
+		name := "guesser" + string(rune('a'+i))
+		out := record(addPipeClient(t, h.ClientManager, name, false))
+		c := h.ClientManager.GetClientByUsername(name)
+		c.IP = guesserIP
+		h.HandleCommand(c.Conn, "/login alice wrong-pass", c)
+		if i < loginFailuresAllowed {
+			out.waitFor(t, "Invalid username or password.")
+		} else {
+			out.waitFor(t, "Too many failed logins for 'alice'.")
+		}
+	}
+	if wait := h.Accounts.LoginLockout("alice", guesserIP); wait <= 0 || wait > loginLockout {
+		t.Fatalf("lockout = %v; want up to %v", wait, loginLockout)
+	}
+
+	// The owner, elsewhere, isn't locked out by someone else's guesses
+	out := record(addPipeClient(t, h.ClientManager, "owner", false))
+	owner := h.ClientManager.GetClientByUsername("owner")
+	owner.IP = ownerIP
+	h.HandleCommand(owner.Conn, "/login alice secret-pass", owner)
+	out.waitFor(t, "Logged in as 'alice'.")
+	if wait := h.Accounts.LoginLockout("alice", guesserIP); wait <= 0 {
+		t.Error("the owner's login lifted the lockout of another address")
+	}
+
+	h.Accounts.LoginFailed("nobody", guesserIP)
+	if wait := h.Accounts.LoginLockout("nobody", guesserIP); wait != 0 {
+		t.Errorf("unregistered name locked for %v", wait)
+	}
+	h.Accounts.LoginSucceeded("alice", guesserIP)
+	if wait := h.Accounts.LoginLockout("alice", guesserIP); wait != 0 {
+		t.Errorf("lockout after a success = %v", wait)
+	}
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"chat-server/server/ai"
+	"chat-server/server/models"
+)
+
+// AIUsername is the name AI replies are attributed to. No user may take it.
+const AIUsername = "AI"
+
+// aiLineWidth is how much unbroken AI text is buffered before it is sent
+// to the lobby; shorter lines go out as soon as the model ends them
+const aiLineWidth = 100
+
+func (h *CommandHandler) handleAICommand(conn net.Conn, client *models.Client, cmd string) {
+	content := strings.TrimPrefix(cmd, "/ai ")
+	userText := strings.TrimSpace(content)
+
+	switch userText {
+	case "stop":
+		if !h.StopAI(client) {
+			conn.Write([]byte(ColorYellow + "You have no AI request queued or running.\n" + ColorReset))
+		}
+		return
+	case "queue":
+		h.showAIQueue(conn, client)
+		return
+	}
+
+	if userText == "" {
+		conn.Write([]byte(ColorRed + "Usage: /ai <your question>\n" + ColorReset))
+		return
+	}
+
+	if len(userText) > 1000 {
+		conn.Write([]byte(ColorRed + "AI question too long. Max: 1000 characters\n" + ColorReset))
+		return
+	}
+
+	if h.CheckMuted(conn, client) {
+		return
+	}
+
+	if !ai.Available() {
+		conn.Write([]byte(ColorRed + "AI is not available on this server\n" + ColorReset))
+		return
+	}
+
+	lobby := client.CurrentLobby
+	job := &aiJob{client: client, asker: client.Username, lobby: lobby, question: userText}
+	ahead, started, err := h.aiQueue.Enqueue(job, func() {
+		h.ClientManager.BroadcastToLobby(lobby,
+			fmt.Sprintf("%s%s%s asked AI: %s", ColorCyan, client.Username, ColorReset, userText))
+	})
+	switch {
+	case err != nil:
+		h.ClientManager.Send(client, ColorRed+"AI request not queued: "+err.Error()+"\n"+ColorReset)
+	case started:
+	case ahead == 0:
+		h.ClientManager.Send(client, ColorYellow+"Your AI request is next; waiting for a free AI worker. Use /ai stop to cancel.\n"+ColorReset)
+	default:
+		h.ClientManager.Send(client, ColorYellow+fmt.Sprintf(
+			"Your AI request is queued at position %d (%d ahead of you). Use /ai queue to watch it or /ai stop to cancel.\n",
+			ahead+1, ahead)+ColorReset)
+	}
+}
+
+// StopAI cancels the client's running AI request or drops it from the queue
+func (h *CommandHandler) StopAI(client *models.Client) bool {
+	return h.aiQueue.Cancel(client)
+}
+
+// showAIQueue lists the running and pending AI requests of the client's lobby
+func (h *CommandHandler) showAIQueue(conn net.Conn, client *models.Client) {
+	running, pending := h.aiQueue.Snapshot(client.CurrentLobby)
+	if running == nil && len(pending) == 0 {
+		conn.Write([]byte(ColorCyan + "No AI requests pending in this lobby.\n" + ColorReset))
+		return
+	}
+
+	now := time.Now()
+	msg := ColorCyan + fmt.Sprintf("\n=== AI queue for '%s' ===\n", client.CurrentLobby) + ColorReset
+	if running != nil {
+		msg += fmt.Sprintf("  %s▶ %s%s: %s %s(running %s)%s\n", ColorGreen, running.asker, ColorReset,
+			truncate(running.question, 60), ColorCyan, formatDuration(now.Sub(running.started)), ColorReset)
+	}
+	for i, job := range pending {
+		msg += fmt.Sprintf("  %d. %s: %s %s(waiting %s)%s\n", i+1, job.asker,
+			truncate(job.question, 60), ColorCyan, formatDuration(now.Sub(job.queued)), ColorReset)
+	}
+	conn.Write([]byte(msg + "\n"))
+}
+
+// truncate shortens s to at most n runes
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+// streamAIReply runs one AI request and relays the reply to the lobby
+// between start and end markers as it is generated
+func (h *CommandHandler) streamAIReply(ctx context.Context, job *aiJob) {
+	lobby, asker := job.lobby, job.asker
+
+	out := &aiStream{cm: h.ClientManager, lobby: lobby, asker: asker}
+	h.ClientManager.BroadcastLine(lobby, ColorMagenta+"┌─ AI response to "+asker+ColorReset)
+
+	_, err := ai.StreamAIChat(ctx, job.question, lobby, asker,
+		h.LobbyManager.GetConversations(), h.LobbyManager.GetConversationsMutex(),
+		h.LobbyManager.GetLobbyContext, out.write)
+	out.flush()
+
+	switch {
+	// Providers don't all wrap the cancellation in the error they return,
+	// so /ai stop is told apart by the context itself
+	case err != nil && errors.Is(ctx.Err(), context.Canceled):
+		h.ClientManager.BroadcastLine(lobby, ColorMagenta+"└─ AI response stopped by "+asker+ColorReset)
+	case err != nil:
+		log.Printf("AI error for user %s: %v", asker, err)
+		h.ClientManager.Send(job.client, ColorRed+ai.FormatAIError(err)+"\n"+ColorReset)
+		h.ClientManager.BroadcastLine(lobby, ColorMagenta+"└─ AI response failed"+ColorReset)
+	default:
+		h.LobbyManager.SaveConversation(lobby)
+		h.ClientManager.BroadcastLine(lobby, ColorMagenta+"└─ end of AI response"+ColorReset)
+		// The lobby got the reply line by line; the event hook gets it whole
+		h.ClientManager.notify(models.Event{Type: models.EventAIResponse, Lobby: lobby, From: AIUsername, To: asker,
+			Text: strings.Join(out.lines, "\n"), Timestamp: time.Now()})
+	}
+}
+
+// aiStream turns streamed chunks into whole lines for the lobby
+type aiStream struct {
+	cm      *ClientManager
+	lobby   string
+	asker   string
+	pending string
+	lines   []string // every line sent so far
+}
+
+func (s *aiStream) write(chunk string) {
+	s.pending += chunk
+	for {
+		cut, skip := strings.IndexByte(s.pending, '\n'), 1
+		if cut == -1 {
+			if len(s.pending) < aiLineWidth {
+				return
+			}
+			if cut = strings.LastIndexByte(s.pending[:aiLineWidth], ' '); cut <= 0 {
+				cut, skip = aiLineWidth, 0
+			}
+		}
+		s.emit(s.pending[:cut])
+		s.pending = s.pending[cut+skip:]
+	}
+}
+
+func (s *aiStream) flush() {
+	if strings.TrimSpace(s.pending) != "" {
+		s.emit(s.pending)
+	}
+	s.pending = ""
+}
+
+func (s *aiStream) emit(line string) {
+	s.lines = append(s.lines, line)
+	ev := models.Event{Type: models.EventAIResponse, Lobby: s.lobby, From: AIUsername, To: s.asker, Text: line}
+	s.cm.BroadcastEventLine(ev, ColorMagenta+"│ "+ColorReset+line)
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"chat-server/server/metrics"
+	"chat-server/server/models"
+)
+
+// Default AI queue limits, used until SetAILimits is called
+const (
+	DefaultAIConcurrency = 4
+	DefaultAIQueueLength = 10
+)
+
+var aiQueueDepth = metrics.NewGaugeFunc("chat_ai_queue_requests",
+	"AI requests in the queue, by state.", "state")
+
+// aiJob is one queued or running /ai request
+type aiJob struct {
+	client   *models.Client
+	asker    string
+	lobby    string
+	question string
+	queued   time.Time
+	started  time.Time
+	cancel   context.CancelFunc
+}
+
+// aiQueue runs AI requests with a FIFO queue per lobby. Each lobby has at
+// most one request running, since they share a conversation, and at most
+// limit requests run at once across the server. Lobbies waiting for a
+// free slot are served in turn, so one busy lobby cannot starve the rest.
+type aiQueue struct {
+	mu       sync.Mutex
+	limit    int
+	maxQueue int
+	running  int
+	pending  map[string][]*aiJob
+	active   map[string]*aiJob
+	ready    []string
+	byClient map[*models.Client]*aiJob
+	run      func(ctx context.Context, job *aiJob)
+	timeout  func() time.Duration
+}
+
+// newAIQueue creates a queue that executes jobs with run, giving each a
+// context that expires after timeout() once it starts
+func newAIQueue(run func(ctx context.Context, job *aiJob), timeout func() time.Duration) *aiQueue {
+	q := &aiQueue{
+		limit:    DefaultAIConcurrency,
+		maxQueue: DefaultAIQueueLength,
+		pending:  make(map[string][]*aiJob),
+		active:   make(map[string]*aiJob),
+		byClient: make(map[*models.Client]*aiJob),
+		run:      run,
+		timeout:  timeout,
+	}
+	aiQueueDepth.SetSource(q.depth)
+	return q
+}
+
+// SetLimits changes the global concurrency cap and the per-lobby queue length
+func (q *aiQueue) SetLimits(concurrency, queueLength int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit = concurrency
+	q.maxQueue = queueLength
+	q.dispatch()
+}
+
+// Enqueue adds a request and returns how many requests are ahead of it in
+// its lobby. started reports whether it began running immediately.
+// accepted is called once the request is admitted, before it can start.
+func (q *aiQueue) Enqueue(job *aiJob, accepted func()) (ahead int, started bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, busy := q.byClient[job.client]; busy {
+		return 0, false, fmt.Errorf("you already have an AI request queued or running. Use /ai stop to cancel it")
+	}
+	if len(q.pending[job.lobby]) >= q.maxQueue {
+		return 0, false, fmt.Errorf("the AI queue for this lobby is full (%d requests), try again later", q.maxQueue)
+	}
+
+	accepted()
+	job.queued = time.Now()
+	q.byClient[job.client] = job
+	q.pending[job.lobby] = append(q.pending[job.lobby], job)
+	if q.active[job.lobby] == nil && len(q.pending[job.lobby]) == 1 {
+		q.ready = append(q.ready, job.lobby)
+	}
+	q.dispatch()
+
+	if q.active[job.lobby] == job {
+		return 0, true, nil
+	}
+	ahead = len(q.pending[job.lobby]) - 1
+	if q.active[job.lobby] != nil {
+		ahead++
+	}
+	return ahead, false, nil
+}
+
+// Cancel stops a client's running request or removes it from the queue
+func (q *aiQueue) Cancel(client *models.Client) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.byClient[client]
+	if !ok {
+		return false
+	}
+	if job.cancel != nil {
+		job.cancel()
+		return true
+	}
+
+	delete(q.byClient, client)
+	queue := q.pending[job.lobby]
+	for i, pending := range queue {
+		if pending == job {
+			q.pending[job.lobby] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(q.pending[job.lobby]) == 0 {
+		delete(q.pending, job.lobby)
+		q.removeReady(job.lobby)
+	}
+	return true
+}
+
+// Snapshot returns the running request (or nil) and the pending requests of a lobby
+func (q *aiQueue) Snapshot(lobby string) (running *aiJob, pending []*aiJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job := q.active[lobby]; job != nil {
+		copied := *job
+		running = &copied
+	}
+	for _, job := range q.pending[lobby] {
+		copied := *job
+		pending = append(pending, &copied)
+	}
+	return running, pending
+}
+
+// dispatch starts ready lobbies while slots are free; q.mu must be held
+func (q *aiQueue) dispatch() {
+	for q.running < q.limit && len(q.ready) > 0 {
+		lobby := q.ready[0]
+		q.ready = q.ready[1:]
+
+		job := q.pending[lobby][0]
+		q.pending[lobby] = q.pending[lobby][1:]
+		if len(q.pending[lobby]) == 0 {
+			delete(q.pending, lobby)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), q.timeout())
+		job.cancel = cancel
+		job.started = time.Now()
+		q.active[lobby] = job
+		q.running++
+		go q.execute(ctx, job)
+	}
+}
+
+func (q *aiQueue) execute(ctx context.Context, job *aiJob) {
+	defer func() {
+		// A panicking request must still hand back its slot and its lobby
+		if r := recover(); r != nil {
+			log.Printf("PANIC in AI request from %s in %s: %v", job.asker, job.lobby, r)
+		}
+		job.cancel()
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.running--
+		delete(q.active, job.lobby)
+		delete(q.byClient, job.client)
+		if len(q.pending[job.lobby]) > 0 {
+			q.ready = append(q.ready, job.lobby)
+		}
+		q.dispatch()
+	}()
+	q.run(ctx, job)
+}
+
+func (q *aiQueue) removeReady(lobby string) {
+	for i, name := range q.ready {
+		if name == lobby {
+			q.ready = append(q.ready[:i:i], q.ready[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *aiQueue) depth() map[string]float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := 0
+	for _, jobs := range q.pending {
+		pending += len(jobs)
+	}
+	return map[string]float64{"running": float64(q.running), "pending": float64(pending)}
+}
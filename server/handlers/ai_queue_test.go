@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-server/server/ai"
+	"chat-server/server/models"
+)
+
+// gatedRunner records the order jobs start in and holds each one until released
+type gatedRunner struct {
+	mu      sync.Mutex
+	started []string
+	release map[string]chan struct{}
+}
+
+func newGatedRunner() *gatedRunner {
+	return &gatedRunner{release: make(map[string]chan struct{})}
+}
+
+func (g *gatedRunner) gate(question string) chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.release[question] == nil {
+		g.release[question] = make(chan struct{})
+	}
+	return g.release[question]
+}
+
+func (g *gatedRunner) run(ctx context.Context, job *aiJob) {
+	g.mu.Lock()
+	g.started = append(g.started, job.question)
+	g.mu.Unlock()
+	select {
+	case <-g.gate(job.question):
+	case <-ctx.Done():
+	}
+}
+
+func (g *gatedRunner) waitStarted(t *testing.T, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		g.mu.Lock()
+		got := append([]string(nil), g.started...)
+		g.mu.Unlock()
+		if len(got) == len(want) {
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("started %v; want %v", got, want)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("started %v; want %v", got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func enqueue(t *testing.T, q *aiQueue, lobby, question string) (*models.Client, int, bool) {
+	t.Helper()
+	client := &models.Client{Username: question}
+	ahead, started, err := q.Enqueue(&aiJob{client: client, asker: question, lobby: lobby, question: question}, func() {})
+	if err != nil {
+		t.Fatalf("Enqueue(%s): %v", question, err)
+	}
+	return client, ahead, started
+}
+
+func TestAIQueueFIFOPerLobby(t *testing.T) {
+	g := newGatedRunner()
+	q := newAIQueue(g.run, func() time.Duration { return time.Minute })
+
+	if _, ahead, started := enqueue(t, q, "general", "a1"); !started || ahead != 0 {
+		t.Errorf("first request: ahead %d, started %v; want it to start", ahead, started)
+	}
+	if _, ahead, started := enqueue(t, q, "general", "a2"); started || ahead != 1 {
+		t.Errorf("second request: ahead %d, started %v; want 1 ahead", ahead, started)
+	}
+	enqueue(t, q, "general", "a3")
+	g.waitStarted(t, "a1")
+
+	running, pending := q.Snapshot("general")
+	if running == nil || running.question != "a1" || len(pending) != 2 || pending[0].question != "a2" {
+		t.Fatalf("Snapshot = %+v, %+v", running, pending)
+	}
+
+	close(g.gate("a1"))
+	g.waitStarted(t, "a1", "a2")
+	close(g.gate("a2"))
+	g.waitStarted(t, "a1", "a2", "a3")
+	close(g.gate("a3"))
+}
+
+func TestAIQueueConcurrencyCapIsFair(t *testing.T) {
+	g := newGatedRunner()
+	q := newAIQueue(g.run, func() time.Duration { return time.Minute })
+	q.SetLimits(1, DefaultAIQueueLength)
+
+	enqueue(t, q, "busy", "b1")
+	enqueue(t, q, "busy", "b2")
+	if _, ahead, started := enqueue(t, q, "quiet", "q1"); started || ahead != 0 {
+		t.Errorf("quiet lobby: ahead %d, started %v; want next in line waiting for a slot", ahead, started)
+	}
+	g.waitStarted(t, "b1")
+
+	// The quiet lobby gets the slot before the busy lobby's second request
+	close(g.gate("b1"))
+	g.waitStarted(t, "b1", "q1")
+	close(g.gate("q1"))
+	g.waitStarted(t, "b1", "q1", "b2")
+	close(g.gate("b2"))
+}
+
+func TestAIQueueSurvivesPanic(t *testing.T) {
+	g := newGatedRunner()
+	q := newAIQueue(func(ctx context.Context, job *aiJob) {
+		if job.question == "boom" {
+			panic("provider bug")
+		}
+		g.run(ctx, job)
+	}, func() time.Duration { return time.Minute })
+	q.SetLimits(1, DefaultAIQueueLength)
+
+	enqueue(t, q, "ops", "boom")
+	enqueue(t, q, "ops", "next")
+	g.waitStarted(t, "next")
+	close(g.gate("next"))
+}
+
+func TestAIQueueCancelAndLimits(t *testing.T) {
+	g := newGatedRunner()
+	q := newAIQueue(g.run, func() time.Duration { return time.Minute })
+	q.SetLimits(1, 2)
+
+	first, _, _ := enqueue(t, q, "general", "r1")
+	waiting, _, _ := enqueue(t, q, "general", "r2")
+	enqueue(t, q, "general", "r3")
+
+	if _, _, err := q.Enqueue(&aiJob{client: waiting, lobby: "general", question: "again"}, func() {}); err == nil {
+		t.Error("a client queued a second request")
+	}
+	if _, _, err := q.Enqueue(&aiJob{client: &models.Client{}, lobby: "general", question: "r4"}, func() {}); err == nil {
+		t.Error("a full lobby queue accepted another request")
+	}
+
+	if !q.Cancel(waiting) {
+		t.Fatal("Cancel of a queued request failed")
+	}
+	if _, pending := q.Snapshot("general"); len(pending) != 1 || pending[0].question != "r3" {
+		t.Errorf("pending after cancel = %+v; want only r3", pending)
+	}
+
+	g.waitStarted(t, "r1")
+	q.Cancel(first)
+	g.waitStarted(t, "r1", "r3")
+	close(g.gate("r3"))
+	if q.Cancel(waiting) {
+		t.Error("Cancel succeeded twice")
+	}
+}
+
+func TestAIQueueCommand(t *testing.T) {
+	ai.SetProvider(ai.MockProvider{Delay: 50 * time.Millisecond})
+	defer ai.SetProvider(nil)
+
+	h := newTestHandler(t)
+	alice := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bob := record(addPipeClient(t, h.ClientManager, "bob", false))
+	a := h.ClientManager.GetClientByUsername("alice")
+	b := h.ClientManager.GetClientByUsername("bob")
+
+	h.HandleCommand(a.Conn, "/ai first question", a)
+	h.HandleCommand(b.Conn, "/ai second question", b)
+	bob.waitFor(t, "queued at position 2 (1 ahead of you)")
+
+	h.HandleCommand(b.Conn, "/ai queue", b)
+	bob.waitFor(t, "alice\033[0m: first question")
+	bob.waitFor(t, "1. bob: second question")
+
+	alice.waitFor(t, "mock reply #2: bob asked: second question")
+	alice.waitFor(t, "└─ end of AI response\033[0m\n\033[36m> \033[0m\r\033[K\033[35m┌─ AI response to bob")
+}
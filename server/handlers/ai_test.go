@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-server/server/ai"
+)
+
+// transcript collects everything written to the far end of a client's pipe
+type transcript struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func record(conn net.Conn) *transcript {
+	tr := &transcript{}
+	go func() {
+		chunk := make([]byte, 512)
+		for {
+			n, err := conn.Read(chunk)
+			if err != nil {
+				return
+			}
+			tr.mu.Lock()
+			tr.buf.Write(chunk[:n])
+			tr.mu.Unlock()
+		}
+	}()
+	return tr
+}
+
+// waitFor fails the test unless text shows up within a second
+func (tr *transcript) waitFor(t *testing.T, text string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		tr.mu.Lock()
+		found := strings.Contains(tr.buf.String(), text)
+		tr.mu.Unlock()
+		if found {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	t.Fatalf("%q never arrived; got:\n%s", text, tr.buf.String())
+}
+
+func TestAICommandWithMockProvider(t *testing.T) {
+	ai.SetProvider(ai.MockProvider{})
+	defer ai.SetProvider(nil)
+
+	h := newTestHandler(t)
+	alice := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bob := record(addPipeClient(t, h.ClientManager, "bob", false))
+
+	asker := h.ClientManager.GetClientByUsername("alice")
+	h.HandleCommand(asker.Conn, "/ai what is go?", asker)
+
+	for _, tr := range []*transcript{alice, bob} {
+		tr.waitFor(t, "asked AI: what is go?")
+		tr.waitFor(t, "┌─ AI response to alice")
+		tr.waitFor(t, "mock reply #1: alice asked: what is go?")
+		tr.waitFor(t, "└─ end of AI response")
+	}
+	if _, ok := h.LobbyManager.GetConversations()["general"]; !ok {
+		t.Error("conversation was not recorded for the lobby")
+	}
+}
+
+func TestAIStop(t *testing.T) {
+	ai.SetProvider(ai.MockProvider{Delay: 50 * time.Millisecond})
+	defer ai.SetProvider(nil)
+
+	h := newTestHandler(t)
+	out := record(addPipeClient(t, h.ClientManager, "alice", false))
+	client := h.ClientManager.GetClientByUsername("alice")
+
+	h.HandleCommand(client.Conn, "/ai tell me a long story", client)
+	out.waitFor(t, "┌─ AI response to alice")
+
+	h.HandleCommand(client.Conn, "/ai another one", client)
+	out.waitFor(t, "already have an AI request queued or running")
+
+	h.HandleCommand(client.Conn, "/ai stop", client)
+	out.waitFor(t, "└─ AI response stopped by alice")
+
+	if n := len(h.LobbyManager.GetConversations()["general"].Messages); n != 0 {
+		t.Errorf("cancelled request left %d messages in the conversation", n)
+	}
+
+	h.HandleCommand(client.Conn, "/ai stop", client)
+	out.waitFor(t, "You have no AI request queued or running")
+}
+
+// abortingProvider blocks until its request is cancelled, then fails with
+// an error that doesn't wrap context.Canceled
+type abortingProvider struct{}
+
+func (abortingProvider) Name() string { return "aborting" }
+
+func (abortingProvider) Generate(ctx context.Context, system string, messages []ai.Message, opts ai.Options) (string, error) {
+	<-ctx.Done()
+	return "", errors.New("stream aborted")
+}
+
+func TestAIStopWithOpaqueProviderError(t *testing.T) {
+	ai.SetProvider(abortingProvider{})
+	defer ai.SetProvider(nil)
+
+	h := newTestHandler(t)
+	out := record(addPipeClient(t, h.ClientManager, "alice", false))
+	client := h.ClientManager.GetClientByUsername("alice")
+
+	h.HandleCommand(client.Conn, "/ai hello", client)
+	out.waitFor(t, "┌─ AI response to alice")
+	h.HandleCommand(client.Conn, "/ai stop", client)
+	out.waitFor(t, "└─ AI response stopped by alice")
+
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if strings.Contains(out.buf.String(), "AI response failed") {
+		t.Errorf("stopped request was reported as a failure:\n%s", out.buf.String())
+	}
+}
+
+func TestAIStreamSplitsLines(t *testing.T) {
+	h := newTestHandler(t)
+	out := record(addPipeClient(t, h.ClientManager, "alice", false))
+
+	s := &aiStream{cm: h.ClientManager, lobby: "general"}
+	s.write("first li")
+	s.write("ne\nsecond")
+	out.waitFor(t, "│ \033[0mfirst line\n")
+
+	s.write(" " + strings.Repeat("word ", 30))
+	out.waitFor(t, "│ \033[0msecond word")
+	if strings.Contains(s.pending, "second") || len(s.pending) >= aiLineWidth {
+		t.Errorf("long text was not broken at a space; pending %q", s.pending)
+	}
+
+	s.flush()
+	if s.pending != "" {
+		t.Errorf("flush left %q pending", s.pending)
+	}
+}
+
+func TestAICommandWithoutProvider(t *testing.T) {
+	ai.SetProvider(nil)
+	h := newTestHandler(t)
+	out := record(addPipeClient(t, h.ClientManager, "alice", false))
+
+	client := h.ClientManager.GetClientByUsername("alice")
+	h.HandleCommand(client.Conn, "/ai hello", client)
+	out.waitFor(t, "AI is not available on this server")
+}
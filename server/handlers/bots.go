@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"chat-server/server/models"
+)
+
+// handleBot lets server operators create bot accounts and manage their
+// tokens. A token is shown once, when it is issued.
+func (h *CommandHandler) handleBot(conn net.Conn, client *models.Client, cmd string) {
+	if !h.isOperator(client) {
+		conn.Write([]byte(ColorRed + "Only server operators can manage bots.\n" + ColorReset))
+		return
+	}
+
+	args := strings.Fields(strings.TrimPrefix(cmd, "/bot"))
+	if len(args) == 0 || (len(args) == 1 && args[0] == "list") {
+		h.showBots(conn)
+		return
+	}
+	if len(args) != 2 {
+		conn.Write([]byte(ColorRed + "Usage: /bot [list] | create <name> | token <name> | delete <name>\n" + ColorReset))
+		return
+	}
+
+	action, name := args[0], args[1]
+	switch action {
+	case "create":
+		if h.ClientManager.IsUsernameTaken(name) {
+			conn.Write([]byte(ColorRed + fmt.Sprintf("%s is online; pick a name nobody is using.\n", name) + ColorReset))
+			return
+		}
+		token, err := h.Accounts.CreateBot(name, client.Username)
+		if err != nil {
+			conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+			return
+		}
+		conn.Write([]byte(ColorGreen + fmt.Sprintf("Created bot %s. Its token, which won't be shown again:\n  %s\n",
+			name, token) + ColorReset))
+	case "token":
+		token, err := h.Accounts.RotateBotToken(name)
+		if err != nil {
+			conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+			return
+		}
+		h.disconnectBot(name, "Your token was replaced")
+		conn.Write([]byte(ColorGreen + fmt.Sprintf("New token for %s; the old one no longer works:\n  %s\n",
+			name, token) + ColorReset))
+	case "delete":
+		if err := h.Accounts.DeleteBot(name); err != nil {
+			conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+			return
+		}
+		h.disconnectBot(name, "This bot account was deleted")
+		conn.Write([]byte(ColorGreen + fmt.Sprintf("Deleted bot %s.\n", name) + ColorReset))
+	default:
+		conn.Write([]byte(ColorRed + "Usage: /bot [list] | create <name> | token <name> | delete <name>\n" + ColorReset))
+	}
+}
+
+func (h *CommandHandler) showBots(conn net.Conn) {
+	bots := h.Accounts.Bots()
+	msg := ColorCyan + fmt.Sprintf("\n=== Bots (%d) ===\n", len(bots)) + ColorReset
+	for _, bot := range bots {
+		status := "offline"
+		if c := h.ClientManager.GetClientByUsername(bot.Name); c != nil && c.Bot {
+			status = "online in " + c.CurrentLobby
+		}
+		msg += fmt.Sprintf("  %s%s%s created by %s on %s, %s\n",
+			ColorWhite, bot.Name, ColorReset, bot.CreatedBy, bot.Created.Format("2006-01-02"), status)
+	}
+	msg += "\n"
+	conn.Write([]byte(msg))
+}
+
+// disconnectBot closes the connection of a bot logged in as name, if any
+func (h *CommandHandler) disconnectBot(name, reason string) {
+	target := h.ClientManager.GetClientByUsername(name)
+	if target == nil || !target.Bot {
+		return
+	}
+	h.ClientManager.Send(target, ColorRed+reason+". Disconnecting.\n"+ColorReset)
+	time.AfterFunc(100*time.Millisecond, func() { target.Conn.Close() })
+}
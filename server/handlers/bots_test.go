@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestBotAccounts(t *testing.T) {
+	h := newTestHandler(t)
+	h.Moderation.SetOperators([]string{"root"})
+	rootOut := record(addPipeClient(t, h.ClientManager, "root", false))
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	botOut := record(addPipeClient(t, h.ClientManager, "ci", false))
+	root := h.ClientManager.GetClientByUsername("root")
+	root.Authenticated = true
+	alice := h.ClientManager.GetClientByUsername("alice")
+	ci := h.ClientManager.GetClientByUsername("ci")
+
+	h.HandleCommand(alice.Conn, "/bot create deploybot", alice)
+	aliceOut.waitFor(t, "Only server operators can manage bots.")
+
+	h.HandleCommand(root.Conn, "/bot create alice", root)
+	rootOut.waitFor(t, "alice is online")
+
+	h.HandleCommand(root.Conn, "/bot create deploybot", root)
+	rootOut.waitFor(t, "Created bot deploybot.")
+	rootOut.mu.Lock()
+	match := regexp.MustCompile(BotTokenPrefix + `[0-9a-f]+`).FindString(rootOut.buf.String())
+	rootOut.mu.Unlock()
+	if match == "" {
+		t.Fatal("no token in /bot create output")
+	}
+	if !h.Accounts.IsRegistered("deploybot") || h.Accounts.ClaimKey("deploybot", "SHA256:abc") {
+		t.Error("the bot's name is not reserved")
+	}
+
+	h.HandleCommand(ci.Conn, "/login deploybot wrong-token", ci)
+	botOut.waitFor(t, "Invalid username or password.")
+	h.HandleCommand(ci.Conn, "/login deploybot "+match, ci)
+	botOut.waitFor(t, "Logged in as 'deploybot'.")
+	if !ci.Bot || !ci.Authenticated || ci.Username != "deploybot" {
+		t.Fatalf("after login: %+v", ci)
+	}
+
+	h.HandleCommand(ci.Conn, "/users", ci)
+	botOut.waitFor(t, "[bot]")
+	h.HandleCommand(ci.Conn, "/register hunter22", ci)
+	botOut.waitFor(t, "Bots log in with their token")
+
+	h.HandleCommand(root.Conn, "/bot list", root)
+	rootOut.waitFor(t, "created by root on "+time.Now().Format("2006-01-02")+", online in general")
+
+	h.HandleCommand(root.Conn, "/bot delete deploybot", root)
+	rootOut.waitFor(t, "Deleted bot deploybot.")
+	botOut.waitFor(t, "This bot account was deleted. Disconnecting.")
+	if h.Accounts.IsBot("deploybot") || h.Accounts.AuthenticateBot("deploybot", match) {
+		t.Error("the bot survived /bot delete")
+	}
+}
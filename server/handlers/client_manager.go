@@ -1,48 +1,252 @@
 package handlers
 
 import (
+	"fmt"
+	"log"
 	"net"
+	"strings"
 	"sync"
-"time"
+	"time"
+
 	"chat-server/server/models"
+	"chat-server/server/storage"
+	"chat-server/server/utils"
+)
+
+// SlowConsumerPolicy decides what happens when a client's outbox is full
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room
+	DropOldest SlowConsumerPolicy = iota
+	// DropNewest discards the message being queued
+	DropNewest
+	// Disconnect closes the slow client's connection
+	Disconnect
+)
+
+// ParseSlowConsumerPolicy converts a configured policy name
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	switch name {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "drop-newest":
+		return DropNewest, nil
+	case "disconnect":
+		return Disconnect, nil
+	default:
+		return DropOldest, fmt.Errorf("unknown slow consumer policy %q", name)
+	}
+}
+
+const (
+	// DefaultOutboxSize is the number of messages queued per client
+	DefaultOutboxSize = 64
+	writeTimeout      = 5 * time.Second
 )
 
 // ClientManager manages connected clients
 type ClientManager struct {
 	clients           map[net.Conn]*models.Client
 	clientsByUsername map[string]*models.Client
+	store             storage.Store
+	outboxSize        int
+	policy            SlowConsumerPolicy
 	mu                sync.RWMutex
+
+	// eventHook, if set, is told about lobby events; webhooks hang off it
+	eventHook func(models.Event)
 }
 
-// NewClientManager creates a new client manager
-func NewClientManager() *ClientManager {
-	return &ClientManager{
+// NewClientManager creates a new client manager that persists profiles to store
+func NewClientManager(store storage.Store) *ClientManager {
+	cm := &ClientManager{
 		clients:           make(map[net.Conn]*models.Client),
 		clientsByUsername: make(map[string]*models.Client),
+		store:             store,
+		outboxSize:        DefaultOutboxSize,
+		policy:            DropOldest,
+	}
+	connectedUsers.SetSource(cm.usersPerLobby)
+	return cm
+}
+
+// SetOutboxPolicy sets the outbox size and slow consumer policy. The size
+// is fixed when a client is added, so it applies to new connections; the
+// policy applies to every client from its next full outbox.
+func (cm *ClientManager) SetOutboxPolicy(size int, policy SlowConsumerPolicy) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.outboxSize = size
+	cm.policy = policy
+}
+
+// LoadProfile returns the saved profile picture for a username, or "" if none
+func (cm *ClientManager) LoadProfile(username string) string {
+	profile, err := cm.store.LoadProfile(username)
+	if err != nil {
+		log.Printf("Failed to load profile for %s: %v", username, err)
+		return ""
 	}
+	return profile
 }
 
-// AddClient adds a new client
+// SetProfile changes a client's profile picture and saves it
+func (cm *ClientManager) SetProfile(client *models.Client, profile string) {
+	cm.mu.Lock()
+	client.UserProfile = profile
+	cm.mu.Unlock()
+	if err := cm.store.SaveProfile(client.Username, profile); err != nil {
+		log.Printf("Failed to save profile for %s: %v", client.Username, err)
+	}
+}
+
+// AddClient adds a new client and starts its writer goroutine
 func (cm *ClientManager) AddClient(conn net.Conn, client *models.Client) {
+	cm.saveLastSeen(client.Username)
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+
+	client.Outbox = make(chan []byte, cm.outboxSize)
+	client.Done = make(chan struct{})
+	go writeLoop(client)
+
 	cm.clients[conn] = client
 	cm.clientsByUsername[client.Username] = client
+	connectionsTotal.Inc()
 }
 
-// RemoveClient removes a client
+// RemoveClient removes a client and stops its writer goroutine
 func (cm *ClientManager) RemoveClient(conn net.Conn) *models.Client {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
 	client, exists := cm.clients[conn]
 	if exists {
 		delete(cm.clients, conn)
-		delete(cm.clientsByUsername, client.Username)
+		if cm.clientsByUsername[client.Username] == client {
+			delete(cm.clientsByUsername, client.Username)
+		}
+		close(client.Done)
+		disconnectsTotal.Inc()
+	}
+	cm.mu.Unlock()
+
+	if exists {
+		cm.saveLastSeen(client.Username)
 	}
 	return client
 }
 
+// A connected client's Username and Authenticated only change under the
+// manager's lock: the login grace timer and other clients' logins look at
+// them from other goroutines, and read them through Identity.
+
+// RenameClient changes a connected client's username
+func (cm *ClientManager) RenameClient(client *models.Client, newName string) error {
+	cm.mu.Lock()
+	if _, taken := cm.clientsByUsername[newName]; taken {
+		cm.mu.Unlock()
+		return fmt.Errorf("username already taken")
+	}
+	oldName := client.Username
+	cm.rename(client, newName)
+	cm.mu.Unlock()
+
+	cm.saveLastSeen(oldName)
+	cm.saveLastSeen(newName)
+	return nil
+}
+
+// RenameUnauthenticated renames a client off username unless they have
+// logged in, been renamed or disconnected since, or newName is taken.
+// The check and the rename are one step, so a /login can't slip between.
+func (cm *ClientManager) RenameUnauthenticated(client *models.Client, username, newName string) bool {
+	cm.mu.Lock()
+	_, taken := cm.clientsByUsername[newName]
+	if taken || client.Authenticated || client.Username != username || cm.clientsByUsername[username] != client {
+		cm.mu.Unlock()
+		return false
+	}
+	cm.rename(client, newName)
+	cm.mu.Unlock()
+
+	cm.saveLastSeen(username)
+	cm.saveLastSeen(newName)
+	return true
+}
+
+// rename moves client to newName; the caller holds cm.mu
+func (cm *ClientManager) rename(client *models.Client, newName string) {
+	if cm.clientsByUsername[client.Username] == client {
+		delete(cm.clientsByUsername, client.Username)
+	}
+	client.Username = newName
+	cm.clientsByUsername[newName] = client
+}
+
+// LogIn renames a client to username, unless that is taken by someone
+// else, and marks them logged in to it as a bot or a person. A non-empty
+// profile replaces theirs. Everything changes in one step, so broadcasts
+// never see half a login.
+func (cm *ClientManager) LogIn(client *models.Client, username string, bot bool, profile string) error {
+	cm.mu.Lock()
+	oldName := client.Username
+	if holder, taken := cm.clientsByUsername[username]; taken && holder != client {
+		cm.mu.Unlock()
+		return fmt.Errorf("username already taken")
+	}
+	cm.rename(client, username)
+	if profile != "" {
+		client.UserProfile = profile
+	}
+	client.Authenticated = true
+	client.Bot = bot
+	cm.mu.Unlock()
+
+	if oldName != username {
+		cm.saveLastSeen(oldName)
+		cm.saveLastSeen(username)
+	}
+	return nil
+}
+
+// SetAuthenticated marks a client as logged in to its current name
+func (cm *ClientManager) SetAuthenticated(client *models.Client) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	client.Authenticated = true
+}
+
+// Identity returns a client's name and whether they are logged in to it
+func (cm *ClientManager) Identity(client *models.Client) (username string, authenticated bool) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return client.Username, client.Authenticated
+}
+
+// LastSeen returns when a username was last connected, or the zero time
+// if it never was. Names currently in use count as seen now.
+func (cm *ClientManager) LastSeen(username string) time.Time {
+	if cm.GetClientByUsername(username) != nil {
+		return time.Now()
+	}
+	t, err := cm.store.LoadLastSeen(username)
+	if err != nil {
+		log.Printf("Failed to load last seen time for %s: %v", username, err)
+	}
+	return t
+}
+
+// saveLastSeen records that username is or was just connected; guest
+// names are throwaway and are not recorded
+func (cm *ClientManager) saveLastSeen(username string) {
+	if strings.HasPrefix(username, GuestPrefix) {
+		return
+	}
+	if err := cm.store.SaveLastSeen(username, time.Now()); err != nil {
+		log.Printf("Failed to save last seen time for %s: %v", username, err)
+	}
+}
+
 // GetClient gets client by connection
 func (cm *ClientManager) GetClient(conn net.Conn) *models.Client {
 	cm.mu.RLock()
@@ -79,60 +283,160 @@ func (cm *ClientManager) GetLobbyUsers(lobbyName string) []*models.Client {
 	return users
 }
 
+// A client's CurrentLobby and CurrentThread are also changed under the
+// manager's lock, as kicks, bans and lobby renames move clients other
+// than the one whose command is running.
+
+// MoveClient puts a client in lobbyName, outside any thread, and returns
+// the lobby they were in. It fails if exists reports the lobby gone:
+// MoveClients holds the same lock while a lobby is renamed or deleted, so
+// nobody can join it between the check and the move.
+func (cm *ClientManager) MoveClient(client *models.Client, lobbyName string, exists func(lobbyName string) bool) (string, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	oldLobby := client.CurrentLobby
+	if !exists(lobbyName) {
+		return oldLobby, false
+	}
+	client.CurrentLobby = lobbyName
+	client.CurrentThread = 0
+	return oldLobby, true
+}
+
+// MoveClients runs change, which renames or deletes lobby oldLobby, and
+// if it succeeds moves everyone in oldLobby to newLobby and returns them.
+// Their threads are left alone, which suits a rename.
+func (cm *ClientManager) MoveClients(oldLobby, newLobby string, change func() error) ([]*models.Client, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if err := change(); err != nil {
+		return nil, err
+	}
+	var moved []*models.Client
+	for _, client := range cm.clients {
+		if client.CurrentLobby == oldLobby {
+			client.CurrentLobby = newLobby
+			moved = append(moved, client)
+		}
+	}
+	return moved, nil
+}
+
+// SetThread sends a client's plain messages to thread root, or back to
+// the lobby if root is 0
+func (cm *ClientManager) SetThread(client *models.Client, root uint64) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	client.CurrentThread = root
+}
+
+// CurrentLobby returns the lobby a client is in
+func (cm *ClientManager) CurrentLobby(client *models.Client) string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return client.CurrentLobby
+}
+
+// Send queues text for delivery to a single client without blocking on its connection
+func (cm *ClientManager) Send(client *models.Client, text string) {
+	cm.SendEvent(client, NoticeEvent(text), text)
+}
+
+// NoticeEvent is the event for server output that has no event type of
+// its own: an error if it is printed in red, a notice otherwise
+func NoticeEvent(text string) models.Event {
+	if strings.HasPrefix(text, ColorRed) {
+		return models.Event{Type: models.EventError, Text: text}
+	}
+	return models.Event{Type: models.EventNotice, Text: text}
+}
+
+// SendEvent queues ev for a single client; clients using the ANSI
+// interface get text instead
+func (cm *ClientManager) SendEvent(client *models.Client, ev models.Event, text string) {
+	cm.enqueue(client, encode(client, ev, []byte(text)))
+}
+
+// SetEventHook sets a function that is told about every event sent with
+// BroadcastToLobby or BroadcastEvent. It must be set before clients connect.
+func (cm *ClientManager) SetEventHook(hook func(models.Event)) {
+	cm.eventHook = hook
+}
+
+// notify passes ev to the event hook
+func (cm *ClientManager) notify(ev models.Event) {
+	if cm.eventHook != nil {
+		cm.eventHook(ev)
+	}
+}
+
 // BroadcastToLobby broadcasts a message to all users in a lobby
 func (cm *ClientManager) BroadcastToLobby(lobbyName string, text string) {
-    cm.mu.Lock()
-    defer cm.mu.Unlock()
-
-    var deadConns []net.Conn
-    
-    message := "\r\033[K" + ColorBlue + ColorBold + "[LOBBY] " + ColorReset + text + "\n" + ColorCyan + "> " + ColorReset
-
-    for conn, client := range cm.clients {
-        if client.CurrentLobby == lobbyName {
-            client.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-            _, err := client.Conn.Write([]byte(message))
-            client.Conn.SetWriteDeadline(time.Time{})
-            if err != nil {
-                deadConns = append(deadConns, conn)
-            }
-        }
-    }
-
-    for _, conn := range deadConns {
-        delete(cm.clients, conn)
-        conn.Close()
-    }
+	cm.BroadcastEvent(models.Event{Type: models.EventNotice, Lobby: lobbyName, Text: text}, text)
+}
+
+// BroadcastEvent sends ev to every user in its lobby and the event hook.
+// Clients using the ANSI interface get text as a [LOBBY] line, like
+// BroadcastToLobby.
+func (cm *ClientManager) BroadcastEvent(ev models.Event, text string) {
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+	cm.broadcast(ev, []byte("\r\033[K"+ColorBlue+ColorBold+"[LOBBY] "+ColorReset+text+"\n"+ColorCyan+"> "+ColorReset))
+	cm.notify(ev)
+}
+
+// BroadcastLine sends a line to every user in a lobby without the [LOBBY] tag
+func (cm *ClientManager) BroadcastLine(lobbyName string, line string) {
+	cm.BroadcastEventLine(models.Event{Type: models.EventNotice, Lobby: lobbyName, Text: line}, line)
+}
+
+// BroadcastEventLine sends ev to every user in its lobby. Clients using
+// the ANSI interface get line without the [LOBBY] tag, like BroadcastLine.
+func (cm *ClientManager) BroadcastEventLine(ev models.Event, line string) {
+	cm.broadcast(ev, []byte("\r\033[K"+line+"\n"+ColorCyan+"> "+ColorReset))
 }
 
 // BroadcastMessage broadcasts a user message to lobby
 func (cm *ClientManager) BroadcastMessage(msg *models.Message, formatFn func(string, string, string, string, string, string, string) string) {
-    cm.mu.Lock()
-    defer cm.mu.Unlock()
-
-    var deadConns []net.Conn
-
-    for conn, client := range cm.clients {
-        if client.CurrentLobby == msg.From.CurrentLobby {
-            formattedMsg := formatFn(msg.From.UserProfile, msg.From.Username, msg.Text,
-                ColorYellow, ColorWhite, ColorCyan, ColorReset)
-            
-            fullMsg := "\r\033[K" + formattedMsg + ColorCyan + "> " + ColorReset
-            
-            client.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-            _, err := client.Conn.Write([]byte(fullMsg))  
-            client.Conn.SetWriteDeadline(time.Time{})
-            if err != nil {
-                deadConns = append(deadConns, conn)
-            }
-        }
-    }
-
-    for _, conn := range deadConns {
-        delete(cm.clients, conn)
-        conn.Close()
-    }
+	formattedMsg := formatFn(msg.From.UserProfile, msg.From.Username, msg.Text,
+		ColorYellow, ColorWhite, ColorCyan, ColorReset)
+	ev := models.Event{
+		Type:      models.EventMessage,
+		Lobby:     msg.Lobby,
+		From:      msg.From.Username,
+		ID:        msg.ID,
+		Text:      msg.Text,
+		Timestamp: msg.Timestamp,
+	}
+	cm.broadcast(ev, []byte("\r\033[K"+formattedMsg+ColorCyan+"> "+ColorReset))
 }
+
+// broadcast queues ev for every user in its lobby, with ansi as the
+// ANSI rendering
+func (cm *ClientManager) broadcast(ev models.Event, ansi []byte) {
+	defer broadcastDuration.ObserveSince(time.Now())
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+	for _, client := range cm.GetLobbyUsers(ev.Lobby) {
+		cm.enqueue(client, encode(client, ev, ansi))
+	}
+}
+
+// encode returns what client is sent for ev: the ANSI text, or the
+// event as rendered by the client's frontend
+func encode(client *models.Client, ev models.Event, ansi []byte) []byte {
+	if client.Renderer == nil {
+		return ansi
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+	ev.Text = utils.StripANSI(ev.Text)
+	return client.Renderer.Render(client, ev)
+}
+
 // ClientsSnapshot returns a slice copy of all connected clients
 func (cm *ClientManager) ClientsSnapshot() []*models.Client {
 	cm.mu.RLock()
@@ -144,3 +448,67 @@ func (cm *ClientManager) ClientsSnapshot() []*models.Client {
 	}
 	return clients
 }
+
+// enqueue adds msg to a client's outbox, applying the slow consumer
+// policy when the outbox is full
+func (cm *ClientManager) enqueue(client *models.Client, msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	if client.Outbox == nil {
+		client.Conn.Write(msg)
+		return
+	}
+
+	select {
+	case client.Outbox <- msg:
+		return
+	case <-client.Done:
+		return
+	default:
+	}
+
+	cm.mu.RLock()
+	policy := cm.policy
+	cm.mu.RUnlock()
+
+	switch policy {
+	case DropNewest:
+		droppedMessages.Inc("drop-newest")
+	case DropOldest:
+		droppedMessages.Inc("drop-oldest")
+		select {
+		case <-client.Outbox:
+		default:
+		}
+		select {
+		case client.Outbox <- msg:
+		default:
+		}
+	case Disconnect:
+		log.Printf("Disconnecting slow consumer %s", client.Username)
+		droppedConnections.Inc("slow_consumer")
+		client.Conn.Close()
+	}
+}
+
+// writeLoop drains a client's outbox until the client is removed or a
+// write fails. A failed write closes the connection so that the client's
+// read loop exits and removes it.
+func writeLoop(client *models.Client) {
+	for {
+		select {
+		case msg := <-client.Outbox:
+			client.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err := client.Conn.Write(msg)
+			client.Conn.SetWriteDeadline(time.Time{})
+			if err != nil {
+				droppedConnections.Inc("write_error")
+				client.Conn.Close()
+				return
+			}
+		case <-client.Done:
+			return
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/storage"
+)
+
+// addPipeClient registers a client whose far end is returned to the caller.
+// If drain is true the far end is read continuously, otherwise it is never
+// read and the client behaves like a stalled consumer.
+func addPipeClient(t testing.TB, cm *ClientManager, name string, drain bool) net.Conn {
+	t.Helper()
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() {
+		serverSide.Close()
+		clientSide.Close()
+	})
+	if drain {
+		go io.Copy(io.Discard, clientSide)
+	}
+
+	cm.AddClient(serverSide, &models.Client{
+		Conn:         serverSide,
+		Username:     name,
+		CurrentLobby: "general",
+	})
+	return clientSide
+}
+
+func waitForEmptyOutbox(t *testing.T, client *models.Client) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(client.Outbox) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("writer goroutine never picked up the first message")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func readMessages(t *testing.T, conn net.Conn, n int) []string {
+	t.Helper()
+	var got []string
+	buf := make([]byte, 64)
+	for len(got) < n {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		m, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read %d: %v", len(got), err)
+		}
+		got = append(got, string(buf[:m]))
+	}
+	return got
+}
+
+func TestBroadcastDoesNotBlockOnStalledReader(t *testing.T) {
+	cm := NewClientManager(storage.NewMemoryStore())
+	addPipeClient(t, cm, "stalled", false)
+	healthy := addPipeClient(t, cm, "healthy", false)
+
+	received := make(chan struct{})
+	go func() {
+		buf := make([]byte, 4096)
+		healthy.Read(buf)
+		close(received)
+		io.Copy(io.Discard, healthy)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10*DefaultOutboxSize; i++ {
+			cm.BroadcastToLobby("general", fmt.Sprintf("message %d", i))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcasts blocked on a stalled reader")
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("healthy reader did not receive any broadcast")
+	}
+	if cm.GetClientByUsername("healthy") == nil {
+		t.Error("lookups should still work while a reader is stalled")
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	tests := []struct {
+		policy SlowConsumerPolicy
+		want   []string
+	}{
+		{DropOldest, []string{"m1", "m4", "m5"}},
+		{DropNewest, []string{"m1", "m2", "m3"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprint(tc.want), func(t *testing.T) {
+			cm := NewClientManager(storage.NewMemoryStore())
+			cm.SetOutboxPolicy(2, tc.policy)
+			far := addPipeClient(t, cm, "slow", false)
+			client := cm.GetClientByUsername("slow")
+
+			// m1 is taken by the writer, which then blocks on the pipe
+			cm.Send(client, "m1")
+			waitForEmptyOutbox(t, client)
+			for _, msg := range []string{"m2", "m3", "m4", "m5"} {
+				cm.Send(client, msg)
+			}
+
+			got := readMessages(t, far, 3)
+			for i := range tc.want {
+				if got[i] != tc.want[i] {
+					t.Fatalf("received %v; want %v", got, tc.want)
+				}
+			}
+		})
+	}
+
+	t.Run("disconnect", func(t *testing.T) {
+		cm := NewClientManager(storage.NewMemoryStore())
+		cm.SetOutboxPolicy(1, Disconnect)
+		far := addPipeClient(t, cm, "slow", false)
+		client := cm.GetClientByUsername("slow")
+
+		cm.Send(client, "m1")
+		waitForEmptyOutbox(t, client)
+		cm.Send(client, "m2")
+		cm.Send(client, "m3")
+
+		far.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 64)
+		for {
+			if _, err := far.Read(buf); err != nil {
+				if err != io.EOF {
+					t.Errorf("expected connection to be closed, got %v", err)
+				}
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkBroadcastToLobby measures broadcast latency with every reader
+// healthy and with one reader that never reads. Both should be flat since
+// broadcasting only enqueues.
+func BenchmarkBroadcastToLobby(b *testing.B) {
+	for _, stalled := range []bool{false, true} {
+		name := "all-readers-healthy"
+		if stalled {
+			name = "one-reader-stalled"
+		}
+		b.Run(name, func(b *testing.B) {
+			cm := NewClientManager(storage.NewMemoryStore())
+			for i := 0; i < 50; i++ {
+				addPipeClient(b, cm, fmt.Sprintf("user%d", i), true)
+			}
+			if stalled {
+				addPipeClient(b, cm, "stalled", false)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cm.BroadcastToLobby("general", "benchmark message")
+			}
+		})
+	}
+}
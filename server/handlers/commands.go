@@ -4,26 +4,55 @@ import (
 	"chat-server/server/ai"
 	"chat-server/server/middleware"
 	"chat-server/server/models"
-	"context"
+	"chat-server/server/webhooks"
 	"time"
 	"fmt"
-	"log"
 	"net"
 	"strings"
+	"sync/atomic"
 )
 
 // CommandHandler holds dependencies for command handling
 type CommandHandler struct {
 	ClientManager *ClientManager
 	LobbyManager  *LobbyManager
+	Accounts      *AccountManager
+	Moderation    *ModerationManager
+	Mailbox       *MailboxManager
+	DMs           *DirectMessageManager
+	Webhooks      *webhooks.Dispatcher // nil if the server delivers no webhooks
+
+	// loginGrace is how long a registered name may be held without /login
+	loginGrace atomic.Int64
+
+	// aiQueue schedules /ai requests
+	aiQueue *aiQueue
 }
 
 // NewCommandHandler creates a new command handler
-func NewCommandHandler(cm *ClientManager, lm *LobbyManager) *CommandHandler {
-	return &CommandHandler{
+func NewCommandHandler(cm *ClientManager, lm *LobbyManager, am *AccountManager, mm *ModerationManager, mb *MailboxManager, dm *DirectMessageManager) *CommandHandler {
+	h := &CommandHandler{
 		ClientManager: cm,
 		LobbyManager:  lm,
+		Accounts:      am,
+		Moderation:    mm,
+		Mailbox:       mb,
+		DMs:           dm,
 	}
+	h.aiQueue = newAIQueue(h.streamAIReply, ai.RequestTimeout)
+	h.SetLoginGracePeriod(DefaultLoginGracePeriod)
+	return h
+}
+
+// SetAILimits changes how many AI requests run at once across the server
+// and how many may wait in each lobby
+func (h *CommandHandler) SetAILimits(concurrency, queueLength int) {
+	h.aiQueue.SetLimits(concurrency, queueLength)
+}
+
+// SetLoginGracePeriod changes how long newly reserved names wait for /login
+func (h *CommandHandler) SetLoginGracePeriod(d time.Duration) {
+	h.loginGrace.Store(int64(d))
 }
 
 // HandleCommand processes user commands
@@ -41,6 +70,10 @@ func (h *CommandHandler) HandleCommand(conn net.Conn, cmd string, client *models
 	}
 	middleware.RecordMessage(client)
 
+	if !h.authorizeCommand(conn, client, cmd) {
+		return
+	}
+
 	switch {
 	case cmd == "/users":
 		h.showLobbyUsers(conn, client)
@@ -48,8 +81,34 @@ func (h *CommandHandler) HandleCommand(conn net.Conn, cmd string, client *models
 		showHelpMessage(conn)
 	case strings.HasPrefix(cmd, "/ai "):
 		h.handleAICommand(conn, client, cmd)
+	case cmd == "/lobby" || strings.HasPrefix(cmd, "/lobby "):
+		h.handleLobby(conn, client, cmd)
 	case cmd == "/lobbies":
 		h.LobbyManager.ShowAllLobbies(conn)
+	case cmd == "/history" || strings.HasPrefix(cmd, "/history "):
+		h.handleHistory(conn, client, cmd)
+	case cmd == "/search" || strings.HasPrefix(cmd, "/search "):
+		h.handleSearch(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/edit "):
+		h.handleEdit(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/delete "):
+		h.handleDelete(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/reply "):
+		h.handleReply(conn, client, cmd)
+	case cmd == "/thread" || strings.HasPrefix(cmd, "/thread "):
+		h.handleThread(conn, client, cmd)
+	case cmd == "/threads":
+		h.showThreads(conn, client)
+	case strings.HasPrefix(cmd, "/react "):
+		h.handleReact(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/unreact "):
+		h.handleUnreact(conn, client, cmd)
+	case cmd == "/dms":
+		h.showDirectConversations(conn, client)
+	case strings.HasPrefix(cmd, "/dm "):
+		h.handleDirectHistory(conn, client, cmd)
+	case cmd == "/inbox" || strings.HasPrefix(cmd, "/inbox "):
+		h.handleInbox(conn, client, cmd)
 	case strings.HasPrefix(cmd, "/tag "):
 		h.handleTagCommand(conn, client, cmd)
 	case strings.HasPrefix(cmd, "/setai "):
@@ -58,61 +117,66 @@ func (h *CommandHandler) HandleCommand(conn net.Conn, cmd string, client *models
 		h.handlePrivateMessage(conn, client, cmd)
 	case strings.HasPrefix(cmd, "/create "):
 		h.handleCreateLobby(conn, client, cmd)
+	case cmd == "/invite" || strings.HasPrefix(cmd, "/invite "):
+		h.handleInvite(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/uninvite "):
+		h.handleUninvite(conn, client, cmd)
+	case cmd == "/accept" || strings.HasPrefix(cmd, "/accept "):
+		h.handleAccept(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/invite-only"):
+		h.handleInviteOnly(conn, client, cmd)
 	case strings.HasPrefix(cmd, "/join "):
 		h.handleJoinLobby(conn, client, cmd)
 	case strings.HasPrefix(cmd, "/sp"):
 		h.handleSetProfile(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/register "):
+		h.handleRegister(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/login "):
+		h.handleLogin(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/kick "):
+		h.handleKick(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/ban "):
+		h.handleBan(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/unban "):
+		h.handleUnban(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/mute "):
+		h.handleMute(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/unmute "):
+		h.handleUnmute(conn, client, cmd)
+	case cmd == "/banlist":
+		h.handleBanList(conn, client)
+	case strings.HasPrefix(cmd, "/op "):
+		h.handleOp(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/deop "):
+		h.handleDeop(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/voice "):
+		h.handleVoice(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/devoice "):
+		h.handleDevoice(conn, client, cmd)
+	case strings.HasPrefix(cmd, "/transfer "):
+		h.handleTransfer(conn, client, cmd)
+	case cmd == "/bot" || strings.HasPrefix(cmd, "/bot "):
+		h.handleBot(conn, client, cmd)
+	case cmd == "/webhook" || strings.HasPrefix(cmd, "/webhook "):
+		h.handleWebhook(conn, client, cmd)
 	default:
 		conn.Write([]byte(ColorRed + "Unknown command. Type /help for available commands.\n" + ColorReset))
 	}
 }
 
-func (h *CommandHandler) handleAICommand(conn net.Conn, client *models.Client, cmd string) {
-	content := strings.TrimPrefix(cmd, "/ai ")
-	userText := strings.TrimSpace(content)
-
-	if userText == "" {
-		conn.Write([]byte(ColorRed + "Usage: /ai <your question>\n" + ColorReset))
-		return
-	}
-
-	if len(userText) > 1000 {
-		conn.Write([]byte(ColorRed + "AI question too long. Max: 1000 characters\n" + ColorReset))
-		return
-	}
-
-	if ai.GetAPIKey() == "" {
-		conn.Write([]byte(ColorRed + "AI is not available on this server\n" + ColorReset))
-		return
-	}
-
-	conn.Write([]byte(ColorMagenta + "[AI] Thinking...\n" + ColorReset))
-	h.ClientManager.BroadcastToLobby(client.CurrentLobby,
-		fmt.Sprintf("%s%s%s asked AI: %s", ColorCyan, client.Username, ColorReset, userText))
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	reply, err := ai.HandleAIChat(ctx, userText, client.CurrentLobby, client.Username,
-		h.LobbyManager.GetConversations(), h.LobbyManager.GetConversationsMutex(),
-		h.LobbyManager.GetLobbyContext)
-
-	if err != nil {
-		log.Printf("AI error for user %s: %v", client.Username, err)
-		errMsg := ai.FormatAIError(err)
-		conn.Write([]byte(ColorRed + errMsg + "\n" + ColorReset))
-		return
-	}
-
-	h.ClientManager.BroadcastToLobby(client.CurrentLobby,
-		fmt.Sprintf("%s[AI Response to %s]%s\n%s", ColorMagenta, client.Username, ColorReset, reply))
-}
-
 func (h *CommandHandler) showLobbyUsers(conn net.Conn, client *models.Client) {
 	users := h.ClientManager.GetLobbyUsers(client.CurrentLobby)
 	msg := ColorCyan + fmt.Sprintf("\n=== Users in '%s' (%d) ===\n", client.CurrentLobby, len(users)) + ColorReset
 	for _, user := range users {
-		msg += fmt.Sprintf("  %s %s%s%s\n", user.UserProfile, ColorWhite, user.Username, ColorReset)
+		role := h.RoleIn(user, client.CurrentLobby)
+		msg += fmt.Sprintf("  %s %s%s%s%s", user.UserProfile, ColorWhite, RoleBadge(role), user.Username, ColorReset)
+		if user.Bot {
+			msg += fmt.Sprintf(" %s[bot]%s", ColorMagenta, ColorReset)
+		}
+		if role != models.RoleMember {
+			msg += fmt.Sprintf(" %s(%s)%s", ColorCyan, role, ColorReset)
+		}
+		msg += "\n"
 	}
 	msg += "\n"
 	conn.Write([]byte(msg))
@@ -122,14 +186,50 @@ func showHelpMessage(conn net.Conn) {
 	helpMsg := ColorCyan + "\n=== Available Commands ===\n" + ColorReset
 	helpMsg += "  /users  - Show users in current lobby\n"
 	helpMsg += "  /lobbies - List all lobbies\n"
-	helpMsg += "  /create <name> [password] <desc> - Create new lobby\n"
-	helpMsg += "  /join <name> [password] - Join a lobby\n"
+	helpMsg += "  /create <name> [password|--invite-only] <desc> - Create new lobby\n"
+	helpMsg += "  /join <name> [password|--token <t>] - Join a lobby\n"
+	helpMsg += "  /lobby - Show this lobby's settings\n"
+	helpMsg += "  /lobby rename <name>|desc <text>|passwd <pw>|public|private <pw> - Change this lobby (owner)\n"
+	helpMsg += "  /lobby archive|unarchive|delete - Make this lobby read-only, or remove it (owner)\n"
+	helpMsg += "  /accept [lobby] - Accept an invitation and join the lobby\n"
+	helpMsg += "  /invite [<user> [lobby]] - Invite a user, or list this lobby's invitations (operator)\n"
+	helpMsg += "  /uninvite <user> [lobby] - Withdraw an invitation or allowlist entry (operator)\n"
+	helpMsg += "  /invite-only on|off - Admit only invited users to this lobby (owner)\n"
+	helpMsg += "  /webhook [list]|add <url> <events|all>|remove <id>|test <id>|failed [n] - Manage this lobby's webhooks (owner)\n"
+	helpMsg += "  /history [n] - Show the last n messages of this lobby\n"
+	helpMsg += "  /history since <time> - Show messages since 2h, 3d, 2024-05-01 or 14:30\n"
+	helpMsg += "  /search <terms> [from:<user>] [in:<lobby>] - Search message history\n"
 	helpMsg += "  /sp <name> - Set profile picture\n"
 	helpMsg += "  /sp list - List available profile pictures\n"
 	helpMsg += "  /msg <user> <message> - Send private message\n"
+	helpMsg += "  /dms - List your private conversations and unread counts\n"
+	helpMsg += "  /dm <user> [n] - Show the last n messages with a user\n"
+	helpMsg += "  /inbox [read <id>|delete <id|all>] - Messages sent while you were offline\n"
 	helpMsg += "  /tag <user> <message> - Tag someone in lobby\n"
+	helpMsg += "  /reply <id> <message> - Answer a message, quoting it\n"
+	helpMsg += "  /edit <id> <text> - Change one of your messages\n"
+	helpMsg += "  /delete <id> - Delete your message (operators: any message)\n"
+	helpMsg += "  /thread <id> [message] - Open a thread on a message, or reply in it\n"
+	helpMsg += "  /thread close | unfollow <id> - Go back to the lobby / stop getting replies\n"
+	helpMsg += "  /threads - List active threads in this lobby\n"
+	helpMsg += "  /react <id> <emoji|shortcode> - React to a message, e.g. /react 42 :+1:\n"
+	helpMsg += "  /unreact <id> [emoji] - Remove your reaction(s) from a message\n"
 	helpMsg += "  /ai <question> - Ask AI a question\n"
-	helpMsg += "  /setai <prompt> - Set custom AI (creator only)\n"
+	helpMsg += "  /ai queue - Show pending AI requests in this lobby\n"
+	helpMsg += "  /ai stop - Cancel your queued or running AI request\n"
+	helpMsg += "  /setai <prompt> - Set custom AI (operator)\n"
+	helpMsg += "  /register <password> - Reserve your current username\n"
+	helpMsg += "  /login <user> <password> - Log in to a registered username\n"
+	helpMsg += "  /kick <user> [reason] - Kick a user (operator)\n"
+	helpMsg += "  /ban <user|ip> [duration] [reason] - Ban a user or IP (operator)\n"
+	helpMsg += "  /unban <user|ip> - Lift a ban (operator)\n"
+	helpMsg += "  /mute <user> [duration] - Mute a user (operator)\n"
+	helpMsg += "  /unmute <user> - Lift a mute (operator)\n"
+	helpMsg += "  /voice <user>, /devoice <user> - Grant or revoke voice (operator)\n"
+	helpMsg += "  /op <user>, /deop <user> - Grant or revoke operator (owner)\n"
+	helpMsg += "  /transfer <user> - Hand the lobby to another user (owner)\n"
+	helpMsg += "  /banlist - Show active bans\n"
+	helpMsg += "  /bot [list]|create <name>|token <name>|delete <name> - Manage bot accounts (server operator)\n"
 	helpMsg += "  /quit   - Disconnect from server\n\n"
 	conn.Write([]byte(helpMsg))
 }
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/storage"
+)
+
+// DirectMessageManager records private conversations and what each
+// participant has read
+type DirectMessageManager struct {
+	store storage.Store
+	mu    sync.Mutex // keeps conversation summaries in step with the messages
+}
+
+// NewDirectMessageManager creates a direct message manager backed by store
+func NewDirectMessageManager(store storage.Store) *DirectMessageManager {
+	return &DirectMessageManager{store: store}
+}
+
+// Record stores a private message and updates both participants'
+// conversation summaries. Writing to someone counts as having read
+// everything they sent before.
+func (dm *DirectMessageManager) Record(from *models.Client, to, text string) error {
+	msg := models.DirectMessage{
+		From:        from.Username,
+		To:          to,
+		FromProfile: from.UserProfile,
+		Text:        text,
+		Timestamp:   time.Now(),
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	id, err := dm.store.AppendDirectMessage(msg)
+	if err != nil {
+		return fmt.Errorf("store direct message: %w", err)
+	}
+	for _, side := range []struct{ user, peer string }{{msg.From, to}, {to, msg.From}} {
+		conv, err := dm.conversation(side.user, side.peer)
+		if err != nil {
+			return err
+		}
+		conv.LastID, conv.LastFrom, conv.LastText, conv.LastAt = id, msg.From, text, msg.Timestamp
+		if side.user == msg.From {
+			conv.ReadID = id
+		}
+		if err := dm.store.SaveDirectConversation(side.user, conv); err != nil {
+			return fmt.Errorf("save conversation of %s: %w", side.user, err)
+		}
+	}
+	return nil
+}
+
+// Conversations returns a user's conversations, most recent first
+func (dm *DirectMessageManager) Conversations(username string) ([]models.DirectConversation, error) {
+	convs, err := dm.store.LoadDirectConversations(username)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(convs, func(i, j int) bool { return convs[i].LastAt.After(convs[j].LastAt) })
+	return convs, nil
+}
+
+// History returns up to limit of the latest messages between username and
+// peer, oldest first, and marks the conversation read for username
+func (dm *DirectMessageManager) History(username, peer string, limit int) ([]models.DirectMessage, error) {
+	msgs, err := dm.store.LoadDirectMessages(username, peer, limit)
+	if err != nil || len(msgs) == 0 {
+		return msgs, err
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	conv, err := dm.conversation(username, peer)
+	if err != nil {
+		return nil, err
+	}
+	if conv.ReadID < conv.LastID {
+		conv.ReadID = conv.LastID
+		if err := dm.store.SaveDirectConversation(username, conv); err != nil {
+			return nil, fmt.Errorf("mark conversation read: %w", err)
+		}
+	}
+	return msgs, nil
+}
+
+// conversation loads username's summary of their conversation with peer,
+// or a fresh one; dm.mu must be held
+func (dm *DirectMessageManager) conversation(username, peer string) (models.DirectConversation, error) {
+	convs, err := dm.store.LoadDirectConversations(username)
+	if err != nil {
+		return models.DirectConversation{}, fmt.Errorf("load conversations of %s: %w", username, err)
+	}
+	for _, conv := range convs {
+		if conv.Peer == peer {
+			return conv, nil
+		}
+	}
+	return models.DirectConversation{Peer: peer}, nil
+}
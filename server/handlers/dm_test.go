@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"testing"
+)
+
+func TestDirectMessageHistory(t *testing.T) {
+	h := newTestHandler(t)
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	bob := h.ClientManager.GetClientByUsername("bob")
+	logIn(t, h, "alice", "bob")
+
+	h.HandleCommand(alice.Conn, "/msg bob are you there?", alice)
+	h.HandleCommand(alice.Conn, "/msg bob hello??", alice)
+	bobOut.waitFor(t, "hello??")
+
+	h.HandleCommand(bob.Conn, "/dms", bob)
+	bobOut.waitFor(t, "alice\033[0m \033[32m(2 unread)")
+	h.HandleCommand(alice.Conn, "/dms", alice)
+	aliceOut.waitFor(t, "=== Private conversations (1) ===")
+
+	h.HandleCommand(bob.Conn, "/dm alice 1", bob)
+	bobOut.waitFor(t, "Last 1 messages with alice")
+	convs, _ := h.DMs.Conversations("bob")
+	if len(convs) != 1 || convs[0].Unread() != 0 {
+		t.Errorf("after /dm bob's conversations = %+v; want alice marked read", convs)
+	}
+
+	h.HandleCommand(bob.Conn, "/msg alice yes", bob)
+	convs, _ = h.DMs.Conversations("alice")
+	if len(convs) != 1 || convs[0].Unread() != 1 || convs[0].LastText != "yes" {
+		t.Errorf("alice's conversations = %+v; want bob's reply unread", convs)
+	}
+
+	msgs, _ := h.DMs.History("alice", "bob", 0)
+	if len(msgs) != 3 || msgs[0].Text != "are you there?" || msgs[2].From != "bob" {
+		t.Errorf("History = %+v; want all three messages in order", msgs)
+	}
+
+	h.HandleCommand(alice.Conn, "/dm carol", alice)
+	aliceOut.waitFor(t, "No messages with carol yet.")
+}
+
+func TestDirectHistoryNeedsAccounts(t *testing.T) {
+	h := newTestHandler(t)
+	record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	bob := h.ClientManager.GetClientByUsername("bob")
+	logIn(t, h, "alice")
+
+	h.HandleCommand(alice.Conn, "/msg bob the vault code is 0451", alice)
+	bobOut.waitFor(t, "the vault code is 0451")
+	h.HandleCommand(bob.Conn, "/dms", bob)
+	bobOut.waitFor(t, "Private conversations are only kept for registered users.")
+	h.HandleCommand(bob.Conn, "/dm alice", bob)
+	bobOut.waitFor(t, "Private conversations are only kept for registered users.")
+
+	// Whoever registers the name next starts with an empty history
+	logIn(t, h, "bob")
+	h.HandleCommand(bob.Conn, "/dm alice", bob)
+	bobOut.waitFor(t, "No messages with alice yet.")
+	if msgs, _ := h.DMs.History("alice", "bob", 0); len(msgs) != 0 {
+		t.Errorf("History = %+v; want nothing kept for an unregistered name", msgs)
+	}
+}
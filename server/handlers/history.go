@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/search"
+	"chat-server/server/utils"
+)
+
+// History and search page sizes
+const (
+	defaultHistoryLines = 20
+	maxHistoryLines     = 200
+	searchResultLimit   = 20
+)
+
+// pageTimestampLayout keeps the full precision of the stored timestamps so
+// that a "/history since" page picks up exactly where the previous one stopped
+const pageTimestampLayout = utils.TimestampLayout + ".000000000"
+
+func (h *CommandHandler) handleHistory(conn net.Conn, client *models.Client, cmd string) {
+	arg := strings.TrimSpace(strings.TrimPrefix(cmd, "/history"))
+	lobby := client.CurrentLobby
+
+	if rest, ok := strings.CutPrefix(arg, "since"); ok && (rest == "" || rest[0] == ' ') {
+		since, ok := parseSince(strings.TrimSpace(rest), time.Now())
+		if !ok {
+			conn.Write([]byte(ColorRed + "Usage: /history since <2h|3d|YYYY-MM-DD [HH:MM[:SS]]|HH:MM>\n" + ColorReset))
+			return
+		}
+		msgs, err := h.LobbyManager.HistorySince(lobby, since, maxHistoryLines)
+		if err != nil {
+			log.Printf("Failed to load history of %s: %v", lobby, err)
+			conn.Write([]byte(ColorRed + "Could not load history.\n" + ColorReset))
+			return
+		}
+		header := fmt.Sprintf("History of '%s' since %s", lobby, utils.FormatTimestamp(since))
+		footer := ""
+		if len(msgs) == maxHistoryLines {
+			last := msgs[len(msgs)-1].Timestamp.Local().Format(pageTimestampLayout)
+			footer = ColorCyan + "More: /history since " + last + ColorReset + "\n"
+		}
+		h.sendHistory(conn, lobby, header, msgs, footer)
+		return
+	}
+
+	n := defaultHistoryLines
+	if arg != "" {
+		parsed, err := strconv.Atoi(arg)
+		if err != nil || parsed <= 0 {
+			conn.Write([]byte(ColorRed + "Usage: /history [n|since <time>]\n" + ColorReset))
+			return
+		}
+		n = min(parsed, maxHistoryLines)
+	}
+	msgs, err := h.LobbyManager.History(lobby, n)
+	if err != nil {
+		log.Printf("Failed to load history of %s: %v", lobby, err)
+		conn.Write([]byte(ColorRed + "Could not load history.\n" + ColorReset))
+		return
+	}
+	h.sendHistory(conn, lobby, fmt.Sprintf("Last %d messages in '%s'", len(msgs), lobby), msgs, "")
+}
+
+func (h *CommandHandler) sendHistory(conn net.Conn, lobby, header string, msgs []models.LobbyMessage, footer string) {
+	if len(msgs) == 0 {
+		conn.Write([]byte(ColorCyan + "No messages found.\n" + ColorReset))
+		return
+	}
+	out := ColorCyan + "\n=== " + header + " ===\n" + ColorReset
+	out += h.LobbyManager.FormatMessages(lobby, msgs, true)
+	conn.Write([]byte(out + footer + "\n"))
+}
+
+// parseSince accepts a duration back from now ("90m", "2d"), a date with
+// an optional time, or a time of day today
+func parseSince(s string, now time.Time) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	if d, ok := parseDuration(s); ok {
+		return now.Add(-d), true
+	}
+	for _, layout := range []string{utils.TimestampLayout, "2006-01-02 15:04", "2006-01-02", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			y, m, d := now.Local().Date()
+			return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.Local), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (h *CommandHandler) handleSearch(conn net.Conn, client *models.Client, cmd string) {
+	var q search.Query
+	for _, field := range strings.Fields(strings.TrimPrefix(cmd, "/search")) {
+		switch {
+		case strings.HasPrefix(field, "from:"):
+			q.From = strings.TrimPrefix(field, "from:")
+		case strings.HasPrefix(field, "in:"):
+			q.Lobby = strings.TrimPrefix(field, "in:")
+		default:
+			q.Terms = append(q.Terms, field)
+		}
+	}
+	if len(q.Terms) == 0 && q.From == "" {
+		conn.Write([]byte(ColorRed + "Usage: /search <terms> [from:<user>] [in:<lobby>]\n" + ColorReset))
+		return
+	}
+	if q.From == "" && len(search.Tokenize(strings.Join(q.Terms, " "))) == 0 {
+		conn.Write([]byte(ColorRed + "Search for words or numbers, or add from:<user>.\n" + ColorReset))
+		return
+	}
+
+	allowed := h.searchableLobbies(client)
+	if q.Lobby != "" && !allowed[q.Lobby] {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("You cannot search '%s'.\n", q.Lobby) + ColorReset))
+		return
+	}
+	q.Allowed = func(lobby string) bool { return allowed[lobby] }
+	q.Limit = searchResultLimit
+
+	results, total, err := h.LobbyManager.Search(q)
+	if err != nil {
+		log.Printf("Search failed: %v", err)
+		conn.Write([]byte(ColorRed + "Search failed.\n" + ColorReset))
+		return
+	}
+	if total == 0 {
+		conn.Write([]byte(ColorCyan + "No messages found.\n" + ColorReset))
+		return
+	}
+
+	out := ColorCyan + fmt.Sprintf("\n=== %d of %d matches, newest first ===\n", len(results), total) + ColorReset
+	for _, r := range results {
+		out += ColorCyan + "[" + r.Lobby + "] " + ColorReset +
+			h.LobbyManager.FormatMessages(r.Lobby, []models.LobbyMessage{r.Message}, true)
+	}
+	conn.Write([]byte(out + "\n"))
+}
+
+// searchableLobbies returns the lobbies whose history the client may
+// search: public lobbies they are not banned from and the lobby they are in.
+// Server operators may search everything.
+func (h *CommandHandler) searchableLobbies(client *models.Client) map[string]bool {
+	operator := h.isOperator(client)
+	allowed := make(map[string]bool)
+	for _, lobby := range h.LobbyManager.Lobbies() {
+		switch {
+		case operator, lobby.Name == client.CurrentLobby:
+			allowed[lobby.Name] = true
+		case lobby.IsPrivate, lobby.InviteOnly:
+		case h.Moderation.FindBan(lobby.Name, client.Username, client.IP) != nil:
+		default:
+			allowed[lobby.Name] = true
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"chat-server/server/storage"
+)
+
+func TestHistoryAndSearchSurviveRestart(t *testing.T) {
+	store := storage.NewMemoryStore()
+	lm := NewLobbyManager(store, NewModerationManager(store))
+	lm.CreateDefaultLobby()
+	lm.CreateLobby("ops", "hunter2", "private ops", "carol", true, false)
+	for i := 0; i < 30; i++ {
+		lm.StoreMessage("general", "", "bob", "filler")
+	}
+	lm.StoreMessage("general", "", "alice", "the deploy is broken")
+	lm.StoreMessage("ops", "", "carol", "deploy secrets rotated")
+
+	// A fresh manager over the same store rebuilds the index
+	mm := NewModerationManager(store)
+	lm = NewLobbyManager(store, mm)
+	lm.CreateDefaultLobby()
+	if err := lm.LoadFromStore(); err != nil {
+		t.Fatalf("LoadFromStore: %v", err)
+	}
+	h := NewCommandHandler(NewClientManager(store), lm, NewAccountManager(store), mm, NewMailboxManager(store), NewDirectMessageManager(store))
+	out := record(addPipeClient(t, h.ClientManager, "dave", false))
+	dave := h.ClientManager.GetClientByUsername("dave")
+
+	h.HandleCommand(dave.Conn, "/history 3", dave)
+	out.waitFor(t, "Last 3 messages in 'general'")
+	out.waitFor(t, "the deploy is broken")
+
+	h.HandleCommand(dave.Conn, "/search DEPLOY", dave)
+	out.waitFor(t, "1 of 1 matches")
+	out.waitFor(t, "[general] ")
+
+	h.HandleCommand(dave.Conn, "/search deploy in:ops", dave)
+	out.waitFor(t, "You cannot search 'ops'.")
+
+	h.HandleCommand(dave.Conn, "/search from:bob", dave)
+	out.waitFor(t, "20 of 30 matches")
+
+	erinOut := record(addPipeClient(t, h.ClientManager, "erin", false))
+	erin := h.ClientManager.GetClientByUsername("erin")
+	h.HandleCommand(erin.Conn, "/search !!!", erin)
+	erinOut.waitFor(t, "Search for words or numbers, or add from:<user>.")
+}
+
+func TestHistorySincePages(t *testing.T) {
+	h := newTestHandler(t)
+	out := record(addPipeClient(t, h.ClientManager, "alice", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	for i := 0; i < maxHistoryLines+1; i++ {
+		h.LobbyManager.StoreMessage("general", "", "bob", "hello")
+	}
+	h.LobbyManager.StoreMessage("general", "", "bob", "the very last one")
+
+	h.HandleCommand(alice.Conn, "/history since 1h", alice)
+	out.waitFor(t, "More: /history since ")
+
+	msgs, _ := h.LobbyManager.HistorySince("general", time.Now().Add(-time.Hour), maxHistoryLines)
+	next := msgs[len(msgs)-1].Timestamp.Local().Format(pageTimestampLayout)
+	h.HandleCommand(alice.Conn, "/history since "+next, alice)
+	out.waitFor(t, "the very last one")
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 2, 15, 0, 0, 0, time.Local)
+	tests := []struct {
+		in   string
+		want time.Time
+		ok   bool
+	}{
+		{"90m", now.Add(-90 * time.Minute), true},
+		{"2d", now.Add(-48 * time.Hour), true},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local), true},
+		{"2024-05-01 09:30", time.Date(2024, 5, 1, 9, 30, 0, 0, time.Local), true},
+		{"2024-05-01 09:30:15.250", time.Date(2024, 5, 1, 9, 30, 15, 250e6, time.Local), true},
+		{"14:30", time.Date(2024, 5, 2, 14, 30, 0, 0, time.Local), true},
+		{"yesterday", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			got, ok := parseSince(tc.in, now)
+			if ok != tc.ok || !got.Equal(tc.want) {
+				t.Errorf("parseSince(%q) = %v, %v; want %v, %v", tc.in, got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
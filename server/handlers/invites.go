@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/utils"
+)
+
+// inviteTTL is how long an invitation can be accepted
+const inviteTTL = 24 * time.Hour
+
+// inviteTarget parses "<user> [lobby]" and checks that the client may
+// manage invitations of the lobby, which defaults to their current one
+func (h *CommandHandler) inviteTarget(conn net.Conn, client *models.Client, args, usage string) (target, lobbyName string, ok bool) {
+	fields := strings.Fields(args)
+	if len(fields) < 1 || len(fields) > 2 {
+		conn.Write([]byte(ColorRed + usage + "\n" + ColorReset))
+		return "", "", false
+	}
+	target, lobbyName = fields[0], client.CurrentLobby
+	if len(fields) == 2 {
+		lobbyName = fields[1]
+	}
+	if valid, errMsg := utils.IsValidUsername(target); !valid {
+		conn.Write([]byte(ColorRed + errMsg + "\n" + ColorReset))
+		return "", "", false
+	}
+	if _, exists := h.LobbyManager.GetLobby(lobbyName); !exists {
+		conn.Write([]byte(ColorRed + "lobby does not exist\n" + ColorReset))
+		return "", "", false
+	}
+	if !h.HasPermission(client, lobbyName, PermInvite) {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("You need to be %s or higher in '%s' to manage its invitations.\n",
+			requiredRoles[PermInvite], lobbyName) + ColorReset))
+		return "", "", false
+	}
+	return target, lobbyName, true
+}
+
+func (h *CommandHandler) handleInvite(conn net.Conn, client *models.Client, cmd string) {
+	args := strings.TrimSpace(strings.TrimPrefix(cmd, "/invite"))
+	if args == "" {
+		h.showInvites(conn, client)
+		return
+	}
+	target, lobbyName, ok := h.inviteTarget(conn, client, args, "Usage: /invite <user> [lobby]")
+	if !ok {
+		return
+	}
+	if target == client.Username {
+		conn.Write([]byte(ColorRed + "You can't invite yourself.\n" + ColorReset))
+		return
+	}
+	// Anyone could connect under an unregistered name and take its place
+	if !h.Accounts.IsRegistered(target) {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("%s has to /register before they can be invited.\n", target) + ColorReset))
+		return
+	}
+
+	token, err := h.LobbyManager.Invite(lobbyName, target, client.Username, inviteTTL)
+	if err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("Invited %s to '%s'. They can accept with /accept %s, or use this single-use token within %s:\n",
+		target, lobbyName, lobbyName, inviteTTL) + ColorReset +
+		fmt.Sprintf("  /join %s --token %s\n", lobbyName, token)))
+
+	invitee := h.ClientManager.GetClientByUsername(target)
+	if invitee == nil || !h.isVerified(invitee) {
+		conn.Write([]byte(fmt.Sprintf("%s is offline and will see the invitation when they next connect.\n", target)))
+		return
+	}
+	h.ClientManager.Send(invitee, formatInvite(lobbyName, client.Username))
+}
+
+func formatInvite(lobbyName, by string) string {
+	return ColorMagenta + fmt.Sprintf("✉ %s invited you to '%s'. Type /accept %s to join.", by, lobbyName, lobbyName) + ColorReset + "\n"
+}
+
+// DeliverInvites tells a client about invitations sent while they were
+// away, once they are logged in
+func (h *CommandHandler) DeliverInvites(client *models.Client) {
+	if !h.isVerified(client) {
+		return
+	}
+	var out string
+	for _, invite := range h.LobbyManager.PendingInvites(client.Username) {
+		out += formatInvite(invite.Lobby, invite.By)
+	}
+	if out != "" {
+		h.ClientManager.Send(client, out)
+	}
+}
+
+func (h *CommandHandler) handleAccept(conn net.Conn, client *models.Client, cmd string) {
+	lobbyName := strings.TrimSpace(strings.TrimPrefix(cmd, "/accept"))
+	if !h.isVerified(client) {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("Log in as %s to accept invitations.\n", client.Username) + ColorReset))
+		return
+	}
+	if lobbyName == "" {
+		invites := h.LobbyManager.PendingInvites(client.Username)
+		if len(invites) == 0 {
+			conn.Write([]byte(ColorRed + "You have no pending invitations.\n" + ColorReset))
+			return
+		}
+		lobbyName = invites[0].Lobby
+	}
+
+	if err := h.LobbyManager.RedeemInvite(lobbyName, client.Username, ""); err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+	h.joinLobby(conn, client, lobbyName, "")
+}
+
+func (h *CommandHandler) handleUninvite(conn net.Conn, client *models.Client, cmd string) {
+	target, lobbyName, ok := h.inviteTarget(conn, client,
+		strings.TrimPrefix(cmd, "/uninvite"), "Usage: /uninvite <user> [lobby]")
+	if !ok {
+		return
+	}
+	removed, err := h.LobbyManager.Uninvite(lobbyName, target)
+	if err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+	if !removed {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("%s is not invited to '%s'.\n", target, lobbyName) + ColorReset))
+		return
+	}
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("%s is no longer invited to '%s'.\n", target, lobbyName) + ColorReset))
+
+	// Someone still inside an invite-only lobby they can no longer join is
+	// sent back to general, like a kick
+	member := h.ClientManager.GetClientByUsername(target)
+	if member == nil || h.ClientManager.CurrentLobby(member) != lobbyName {
+		return
+	}
+	if err := h.LobbyManager.JoinLobby(lobbyName, "", member.Username, member.IP, h.isVerified(member)); err == nil {
+		return
+	}
+	h.ClientManager.Send(member, ColorRed+fmt.Sprintf("Your invitation to '%s' was withdrawn by %s.\n", lobbyName, client.Username)+ColorReset)
+	h.moveToLobby(member, "general")
+}
+
+// handleInviteOnly turns invite-only mode of the current lobby on or off
+func (h *CommandHandler) handleInviteOnly(conn net.Conn, client *models.Client, cmd string) {
+	var inviteOnly bool
+	switch strings.TrimSpace(strings.TrimPrefix(cmd, "/invite-only")) {
+	case "on":
+		inviteOnly = true
+	case "off":
+	default:
+		conn.Write([]byte(ColorRed + "Usage: /invite-only on|off\n" + ColorReset))
+		return
+	}
+	if err := h.LobbyManager.SetInviteOnly(client.CurrentLobby, inviteOnly); err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+	state := "now invite-only. Use /invite <user> to let people in"
+	if !inviteOnly {
+		state = "no longer invite-only"
+	}
+	h.ClientManager.BroadcastToLobby(client.CurrentLobby,
+		fmt.Sprintf("%s%s: '%s' is %s%s", ColorYellow, client.Username, client.CurrentLobby, state, ColorReset))
+}
+
+// showInvites lists the allowlist and pending invitations of the current lobby
+func (h *CommandHandler) showInvites(conn net.Conn, client *models.Client) {
+	lobbyName := client.CurrentLobby
+	if !h.HasPermission(client, lobbyName, PermInvite) {
+		conn.Write([]byte(ColorRed + "Usage: /invite <user> [lobby]\n" + ColorReset))
+		return
+	}
+	lobby, _ := h.LobbyManager.GetLobby(lobbyName)
+
+	allowed := make([]string, 0, len(lobby.Allowlist))
+	for name := range lobby.Allowlist {
+		allowed = append(allowed, name)
+	}
+	sort.Strings(allowed)
+	mode := "open to everyone who can join"
+	if lobby.InviteOnly {
+		mode = "invite-only"
+	}
+
+	out := ColorCyan + fmt.Sprintf("=== Invitations for '%s' (%s) ===", lobbyName, mode) + ColorReset + "\n"
+	if len(allowed) == 0 {
+		out += "Allowlist: (empty)\n"
+	} else {
+		out += "Allowlist: " + strings.Join(allowed, ", ") + "\n"
+	}
+	now := time.Now()
+	for _, invite := range pendingInvites(lobby.Invites, now) {
+		out += fmt.Sprintf("  pending: %s (by %s, expires in %s)\n",
+			invite.Username, invite.By, invite.Expires.Sub(now).Round(time.Minute))
+	}
+	conn.Write([]byte(out))
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestInviteOnlyLobby(t *testing.T) {
+	h := newTestHandler(t)
+	h.LobbyManager.CreateLobby("ops", "", "on-call", "alice", true, true)
+	h.Accounts.Register("dave", "secret-pass")
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	carolOut := record(addPipeClient(t, h.ClientManager, "carol", false))
+	daveOut := record(addPipeClient(t, h.ClientManager, "dave", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	bob := h.ClientManager.GetClientByUsername("bob")
+	carol := h.ClientManager.GetClientByUsername("carol")
+	dave := h.ClientManager.GetClientByUsername("dave")
+	logIn(t, h, "alice", "bob", "carol")
+
+	h.HandleCommand(bob.Conn, "/join ops", bob)
+	bobOut.waitFor(t, "'ops' is invite-only")
+
+	h.HandleCommand(carol.Conn, "/invite bob ops", carol)
+	carolOut.waitFor(t, "You need to be operator or higher in 'ops' to manage its invitations.")
+
+	h.HandleCommand(alice.Conn, "/invite erin ops", alice)
+	aliceOut.waitFor(t, "erin has to /register before they can be invited.")
+	h.HandleCommand(alice.Conn, "/invite bob ops", alice)
+	aliceOut.waitFor(t, "Invited bob to 'ops'.")
+	bobOut.waitFor(t, "alice invited you to 'ops'. Type /accept ops to join.")
+	aliceOut.mu.Lock()
+	match := regexp.MustCompile(`--token ([0-9a-f]+)`).FindStringSubmatch(aliceOut.buf.String())
+	aliceOut.mu.Unlock()
+	if match == nil {
+		t.Fatal("no token in /invite output")
+	}
+	token := match[1]
+
+	h.HandleCommand(carol.Conn, "/join ops --token "+token, carol)
+	carolOut.waitFor(t, "that invitation is for bob")
+
+	h.HandleCommand(bob.Conn, "/accept", bob)
+	bobOut.waitFor(t, "Joined lobby 'ops'")
+	if lobby, _ := h.LobbyManager.GetLobby("ops"); !lobby.Allowlist["bob"] || len(lobby.Invites) != 0 {
+		t.Errorf("after /accept: allowlist %v, invites %v", lobby.Allowlist, lobby.Invites)
+	}
+	if err := h.LobbyManager.RedeemInvite("ops", "bob", token); err == nil {
+		t.Error("invitation token worked twice")
+	}
+
+	// An unauthenticated holder of a registered name can't use its invitation
+	h.HandleCommand(alice.Conn, "/invite dave ops", alice)
+	h.HandleCommand(dave.Conn, "/accept ops", dave)
+	daveOut.waitFor(t, "Log in as dave to accept invitations.")
+
+	h.HandleCommand(alice.Conn, "/uninvite bob ops", alice)
+	aliceOut.waitFor(t, "bob is no longer invited to 'ops'.")
+	bobOut.waitFor(t, "Your invitation to 'ops' was withdrawn by alice.")
+	bobOut.waitFor(t, "Joined lobby 'general'")
+}
+
+func TestInviteExpires(t *testing.T) {
+	h := newTestHandler(t)
+	h.LobbyManager.CreateLobby("ops", "hunter2", "on-call", "alice", true, false)
+
+	token, err := h.LobbyManager.Invite("ops", "bob", "alice", -time.Second)
+	if err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+	if err := h.LobbyManager.RedeemInvite("ops", "bob", token); err == nil {
+		t.Error("expired invitation was accepted")
+	}
+	if got := h.LobbyManager.PendingInvites("bob"); len(got) != 0 {
+		t.Errorf("PendingInvites = %+v, want none", got)
+	}
+
+	// On a password lobby an accepted invitation replaces the password
+	token, _ = h.LobbyManager.Invite("ops", "bob", "alice", time.Hour)
+	if err := h.LobbyManager.RedeemInvite("ops", "bob", token); err != nil {
+		t.Fatalf("RedeemInvite: %v", err)
+	}
+	if err := h.LobbyManager.JoinLobby("ops", "", "bob", "", true); err != nil {
+		t.Errorf("allowlisted user could not join: %v", err)
+	}
+	if err := h.LobbyManager.JoinLobby("ops", "", "bob", "", false); err == nil {
+		t.Error("allowlist applied to an unidentified user")
+	}
+}
+
+func TestCreateInviteOnlyLobby(t *testing.T) {
+	h := newTestHandler(t)
+	out := record(addPipeClient(t, h.ClientManager, "alice", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	logIn(t, h, "alice")
+
+	h.HandleCommand(alice.Conn, "/create ops --invite-only on-call", alice)
+	out.waitFor(t, "Created invite-only lobby 'ops'.")
+	if lobby, _ := h.LobbyManager.GetLobby("ops"); !lobby.InviteOnly || lobby.IsPrivate {
+		t.Errorf("lobby = %+v; want invite-only without a password", lobby)
+	}
+	if err := h.LobbyManager.JoinLobby("ops", "", "bob", "", true); err == nil {
+		t.Error("joined a new invite-only lobby uninvited")
+	}
+	if err := h.LobbyManager.SetInviteOnly("general", true); err == nil {
+		t.Error("general was made invite-only")
+	}
+}
@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"chat-server/server/models"
+	"chat-server/server/utils"
 	"fmt"
+	"log"
 	"net"
 	"strings"
 	"time"
@@ -13,20 +15,36 @@ func (h *CommandHandler) handleCreateLobby(conn net.Conn, client *models.Client,
 	parts := strings.SplitN(content, " ", 3)
 
 	if len(parts) < 2 {
-		conn.Write([]byte(ColorRed + "Usage: /create <name> [password] <description>\n" + ColorReset))
+		conn.Write([]byte(ColorRed + "Usage: /create <name> [password|--invite-only] <description>\n" + ColorReset))
 		return
 	}
 
 	lobbyName := parts[0]
 	password := ""
 	desc := parts[len(parts)-1]
+	if ok, msg := utils.IsValidLobbyName(lobbyName); !ok {
+		conn.Write([]byte(ColorRed + msg + "\n" + ColorReset))
+		return
+	}
 
 	if len(parts) == 3 {
 		password = parts[1]
 		desc = parts[2]
 	}
+	inviteOnly := password == "--invite-only"
+	if inviteOnly {
+		password = ""
+	}
+
+	// Anyone can connect under a name nobody registered, so only logged in
+	// creators own what they create
+	owned := h.isVerified(client)
+	if inviteOnly && !owned {
+		conn.Write([]byte(ColorRed + "Log in with /register or /login to create an invite-only lobby, as nobody would own it to invite you.\n" + ColorReset))
+		return
+	}
 
-	if err := h.LobbyManager.CreateLobby(lobbyName, password, desc, client.Username); err != nil {
+	if err := h.LobbyManager.CreateLobby(lobbyName, password, desc, client.Username, owned, inviteOnly); err != nil {
 		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
 		return
 	}
@@ -35,9 +53,15 @@ func (h *CommandHandler) handleCreateLobby(conn net.Conn, client *models.Client,
 	if password != "" {
 		lobbyType = "private"
 	}
+	if inviteOnly {
+		lobbyType = "invite-only"
+	}
 
 	conn.Write([]byte(ColorGreen + fmt.Sprintf("Created %s lobby '%s'. Use /join %s to enter.\n",
 		lobbyType, lobbyName, lobbyName) + ColorReset))
+	if !owned {
+		conn.Write([]byte(ColorYellow + "You are not logged in, so nobody owns this lobby. /register before creating one to own it.\n" + ColorReset))
+	}
 }
 
 func (h *CommandHandler) handleJoinLobby(conn net.Conn, client *models.Client, cmd string) {
@@ -50,28 +74,61 @@ func (h *CommandHandler) handleJoinLobby(conn net.Conn, client *models.Client, c
 		password = parts[1]
 	}
 
-	if err := h.LobbyManager.JoinLobby(lobbyName, password); err != nil {
+	if token, ok := strings.CutPrefix(password, "--token "); ok {
+		if !h.isVerified(client) {
+			conn.Write([]byte(ColorRed + fmt.Sprintf("Log in as %s to use this invitation.\n", client.Username) + ColorReset))
+			return
+		}
+		if err := h.LobbyManager.RedeemInvite(lobbyName, client.Username, strings.TrimSpace(token)); err != nil {
+			conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+			return
+		}
+		password = ""
+	}
+	h.joinLobby(conn, client, lobbyName, password)
+}
+
+// joinLobby moves a client into a lobby once they are let in
+func (h *CommandHandler) joinLobby(conn net.Conn, client *models.Client, lobbyName, password string) {
+	if err := h.LobbyManager.JoinLobby(lobbyName, password, client.Username, client.IP, h.isVerified(client)); err != nil {
 		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
 		return
 	}
 
-	oldLobby := client.CurrentLobby
-	h.ClientManager.BroadcastToLobby(oldLobby,
-		fmt.Sprintf("%s%s%s has left the lobby", ColorRed, client.Username, ColorReset))
+	h.moveToLobby(client, lobbyName)
+}
+
+// moveToLobby switches a client to another lobby, announcing the move in
+// both lobbies and replaying recent history. Everything is queued through
+// the client's outbox so it also works for clients other than the caller.
+func (h *CommandHandler) moveToLobby(client *models.Client, lobbyName string) {
+	oldLobby, ok := h.ClientManager.MoveClient(client, lobbyName, h.LobbyManager.Exists)
+	if !ok {
+		h.ClientManager.Send(client, ColorRed+"lobby does not exist\n"+ColorReset)
+		return
+	}
+	h.announceMove(client, oldLobby, lobbyName)
+}
 
-	client.CurrentLobby = lobbyName
-	conn.Write([]byte(ColorGreen + fmt.Sprintf("Joined lobby '%s'\n", lobbyName) + ColorReset))
+// announceMove tells both lobbies about a client that moved between them
+// and shows the client the new one
+func (h *CommandHandler) announceMove(client *models.Client, oldLobby, lobbyName string) {
+	h.ClientManager.BroadcastEvent(models.Event{Type: models.EventLeave, Lobby: oldLobby, From: client.Username},
+		fmt.Sprintf("%s%s%s has left the lobby", ColorRed, client.Username, ColorReset))
+	h.ClientManager.Send(client, ColorGreen+fmt.Sprintf("Joined lobby '%s'\n", lobbyName)+ColorReset)
 
-	h.ClientManager.BroadcastToLobby(lobbyName,
+	h.ClientManager.BroadcastEvent(models.Event{Type: models.EventJoin, Lobby: lobbyName, From: client.Username},
 		fmt.Sprintf("%s%s%s has joined the lobby", ColorGreen, client.Username, ColorReset))
 	recent := h.LobbyManager.GetRecentMessages(lobbyName, 10*time.Minute)
-	conn.Write([]byte(recent))
+	if recent != "" {
+		h.ClientManager.Send(client, recent)
+	}
 }
 
 func (h *CommandHandler) handleSetAI(conn net.Conn, client *models.Client, cmd string) {
 	prompt := strings.TrimSpace(strings.TrimPrefix(cmd, "/setai "))
 
-	if err := h.LobbyManager.SetAIPrompt(client.CurrentLobby, client.Username, prompt); err != nil {
+	if err := h.LobbyManager.SetAIPrompt(client.CurrentLobby, prompt); err != nil {
 		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
 		return
 	}
@@ -80,3 +137,145 @@ func (h *CommandHandler) handleSetAI(conn net.Conn, client *models.Client, cmd s
 	h.ClientManager.BroadcastToLobby(client.CurrentLobby,
 		fmt.Sprintf("%s%s%s updated the AI prompt", ColorYellow, client.Username, ColorReset))
 }
+
+// handleLobby shows or changes the settings of the current lobby. Changes
+// are for its owner, which is its creator unless ownership was transferred.
+func (h *CommandHandler) handleLobby(conn net.Conn, client *models.Client, cmd string) {
+	lobbyName := client.CurrentLobby
+	action, arg, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(cmd, "/lobby")), " ")
+	arg = strings.TrimSpace(arg)
+	if action == "" {
+		h.showLobbyInfo(conn, lobbyName)
+		return
+	}
+
+	usage := "Usage: /lobby [delete|archive|unarchive|rename <name>|desc <text>|passwd <password>|public|private [password]]"
+	switch action {
+	case "delete", "archive", "unarchive", "rename", "desc", "passwd", "public", "private":
+	default:
+		conn.Write([]byte(ColorRed + usage + "\n" + ColorReset))
+		return
+	}
+	if !h.HasPermission(client, lobbyName, PermManageLobby) {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("Only the owner of '%s' can change it.\n", lobbyName) + ColorReset))
+		return
+	}
+	if lobbyName == "general" {
+		conn.Write([]byte(ColorRed + "The general lobby can't be changed.\n" + ColorReset))
+		return
+	}
+
+	var err error
+	var notice string
+	switch action {
+	case "delete":
+		if arg != lobbyName {
+			conn.Write([]byte(ColorYellow + fmt.Sprintf("This deletes '%s' and its whole history. Type /lobby delete %s to confirm.\n",
+				lobbyName, lobbyName) + ColorReset))
+			return
+		}
+		h.deleteLobby(conn, client, lobbyName)
+		return
+	case "rename":
+		h.renameLobby(conn, client, lobbyName, arg)
+		return
+	case "archive", "unarchive":
+		err = h.LobbyManager.SetArchived(lobbyName, action == "archive")
+		notice = fmt.Sprintf("%s archived '%s'. Its history stays readable but nobody can post.", client.Username, lobbyName)
+		if action == "unarchive" {
+			notice = fmt.Sprintf("%s reopened '%s'.", client.Username, lobbyName)
+		}
+	case "desc":
+		if arg == "" {
+			conn.Write([]byte(ColorRed + "Usage: /lobby desc <text>\n" + ColorReset))
+			return
+		}
+		err = h.LobbyManager.SetDescription(lobbyName, arg)
+		notice = fmt.Sprintf("%s changed the description: %s", client.Username, arg)
+	case "passwd", "private":
+		if arg == "" {
+			if lobby, _ := h.LobbyManager.GetLobby(lobbyName); action == "private" && lobby.IsPrivate {
+				conn.Write([]byte(ColorRed + fmt.Sprintf("'%s' is already private.\n", lobbyName) + ColorReset))
+				return
+			}
+			conn.Write([]byte(ColorRed + fmt.Sprintf("Usage: /lobby %s <password>\n", action) + ColorReset))
+			return
+		}
+		err = h.LobbyManager.SetPassword(lobbyName, arg)
+		notice = fmt.Sprintf("%s made '%s' private. Members need the new password to rejoin.", client.Username, lobbyName)
+	case "public":
+		err = h.LobbyManager.SetPassword(lobbyName, "")
+		notice = fmt.Sprintf("%s made '%s' public.", client.Username, lobbyName)
+	}
+	if err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+	ev := models.Event{Type: models.EventNotice, Lobby: lobbyName, From: client.Username, Text: notice}
+	if action == "desc" {
+		ev.Type, ev.Text = models.EventTopic, arg
+	}
+	h.ClientManager.BroadcastEvent(ev, ColorYellow+notice+ColorReset)
+}
+
+// deleteLobby removes a lobby and moves everyone in it back to general
+func (h *CommandHandler) deleteLobby(conn net.Conn, client *models.Client, lobbyName string) {
+	members, err := h.ClientManager.MoveClients(lobbyName, "general", func() error {
+		return h.LobbyManager.DeleteLobby(lobbyName)
+	})
+	if err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+	log.Printf("%s deleted lobby %s", client.Username, lobbyName)
+	for _, member := range members {
+		h.ClientManager.SetThread(member, 0)
+		h.ClientManager.Send(member, ColorYellow+fmt.Sprintf("'%s' was deleted by %s.\n", lobbyName, client.Username)+ColorReset)
+		h.announceMove(member, lobbyName, "general")
+	}
+}
+
+// renameLobby renames a lobby, taking the clients in it along
+func (h *CommandHandler) renameLobby(conn net.Conn, client *models.Client, oldName, newName string) {
+	if newName == "" {
+		conn.Write([]byte(ColorRed + "Usage: /lobby rename <new-name>\n" + ColorReset))
+		return
+	}
+	if ok, msg := utils.IsValidLobbyName(newName); !ok {
+		conn.Write([]byte(ColorRed + msg + "\n" + ColorReset))
+		return
+	}
+	if _, err := h.ClientManager.MoveClients(oldName, newName, func() error {
+		return h.LobbyManager.RenameLobby(oldName, newName)
+	}); err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+	h.ClientManager.BroadcastToLobby(newName, fmt.Sprintf("%s%s renamed '%s' to '%s'%s",
+		ColorYellow, client.Username, oldName, newName, ColorReset))
+}
+
+// showLobbyInfo describes a lobby and how to change it
+func (h *CommandHandler) showLobbyInfo(conn net.Conn, lobbyName string) {
+	lobby, exists := h.LobbyManager.GetLobby(lobbyName)
+	if !exists {
+		conn.Write([]byte(ColorRed + "lobby does not exist\n" + ColorReset))
+		return
+	}
+	var flags []string
+	switch {
+	case lobby.InviteOnly:
+		flags = append(flags, "invite-only")
+	case lobby.IsPrivate:
+		flags = append(flags, "private")
+	default:
+		flags = append(flags, "public")
+	}
+	if lobby.Archived {
+		flags = append(flags, "archived")
+	}
+	msg := ColorCyan + fmt.Sprintf("=== %s ===", lobby.Name) + ColorReset + "\n"
+	msg += fmt.Sprintf("  %s | Owner: %s | Created by: %s\n", strings.Join(flags, ", "), ownerName(lobby), lobby.Creator)
+	msg += fmt.Sprintf("  Description: %s\n", lobby.Desc)
+	conn.Write([]byte(msg))
+}
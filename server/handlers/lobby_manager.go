@@ -1,34 +1,127 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"chat-server/server/ai"
 	"chat-server/server/models"
-	"chat-server/server/utils"
+	"chat-server/server/search"
+	"chat-server/server/storage"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// maxContextMessages is how many recent messages each lobby keeps in memory
+const maxContextMessages = 5
+
 // LobbyManager manages chat lobbies
 type LobbyManager struct {
 	lobbies            map[string]*models.Lobby
 	lobbyContexts      map[string]*models.LobbyContext
 	lobbyConversations map[string]*ai.ConversationHistory
+	store              storage.Store
+	index              *search.Index
+	moderation         *ModerationManager
+	Threads            *ThreadManager
+	threadContext      atomic.Bool // whether the AI sees thread replies
 	mu                 sync.RWMutex
 	contextMu          sync.RWMutex
 	conversationsMu    sync.RWMutex
+	modifyMu           sync.Mutex // serializes read-modify-write of stored messages
 }
 
-// NewLobbyManager creates a new lobby manager
-func NewLobbyManager() *LobbyManager {
-	return &LobbyManager{
+// NewLobbyManager creates a new lobby manager that writes through to store
+// and enforces the bans tracked by moderation
+func NewLobbyManager(store storage.Store, moderation *ModerationManager) *LobbyManager {
+	lm := &LobbyManager{
 		lobbies:            make(map[string]*models.Lobby),
 		lobbyContexts:      make(map[string]*models.LobbyContext),
 		lobbyConversations: make(map[string]*ai.ConversationHistory),
+		store:              store,
+		index:              search.NewIndex(),
+		moderation:         moderation,
+		Threads:            NewThreadManager(),
+	}
+	lobbyCount.SetSource(lm.lobbiesByVisibility)
+	return lm
+}
+
+// LoadFromStore restores lobbies, recent history, threads and AI
+// conversations, and indexes every stored message for /search
+func (lm *LobbyManager) LoadFromStore() error {
+	lobbies, err := lm.store.LoadLobbies()
+	if err != nil {
+		return fmt.Errorf("load lobbies: %w", err)
+	}
+
+	lm.mu.Lock()
+	for _, lobby := range lobbies {
+		if lobby.Owner == "" && !lobby.Unowned {
+			lobby.Owner = lobby.Creator
+		}
+		lm.lobbies[lobby.Name] = lobby
+		if lobby.AIPrompt != "" {
+			ai.SetAIPromptForLobby(lobby.Name, lobby.AIPrompt)
+		}
+	}
+	names := make([]string, 0, len(lm.lobbies))
+	for name := range lm.lobbies {
+		names = append(names, name)
+	}
+	lm.mu.Unlock()
+
+	lm.contextMu.Lock()
+	for _, name := range names {
+		msgs, err := lm.store.LoadMessages(name, 0)
+		if err != nil {
+			lm.contextMu.Unlock()
+			return fmt.Errorf("load history for %s: %w", name, err)
+		}
+		var main, replies []models.LobbyMessage
+		roots := make(map[uint64]models.LobbyMessage)
+		for _, msg := range msgs {
+			lm.index.Add(name, msg)
+			if msg.Thread == 0 {
+				main = append(main, msg)
+				roots[msg.ID] = msg
+				continue
+			}
+			replies = append(replies, msg)
+			if root, ok := roots[msg.Thread]; ok {
+				lm.Threads.record(name, root, msg)
+			}
+		}
+		if len(main) > 0 || len(replies) > 0 {
+			lm.lobbyContexts[name] = &models.LobbyContext{
+				RecentMessages: lastMessages(main, maxContextMessages),
+				ThreadMessages: lastMessages(replies, maxContextMessages),
+				Mu:             &sync.RWMutex{},
+			}
+		}
+	}
+	lm.contextMu.Unlock()
+
+	conversations, err := lm.store.LoadConversations()
+	if err != nil {
+		return fmt.Errorf("load AI conversations: %w", err)
+	}
+	lm.conversationsMu.Lock()
+	for name, conv := range conversations {
+		lm.lobbyConversations[name] = conv
 	}
+	lm.conversationsMu.Unlock()
+
+	return nil
 }
 
 // CreateDefaultLobby creates the general lobby
@@ -41,13 +134,15 @@ func (lm *LobbyManager) CreateDefaultLobby() {
 		IsPrivate: false,
 		Password:  "",
 		Creator:   "server",
+		Owner:     "server",
 		Desc:      "Welcome to the General Lobby — this is where everyone spawns when they enter the server.",
 		AIPrompt:  "",
 	}
 }
 
-// CreateLobby creates a new lobby
-func (lm *LobbyManager) CreateLobby(name, password, desc, creator string) error {
+// CreateLobby creates a new lobby. The creator only becomes its owner
+// when owned is set.
+func (lm *LobbyManager) CreateLobby(name, password, desc, creator string, owned, inviteOnly bool) error {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
 
@@ -58,36 +153,485 @@ func (lm *LobbyManager) CreateLobby(name, password, desc, creator string) error
 	if err != nil {
 		return fmt.Errorf("failed to secure lobby password")
 	}
-	lm.lobbies[name] = &models.Lobby{
-		Name:      name,
-		IsPrivate: password != "",
-		Password:  hashedPassword,
-		Creator:   creator,
-		Desc:      desc,
-		AIPrompt:  "",
+	lobby := &models.Lobby{
+		Name:       name,
+		IsPrivate:  password != "",
+		Password:   hashedPassword,
+		InviteOnly: inviteOnly,
+		Creator:    creator,
+		Desc:       desc,
+		AIPrompt:   "",
+		Unowned:    !owned,
+	}
+	if owned {
+		lobby.Owner = creator
 	}
+	if err := lm.store.SaveLobby(lobby); err != nil {
+		log.Printf("Failed to save lobby %s: %v", name, err)
+		return fmt.Errorf("failed to save lobby")
+	}
+	lm.lobbies[name] = lobby
 	return nil
 }
 
-// JoinLobby validates lobby join request
-func (lm *LobbyManager) JoinLobby(name, password string) error {
+// GetLobby returns a copy of a lobby
+func (lm *LobbyManager) GetLobby(name string) (models.Lobby, bool) {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	lobby, exists := lm.lobbies[name]
+	if !exists {
+		return models.Lobby{}, false
+	}
+	return *lobby, true
+}
+
+// Exists reports whether a lobby exists
+func (lm *LobbyManager) Exists(name string) bool {
 	lm.mu.RLock()
 	defer lm.mu.RUnlock()
+	_, exists := lm.lobbies[name]
+	return exists
+}
+
+// Lobbies returns copies of all lobbies
+func (lm *LobbyManager) Lobbies() []models.Lobby {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	lobbies := make([]models.Lobby, 0, len(lm.lobbies))
+	for _, lobby := range lm.lobbies {
+		lobbies = append(lobbies, *lobby)
+	}
+	return lobbies
+}
+
+// JoinLobby validates lobby join request. identified reports whether the
+// user is logged in to username's registered account, which invite-only
+// lobbies and the allowlist require.
+func (lm *LobbyManager) JoinLobby(name, password, username, ip string, identified bool) (err error) {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	defer func() {
+		if err != nil {
+			lobbyJoins.Inc("denied")
+		} else {
+			lobbyJoins.Inc("ok")
+		}
+	}()
 
 	lobby, exists := lm.lobbies[name]
 	if !exists {
 		return fmt.Errorf("lobby does not exist")
 	}
 
-	if lobby.IsPrivate && !checkPassword(lobby.Password, password) {
+	if ban := lm.moderation.FindBan(name, username, ip); ban != nil {
+		return fmt.Errorf("you are banned from this lobby%s", describeBan(ban))
+	}
+
+	allowed := identified && lobby.Allowlist[username]
+	if lobby.InviteOnly {
+		member := lobby.Owner == username || lobby.Roles[username] >= models.RoleVoiced
+		if !allowed && !(identified && member) {
+			return fmt.Errorf("'%s' is invite-only; ask one of its operators to /invite you", name)
+		}
+		return nil
+	}
+	if lobby.IsPrivate && !allowed && !checkPassword(lobby.Password, password) {
 		return fmt.Errorf("incorrect password for private lobby")
 	}
 
 	return nil
 }
 
+// SetInviteOnly turns a lobby's invite-only mode on or off
+func (lm *LobbyManager) SetInviteOnly(lobbyName string, inviteOnly bool) error {
+	if lobbyName == "general" {
+		return fmt.Errorf("the general lobby is open to everyone")
+	}
+	return lm.updateLobby(lobbyName, func(lobby *models.Lobby) error {
+		lobby.InviteOnly = inviteOnly
+		return nil
+	})
+}
+
+// updateLobby applies change to a lobby other than general and saves it
+func (lm *LobbyManager) updateLobby(lobbyName string, change func(lobby *models.Lobby) error) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lobby, exists := lm.lobbies[lobbyName]
+	if !exists {
+		return fmt.Errorf("lobby does not exist")
+	}
+	if lobbyName == "general" {
+		return fmt.Errorf("the general lobby can't be changed")
+	}
+	if err := change(lobby); err != nil {
+		return err
+	}
+	if err := lm.store.SaveLobby(lobby); err != nil {
+		log.Printf("Failed to save lobby %s: %v", lobbyName, err)
+		return fmt.Errorf("failed to save lobby")
+	}
+	return nil
+}
+
+// SetDescription changes a lobby's description
+func (lm *LobbyManager) SetDescription(lobbyName, desc string) error {
+	return lm.updateLobby(lobbyName, func(lobby *models.Lobby) error {
+		lobby.Desc = desc
+		return nil
+	})
+}
+
+// SetPassword changes a lobby's password. An empty password makes the
+// lobby public.
+func (lm *LobbyManager) SetPassword(lobbyName, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to secure lobby password")
+	}
+	return lm.updateLobby(lobbyName, func(lobby *models.Lobby) error {
+		lobby.Password = hashedPassword
+		lobby.IsPrivate = password != ""
+		return nil
+	})
+}
+
+// SetArchived makes a lobby read-only, or writable again
+func (lm *LobbyManager) SetArchived(lobbyName string, archived bool) error {
+	return lm.updateLobby(lobbyName, func(lobby *models.Lobby) error {
+		if lobby.Archived == archived {
+			if archived {
+				return fmt.Errorf("'%s' is already archived", lobbyName)
+			}
+			return fmt.Errorf("'%s' is not archived", lobbyName)
+		}
+		lobby.Archived = archived
+		return nil
+	})
+}
+
+// IsArchived reports whether a lobby is read-only
+func (lm *LobbyManager) IsArchived(lobbyName string) bool {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	lobby, exists := lm.lobbies[lobbyName]
+	return exists && lobby.Archived
+}
+
+// DeleteLobby removes a lobby with its history, threads, AI conversation,
+// bans and mutes. Clients still in it must be moved elsewhere.
+func (lm *LobbyManager) DeleteLobby(lobbyName string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if _, exists := lm.lobbies[lobbyName]; !exists {
+		return fmt.Errorf("lobby does not exist")
+	}
+	if lobbyName == "general" {
+		return fmt.Errorf("the general lobby can't be deleted")
+	}
+	if err := lm.store.DeleteLobby(lobbyName); err != nil {
+		log.Printf("Failed to delete lobby %s: %v", lobbyName, err)
+		return fmt.Errorf("failed to delete lobby")
+	}
+	delete(lm.lobbies, lobbyName)
+
+	lm.index.RemoveLobby(lobbyName)
+	lm.Threads.removeLobby(lobbyName)
+	lm.moderation.RemoveLobby(lobbyName)
+	lm.contextMu.Lock()
+	delete(lm.lobbyContexts, lobbyName)
+	lm.contextMu.Unlock()
+	lm.conversationsMu.Lock()
+	delete(lm.lobbyConversations, lobbyName)
+	lm.conversationsMu.Unlock()
+	ai.ClearAIPromptForLobby(lobbyName)
+	return nil
+}
+
+// RenameLobby gives a lobby a new name, taking its history, threads, AI
+// conversation and prompt, bans and mutes along. Clients still in it must
+// be moved to the new name.
+func (lm *LobbyManager) RenameLobby(oldName, newName string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lobby, exists := lm.lobbies[oldName]
+	if !exists {
+		return fmt.Errorf("lobby does not exist")
+	}
+	if oldName == "general" {
+		return fmt.Errorf("the general lobby can't be renamed")
+	}
+	if _, taken := lm.lobbies[newName]; taken {
+		return fmt.Errorf("lobby already exists")
+	}
+
+	renamed := *lobby
+	renamed.Name = newName
+	if err := lm.store.RenameLobby(oldName, &renamed); err != nil {
+		log.Printf("Failed to rename lobby %s to %s: %v", oldName, newName, err)
+		return fmt.Errorf("failed to rename lobby")
+	}
+	delete(lm.lobbies, oldName)
+	lm.lobbies[newName] = &renamed
+
+	lm.index.RemoveLobby(oldName)
+	msgs, err := lm.store.LoadMessages(newName, 0)
+	if err != nil {
+		log.Printf("Failed to reindex %s: %v", newName, err)
+	}
+	for _, msg := range msgs {
+		lm.index.Add(newName, msg)
+	}
+	lm.Threads.renameLobby(oldName, newName)
+	lm.moderation.RenameLobby(oldName, newName)
+
+	lm.contextMu.Lock()
+	if ctx, ok := lm.lobbyContexts[oldName]; ok {
+		lm.lobbyContexts[newName] = ctx
+		delete(lm.lobbyContexts, oldName)
+	}
+	lm.contextMu.Unlock()
+	lm.conversationsMu.Lock()
+	if conv, ok := lm.lobbyConversations[oldName]; ok {
+		lm.lobbyConversations[newName] = conv
+		delete(lm.lobbyConversations, oldName)
+	}
+	lm.conversationsMu.Unlock()
+	ai.ClearAIPromptForLobby(oldName)
+	if renamed.AIPrompt != "" {
+		ai.SetAIPromptForLobby(newName, renamed.AIPrompt)
+	}
+	return nil
+}
+
+// Invite records an invitation for username that can be used once within
+// ttl and returns its token. It replaces any earlier invitation of theirs.
+func (lm *LobbyManager) Invite(lobbyName, username, by string, ttl time.Duration) (string, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lobby, exists := lm.lobbies[lobbyName]
+	if !exists {
+		return "", fmt.Errorf("lobby does not exist")
+	}
+	if lobbyName == "general" {
+		return "", fmt.Errorf("the general lobby is open to everyone")
+	}
+	if lobby.Allowlist[username] {
+		return "", fmt.Errorf("%s can already join '%s'", username, lobbyName)
+	}
+	token, err := newInviteToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to create invitation")
+	}
+
+	now := time.Now()
+	invites := pendingInvites(lobby.Invites, now)
+	for i, invite := range invites {
+		if invite.Username == username {
+			invites = append(invites[:i:i], invites[i+1:]...)
+			break
+		}
+	}
+	lobby.Invites = append(invites, models.Invite{
+		Username:  username,
+		By:        by,
+		TokenHash: hashToken(token),
+		Created:   now,
+		Expires:   now.Add(ttl),
+	})
+	if err := lm.store.SaveLobby(lobby); err != nil {
+		log.Printf("Failed to save invitation to %s: %v", lobbyName, err)
+		return "", fmt.Errorf("failed to save invitation")
+	}
+	return token, nil
+}
+
+// RedeemInvite uses up username's invitation to a lobby and adds them to
+// its allowlist. A non-empty token must match the invitation.
+func (lm *LobbyManager) RedeemInvite(lobbyName, username, token string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lobby, exists := lm.lobbies[lobbyName]
+	if !exists {
+		return fmt.Errorf("lobby does not exist")
+	}
+	invites := pendingInvites(lobby.Invites, time.Now())
+	found := -1
+	for i, invite := range invites {
+		if token != "" && invite.TokenHash == hashToken(token) {
+			if invite.Username != username {
+				return fmt.Errorf("that invitation is for %s", invite.Username)
+			}
+			found = i
+		}
+		if token == "" && invite.Username == username {
+			found = i
+		}
+	}
+	if found < 0 {
+		if token != "" {
+			return fmt.Errorf("invalid or expired invitation token")
+		}
+		return fmt.Errorf("you have no invitation to '%s'", lobbyName)
+	}
+
+	lobby.Invites = append(invites[:found:found], invites[found+1:]...)
+	if lobby.Allowlist == nil {
+		lobby.Allowlist = make(map[string]bool)
+	}
+	lobby.Allowlist[username] = true
+	if err := lm.store.SaveLobby(lobby); err != nil {
+		log.Printf("Failed to save allowlist for %s: %v", lobbyName, err)
+	}
+	return nil
+}
+
+// Uninvite removes username from a lobby's allowlist and cancels their
+// pending invitation, reporting whether there was either
+func (lm *LobbyManager) Uninvite(lobbyName, username string) (bool, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lobby, exists := lm.lobbies[lobbyName]
+	if !exists {
+		return false, fmt.Errorf("lobby does not exist")
+	}
+	removed := lobby.Allowlist[username]
+	delete(lobby.Allowlist, username)
+	invites := pendingInvites(lobby.Invites, time.Now())
+	for i, invite := range invites {
+		if invite.Username == username {
+			invites = append(invites[:i:i], invites[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	lobby.Invites = invites
+	if !removed {
+		return false, nil
+	}
+	if err := lm.store.SaveLobby(lobby); err != nil {
+		log.Printf("Failed to save allowlist for %s: %v", lobbyName, err)
+	}
+	return true, nil
+}
+
+// LobbyInvite is a pending invitation as seen by the invited user
+type LobbyInvite struct {
+	Lobby string
+	models.Invite
+}
+
+// PendingInvites returns username's unexpired invitations, newest first
+func (lm *LobbyManager) PendingInvites(username string) []LobbyInvite {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	now := time.Now()
+	var result []LobbyInvite
+	for name, lobby := range lm.lobbies {
+		for _, invite := range pendingInvites(lobby.Invites, now) {
+			if invite.Username == username {
+				result = append(result, LobbyInvite{Lobby: name, Invite: invite})
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.After(result[j].Created) })
+	return result
+}
+
+// pendingInvites returns the invites that have not expired by now
+func pendingInvites(invites []models.Invite, now time.Time) []models.Invite {
+	var pending []models.Invite
+	for _, invite := range invites {
+		if now.Before(invite.Expires) {
+			pending = append(pending, invite)
+		}
+	}
+	return pending
+}
+
+// newInviteToken returns a random token that is short enough to type
+func newInviteToken() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the form invitation and bot tokens are stored in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// MaxWebhooksPerLobby is how many webhooks one lobby may register
+const MaxWebhooksPerLobby = 10
+
+// AddWebhook registers hook with a lobby
+func (lm *LobbyManager) AddWebhook(lobbyName string, hook models.Webhook) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lobby, exists := lm.lobbies[lobbyName]
+	if !exists {
+		return fmt.Errorf("lobby does not exist")
+	}
+	if len(lobby.Webhooks) >= MaxWebhooksPerLobby {
+		return fmt.Errorf("'%s' already has %d webhooks", lobbyName, MaxWebhooksPerLobby)
+	}
+	// Copies handed out by GetLobby share the old slice
+	lobby.Webhooks = append(slices.Clip(lobby.Webhooks), hook)
+	if err := lm.store.SaveLobby(lobby); err != nil {
+		log.Printf("Failed to save webhook of %s: %v", lobbyName, err)
+		return fmt.Errorf("failed to save webhook")
+	}
+	return nil
+}
+
+// RemoveWebhook deletes the webhook with id from a lobby
+func (lm *LobbyManager) RemoveWebhook(lobbyName, id string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lobby, exists := lm.lobbies[lobbyName]
+	if !exists {
+		return fmt.Errorf("lobby does not exist")
+	}
+	i := slices.IndexFunc(lobby.Webhooks, func(hook models.Webhook) bool { return hook.ID == id })
+	if i < 0 {
+		return fmt.Errorf("'%s' has no webhook %s", lobbyName, id)
+	}
+	lobby.Webhooks = slices.Delete(slices.Clone(lobby.Webhooks), i, i+1)
+	if err := lm.store.SaveLobby(lobby); err != nil {
+		log.Printf("Failed to save webhooks of %s: %v", lobbyName, err)
+		return fmt.Errorf("failed to remove webhook")
+	}
+	return nil
+}
+
+// Webhooks returns a copy of a lobby's webhooks
+func (lm *LobbyManager) Webhooks(lobbyName string) []models.Webhook {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	lobby, exists := lm.lobbies[lobbyName]
+	if !exists {
+		return nil
+	}
+	return slices.Clone(lobby.Webhooks)
+}
+
 // SetAIPrompt sets custom AI prompt for a lobby
-func (lm *LobbyManager) SetAIPrompt(lobbyName, username, prompt string) error {
+func (lm *LobbyManager) SetAIPrompt(lobbyName, prompt string) error {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
 
@@ -100,15 +644,115 @@ func (lm *LobbyManager) SetAIPrompt(lobbyName, username, prompt string) error {
 		return fmt.Errorf("cannot set prompt for general lobby")
 	}
 
-	if lobby.Creator != username {
-		return fmt.Errorf("only the lobby creator can set the AI prompt")
-	}
-
 	lobby.AIPrompt = prompt
+	if err := lm.store.SaveLobby(lobby); err != nil {
+		log.Printf("Failed to save AI prompt for %s: %v", lobbyName, err)
+	}
 	ai.SetAIPromptForLobby(lobbyName, prompt)
 	return nil
 }
 
+// RoleOf returns the role a username holds in a lobby. Users without an
+// explicit grant are members.
+func (lm *LobbyManager) RoleOf(lobbyName, username string) models.Role {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	lobby, exists := lm.lobbies[lobbyName]
+	if !exists {
+		return models.RoleMember
+	}
+	if lobby.Owner == username {
+		return models.RoleOwner
+	}
+	if role, granted := lobby.Roles[username]; granted {
+		return role
+	}
+	return models.RoleMember
+}
+
+// SetRole grants a voiced or operator role, or resets a user to member
+func (lm *LobbyManager) SetRole(lobbyName, username string, role models.Role) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lobby, exists := lm.lobbies[lobbyName]
+	if !exists {
+		return fmt.Errorf("lobby not found")
+	}
+	if lobby.Owner == username {
+		return fmt.Errorf("the owner's role can only change through /transfer")
+	}
+
+	if role == models.RoleMember {
+		delete(lobby.Roles, username)
+	} else {
+		if lobby.Roles == nil {
+			lobby.Roles = make(map[string]models.Role)
+		}
+		lobby.Roles[username] = role
+	}
+
+	if err := lm.store.SaveLobby(lobby); err != nil {
+		log.Printf("Failed to save roles for %s: %v", lobbyName, err)
+	}
+	return nil
+}
+
+// TransferOwnership hands a lobby to a new owner. The previous owner
+// stays on as an operator.
+func (lm *LobbyManager) TransferOwnership(lobbyName, newOwner string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lobby, exists := lm.lobbies[lobbyName]
+	if !exists {
+		return fmt.Errorf("lobby not found")
+	}
+	if lobbyName == "general" {
+		return fmt.Errorf("the general lobby belongs to the server")
+	}
+	if lobby.Owner == newOwner {
+		return fmt.Errorf("%s already owns this lobby", newOwner)
+	}
+
+	if lobby.Roles == nil {
+		lobby.Roles = make(map[string]models.Role)
+	}
+	if lobby.Owner != "" {
+		lobby.Roles[lobby.Owner] = models.RoleOperator
+	}
+	delete(lobby.Roles, newOwner)
+	lobby.Owner = newOwner
+	lobby.Unowned = false
+
+	if err := lm.store.SaveLobby(lobby); err != nil {
+		log.Printf("Failed to save owner for %s: %v", lobbyName, err)
+	}
+	return nil
+}
+
+// ownerName is how lobby's owner is shown to users
+func ownerName(lobby models.Lobby) string {
+	if lobby.Owner == "" {
+		return "none"
+	}
+	return lobby.Owner
+}
+
+// LobbyAccess says who may join lobby, as one of the models.Access values
+func LobbyAccess(lobby models.Lobby) string {
+	switch {
+	case lobby.Archived:
+		return models.AccessArchived
+	case lobby.InviteOnly:
+		return models.AccessInviteOnly
+	case lobby.IsPrivate:
+		return models.AccessPrivate
+	}
+	return models.AccessPublic
+}
+
 // ShowAllLobbies displays all lobbies to a connection
 func (lm *LobbyManager) ShowAllLobbies(conn net.Conn) {
 	lm.mu.RLock()
@@ -117,10 +761,7 @@ func (lm *LobbyManager) ShowAllLobbies(conn net.Conn) {
 	msg := ColorCyan + fmt.Sprintf("\n=== Available Lobbies (%d) ===\n\n", len(lm.lobbies)) + ColorReset
 
 	for name, lobby := range lm.lobbies {
-		privacyText := "public"
-		if lobby.IsPrivate {
-			privacyText = "private"
-		}
+		privacyText := LobbyAccess(*lobby)
 
 		aiStatus := "default AI"
 		if lobby.AIPrompt != "" {
@@ -133,15 +774,54 @@ func (lm *LobbyManager) ShowAllLobbies(conn net.Conn) {
 		}
 
 		msg += fmt.Sprintf("%sLobby: %s%s\n", ColorWhite, name, ColorReset)
-		msg += fmt.Sprintf("  Privacy: %s | AI: %s | Created by: %s\n", privacyText, aiStatus, lobby.Creator)
+		msg += fmt.Sprintf("  Privacy: %s | AI: %s | Owner: %s\n", privacyText, aiStatus, ownerName(*lobby))
 		msg += fmt.Sprintf("  Description: %s\n\n", desc)
 	}
 
 	conn.Write([]byte(msg))
 }
 
-// StoreMessage stores a message in lobby context
-func (lm *LobbyManager) StoreMessage(lobbyName, userProfile, username, text string) {
+// StoreMessage appends a message to the lobby history, the search index
+// and the in-memory context used by the AI, and returns it with its ID
+func (lm *LobbyManager) StoreMessage(lobbyName, userProfile, username, text string) models.LobbyMessage {
+	return lm.storeMessage(lobbyName, models.LobbyMessage{
+		Username:    username,
+		Text:        text,
+		UserProfile: userProfile,
+	})
+}
+
+// StoreThreadReply is StoreMessage for a reply in the thread started by root
+func (lm *LobbyManager) StoreThreadReply(lobbyName, userProfile, username, text string, root models.LobbyMessage) models.LobbyMessage {
+	msg := lm.storeMessage(lobbyName, models.LobbyMessage{
+		Username:    username,
+		Text:        text,
+		UserProfile: userProfile,
+		Thread:      root.ID,
+	})
+	if msg.ID != 0 {
+		lm.Threads.record(lobbyName, root, msg)
+	}
+	return msg
+}
+
+// SetThreadContext chooses whether GetLobbyContext includes thread replies
+func (lm *LobbyManager) SetThreadContext(enabled bool) {
+	lm.threadContext.Store(enabled)
+}
+
+// StoreReply is StoreMessage for a message answering message replyTo
+func (lm *LobbyManager) StoreReply(lobbyName, userProfile, username, text string, replyTo uint64) models.LobbyMessage {
+	return lm.storeMessage(lobbyName, models.LobbyMessage{
+		Username:    username,
+		Text:        text,
+		UserProfile: userProfile,
+		ReplyTo:     replyTo,
+	})
+}
+
+func (lm *LobbyManager) storeMessage(lobbyName string, msg models.LobbyMessage) models.LobbyMessage {
+	lobbyMessages.Inc(lobbyName)
 	lm.contextMu.Lock()
 	defer lm.contextMu.Unlock()
 
@@ -158,16 +838,186 @@ func (lm *LobbyManager) StoreMessage(lobbyName, userProfile, username, text stri
 	mu.Lock()
 	defer mu.Unlock()
 
-	ctx.RecentMessages = append(ctx.RecentMessages, models.LobbyMessage{
-		Username:    username,
-		Text:        text,
-		UserProfile: userProfile,
-		Timestamp:   time.Now(),
-	})
+	msg.Timestamp = time.Now()
+	id, err := lm.store.AppendMessage(lobbyName, msg)
+	if err != nil {
+		log.Printf("Failed to store message in %s: %v", lobbyName, err)
+	} else {
+		msg.ID = id
+		lm.index.Add(lobbyName, msg)
+	}
+	if msg.Thread != 0 {
+		ctx.ThreadMessages = lastMessages(append(ctx.ThreadMessages, msg), maxContextMessages)
+	} else {
+		ctx.RecentMessages = lastMessages(append(ctx.RecentMessages, msg), maxContextMessages)
+	}
+	return msg
+}
+
+// lastMessages returns the last n of msgs
+func lastMessages(msgs []models.LobbyMessage, n int) []models.LobbyMessage {
+	if len(msgs) > n {
+		return msgs[len(msgs)-n:]
+	}
+	return msgs
+}
+
+// Message returns a stored lobby message by ID
+func (lm *LobbyManager) Message(lobbyName string, id uint64) (models.LobbyMessage, bool) {
+	msgs, err := lm.store.LoadMessagesByID(lobbyName, []uint64{id})
+	if err != nil {
+		log.Printf("Failed to load message %d in %s: %v", id, lobbyName, err)
+	}
+	if len(msgs) == 0 {
+		return models.LobbyMessage{}, false
+	}
+	return msgs[0], true
+}
+
+// Messages returns the stored messages of a lobby with the given IDs,
+// skipping any that do not exist
+func (lm *LobbyManager) Messages(lobbyName string, ids []uint64) ([]models.LobbyMessage, error) {
+	return lm.store.LoadMessagesByID(lobbyName, ids)
+}
+
+// errNoMessage is returned by ModifyMessage for unknown or deleted messages
+var errNoMessage = errors.New("no such message")
+
+// ModifyMessage applies change to a live stored message and saves the
+// result unless change returns an error. Concurrent modifications of the
+// same message are applied one after another.
+func (lm *LobbyManager) ModifyMessage(lobbyName string, id uint64, change func(msg *models.LobbyMessage) error) (models.LobbyMessage, error) {
+	lm.modifyMu.Lock()
+	defer lm.modifyMu.Unlock()
+
+	msg, ok := lm.Message(lobbyName, id)
+	if !ok || msg.Deleted {
+		return msg, errNoMessage
+	}
+	if err := change(&msg); err != nil {
+		return msg, err
+	}
+	return msg, lm.updateMessage(lobbyName, msg)
+}
+
+// updateMessage saves a changed message and brings the search index and
+// the AI context in line with it
+func (lm *LobbyManager) updateMessage(lobbyName string, msg models.LobbyMessage) error {
+	if err := lm.store.UpdateMessage(lobbyName, msg); err != nil {
+		return err
+	}
+	if msg.Deleted {
+		lm.index.Remove(lobbyName, msg.ID)
+	} else {
+		lm.index.Add(lobbyName, msg)
+	}
+
+	lm.contextMu.RLock()
+	ctx, exists := lm.lobbyContexts[lobbyName]
+	lm.contextMu.RUnlock()
+	if !exists {
+		return nil
+	}
+	mu := ctx.Mu.(*sync.RWMutex)
+	mu.Lock()
+	defer mu.Unlock()
+	recent := ctx.RecentMessages
+	if msg.Thread != 0 {
+		recent = ctx.ThreadMessages
+	}
+	for i := range recent {
+		if recent[i].ID == msg.ID {
+			recent[i] = msg
+		}
+	}
+	return nil
+}
+
+// History returns up to limit of a lobby's most recent stored messages,
+// oldest first, leaving out thread replies
+func (lm *LobbyManager) History(lobbyName string, limit int) ([]models.LobbyMessage, error) {
+	if limit <= 0 {
+		msgs, err := lm.store.LoadMessages(lobbyName, 0)
+		return withoutThreads(msgs), err
+	}
+	// Thread replies are interleaved with the main messages, so keep
+	// loading a larger tail until it holds enough of them
+	for load := limit; ; load *= 2 {
+		msgs, err := lm.store.LoadMessages(lobbyName, load)
+		if err != nil {
+			return nil, err
+		}
+		main := withoutThreads(msgs)
+		if len(main) >= limit || len(msgs) < load {
+			return lastMessages(main, limit), nil
+		}
+	}
+}
 
-	if len(ctx.RecentMessages) > 5 {
-		ctx.RecentMessages = ctx.RecentMessages[len(ctx.RecentMessages)-5:]
+// HistorySince returns up to limit of a lobby's stored messages sent after
+// since, oldest first, leaving out thread replies
+func (lm *LobbyManager) HistorySince(lobbyName string, since time.Time, limit int) ([]models.LobbyMessage, error) {
+	var result []models.LobbyMessage
+	for len(result) < limit {
+		msgs, err := lm.store.LoadMessagesSince(lobbyName, since, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range withoutThreads(msgs) {
+			if len(result) < limit {
+				result = append(result, msg)
+			}
+		}
+		if len(msgs) < limit {
+			break
+		}
+		since = msgs[len(msgs)-1].Timestamp
+	}
+	return result, nil
+}
+
+func withoutThreads(msgs []models.LobbyMessage) []models.LobbyMessage {
+	main := msgs[:0:0]
+	for _, msg := range msgs {
+		if msg.Thread == 0 {
+			main = append(main, msg)
+		}
 	}
+	return main
+}
+
+// SearchResult is a stored message matched by Search
+type SearchResult struct {
+	Lobby   string
+	Message models.LobbyMessage
+}
+
+// Search looks q up in the message index and loads the matching messages,
+// newest first. total counts every match, including those past q.Limit.
+func (lm *LobbyManager) Search(q search.Query) (results []SearchResult, total int, err error) {
+	refs, total := lm.index.Search(q)
+
+	byLobby := make(map[string][]uint64)
+	for _, ref := range refs {
+		byLobby[ref.Lobby] = append(byLobby[ref.Lobby], ref.ID)
+	}
+	loaded := make(map[search.Ref]models.LobbyMessage, len(refs))
+	for lobby, ids := range byLobby {
+		msgs, err := lm.store.LoadMessagesByID(lobby, ids)
+		if err != nil {
+			return nil, 0, fmt.Errorf("load search results from %s: %w", lobby, err)
+		}
+		for _, msg := range msgs {
+			loaded[search.Ref{Lobby: lobby, ID: msg.ID}] = msg
+		}
+	}
+
+	for _, ref := range refs {
+		if msg, ok := loaded[ref]; ok {
+			results = append(results, SearchResult{Lobby: ref.Lobby, Message: msg})
+		}
+	}
+	return results, total, nil
 }
 
 // GetLobbyContext returns formatted lobby context
@@ -190,7 +1040,16 @@ func (lm *LobbyManager) GetLobbyContext(lobbyName string) string {
 
 	var result string
 	for _, msg := range ctx.RecentMessages {
-		result += fmt.Sprintf("%s: %s\n", msg.Username, msg.Text)
+		if !msg.Deleted {
+			result += fmt.Sprintf("%s: %s\n", msg.Username, msg.Text)
+		}
+	}
+	if lm.threadContext.Load() {
+		for _, msg := range ctx.ThreadMessages {
+			if !msg.Deleted {
+				result += fmt.Sprintf("(in thread #%d) %s: %s\n", msg.Thread, msg.Username, msg.Text)
+			}
+		}
 	}
 	return result
 }
@@ -207,31 +1066,52 @@ func (lm *LobbyManager) GetRecentMessages(lobbyName string, duration time.Durati
 
 	mu := ctx.Mu.(*sync.RWMutex)
 	mu.RLock()
-	defer mu.RUnlock()
-
-	if len(ctx.RecentMessages) == 0 {
-		return ""
+	since := time.Now().Add(-duration)
+	var recent []models.LobbyMessage
+	for _, msg := range ctx.RecentMessages {
+		if !msg.Timestamp.Before(since) {
+			recent = append(recent, msg)
+		}
 	}
+	mu.RUnlock()
 
-	since := time.Now().Add(-duration)
-	var result string
+	return lm.FormatMessages(lobbyName, recent, false)
+}
 
-	for _, msg := range ctx.RecentMessages {
-		if msg.Timestamp.Before(since) {
-			continue
+// FormatMessages renders stored messages of a lobby, quoting the parent of
+// each reply. absolute selects timestamps over "5m ago".
+func (lm *LobbyManager) FormatMessages(lobbyName string, msgs []models.LobbyMessage, absolute bool) string {
+	byID := make(map[uint64]models.LobbyMessage, len(msgs))
+	for _, msg := range msgs {
+		byID[msg.ID] = msg
+	}
+	var missing []uint64
+	for _, msg := range msgs {
+		if _, ok := byID[msg.ReplyTo]; msg.ReplyTo != 0 && !ok {
+			missing = append(missing, msg.ReplyTo)
+		}
+	}
+	if len(missing) > 0 {
+		parents, err := lm.store.LoadMessagesByID(lobbyName, missing)
+		if err != nil {
+			log.Printf("Failed to load replied-to messages in %s: %v", lobbyName, err)
+		}
+		for _, parent := range parents {
+			byID[parent.ID] = parent
 		}
-		result += utils.FormatMessage(
-			msg.UserProfile,
-			msg.Username,
-			msg.Text,
-			utils.ColorYellow,
-			utils.ColorWhite,
-			utils.ColorCyan,
-			utils.ColorReset,
-			msg.Timestamp,
-		)
 	}
 
+	var result string
+	for _, msg := range msgs {
+		var parent *models.LobbyMessage
+		if p, ok := byID[msg.ReplyTo]; ok && msg.ReplyTo != 0 {
+			parent = &p
+		}
+		result += formatLobbyMessage(msg, parent, absolute)
+		if msg.Thread == 0 {
+			result += formatThreadCount(msg.ID, lm.Threads.ReplyCount(lobbyName, msg.ID))
+		}
+	}
 	return result
 }
 
@@ -245,36 +1125,61 @@ func (lm *LobbyManager) GetConversationsMutex() interface{} {
 	return &lm.conversationsMu
 }
 
+// SaveConversation persists the current AI conversation for a lobby
+func (lm *LobbyManager) SaveConversation(lobbyName string) {
+	lm.conversationsMu.RLock()
+	conv, exists := lm.lobbyConversations[lobbyName]
+	lm.conversationsMu.RUnlock()
+
+	if !exists {
+		return
+	}
+	if err := lm.store.SaveConversation(lobbyName, conv); err != nil {
+		log.Printf("Failed to save AI conversation for %s: %v", lobbyName, err)
+	}
+}
+
 // CleanupInactiveContexts removes old lobby contexts
 func (lm *LobbyManager) CleanupInactiveContexts() {
 	ticker := time.NewTicker(30 * time.Minute)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		lm.contextMu.Lock()
-		for name, ctx := range lm.lobbyContexts {
-			if name == "general" {
-				continue
-			}
+		lm.removeInactiveContexts(2 * time.Hour)
+	}
+}
 
-			mu := ctx.Mu.(*sync.RWMutex)
-			mu.RLock()
-			shouldDelete := false
-			if len(ctx.RecentMessages) > 0 {
-				lastMsg := ctx.RecentMessages[len(ctx.RecentMessages)-1]
-				if time.Since(lastMsg.Timestamp) > 2*time.Hour {
-					shouldDelete = true
-				}
+// removeInactiveContexts drops the context and AI conversation of every
+// lobby quiet for longer than idle. The lobby's AI prompt is a setting,
+// not context, so it stays.
+func (lm *LobbyManager) removeInactiveContexts(idle time.Duration) {
+	lm.contextMu.Lock()
+	defer lm.contextMu.Unlock()
+	for name, ctx := range lm.lobbyContexts {
+		if name == "general" {
+			continue
+		}
+
+		mu := ctx.Mu.(*sync.RWMutex)
+		mu.RLock()
+		shouldDelete := false
+		if len(ctx.RecentMessages) > 0 {
+			lastMsg := ctx.RecentMessages[len(ctx.RecentMessages)-1]
+			if time.Since(lastMsg.Timestamp) > idle {
+				shouldDelete = true
 			}
-			mu.RUnlock()
+		}
+		mu.RUnlock()
 
-			if shouldDelete {
-				delete(lm.lobbyContexts, name)
-				delete(lm.lobbyConversations, name)
-				ai.ClearAIPromptForLobby(name)
+		if shouldDelete {
+			delete(lm.lobbyContexts, name)
+			lm.conversationsMu.Lock()
+			delete(lm.lobbyConversations, name)
+			lm.conversationsMu.Unlock()
+			if err := lm.store.DeleteConversation(name); err != nil {
+				log.Printf("Failed to delete AI conversation for %s: %v", name, err)
 			}
 		}
-		lm.contextMu.Unlock()
 	}
 }
 func hashPassword(password string) (string, error) {
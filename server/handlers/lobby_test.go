@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"chat-server/server/ai"
+	"chat-server/server/models"
+	"chat-server/server/search"
+)
+
+func TestLobbyRename(t *testing.T) {
+	h := newTestHandler(t)
+	h.LobbyManager.CreateLobby("coding", "", "code talk", "alice", true, false)
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	bob := h.ClientManager.GetClientByUsername("bob")
+	alice.CurrentLobby, bob.CurrentLobby = "coding", "coding"
+	logIn(t, h, "alice")
+
+	h.LobbyManager.StoreMessage("coding", "", "alice", "gofmt everything")
+	h.Moderation.Ban(&models.Ban{Target: "carol", Lobby: "coding", By: "alice", Created: time.Now()})
+
+	h.HandleCommand(bob.Conn, "/lobby desc mine now", bob)
+	bobOut.waitFor(t, "Only the owner of 'coding' can change it.")
+	h.HandleCommand(alice.Conn, "/lobby desc Go and nothing else", alice)
+	bobOut.waitFor(t, "alice changed the description: Go and nothing else")
+
+	h.HandleCommand(alice.Conn, "/lobby rename golang", alice)
+	bobOut.waitFor(t, "alice renamed 'coding' to 'golang'")
+	if bob.CurrentLobby != "golang" {
+		t.Errorf("bob is in %q after rename, want golang", bob.CurrentLobby)
+	}
+	if msgs, _ := h.LobbyManager.History("golang", 10); len(msgs) != 1 {
+		t.Errorf("history after rename = %+v", msgs)
+	}
+	if results, _, _ := h.LobbyManager.Search(search.Query{Terms: []string{"gofmt"}}); len(results) != 1 || results[0].Lobby != "golang" {
+		t.Errorf("search after rename = %+v", results)
+	}
+	if h.Moderation.FindBan("golang", "carol", "") == nil {
+		t.Error("ban did not follow the rename")
+	}
+
+	h.HandleCommand(alice.Conn, "/lobby rename go|lang", alice)
+	aliceOut.waitFor(t, "Lobby name can only contain letters, numbers, -, _ and .")
+	if _, exists := h.LobbyManager.GetLobby("go|lang"); exists {
+		t.Error("renamed to a name with '|'")
+	}
+}
+
+func TestIdleContextKeepsAIPrompt(t *testing.T) {
+	h := newTestHandler(t)
+	lm := h.LobbyManager
+	lm.CreateLobby("golang", "", "code talk", "alice", true, false)
+	lm.SetAIPrompt("golang", "Answer in Go only.")
+	lm.StoreMessage("golang", "", "alice", "hello")
+	lm.contextMu.Lock()
+	lm.lobbyContexts["golang"].RecentMessages[0].Timestamp = time.Now().Add(-3 * time.Hour)
+	lm.contextMu.Unlock()
+
+	lm.removeInactiveContexts(2 * time.Hour)
+	lm.contextMu.Lock()
+	_, kept := lm.lobbyContexts["golang"]
+	lm.contextMu.Unlock()
+	if kept {
+		t.Error("idle context was not removed")
+	}
+	if got := ai.GetAIPromptForLobby("golang"); got != "Answer in Go only." {
+		t.Errorf("AI prompt after cleanup = %q", got)
+	}
+}
+
+// lobbyMembers creates an owned lobby with alice and bob in it
+func lobbyMembers(t *testing.T, h *CommandHandler) (alice, bob *models.Client, aliceOut, bobOut *transcript) {
+	t.Helper()
+	h.LobbyManager.CreateLobby("golang", "", "code talk", "alice", true, false)
+	aliceOut = record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut = record(addPipeClient(t, h.ClientManager, "bob", false))
+	alice = h.ClientManager.GetClientByUsername("alice")
+	bob = h.ClientManager.GetClientByUsername("bob")
+	alice.CurrentLobby, bob.CurrentLobby = "golang", "golang"
+	logIn(t, h, "alice")
+	return alice, bob, aliceOut, bobOut
+}
+
+func TestLobbyArchiveAndPassword(t *testing.T) {
+	h := newTestHandler(t)
+	alice, bob, aliceOut, bobOut := lobbyMembers(t, h)
+	h.LobbyManager.StoreMessage("golang", "", "alice", "gofmt everything")
+
+	h.HandleCommand(alice.Conn, "/lobby archive", alice)
+	bobOut.waitFor(t, "alice archived 'golang'.")
+	h.HandleCommand(bob.Conn, "/reply 1 late reply", bob)
+	bobOut.waitFor(t, "'golang' is archived and read-only.")
+	h.HandleCommand(alice.Conn, "/lobby unarchive", alice)
+	aliceOut.waitFor(t, "alice reopened 'golang'.")
+
+	h.HandleCommand(alice.Conn, "/lobby passwd s3cret", alice)
+	aliceOut.waitFor(t, "alice made 'golang' private.")
+	if err := h.LobbyManager.JoinLobby("golang", "guess", "dave", "", true); err == nil {
+		t.Error("joined a private lobby with the wrong password")
+	}
+	h.HandleCommand(alice.Conn, "/lobby public", alice)
+	aliceOut.waitFor(t, "alice made 'golang' public.")
+}
+
+func TestLobbyDelete(t *testing.T) {
+	h := newTestHandler(t)
+	alice, bob, aliceOut, bobOut := lobbyMembers(t, h)
+	h.LobbyManager.StoreMessage("golang", "", "alice", "gofmt everything")
+
+	h.HandleCommand(alice.Conn, "/lobby delete", alice)
+	aliceOut.waitFor(t, "Type /lobby delete golang to confirm.")
+	h.HandleCommand(alice.Conn, "/lobby delete golang", alice)
+	bobOut.waitFor(t, "'golang' was deleted by alice.")
+	bobOut.waitFor(t, "Joined lobby 'general'")
+	if _, exists := h.LobbyManager.GetLobby("golang"); exists {
+		t.Error("lobby still exists after /lobby delete")
+	}
+	if bob.CurrentLobby != "general" || alice.CurrentLobby != "general" {
+		t.Errorf("members in %q and %q after delete, want general", alice.CurrentLobby, bob.CurrentLobby)
+	}
+	if msgs, _ := h.LobbyManager.History("golang", 10); len(msgs) != 0 {
+		t.Errorf("history survived delete: %+v", msgs)
+	}
+
+	// A join that was let in just before the delete doesn't land in it
+	h.moveToLobby(bob, "golang")
+	bobOut.waitFor(t, "lobby does not exist")
+	if bob.CurrentLobby != "general" {
+		t.Errorf("bob moved into the deleted lobby %q", bob.CurrentLobby)
+	}
+}
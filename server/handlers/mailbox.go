@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/utils"
+)
+
+// sendMail queues a /msg for a recipient who is not connected. Only
+// registered names get mail: anyone can connect under an unregistered
+// name and would read what was sent to its previous holder.
+func (h *CommandHandler) sendMail(conn net.Conn, sender *models.Client, targetName, message string) {
+	if !h.Accounts.IsRegistered(targetName) {
+		seen := h.ClientManager.LastSeen(targetName)
+		if !strings.HasPrefix(targetName, GuestPrefix) && !seen.IsZero() && time.Since(seen) < MailRecipientWindow {
+			conn.Write([]byte(ColorRed + fmt.Sprintf("%s is offline. Messages are only kept for registered users.\n",
+				targetName) + ColorReset))
+			return
+		}
+		conn.Write([]byte(ColorRed + "User not found.\n" + ColorReset))
+		return
+	}
+
+	err := h.Mailbox.Send(sender, targetName, message)
+	switch {
+	case errors.Is(err, ErrMailboxFull):
+		conn.Write([]byte(ColorRed + fmt.Sprintf("%s is offline and their mailbox is full.\n", targetName) + ColorReset))
+	case err != nil:
+		log.Printf("Failed to queue mail for %s: %v", targetName, err)
+		conn.Write([]byte(ColorRed + "Could not save your message, try again later.\n" + ColorReset))
+	default:
+		h.recordDirectMessage(sender, targetName, message)
+		conn.Write([]byte(ColorMagenta + fmt.Sprintf("✉ %s is offline. Your message will be delivered when they log in.\n",
+			targetName) + ColorReset))
+	}
+}
+
+// DeliverMail shows a client the mail that arrived while they were away
+// and marks it read, once they are logged in
+func (h *CommandHandler) DeliverMail(client *models.Client) {
+	if !h.isVerified(client) {
+		return
+	}
+	mails, err := h.Mailbox.List(client.Username)
+	if err != nil {
+		log.Printf("Failed to load mailbox of %s: %v", client.Username, err)
+		return
+	}
+
+	var unread []models.Mail
+	for _, m := range mails {
+		if !m.Read {
+			unread = append(unread, m)
+		}
+	}
+	if len(unread) == 0 {
+		return
+	}
+
+	noun := "messages"
+	if len(unread) == 1 {
+		noun = "message"
+	}
+	out := ColorMagenta + fmt.Sprintf("\n✉ %d unread %s while you were away:\n", len(unread), noun) + ColorReset
+	for _, m := range unread {
+		out += formatMail(m)
+	}
+	out += ColorCyan + "Use /inbox to list or delete your messages.\n\n" + ColorReset
+	h.ClientManager.Send(client, out)
+
+	if err := h.Mailbox.MarkRead(client.Username, unread...); err != nil {
+		log.Printf("Failed to mark mail read for %s: %v", client.Username, err)
+	}
+}
+
+func (h *CommandHandler) handleInbox(conn net.Conn, client *models.Client, cmd string) {
+	if !h.isVerified(client) {
+		conn.Write([]byte(ColorRed + "Mail is only kept for registered users. Use /register or /login to get yours.\n" + ColorReset))
+		return
+	}
+	args := strings.Fields(strings.TrimPrefix(cmd, "/inbox"))
+	switch {
+	case len(args) == 0:
+		h.listInbox(conn, client)
+	case len(args) == 2 && args[0] == "read":
+		h.readMail(conn, client, args[1])
+	case len(args) == 2 && args[0] == "delete" && args[1] == "all":
+		n, err := h.Mailbox.DeleteAll(client.Username)
+		if err != nil {
+			log.Printf("Failed to empty mailbox of %s: %v", client.Username, err)
+			conn.Write([]byte(ColorRed + "Could not empty your inbox.\n" + ColorReset))
+			return
+		}
+		conn.Write([]byte(ColorGreen + fmt.Sprintf("Deleted %d messages.\n", n) + ColorReset))
+	case len(args) == 2 && args[0] == "delete":
+		id, ok := parseMailID(args[1])
+		if !ok {
+			conn.Write([]byte(ColorRed + "Usage: /inbox delete <id|all>\n" + ColorReset))
+			return
+		}
+		found, err := h.Mailbox.Delete(client.Username, id)
+		switch {
+		case err != nil:
+			log.Printf("Failed to delete mail %d of %s: %v", id, client.Username, err)
+			conn.Write([]byte(ColorRed + "Could not delete that message.\n" + ColorReset))
+		case !found:
+			conn.Write([]byte(ColorRed + fmt.Sprintf("No message #%d in your inbox.\n", id) + ColorReset))
+		default:
+			conn.Write([]byte(ColorGreen + fmt.Sprintf("Deleted message #%d.\n", id) + ColorReset))
+		}
+	default:
+		conn.Write([]byte(ColorRed + "Usage: /inbox [read <id>|delete <id|all>]\n" + ColorReset))
+	}
+}
+
+func (h *CommandHandler) listInbox(conn net.Conn, client *models.Client) {
+	mails, err := h.Mailbox.List(client.Username)
+	if err != nil {
+		log.Printf("Failed to load mailbox of %s: %v", client.Username, err)
+		conn.Write([]byte(ColorRed + "Could not load your inbox.\n" + ColorReset))
+		return
+	}
+	if len(mails) == 0 {
+		conn.Write([]byte(ColorCyan + "Your inbox is empty.\n" + ColorReset))
+		return
+	}
+
+	unread := 0
+	for _, m := range mails {
+		if !m.Read {
+			unread++
+		}
+	}
+	msg := ColorCyan + fmt.Sprintf("\n=== Inbox (%d/%d, %d unread) ===\n", len(mails), h.Mailbox.Quota(), unread) + ColorReset
+	for _, m := range mails {
+		marker := " "
+		if !m.Read {
+			marker = ColorGreen + "●" + ColorReset
+		}
+		msg += fmt.Sprintf("  %s #%d %s%s%s [%s] %s\n", marker, m.ID, ColorCyan, m.From, ColorReset,
+			utils.FormatTimestamp(m.Sent), truncate(m.Text, 50))
+	}
+	msg += "Use /inbox read <id> or /inbox delete <id|all>.\n\n"
+	conn.Write([]byte(msg))
+}
+
+func (h *CommandHandler) readMail(conn net.Conn, client *models.Client, arg string) {
+	id, ok := parseMailID(arg)
+	if !ok {
+		conn.Write([]byte(ColorRed + "Usage: /inbox read <id>\n" + ColorReset))
+		return
+	}
+	mails, err := h.Mailbox.List(client.Username)
+	if err != nil {
+		log.Printf("Failed to load mailbox of %s: %v", client.Username, err)
+		conn.Write([]byte(ColorRed + "Could not load your inbox.\n" + ColorReset))
+		return
+	}
+	for _, m := range mails {
+		if m.ID == id {
+			conn.Write([]byte(formatMail(m)))
+			if err := h.Mailbox.MarkRead(client.Username, m); err != nil {
+				log.Printf("Failed to mark mail read for %s: %v", client.Username, err)
+			}
+			return
+		}
+	}
+	conn.Write([]byte(ColorRed + fmt.Sprintf("No message #%d in your inbox.\n", id) + ColorReset))
+}
+
+// parseMailID accepts an inbox ID with or without its leading '#'
+func parseMailID(s string) (uint64, bool) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 10, 64)
+	return id, err == nil
+}
+
+func formatMail(m models.Mail) string {
+	return ColorMagenta + fmt.Sprintf("[DM #%d] ", m.ID) + ColorReset +
+		utils.FormatMessageAt(0, m.FromProfile, m.From, m.Text, ColorYellow, ColorWhite, ColorCyan, ColorReset, m.Sent)
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/storage"
+)
+
+// DefaultMailboxQuota is how many messages a mailbox holds, unless configured otherwise
+const DefaultMailboxQuota = 50
+
+// MailRecipientWindow is how recently an unregistered name must have been
+// connected for a /msg to it to be told mail isn't kept, rather than that
+// the user doesn't exist
+const MailRecipientWindow = 30 * 24 * time.Hour
+
+// ErrMailboxFull is returned by Send when a mailbox is full of unread mail
+var ErrMailboxFull = fmt.Errorf("mailbox is full")
+
+// MailboxManager keeps direct messages for users who are offline
+type MailboxManager struct {
+	store storage.Store
+	quota atomic.Int64
+	mu    sync.Mutex // serializes the quota check with the append
+}
+
+// NewMailboxManager creates a mailbox manager backed by store
+func NewMailboxManager(store storage.Store) *MailboxManager {
+	mb := &MailboxManager{store: store}
+	mb.SetQuota(DefaultMailboxQuota)
+	return mb
+}
+
+// SetQuota changes how many messages each mailbox holds
+func (mb *MailboxManager) SetQuota(n int) {
+	mb.quota.Store(int64(n))
+}
+
+// Quota returns how many messages each mailbox holds
+func (mb *MailboxManager) Quota() int {
+	return int(mb.quota.Load())
+}
+
+// Send puts a message in the recipient's mailbox. A full mailbox makes
+// room by dropping its oldest read message; if everything in it is still
+// unread, Send fails with ErrMailboxFull.
+func (mb *MailboxManager) Send(from *models.Client, to, text string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mails, err := mb.store.LoadMail(to)
+	if err != nil {
+		return fmt.Errorf("load mailbox: %w", err)
+	}
+	for excess := len(mails) - mb.Quota() + 1; excess > 0; excess-- {
+		oldest := -1
+		for i, m := range mails {
+			if m.Read {
+				oldest = i
+				break
+			}
+		}
+		if oldest == -1 {
+			return ErrMailboxFull
+		}
+		if err := mb.store.DeleteMail(to, mails[oldest].ID); err != nil {
+			return fmt.Errorf("make room in mailbox: %w", err)
+		}
+		mails = append(mails[:oldest:oldest], mails[oldest+1:]...)
+	}
+
+	_, err = mb.store.AppendMail(to, models.Mail{
+		From:        from.Username,
+		FromProfile: from.UserProfile,
+		Text:        text,
+		Sent:        time.Now(),
+	})
+	return err
+}
+
+// List returns a user's mailbox, oldest first
+func (mb *MailboxManager) List(username string) ([]models.Mail, error) {
+	return mb.store.LoadMail(username)
+}
+
+// MarkRead flags mails as read
+func (mb *MailboxManager) MarkRead(username string, mails ...models.Mail) error {
+	for _, m := range mails {
+		if m.Read {
+			continue
+		}
+		m.Read = true
+		if err := mb.store.SaveMail(username, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes one mail and reports whether it existed
+func (mb *MailboxManager) Delete(username string, id uint64) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mails, err := mb.store.LoadMail(username)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range mails {
+		if m.ID == id {
+			return true, mb.store.DeleteMail(username, id)
+		}
+	}
+	return false, nil
+}
+
+// DeleteAll empties a mailbox and returns how many mails it held
+func (mb *MailboxManager) DeleteAll(username string) (int, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mails, err := mb.store.LoadMail(username)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range mails {
+		if err := mb.store.DeleteMail(username, m.ID); err != nil {
+			return 0, err
+		}
+	}
+	return len(mails), nil
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+
+	"chat-server/server/models"
+)
+
+func TestOfflineMailDeliveredOnReturn(t *testing.T) {
+	h := newTestHandler(t)
+	logIn(t, h, "bob")
+	addPipeClient(t, h.ClientManager, "bob", true)
+	bobConn := h.ClientManager.GetClientByUsername("bob").Conn
+	h.ClientManager.RemoveClient(bobConn)
+
+	out := record(addPipeClient(t, h.ClientManager, "alice", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+
+	h.HandleCommand(alice.Conn, "/msg nobody hello?", alice)
+	out.waitFor(t, "User not found.")
+
+	h.HandleCommand(alice.Conn, "/msg bob first", alice)
+	out.waitFor(t, "bob is offline")
+	h.HandleCommand(alice.Conn, "/msg bob second", alice)
+
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	bob := h.ClientManager.GetClientByUsername("bob")
+	bob.Authenticated = true
+	h.DeliverMail(bob)
+	bobOut.waitFor(t, "2 unread messages while you were away")
+	bobOut.waitFor(t, "[DM #1] ")
+	bobOut.waitFor(t, "first")
+	bobOut.waitFor(t, "[DM #2] ")
+
+	h.HandleCommand(bob.Conn, "/inbox", bob)
+	bobOut.waitFor(t, "Inbox (2/50, 0 unread)")
+	h.HandleCommand(bob.Conn, "/inbox delete #1", bob)
+	bobOut.waitFor(t, "Deleted message #1.")
+	h.HandleCommand(bob.Conn, "/inbox read 1", bob)
+	bobOut.waitFor(t, "No message #1 in your inbox.")
+	h.HandleCommand(bob.Conn, "/inbox delete all", bob)
+	bobOut.waitFor(t, "Deleted 1 messages.")
+}
+
+func TestRegisteredMailWaitsForLogin(t *testing.T) {
+	h := newTestHandler(t)
+	h.Accounts.Register("carol", "secret-pass")
+	h.Mailbox.Send(&models.Client{Username: "alice"}, "carol", "private")
+
+	out := record(addPipeClient(t, h.ClientManager, "carol", false))
+	carol := h.ClientManager.GetClientByUsername("carol")
+	h.DeliverMail(carol)
+	h.HandleCommand(carol.Conn, "/inbox", carol)
+	out.waitFor(t, "to use /inbox")
+
+	h.HandleCommand(carol.Conn, "/login carol secret-pass", carol)
+	out.waitFor(t, "1 unread message while you were away")
+	out.waitFor(t, "private")
+}
+
+func TestMessageToUnverifiedHolderBecomesMail(t *testing.T) {
+	h := newTestHandler(t)
+	h.Accounts.Register("carol", "secret-pass")
+	impostorOut := record(addPipeClient(t, h.ClientManager, "carol", false))
+	out := record(addPipeClient(t, h.ClientManager, "alice", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+
+	h.HandleCommand(alice.Conn, "/msg carol the vault code is 0451", alice)
+	out.waitFor(t, "carol is offline. Your message will be delivered when they log in.")
+	impostorOut.mu.Lock()
+	leaked := impostorOut.buf.Len() > 0
+	impostorOut.mu.Unlock()
+	if leaked {
+		t.Error("a /msg reached someone holding a registered name without logging in")
+	}
+	if mails, _ := h.Mailbox.List("carol"); len(mails) != 1 {
+		t.Errorf("mailbox of carol = %+v; want the message kept for the owner", mails)
+	}
+}
+
+func TestMailNotKeptForUnregisteredNames(t *testing.T) {
+	h := newTestHandler(t)
+	addPipeClient(t, h.ClientManager, "bob", true)
+	h.ClientManager.RemoveClient(h.ClientManager.GetClientByUsername("bob").Conn)
+
+	out := record(addPipeClient(t, h.ClientManager, "alice", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	h.HandleCommand(alice.Conn, "/msg bob the vault code is 0451", alice)
+	out.waitFor(t, "bob is offline. Messages are only kept for registered users.")
+	if mails, _ := h.Mailbox.List("bob"); len(mails) != 0 {
+		t.Errorf("mailbox of bob = %+v; want nothing queued for an unregistered name", mails)
+	}
+
+	// Mail left from before is not handed to the name's next holder
+	h.Mailbox.Send(alice, "bob", "old secret")
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	bob := h.ClientManager.GetClientByUsername("bob")
+	h.DeliverMail(bob)
+	h.HandleCommand(bob.Conn, "/inbox", bob)
+	bobOut.waitFor(t, "Mail is only kept for registered users.")
+	if mails, _ := h.Mailbox.List("bob"); len(mails) != 1 || mails[0].Read {
+		t.Errorf("mailbox of bob = %+v; want the old mail left unread", mails)
+	}
+}
+
+func TestMailboxQuota(t *testing.T) {
+	h := newTestHandler(t)
+	h.Mailbox.SetQuota(2)
+	alice := &models.Client{Username: "alice"}
+
+	h.Mailbox.Send(alice, "bob", "one")
+	h.Mailbox.Send(alice, "bob", "two")
+	if err := h.Mailbox.Send(alice, "bob", "three"); !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("Send to a mailbox full of unread mail = %v; want ErrMailboxFull", err)
+	}
+
+	mails, _ := h.Mailbox.List("bob")
+	h.Mailbox.MarkRead("bob", mails[0])
+	if err := h.Mailbox.Send(alice, "bob", "three"); err != nil {
+		t.Fatalf("Send after reading one: %v", err)
+	}
+	mails, _ = h.Mailbox.List("bob")
+	if len(mails) != 2 || mails[0].Text != "two" || mails[1].Text != "three" {
+		t.Errorf("mailbox = %+v; want the oldest read message dropped", mails)
+	}
+}
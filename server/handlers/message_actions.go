@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/utils"
+)
+
+// quoteWidth is how much of a replied-to message is quoted above the reply
+const quoteWidth = 60
+
+// formatLobbyMessage renders a stored lobby message with its ID. Replies
+// get a quoted line for their parent, which is nil if it could not be found,
+// and reactions are summarized on a line of their own.
+func formatLobbyMessage(msg models.LobbyMessage, parent *models.LobbyMessage, absolute bool) string {
+	text := msg.Text
+	switch {
+	case msg.Deleted:
+		text = ColorWhite + "[message deleted]" + ColorReset
+	case !msg.EditedAt.IsZero():
+		text += ColorWhite + " (edited)" + ColorReset
+	}
+	if msg.Thread != 0 {
+		text = ColorWhite + fmt.Sprintf("[thread #%d] ", msg.Thread) + ColorReset + text
+	}
+
+	out := ""
+	if msg.ReplyTo != 0 {
+		out = quoteParent(msg.ReplyTo, parent)
+	}
+	format := utils.FormatMessage
+	if absolute {
+		format = utils.FormatMessageAt
+	}
+	out += format(msg.ID, msg.UserProfile, msg.Username, text,
+		ColorYellow, ColorWhite, ColorCyan, ColorReset, msg.Timestamp)
+	if len(msg.Reactions) > 0 && !msg.Deleted {
+		out += "      " + ColorWhite + formatReactions(msg.Reactions) + ColorReset + "\n"
+	}
+	return out
+}
+
+func quoteParent(id uint64, parent *models.LobbyMessage) string {
+	snippet := "[message unavailable]"
+	switch {
+	case parent == nil:
+	case parent.Deleted:
+		snippet = "[message deleted]"
+	default:
+		snippet = parent.Username + ": " + truncate(parent.Text, quoteWidth)
+	}
+	return fmt.Sprintf("  %s┌ #%d %s%s\n", ColorWhite, id, snippet, ColorReset)
+}
+
+// ownsName reports whether a client really is the user its name says,
+// rather than someone holding a registered name without logging in
+func (h *CommandHandler) ownsName(client *models.Client) bool {
+	username, authenticated := h.ClientManager.Identity(client)
+	return authenticated || !h.Accounts.IsRegistered(username)
+}
+
+// parseMessageRef splits "<id> <text>" as used by /edit and /reply
+func parseMessageRef(args string) (uint64, string, bool) {
+	idText, text, _ := strings.Cut(strings.TrimSpace(args), " ")
+	id, err := strconv.ParseUint(strings.TrimPrefix(idText, "#"), 10, 64)
+	return id, strings.TrimSpace(text), err == nil && id > 0
+}
+
+// lookupMessage loads a live message of the client's lobby, telling the
+// client if there is none
+func (h *CommandHandler) lookupMessage(conn net.Conn, client *models.Client, id uint64) (models.LobbyMessage, bool) {
+	msg, ok := h.LobbyManager.Message(client.CurrentLobby, id)
+	if !ok || msg.Deleted {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("No message #%d in '%s'.\n", id, client.CurrentLobby) + ColorReset))
+		return msg, false
+	}
+	return msg, true
+}
+
+func (h *CommandHandler) handleEdit(conn net.Conn, client *models.Client, cmd string) {
+	id, text, ok := parseMessageRef(strings.TrimPrefix(cmd, "/edit "))
+	if !ok || text == "" {
+		conn.Write([]byte(ColorRed + "Usage: /edit <id> <new text>\n" + ColorReset))
+		return
+	}
+	msg, ok := h.lookupMessage(conn, client, id)
+	if !ok {
+		return
+	}
+	if msg.Username != client.Username || !h.ownsName(client) {
+		conn.Write([]byte(ColorRed + "You can only edit your own messages.\n" + ColorReset))
+		return
+	}
+	if h.CheckMuted(conn, client) {
+		return
+	}
+
+	_, err := h.LobbyManager.ModifyMessage(client.CurrentLobby, id, func(msg *models.LobbyMessage) error {
+		msg.Text = text
+		msg.EditedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to edit message %d in %s: %v", id, client.CurrentLobby, err)
+		conn.Write([]byte(ColorRed + "Could not edit that message.\n" + ColorReset))
+		return
+	}
+	notice := fmt.Sprintf("%s✎ %s edited #%d:%s %s", ColorYellow, client.Username, id, ColorReset, text)
+	if msg.Thread != 0 {
+		h.sendToThread(client.CurrentLobby, msg.Thread, client.Username, notice+"\n")
+		return
+	}
+	h.ClientManager.BroadcastToLobby(client.CurrentLobby, notice)
+}
+
+func (h *CommandHandler) handleDelete(conn net.Conn, client *models.Client, cmd string) {
+	id, _, ok := parseMessageRef(strings.TrimPrefix(cmd, "/delete "))
+	if !ok {
+		conn.Write([]byte(ColorRed + "Usage: /delete <id>\n" + ColorReset))
+		return
+	}
+	msg, ok := h.lookupMessage(conn, client, id)
+	if !ok || h.checkArchived(conn, client) {
+		return
+	}
+	author := msg.Username == client.Username && h.ownsName(client)
+	if !author && !h.HasPermission(client, client.CurrentLobby, PermModerate) {
+		conn.Write([]byte(ColorRed + "You can only delete your own messages.\n" + ColorReset))
+		return
+	}
+
+	_, err := h.LobbyManager.ModifyMessage(client.CurrentLobby, id, func(msg *models.LobbyMessage) error {
+		msg.Deleted = true
+		msg.Text = ""
+		msg.Reactions = nil
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to delete message %d in %s: %v", id, client.CurrentLobby, err)
+		conn.Write([]byte(ColorRed + "Could not delete that message.\n" + ColorReset))
+		return
+	}
+	notice := fmt.Sprintf("%s🗑 Message #%d by %s was deleted", ColorYellow, id, msg.Username)
+	if !author {
+		notice += " by " + client.Username
+	}
+	h.ClientManager.BroadcastToLobby(client.CurrentLobby, notice+ColorReset)
+}
+
+func (h *CommandHandler) handleReply(conn net.Conn, client *models.Client, cmd string) {
+	id, text, ok := parseMessageRef(strings.TrimPrefix(cmd, "/reply "))
+	if !ok || text == "" {
+		conn.Write([]byte(ColorRed + "Usage: /reply <id> <text>\n" + ColorReset))
+		return
+	}
+	parent, ok := h.lookupMessage(conn, client, id)
+	if !ok {
+		return
+	}
+	if h.CheckMuted(conn, client) {
+		return
+	}
+
+	// Quoting a thread reply in the lobby would leak it, so the reply
+	// goes into that thread instead
+	if parent.Thread != 0 {
+		root, ok := h.lookupMessage(conn, client, parent.Thread)
+		if !ok {
+			return
+		}
+		h.postThreadReply(client, root, text)
+		return
+	}
+
+	lobby := client.CurrentLobby
+	msg := h.LobbyManager.StoreReply(lobby, client.UserProfile, client.Username, text, parent.ID)
+	rendered := formatLobbyMessage(msg, &parent, false)
+	h.ClientManager.BroadcastMessage(&models.Message{
+		ID:        msg.ID,
+		From:      client,
+		Lobby:     lobby,
+		Text:      text,
+		Timestamp: msg.Timestamp,
+	}, func(_, _, _, _, _, _, _ string) string { return rendered })
+	h.ClientManager.notify(models.Event{
+		Type:      models.EventMessage,
+		Lobby:     lobby,
+		From:      client.Username,
+		ID:        msg.ID,
+		Text:      text,
+		Timestamp: msg.Timestamp,
+	})
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"testing"
+
+	"chat-server/server/models"
+	"chat-server/server/search"
+)
+
+func TestEditDeleteAndReply(t *testing.T) {
+	h := newTestHandler(t)
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	bob := h.ClientManager.GetClientByUsername("bob")
+
+	first := h.LobbyManager.StoreMessage("general", "", "alice", "the build is broken")
+	second := h.LobbyManager.StoreMessage("general", "", "alice", "typo mesage")
+	if first.ID != 1 || second.ID != 2 {
+		t.Fatalf("StoreMessage IDs = %d, %d; want 1, 2", first.ID, second.ID)
+	}
+
+	h.HandleCommand(bob.Conn, "/reply 1 fixed it", bob)
+	aliceOut.waitFor(t, "┌ #1 alice: the build is broken")
+	aliceOut.waitFor(t, "#3\033[0m ")
+	aliceOut.waitFor(t, "fixed it")
+
+	h.HandleCommand(bob.Conn, "/edit 2 hijacked", bob)
+	bobOut.waitFor(t, "You can only edit your own messages.")
+	h.HandleCommand(alice.Conn, "/edit 2 typo message", alice)
+	bobOut.waitFor(t, "✎ alice edited #2:")
+
+	h.HandleCommand(bob.Conn, "/delete 1", bob)
+	bobOut.waitFor(t, "You can only delete your own messages.")
+	h.LobbyManager.SetRole("general", "bob", models.RoleOperator)
+	logIn(t, h, "bob")
+	h.HandleCommand(bob.Conn, "/delete 1", bob)
+	aliceOut.waitFor(t, "Message #1 by alice was deleted by bob")
+	h.HandleCommand(alice.Conn, "/reply 1 too late", alice)
+	aliceOut.waitFor(t, "No message #1 in 'general'.")
+
+	h.HandleCommand(alice.Conn, "/history", alice)
+	aliceOut.waitFor(t, "┌ #1 [message deleted]")
+	aliceOut.waitFor(t, "typo message\033[37m (edited)")
+
+	if results, _, _ := h.LobbyManager.Search(search.Query{Terms: []string{"broken"}}); len(results) != 0 {
+		t.Errorf("deleted message still found by search: %+v", results)
+	}
+	if results, _, _ := h.LobbyManager.Search(search.Query{Terms: []string{"message"}}); len(results) != 1 {
+		t.Errorf("edited text not found by search: %+v", results)
+	}
+}
@@ -2,10 +2,13 @@ package handlers
 
 import (
 	"fmt"
+	"log"
 	"net"
+	"strconv"
 	"strings"
 
 	"chat-server/server/models"
+	"chat-server/server/utils"
 )
 
 func (h *CommandHandler) handlePrivateMessage(conn net.Conn, sender *models.Client, cmd string) {
@@ -20,21 +23,114 @@ func (h *CommandHandler) handlePrivateMessage(conn net.Conn, sender *models.Clie
 	targetName := parts[0]
 	message := parts[1]
 
+	// Someone holding a registered name without logging in, during the
+	// login grace period, is not its owner: the owner gets it as mail
 	target := h.ClientManager.GetClientByUsername(targetName)
-	if target == nil {
-		conn.Write([]byte(ColorRed + "User not found.\n" + ColorReset))
+	if target == nil || (h.Accounts.IsRegistered(targetName) && !h.isVerified(target)) {
+		h.sendMail(conn, sender, targetName, message)
 		return
 	}
 
 	targetMsg := fmt.Sprintf("%s[DM]%s %s%s%s %s—»%s You\n  %s╰─>%s %s\n",
 		ColorMagenta, ColorReset, ColorCyan, sender.Username, ColorReset,
 		ColorMagenta, ColorReset, ColorCyan, ColorReset, message)
-	target.Conn.Write([]byte(targetMsg))
+	ev := models.Event{Type: models.EventDM, From: sender.Username, To: targetName, Text: message}
+	h.ClientManager.SendEvent(target, ev, targetMsg)
 
 	senderMsg := fmt.Sprintf("%s[DM]%s You %s—»%s %s%s%s\n  %s╰─>%s %s\n",
 		ColorMagenta, ColorReset, ColorMagenta, ColorReset,
 		ColorCyan, targetName, ColorReset, ColorCyan, ColorReset, message)
-	sender.Conn.Write([]byte(senderMsg))
+	h.ClientManager.SendEvent(sender, ev, senderMsg)
+	h.recordDirectMessage(sender, targetName, message)
+}
+
+// recordDirectMessage adds a delivered or queued /msg to the conversation
+// history. Only conversations between registered accounts are kept:
+// anyone can connect under an unregistered name, and would otherwise read
+// what its previous holder said and was sent.
+func (h *CommandHandler) recordDirectMessage(sender *models.Client, targetName, message string) {
+	if !h.isVerified(sender) || !h.Accounts.IsRegistered(targetName) {
+		return
+	}
+	if err := h.DMs.Record(sender, targetName, message); err != nil {
+		log.Printf("Failed to record direct message from %s to %s: %v", sender.Username, targetName, err)
+	}
+}
+
+// refuseDirectHistory tells a client that isn't logged in to a registered
+// account that it has no conversation history
+func (h *CommandHandler) refuseDirectHistory(conn net.Conn, client *models.Client) bool {
+	if h.isVerified(client) {
+		return false
+	}
+	conn.Write([]byte(ColorRed + "Private conversations are only kept for registered users. Use /register or /login to keep yours.\n" + ColorReset))
+	return true
+}
+
+func (h *CommandHandler) showDirectConversations(conn net.Conn, client *models.Client) {
+	if h.refuseDirectHistory(conn, client) {
+		return
+	}
+	convs, err := h.DMs.Conversations(client.Username)
+	if err != nil {
+		log.Printf("Failed to load conversations of %s: %v", client.Username, err)
+		conn.Write([]byte(ColorRed + "Could not load your conversations.\n" + ColorReset))
+		return
+	}
+	if len(convs) == 0 {
+		conn.Write([]byte(ColorCyan + "No private conversations yet. Start one with /msg <user> <message>.\n" + ColorReset))
+		return
+	}
+
+	msg := ColorCyan + fmt.Sprintf("\n=== Private conversations (%d) ===\n", len(convs)) + ColorReset
+	for _, conv := range convs {
+		unread := ""
+		if n := conv.Unread(); n > 0 {
+			unread = fmt.Sprintf(" %s(%d unread)%s", ColorGreen, n, ColorReset)
+		}
+		msg += fmt.Sprintf("  %s%s%s%s [%s] %s: %s\n", ColorCyan, conv.Peer, ColorReset, unread,
+			utils.FormatTimestamp(conv.LastAt), conv.LastFrom, truncate(conv.LastText, 40))
+	}
+	msg += "Use /dm <user> to read a conversation.\n\n"
+	conn.Write([]byte(msg))
+}
+
+func (h *CommandHandler) handleDirectHistory(conn net.Conn, client *models.Client, cmd string) {
+	args := strings.Fields(strings.TrimPrefix(cmd, "/dm "))
+	n := defaultHistoryLines
+	if len(args) == 2 {
+		parsed, err := strconv.Atoi(args[1])
+		if err == nil && parsed > 0 {
+			n = min(parsed, maxHistoryLines)
+			args = args[:1]
+		}
+	}
+	if len(args) != 1 {
+		conn.Write([]byte(ColorRed + "Usage: /dm <user> [n]\n" + ColorReset))
+		return
+	}
+	peer := args[0]
+	if h.refuseDirectHistory(conn, client) {
+		return
+	}
+
+	msgs, err := h.DMs.History(client.Username, peer, n)
+	if err != nil {
+		log.Printf("Failed to load conversation of %s with %s: %v", client.Username, peer, err)
+		conn.Write([]byte(ColorRed + "Could not load that conversation.\n" + ColorReset))
+		return
+	}
+	if len(msgs) == 0 {
+		conn.Write([]byte(ColorCyan + fmt.Sprintf("No messages with %s yet.\n", peer) + ColorReset))
+		return
+	}
+
+	out := ColorCyan + fmt.Sprintf("\n=== Last %d messages with %s ===\n", len(msgs), peer) + ColorReset
+	for _, m := range msgs {
+		out += ColorMagenta + "[DM] " + ColorReset +
+			utils.FormatMessageAt(0, m.FromProfile, m.From, m.Text, ColorYellow, ColorWhite, ColorCyan, ColorReset, m.Timestamp)
+	}
+	conn.Write([]byte(out + "\n"))
 }
 
 func (h *CommandHandler) handleTagCommand(conn net.Conn, sender *models.Client, cmd string) {
@@ -55,18 +151,29 @@ func (h *CommandHandler) handleTagCommand(conn net.Conn, sender *models.Client,
 		return
 	}
 
+	if h.CheckMuted(conn, sender) {
+		return
+	}
+
 	fullMessage := fmt.Sprintf("@%s: %s", targetName, message)
-	h.LobbyManager.StoreMessage(sender.CurrentLobby, sender.UserProfile, sender.Username, fullMessage)
+	stored := h.LobbyManager.StoreMessage(sender.CurrentLobby, sender.UserProfile, sender.Username, fullMessage)
 
-	taggedMsg := fmt.Sprintf("%s%s %s%s @%s%s%s\n  %s╰─>%s %s\n",
-		ColorYellow, sender.UserProfile, ColorCyan, sender.Username,
+	taggedMsg := fmt.Sprintf("%s#%d%s %s%s %s%s @%s%s%s\n  %s╰─>%s %s\n",
+		ColorWhite, stored.ID, ColorReset, ColorYellow, sender.UserProfile, ColorCyan, sender.Username,
 		ColorMagenta, targetName, ColorReset, ColorCyan, ColorReset, message)
 
-	h.ClientManager.BroadcastToLobby(sender.CurrentLobby, taggedMsg)
+	h.ClientManager.BroadcastEvent(models.Event{
+		Type:      models.EventMessage,
+		Lobby:     sender.CurrentLobby,
+		From:      sender.Username,
+		ID:        stored.ID,
+		Text:      fullMessage,
+		Timestamp: stored.Timestamp,
+	}, taggedMsg)
 
 	if target.Conn != nil && target.Username != sender.Username {
 		notification := fmt.Sprintf("%s✦ %s tagged you%s\n",
 			ColorMagenta, sender.Username, ColorReset)
-		target.Conn.Write([]byte(notification))
+		h.ClientManager.Send(target, notification)
 	}
 }
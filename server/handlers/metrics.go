@@ -0,0 +1,52 @@
+package handlers
+
+import "chat-server/server/metrics"
+
+// Metrics exported by the client and lobby managers
+var (
+	connectedUsers = metrics.NewGaugeFunc("chat_connected_users",
+		"Users currently connected, by lobby.", "lobby")
+	connectionsTotal = metrics.NewCounter("chat_connections_total",
+		"Clients that completed username selection.")
+	disconnectsTotal = metrics.NewCounter("chat_disconnects_total",
+		"Clients removed from the server for any reason.")
+	droppedConnections = metrics.NewCounterVec("chat_dropped_connections_total",
+		"Connections closed by the server, by reason.", "reason")
+	droppedMessages = metrics.NewCounterVec("chat_outbox_dropped_messages_total",
+		"Messages discarded because a client's outbox was full, by policy.", "policy")
+	broadcastDuration = metrics.NewHistogram("chat_broadcast_duration_seconds",
+		"Time taken to queue a broadcast for every member of a lobby.", metrics.DefaultBuckets)
+
+	lobbyCount = metrics.NewGaugeFunc("chat_lobbies",
+		"Lobbies that exist, by visibility.", "visibility")
+	lobbyMessages = metrics.NewCounterVec("chat_messages_total",
+		"Chat messages sent, by lobby.", "lobby")
+	lobbyJoins = metrics.NewCounterVec("chat_lobby_joins_total",
+		"Lobby join attempts, by result.", "result")
+)
+
+// usersPerLobby counts connected clients in each lobby
+func (cm *ClientManager) usersPerLobby() map[string]float64 {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	counts := make(map[string]float64)
+	for _, client := range cm.clients {
+		counts[client.CurrentLobby]++
+	}
+	return counts
+}
+
+// lobbiesByVisibility counts public and private lobbies
+func (lm *LobbyManager) lobbiesByVisibility() map[string]float64 {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	counts := map[string]float64{"public": 0, "private": 0}
+	for _, lobby := range lm.lobbies {
+		if lobby.IsPrivate {
+			counts["private"]++
+		} else {
+			counts["public"]++
+		}
+	}
+	return counts
+}
@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-server/server/models"
+)
+
+// DefaultMuteDuration is used when /mute is given no duration
+const DefaultMuteDuration = 10 * time.Minute
+
+func (h *CommandHandler) handleKick(conn net.Conn, client *models.Client, cmd string) {
+	parts := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(cmd, "/kick ")), " ", 2)
+	if parts[0] == "" {
+		conn.Write([]byte(ColorRed + "Usage: /kick <user> [reason]\n" + ColorReset))
+		return
+	}
+	reason := ""
+	if len(parts) == 2 {
+		reason = strings.TrimSpace(parts[1])
+	}
+
+	target := h.ClientManager.GetClientByUsername(parts[0])
+	if target == nil {
+		conn.Write([]byte(ColorRed + "User not found.\n" + ColorReset))
+		return
+	}
+	if target == client {
+		conn.Write([]byte(ColorRed + "You can't kick yourself.\n" + ColorReset))
+		return
+	}
+
+	targetLobby := h.ClientManager.CurrentLobby(target)
+	scope, ok := h.moderationScope(client, targetLobby)
+	if !ok || !h.outranks(client, target, targetLobby) {
+		conn.Write([]byte(ColorRed + "You don't have permission to kick that user.\n" + ColorReset))
+		return
+	}
+
+	if scope == "" {
+		h.ClientManager.Send(target, ColorRed+fmt.Sprintf("You were kicked from the server by %s%s\n",
+			client.Username, formatReason(reason))+ColorReset)
+		h.ClientManager.BroadcastToLobby(targetLobby,
+			fmt.Sprintf("%s%s was kicked by %s%s%s", ColorRed, target.Username, client.Username, formatReason(reason), ColorReset))
+		time.AfterFunc(100*time.Millisecond, func() { target.Conn.Close() })
+	} else {
+		h.ClientManager.Send(target, ColorRed+fmt.Sprintf("You were kicked from '%s' by %s%s\n",
+			scope, client.Username, formatReason(reason))+ColorReset)
+		h.ClientManager.BroadcastToLobby(scope,
+			fmt.Sprintf("%s%s was kicked by %s%s%s", ColorRed, target.Username, client.Username, formatReason(reason), ColorReset))
+		h.moveToLobby(target, "general")
+	}
+
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("Kicked %s.\n", target.Username) + ColorReset))
+}
+
+func (h *CommandHandler) handleBan(conn net.Conn, client *models.Client, cmd string) {
+	args := strings.Fields(strings.TrimPrefix(cmd, "/ban "))
+	if len(args) == 0 {
+		conn.Write([]byte(ColorRed + "Usage: /ban <user|ip> [duration] [reason]\n" + ColorReset))
+		return
+	}
+
+	target := args[0]
+	args = args[1:]
+	var duration time.Duration
+	if len(args) > 0 {
+		if d, ok := parseDuration(args[0]); ok {
+			duration = d
+			args = args[1:]
+		}
+	}
+	reason := strings.Join(args, " ")
+
+	scope, ok := h.moderationScope(client, client.CurrentLobby)
+	if !ok {
+		conn.Write([]byte(ColorRed + "Only lobby operators and server operators can ban.\n" + ColorReset))
+		return
+	}
+	if target == client.Username || target == client.IP {
+		conn.Write([]byte(ColorRed + "You can't ban yourself.\n" + ColorReset))
+		return
+	}
+	// An address can't be ranked: whoever connects from it later, the
+	// lobby's owner included, would be locked out of the lobby
+	if scope != "" && net.ParseIP(target) != nil {
+		conn.Write([]byte(ColorRed + "Only server operators can ban IP addresses; ban the user instead.\n" + ColorReset))
+		return
+	}
+	if scope != "" && !h.canBan(client, target, scope) {
+		conn.Write([]byte(ColorRed + "You can't ban a user with an equal or higher role.\n" + ColorReset))
+		return
+	}
+
+	ban := &models.Ban{
+		Target:  target,
+		IsIP:    net.ParseIP(target) != nil,
+		Lobby:   scope,
+		Reason:  reason,
+		By:      client.Username,
+		Created: time.Now(),
+	}
+	if duration > 0 {
+		ban.Expires = ban.Created.Add(duration)
+	}
+	if err := h.Moderation.Ban(ban); err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+
+	for _, c := range h.ClientManager.ClientsSnapshot() {
+		if (ban.IsIP && c.IP != target) || (!ban.IsIP && c.Username != target) {
+			continue
+		}
+		if scope == "" {
+			h.ClientManager.Send(c, ColorRed+"You have been banned from this server"+describeBan(ban)+"\n"+ColorReset)
+			h.ClientManager.BroadcastToLobby(h.ClientManager.CurrentLobby(c),
+				fmt.Sprintf("%s%s was banned by %s%s", ColorRed, c.Username, client.Username, ColorReset))
+			closeConn := c.Conn
+			time.AfterFunc(100*time.Millisecond, func() { closeConn.Close() })
+		} else if h.ClientManager.CurrentLobby(c) == scope {
+			h.ClientManager.Send(c, ColorRed+fmt.Sprintf("You have been banned from '%s'%s\n", scope, describeBan(ban))+ColorReset)
+			h.ClientManager.BroadcastToLobby(scope,
+				fmt.Sprintf("%s%s was banned by %s%s", ColorRed, c.Username, client.Username, ColorReset))
+			h.moveToLobby(c, "general")
+		}
+	}
+
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("Banned %s from %s%s\n", target, scopeName(scope), describeBan(ban)) + ColorReset))
+}
+
+func (h *CommandHandler) handleUnban(conn net.Conn, client *models.Client, cmd string) {
+	target := strings.TrimSpace(strings.TrimPrefix(cmd, "/unban "))
+	if target == "" {
+		conn.Write([]byte(ColorRed + "Usage: /unban <user|ip>\n" + ColorReset))
+		return
+	}
+
+	scope, ok := h.moderationScope(client, client.CurrentLobby)
+	if !ok {
+		conn.Write([]byte(ColorRed + "Only lobby operators and server operators can unban.\n" + ColorReset))
+		return
+	}
+
+	// Operators can lift server-wide bans and bans in the lobby they are in
+	lifted := h.Moderation.Unban(scope, target)
+	if !lifted && scope == "" {
+		scope = client.CurrentLobby
+		lifted = h.Moderation.Unban(scope, target)
+	}
+	if !lifted {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("%s is not banned.\n", target) + ColorReset))
+		return
+	}
+
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("Unbanned %s from %s.\n", target, scopeName(scope)) + ColorReset))
+}
+
+func (h *CommandHandler) handleMute(conn net.Conn, client *models.Client, cmd string) {
+	args := strings.Fields(strings.TrimPrefix(cmd, "/mute "))
+	if len(args) == 0 || len(args) > 2 {
+		conn.Write([]byte(ColorRed + "Usage: /mute <user> [duration]\n" + ColorReset))
+		return
+	}
+
+	duration := DefaultMuteDuration
+	if len(args) == 2 {
+		d, ok := parseDuration(args[1])
+		if !ok {
+			conn.Write([]byte(ColorRed + "Invalid duration. Examples: 30s, 10m, 2h, 1d\n" + ColorReset))
+			return
+		}
+		duration = d
+	}
+
+	target := h.ClientManager.GetClientByUsername(args[0])
+	if target == nil {
+		conn.Write([]byte(ColorRed + "User not found.\n" + ColorReset))
+		return
+	}
+
+	// Voiced users can only be muted by the owner or a server operator
+	targetLobby := h.ClientManager.CurrentLobby(target)
+	scope, ok := h.moderationScope(client, targetLobby)
+	actorRole, targetRole := h.RoleIn(client, targetLobby), h.RoleIn(target, targetLobby)
+	if !ok || actorRole <= targetRole || (targetRole >= models.RoleVoiced && actorRole < models.RoleOwner) {
+		conn.Write([]byte(ColorRed + "You don't have permission to mute that user.\n" + ColorReset))
+		return
+	}
+
+	h.Moderation.Mute(scope, target.Username, time.Now().Add(duration))
+	h.ClientManager.Send(target, ColorYellow+fmt.Sprintf("You have been muted in %s for %s by %s\n",
+		scopeName(scope), formatDuration(duration), client.Username)+ColorReset)
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("Muted %s in %s for %s.\n",
+		target.Username, scopeName(scope), formatDuration(duration)) + ColorReset))
+}
+
+func (h *CommandHandler) handleUnmute(conn net.Conn, client *models.Client, cmd string) {
+	targetName := strings.TrimSpace(strings.TrimPrefix(cmd, "/unmute "))
+	if targetName == "" {
+		conn.Write([]byte(ColorRed + "Usage: /unmute <user>\n" + ColorReset))
+		return
+	}
+
+	lobbyName := client.CurrentLobby
+	if target := h.ClientManager.GetClientByUsername(targetName); target != nil {
+		lobbyName = h.ClientManager.CurrentLobby(target)
+	}
+
+	scope, ok := h.moderationScope(client, lobbyName)
+	if !ok {
+		conn.Write([]byte(ColorRed + "You don't have permission to unmute that user.\n" + ColorReset))
+		return
+	}
+
+	lifted := h.Moderation.Unmute(scope, targetName)
+	if scope == "" {
+		lifted = h.Moderation.Unmute(lobbyName, targetName) || lifted
+	}
+	if !lifted {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("%s is not muted.\n", targetName) + ColorReset))
+		return
+	}
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("Unmuted %s.\n", targetName) + ColorReset))
+}
+
+func (h *CommandHandler) handleBanList(conn net.Conn, client *models.Client) {
+	lobbyName := client.CurrentLobby
+	title := fmt.Sprintf("Bans in '%s'", lobbyName)
+	if h.isOperator(client) {
+		lobbyName = "*"
+		title = "All bans"
+	}
+
+	bans := h.Moderation.ActiveBans(lobbyName)
+	msg := ColorCyan + fmt.Sprintf("\n=== %s (%d) ===\n", title, len(bans)) + ColorReset
+	for _, ban := range bans {
+		msg += fmt.Sprintf("  %s%s%s in %s by %s%s\n",
+			ColorWhite, ban.Target, ColorReset, scopeName(ban.Lobby), ban.By, describeBan(ban))
+	}
+	msg += "\n"
+	conn.Write([]byte(msg))
+}
+
+// CheckMuted tells a muted client how long they have left and reports
+// whether they are muted in their current lobby. Nobody can speak in an
+// archived lobby, so it also counts as muted.
+func (h *CommandHandler) CheckMuted(conn net.Conn, client *models.Client) bool {
+	if h.checkArchived(conn, client) {
+		return true
+	}
+	left := h.Moderation.MutedFor(client.CurrentLobby, client.Username)
+	if left <= 0 {
+		return false
+	}
+	conn.Write([]byte(ColorRed + fmt.Sprintf("⚠ You are muted for another %s.\n", formatDuration(left)) + ColorReset))
+	return true
+}
+
+// checkArchived tells a client when their current lobby is read-only and
+// reports whether it is
+func (h *CommandHandler) checkArchived(conn net.Conn, client *models.Client) bool {
+	if !h.LobbyManager.IsArchived(client.CurrentLobby) {
+		return false
+	}
+	conn.Write([]byte(ColorRed + fmt.Sprintf("'%s' is archived and read-only.\n", client.CurrentLobby) + ColorReset))
+	return true
+}
+
+// moderationScope returns the scope a client may moderate lobbyName in:
+// "" (server-wide) for server operators, the lobby itself for its operators
+func (h *CommandHandler) moderationScope(client *models.Client, lobbyName string) (string, bool) {
+	if h.isOperator(client) {
+		return "", true
+	}
+	if lobbyName == "general" || !h.HasPermission(client, lobbyName, PermModerate) {
+		return "", false
+	}
+	return lobbyName, true
+}
+
+// canBan reports whether a lobby operator outranks a ban target, who may
+// be offline and is then judged by their stored role alone
+func (h *CommandHandler) canBan(client *models.Client, target, lobbyName string) bool {
+	if online := h.ClientManager.GetClientByUsername(target); online != nil {
+		return h.outranks(client, online, lobbyName)
+	}
+	return h.LobbyManager.RoleOf(lobbyName, target) < h.RoleIn(client, lobbyName)
+}
+
+// parseDuration accepts Go durations plus a "d" suffix for days
+func parseDuration(s string) (time.Duration, bool) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, false
+		}
+		return time.Duration(days) * 24 * time.Hour, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// formatDuration renders a duration rounded to a readable unit
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	default:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+}
+
+// describeBan summarizes a ban's expiry and reason
+func describeBan(ban *models.Ban) string {
+	desc := " (permanent)"
+	if !ban.Expires.IsZero() {
+		desc = fmt.Sprintf(" (expires in %s)", formatDuration(time.Until(ban.Expires)))
+	}
+	return desc + formatReason(ban.Reason)
+}
+
+func formatReason(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ": " + reason
+}
+
+func scopeName(lobbyName string) string {
+	if lobbyName == "" {
+		return "the server"
+	}
+	return "'" + lobbyName + "'"
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/storage"
+)
+
+// ModerationManager tracks server operators, bans and mutes.
+// An empty lobby name means the ban or mute applies server-wide.
+type ModerationManager struct {
+	operators map[string]bool
+	bans      map[string]*models.Ban
+	mutes     map[string]time.Time
+	store     storage.Store
+	mu        sync.RWMutex
+}
+
+// NewModerationManager creates a new moderation manager backed by store
+func NewModerationManager(store storage.Store) *ModerationManager {
+	return &ModerationManager{
+		operators: make(map[string]bool),
+		bans:      make(map[string]*models.Ban),
+		mutes:     make(map[string]time.Time),
+		store:     store,
+	}
+}
+
+// LoadFromStore restores saved bans, discarding any that have expired
+func (mm *ModerationManager) LoadFromStore() error {
+	bans, err := mm.store.LoadBans()
+	if err != nil {
+		return fmt.Errorf("load bans: %w", err)
+	}
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	for _, ban := range bans {
+		if ban.Expired() {
+			mm.store.DeleteBan(ban.Lobby, ban.Target)
+			continue
+		}
+		mm.bans[moderationKey(ban.Lobby, ban.Target)] = ban
+	}
+	return nil
+}
+
+// SetOperators replaces the list of server operator usernames
+func (mm *ModerationManager) SetOperators(usernames []string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	mm.operators = make(map[string]bool, len(usernames))
+	for _, name := range usernames {
+		mm.operators[name] = true
+	}
+}
+
+// IsOperator reports whether a user holds server operator powers.
+// Operators must be logged in so that nobody can borrow the name.
+func (mm *ModerationManager) IsOperator(username string, authenticated bool) bool {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	return authenticated && mm.operators[username]
+}
+
+// Ban adds or replaces a ban
+func (mm *ModerationManager) Ban(ban *models.Ban) error {
+	if err := mm.store.SaveBan(ban); err != nil {
+		log.Printf("Failed to save ban on %s: %v", ban.Target, err)
+		return fmt.Errorf("failed to save ban")
+	}
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.bans[moderationKey(ban.Lobby, ban.Target)] = ban
+	return nil
+}
+
+// Unban lifts a ban, reporting whether one existed
+func (mm *ModerationManager) Unban(lobbyName, target string) bool {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	key := moderationKey(lobbyName, target)
+	if _, exists := mm.bans[key]; !exists {
+		return false
+	}
+	delete(mm.bans, key)
+	if err := mm.store.DeleteBan(lobbyName, target); err != nil {
+		log.Printf("Failed to delete ban on %s: %v", target, err)
+	}
+	return true
+}
+
+// FindBan returns the active ban keeping username or ip out of a lobby,
+// checking server-wide bans first. Pass an empty lobby name to check
+// server-wide bans only.
+func (mm *ModerationManager) FindBan(lobbyName, username, ip string) *models.Ban {
+	scopes := []string{""}
+	if lobbyName != "" {
+		scopes = append(scopes, lobbyName)
+	}
+
+	for _, scope := range scopes {
+		for _, target := range []string{username, ip} {
+			if target == "" {
+				continue
+			}
+			if ban := mm.activeBan(scope, target); ban != nil {
+				return ban
+			}
+		}
+	}
+	return nil
+}
+
+// ActiveBans lists unexpired bans, limited to one lobby unless lobbyName is "*"
+func (mm *ModerationManager) ActiveBans(lobbyName string) []*models.Ban {
+	mm.mu.RLock()
+	var bans []*models.Ban
+	for _, ban := range mm.bans {
+		if ban.Expired() || (lobbyName != "*" && ban.Lobby != lobbyName) {
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	mm.mu.RUnlock()
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Created.Before(bans[j].Created)
+	})
+	return bans
+}
+
+// Mute silences a user in a lobby (or server-wide) until the given time
+func (mm *ModerationManager) Mute(lobbyName, username string, until time.Time) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.mutes[moderationKey(lobbyName, username)] = until
+}
+
+// Unmute lifts a mute, reporting whether one existed
+func (mm *ModerationManager) Unmute(lobbyName, username string) bool {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	key := moderationKey(lobbyName, username)
+	_, exists := mm.mutes[key]
+	delete(mm.mutes, key)
+	return exists
+}
+
+// MutedFor returns how much longer a user is muted in a lobby, or zero
+func (mm *ModerationManager) MutedFor(lobbyName, username string) time.Duration {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	var longest time.Duration
+	for _, scope := range []string{"", lobbyName} {
+		key := moderationKey(scope, username)
+		until, exists := mm.mutes[key]
+		if !exists {
+			continue
+		}
+		left := time.Until(until)
+		if left <= 0 {
+			delete(mm.mutes, key)
+			continue
+		}
+		if left > longest {
+			longest = left
+		}
+	}
+	return longest
+}
+
+// RenameLobby moves the bans and mutes of a lobby to its new name
+func (mm *ModerationManager) RenameLobby(oldName, newName string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	for key, ban := range mm.bans {
+		if ban.Lobby != oldName {
+			continue
+		}
+		if err := mm.store.DeleteBan(oldName, ban.Target); err != nil {
+			log.Printf("Failed to delete ban on %s: %v", ban.Target, err)
+		}
+		moved := *ban
+		moved.Lobby = newName
+		if err := mm.store.SaveBan(&moved); err != nil {
+			log.Printf("Failed to save ban on %s: %v", ban.Target, err)
+		}
+		delete(mm.bans, key)
+		mm.bans[moderationKey(newName, ban.Target)] = &moved
+	}
+	for key, until := range mm.mutes {
+		if username, ok := strings.CutPrefix(key, moderationKey(oldName, "")); ok {
+			delete(mm.mutes, key)
+			mm.mutes[moderationKey(newName, username)] = until
+		}
+	}
+}
+
+// RemoveLobby drops the bans and mutes of a deleted lobby
+func (mm *ModerationManager) RemoveLobby(lobbyName string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	for key, ban := range mm.bans {
+		if ban.Lobby != lobbyName {
+			continue
+		}
+		delete(mm.bans, key)
+		if err := mm.store.DeleteBan(lobbyName, ban.Target); err != nil {
+			log.Printf("Failed to delete ban on %s: %v", ban.Target, err)
+		}
+	}
+	for key := range mm.mutes {
+		if strings.HasPrefix(key, moderationKey(lobbyName, "")) {
+			delete(mm.mutes, key)
+		}
+	}
+}
+
+// activeBan returns an unexpired ban, dropping it if it has expired
+func (mm *ModerationManager) activeBan(lobbyName, target string) *models.Ban {
+	key := moderationKey(lobbyName, target)
+
+	mm.mu.RLock()
+	ban, exists := mm.bans[key]
+	mm.mu.RUnlock()
+
+	if !exists {
+		return nil
+	}
+	if ban.Expired() {
+		mm.Unban(lobbyName, target)
+		return nil
+	}
+	return ban
+}
+
+func moderationKey(lobbyName, target string) string {
+	return lobbyName + "|" + target
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/storage"
+)
+
+func TestFindBanScopes(t *testing.T) {
+	mm := NewModerationManager(storage.NewMemoryStore())
+	mm.Ban(&models.Ban{Target: "mallory", Lobby: "coding"})
+	mm.Ban(&models.Ban{Target: "10.0.0.9", IsIP: true})
+
+	tests := []struct {
+		name            string
+		lobby, user, ip string
+		wantBanned      bool
+	}{
+		{"lobby ban applies in its lobby", "coding", "mallory", "1.1.1.1", true},
+		{"lobby ban ignored elsewhere", "gaming", "mallory", "1.1.1.1", false},
+		{"lobby ban ignored server-wide", "", "mallory", "1.1.1.1", false},
+		{"server IP ban applies everywhere", "gaming", "bob", "10.0.0.9", true},
+		{"server IP ban applies on connect", "", "", "10.0.0.9", true},
+		{"unrelated user", "coding", "bob", "1.1.1.1", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mm.FindBan(tc.lobby, tc.user, tc.ip) != nil
+			if got != tc.wantBanned {
+				t.Errorf("FindBan(%q, %q, %q) banned = %v; want %v", tc.lobby, tc.user, tc.ip, got, tc.wantBanned)
+			}
+		})
+	}
+}
+
+func TestBansExpireAndPersist(t *testing.T) {
+	store := storage.NewMemoryStore()
+	mm := NewModerationManager(store)
+	mm.Ban(&models.Ban{Target: "old", Expires: time.Now().Add(-time.Minute)})
+	mm.Ban(&models.Ban{Target: "current", Expires: time.Now().Add(time.Hour)})
+
+	if mm.FindBan("", "old", "") != nil {
+		t.Error("expired ban should not apply")
+	}
+	if bans := mm.ActiveBans("*"); len(bans) != 1 || bans[0].Target != "current" {
+		t.Errorf("ActiveBans = %v; want only 'current'", bans)
+	}
+
+	reloaded := NewModerationManager(store)
+	if err := reloaded.LoadFromStore(); err != nil {
+		t.Fatalf("LoadFromStore: %v", err)
+	}
+	if reloaded.FindBan("", "current", "") == nil {
+		t.Error("ban should survive a reload")
+	}
+	if !reloaded.Unban("", "current") || reloaded.FindBan("", "current", "") != nil {
+		t.Error("Unban should lift the ban")
+	}
+}
+
+func TestMutes(t *testing.T) {
+	mm := NewModerationManager(storage.NewMemoryStore())
+	mm.Mute("coding", "bob", time.Now().Add(time.Minute))
+
+	if mm.MutedFor("coding", "bob") <= 0 {
+		t.Error("bob should be muted in coding")
+	}
+	if mm.MutedFor("general", "bob") != 0 {
+		t.Error("lobby mute should not apply in other lobbies")
+	}
+
+	mm.Mute("", "bob", time.Now().Add(-time.Second))
+	if mm.MutedFor("general", "bob") != 0 {
+		t.Error("expired mute should not apply")
+	}
+	if !mm.Unmute("coding", "bob") || mm.MutedFor("coding", "bob") != 0 {
+		t.Error("Unmute should lift the mute")
+	}
+}
+
+func TestOperatorsMustBeAuthenticated(t *testing.T) {
+	mm := NewModerationManager(storage.NewMemoryStore())
+	mm.SetOperators([]string{"admin"})
+
+	if mm.IsOperator("admin", false) {
+		t.Error("unauthenticated client should not get operator powers")
+	}
+	if !mm.IsOperator("admin", true) {
+		t.Error("authenticated operator should be recognized")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"30s", 30 * time.Second, true},
+		{"10m", 10 * time.Minute, true},
+		{"2d", 48 * time.Hour, true},
+		{"spam", 0, false},
+		{"-5m", 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			got, ok := parseDuration(tc.input)
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("parseDuration(%q) = %v, %v; want %v, %v", tc.input, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestLobbyOperatorsCantBanIPs(t *testing.T) {
+	h := newTestHandler(t)
+	h.LobbyManager.CreateLobby("ops", "", "on-call", "alice", true, false)
+	h.LobbyManager.SetRole("ops", "bob", models.RoleOperator)
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	bob := h.ClientManager.GetClientByUsername("bob")
+	bob.CurrentLobby = "ops"
+	logIn(t, h, "alice", "bob")
+
+	h.HandleCommand(bob.Conn, "/ban 203.0.113.7 1h", bob)
+	bobOut.waitFor(t, "Only server operators can ban IP addresses")
+	h.HandleCommand(bob.Conn, "/ban alice", bob)
+	bobOut.waitFor(t, "You can't ban a user with an equal or higher role.")
+	if err := h.LobbyManager.JoinLobby("ops", "", "alice", "203.0.113.7", true); err != nil {
+		t.Errorf("the owner was locked out: %v", err)
+	}
+}
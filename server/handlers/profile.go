@@ -62,7 +62,7 @@ func (h *CommandHandler) handleSetProfile(conn net.Conn, client *models.Client,
 	content := strings.TrimSpace(strings.TrimPrefix(cmd, "/sp"))
 
 	if content == "" || content == "default" {
-		client.UserProfile = profilePics["default"]
+		h.ClientManager.SetProfile(client, profilePics["default"])
 		conn.Write([]byte(ColorGreen + "Profile picture reset to default.\n" + ColorReset))
 		return
 	}
@@ -78,7 +78,7 @@ func (h *CommandHandler) handleSetProfile(conn net.Conn, client *models.Client,
 		return
 	}
 
-	client.UserProfile = pic
+	h.ClientManager.SetProfile(client, pic)
 	conn.Write([]byte(ColorGreen + fmt.Sprintf("Profile picture changed to: %s\n", pic) + ColorReset))
 }
 
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"chat-server/server/models"
+)
+
+// maxReactionKinds caps how many different emoji one message can collect
+const maxReactionKinds = 20
+
+// reactionShortcodes maps the names accepted by /react to their emoji.
+// Names may also be given wrapped in colons, as in :thumbsup:.
+var reactionShortcodes = map[string]string{
+	"+1":               "👍",
+	"thumbsup":         "👍",
+	"-1":               "👎",
+	"thumbsdown":       "👎",
+	"heart":            "❤️",
+	"tada":             "🎉",
+	"joy":              "😂",
+	"smile":            "😄",
+	"eyes":             "👀",
+	"fire":             "🔥",
+	"rocket":           "🚀",
+	"white_check_mark": "✅",
+	"check":            "✅",
+	"x":                "❌",
+	"thinking":         "🤔",
+	"pray":             "🙏",
+	"100":              "💯",
+	"wave":             "👋",
+}
+
+var (
+	errAlreadyReacted   = errors.New("already reacted")
+	errTooManyReactions = errors.New("too many reactions")
+	errNotReacted       = errors.New("not reacted")
+)
+
+// zeroWidthJoiner glues emoji into one, as in 👩‍💻
+const zeroWidthJoiner = '\u200d'
+
+// maxEmojiRunes is the longest literal emoji accepted, enough for 🏳️‍🌈 or
+// 👩🏽‍💻 but not for a row of symbols
+const maxEmojiRunes = 5
+
+// resolveEmoji turns a shortcode or a literal emoji into the emoji to store
+func resolveEmoji(s string) (string, bool) {
+	if emoji, ok := reactionShortcodes[strings.ToLower(strings.Trim(s, ":"))]; ok {
+		return emoji, true
+	}
+	// A literal emoji is a short run of non-ASCII symbols; this keeps
+	// words and markup out of the reaction summaries. Control and format
+	// characters, such as C1 controls, bidi overrides and zero-width
+	// spaces, could hide or reorder text around the reaction, so the only
+	// one allowed is the zero-width joiner inside a sequence like 👩‍💻.
+	// Combining marks may only follow a symbol, one each, so a variation
+	// selector fits but a stack of marks spilling over the line doesn't.
+	if s == "" || utf8.RuneCountInString(s) > maxEmojiRunes {
+		return "", false
+	}
+	runes := []rune(s)
+	for i, r := range runes {
+		if r == zeroWidthJoiner && i > 0 && i < len(runes)-1 && runes[i-1] != zeroWidthJoiner {
+			continue
+		}
+		if unicode.In(r, unicode.Mn, unicode.Me) {
+			if i == 0 || runes[i-1] == zeroWidthJoiner || unicode.In(runes[i-1], unicode.Mn, unicode.Me) {
+				return "", false
+			}
+			continue
+		}
+		if r < utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) ||
+			unicode.IsControl(r) || unicode.In(r, unicode.Cf) {
+			return "", false
+		}
+	}
+	return s, true
+}
+
+// addReaction records user's emoji on msg. Slices are copied rather than
+// appended to in place, as they may be shared with the store.
+func addReaction(msg *models.LobbyMessage, emoji, user string) error {
+	for i, r := range msg.Reactions {
+		if r.Emoji != emoji {
+			continue
+		}
+		for _, u := range r.Users {
+			if u == user {
+				return errAlreadyReacted
+			}
+		}
+		reactions := append([]models.Reaction(nil), msg.Reactions...)
+		reactions[i].Users = append(append([]string(nil), r.Users...), user)
+		msg.Reactions = reactions
+		return nil
+	}
+	if len(msg.Reactions) >= maxReactionKinds {
+		return errTooManyReactions
+	}
+	msg.Reactions = append(append([]models.Reaction(nil), msg.Reactions...),
+		models.Reaction{Emoji: emoji, Users: []string{user}})
+	return nil
+}
+
+// removeReaction takes user's emoji off msg, or all of user's reactions
+// if emoji is empty, and returns the emoji that were removed
+func removeReaction(msg *models.LobbyMessage, emoji, user string) ([]string, error) {
+	var removed []string
+	reactions := make([]models.Reaction, 0, len(msg.Reactions))
+	for _, r := range msg.Reactions {
+		users := make([]string, 0, len(r.Users))
+		for _, u := range r.Users {
+			if u == user && (emoji == "" || emoji == r.Emoji) {
+				removed = append(removed, r.Emoji)
+				continue
+			}
+			users = append(users, u)
+		}
+		if len(users) > 0 {
+			reactions = append(reactions, models.Reaction{Emoji: r.Emoji, Users: users})
+		}
+	}
+	if len(removed) == 0 {
+		return nil, errNotReacted
+	}
+	if len(reactions) == 0 {
+		reactions = nil
+	}
+	msg.Reactions = reactions
+	return removed, nil
+}
+
+// formatReactions summarizes reactions as "👍 3  ❤️ 1"
+func formatReactions(reactions []models.Reaction) string {
+	parts := make([]string, len(reactions))
+	for i, r := range reactions {
+		parts[i] = fmt.Sprintf("%s %d", r.Emoji, len(r.Users))
+	}
+	return strings.Join(parts, "  ")
+}
+
+func (h *CommandHandler) handleReact(conn net.Conn, client *models.Client, cmd string) {
+	id, arg, ok := parseMessageRef(strings.TrimPrefix(cmd, "/react "))
+	emoji, valid := resolveEmoji(arg)
+	if !ok || arg == "" {
+		conn.Write([]byte(ColorRed + "Usage: /react <id> <emoji|shortcode>\n" + ColorReset))
+		return
+	}
+	if !valid {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("Unknown reaction '%s'. Use an emoji or one of: %s\n",
+			arg, strings.Join(shortcodeNames(), ", ")) + ColorReset))
+		return
+	}
+	if _, ok := h.lookupMessage(conn, client, id); !ok {
+		return
+	}
+	if h.CheckMuted(conn, client) {
+		return
+	}
+
+	msg, err := h.LobbyManager.ModifyMessage(client.CurrentLobby, id, func(msg *models.LobbyMessage) error {
+		return addReaction(msg, emoji, client.Username)
+	})
+	switch {
+	case errors.Is(err, errAlreadyReacted):
+		conn.Write([]byte(ColorRed + fmt.Sprintf("You already reacted %s to #%d.\n", emoji, id) + ColorReset))
+		return
+	case errors.Is(err, errTooManyReactions):
+		conn.Write([]byte(ColorRed + fmt.Sprintf("Message #%d already has %d different reactions.\n", id, maxReactionKinds) + ColorReset))
+		return
+	case errors.Is(err, errNoMessage):
+		conn.Write([]byte(ColorRed + fmt.Sprintf("No message #%d in '%s'.\n", id, client.CurrentLobby) + ColorReset))
+		return
+	case err != nil:
+		log.Printf("Failed to add reaction to message %d in %s: %v", id, client.CurrentLobby, err)
+		conn.Write([]byte(ColorRed + "Could not add that reaction.\n" + ColorReset))
+		return
+	}
+	h.ClientManager.BroadcastToLobby(client.CurrentLobby, fmt.Sprintf("%s reacted %s to #%d %s(%s)%s",
+		client.Username, emoji, id, ColorWhite, formatReactions(msg.Reactions), ColorReset))
+}
+
+func (h *CommandHandler) handleUnreact(conn net.Conn, client *models.Client, cmd string) {
+	id, arg, ok := parseMessageRef(strings.TrimPrefix(cmd, "/unreact "))
+	if !ok {
+		conn.Write([]byte(ColorRed + "Usage: /unreact <id> [emoji|shortcode]\n" + ColorReset))
+		return
+	}
+	emoji := ""
+	if arg != "" {
+		if emoji, ok = resolveEmoji(arg); !ok {
+			conn.Write([]byte(ColorRed + fmt.Sprintf("Unknown reaction '%s'.\n", arg) + ColorReset))
+			return
+		}
+	}
+	if _, ok := h.lookupMessage(conn, client, id); !ok || h.checkArchived(conn, client) {
+		return
+	}
+
+	var removed []string
+	msg, err := h.LobbyManager.ModifyMessage(client.CurrentLobby, id, func(msg *models.LobbyMessage) error {
+		var err error
+		removed, err = removeReaction(msg, emoji, client.Username)
+		return err
+	})
+	switch {
+	case errors.Is(err, errNotReacted):
+		conn.Write([]byte(ColorRed + fmt.Sprintf("You have no reaction %son #%d.\n", emoji+" ", id) + ColorReset))
+		return
+	case errors.Is(err, errNoMessage):
+		conn.Write([]byte(ColorRed + fmt.Sprintf("No message #%d in '%s'.\n", id, client.CurrentLobby) + ColorReset))
+		return
+	case err != nil:
+		log.Printf("Failed to remove reaction from message %d in %s: %v", id, client.CurrentLobby, err)
+		conn.Write([]byte(ColorRed + "Could not remove that reaction.\n" + ColorReset))
+		return
+	}
+	summary := formatReactions(msg.Reactions)
+	if summary == "" {
+		summary = "no reactions"
+	}
+	h.ClientManager.BroadcastToLobby(client.CurrentLobby, fmt.Sprintf("%s removed %s from #%d %s(%s)%s",
+		client.Username, strings.Join(removed, " "), id, ColorWhite, summary, ColorReset))
+}
+
+// shortcodeNames lists one name per emoji for the /react usage message
+func shortcodeNames() []string {
+	return []string{"+1", "-1", "heart", "tada", "joy", "smile", "eyes", "fire",
+		"rocket", "check", "x", "thinking", "pray", "100", "wave"}
+}
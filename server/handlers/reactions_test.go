@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"testing"
+
+	"chat-server/server/models"
+)
+
+func TestResolveEmoji(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  string
+		valid bool
+	}{
+		{":+1:", "👍", true},
+		{"thumbsup", "👍", true},
+		{":HEART:", "❤️", true},
+		{"🦀", "🦀", true},
+		{"lol", "", false},
+		{"<b>", "", false},
+		{"🦀x", "", false},
+		{"", "", false},
+		{"👩\u200d💻", "👩\u200d💻", true},
+		{"🦀\u0085", "", false},        // C1 control
+		{"\u202e🦀", "", false},        // bidi override
+		{"🦀\u200b", "", false},        // zero-width space
+		{"\u200d🦀", "", false},        // joiner with nothing to join
+		{"🦀\u200d\u200d🦀", "", false}, // doubled joiner
+		{"🏳\ufe0f\u200d🌈", "🏳\ufe0f\u200d🌈", true},
+		{"👩🏽\u200d💻", "👩🏽\u200d💻", true},
+		{"\u0301", "", false},         // lone combining mark
+		{"\u20e3", "", false},         // lone enclosing mark
+		{"🦀\u0301\u0301", "", false},  // stacked marks
+		{"🦀\u200d\u0301🦀", "", false}, // mark after a joiner
+		{"🦀🦀🦀🦀🦀🦀", "", false},         // too long
+	}
+	for _, tt := range tests {
+		got, ok := resolveEmoji(tt.in)
+		if got != tt.want || ok != tt.valid {
+			t.Errorf("resolveEmoji(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.valid)
+		}
+	}
+}
+
+func TestReactions(t *testing.T) {
+	h := newTestHandler(t)
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	bob := h.ClientManager.GetClientByUsername("bob")
+
+	h.LobbyManager.StoreMessage("general", "", "alice", "release is out")
+
+	h.HandleCommand(alice.Conn, "/react 1 :+1:", alice)
+	bobOut.waitFor(t, "alice reacted 👍 to #1 \033[37m(👍 1)")
+	h.HandleCommand(bob.Conn, "/react 1 👍", bob)
+	aliceOut.waitFor(t, "bob reacted 👍 to #1 \033[37m(👍 2)")
+	h.HandleCommand(bob.Conn, "/react 1 +1", bob)
+	bobOut.waitFor(t, "You already reacted 👍 to #1.")
+	h.HandleCommand(bob.Conn, "/react 1 tada", bob)
+	aliceOut.waitFor(t, "(👍 2  🎉 1)")
+	h.HandleCommand(bob.Conn, "/react 2 tada", bob)
+	bobOut.waitFor(t, "No message #2 in 'general'.")
+
+	h.HandleCommand(alice.Conn, "/history", alice)
+	aliceOut.waitFor(t, "👍 2  🎉 1")
+
+	h.HandleCommand(bob.Conn, "/unreact 1", bob)
+	aliceOut.waitFor(t, "bob removed 👍 🎉 from #1 \033[37m(👍 1)")
+	h.HandleCommand(alice.Conn, "/unreact 1 tada", alice)
+	aliceOut.waitFor(t, "You have no reaction 🎉 on #1.")
+
+	msg, _ := h.LobbyManager.Message("general", 1)
+	want := []models.Reaction{{Emoji: "👍", Users: []string{"alice"}}}
+	if len(msg.Reactions) != 1 || msg.Reactions[0].Emoji != want[0].Emoji ||
+		len(msg.Reactions[0].Users) != 1 || msg.Reactions[0].Users[0] != "alice" {
+		t.Errorf("stored reactions = %+v, want %+v", msg.Reactions, want)
+	}
+}
+
+func TestReactionKindLimit(t *testing.T) {
+	var msg models.LobbyMessage
+	for i := 0; i < maxReactionKinds; i++ {
+		if err := addReaction(&msg, string(rune(0x1F600+i)), "alice"); err != nil {
+			t.Fatalf("addReaction #%d: %v", i, err)
+		}
+	}
+	if err := addReaction(&msg, "🦀", "alice"); err != errTooManyReactions {
+		t.Errorf("addReaction past limit = %v, want errTooManyReactions", err)
+	}
+	if err := addReaction(&msg, string(rune(0x1F600)), "bob"); err != nil {
+		t.Errorf("adding to an existing reaction past limit: %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"chat-server/server/models"
+	"chat-server/server/utils"
+)
+
+// Permission is an action gated by a user's role in their current lobby
+type Permission int
+
+const (
+	PermBasic Permission = iota
+	PermChat
+	PermDirectMessage
+	PermTag
+	PermCreateLobby
+	PermAI
+	PermSetAI
+	PermModerate
+	PermInvite
+	PermVoice
+	PermOp
+	PermTransfer
+	PermManageLobby
+)
+
+// requiredRoles is the minimum lobby role for each permission
+var requiredRoles = map[Permission]models.Role{
+	PermBasic:         models.RoleGuest,
+	PermChat:          models.RoleGuest,
+	PermDirectMessage: models.RoleMember,
+	PermTag:           models.RoleMember,
+	PermCreateLobby:   models.RoleMember,
+	PermAI:            models.RoleMember,
+	PermSetAI:         models.RoleOperator,
+	PermModerate:      models.RoleOperator,
+	PermInvite:        models.RoleOperator,
+	PermVoice:         models.RoleOperator,
+	PermOp:            models.RoleOwner,
+	PermTransfer:      models.RoleOwner,
+	PermManageLobby:   models.RoleOwner,
+}
+
+// commandPermissions maps each command to the permission it needs
+var commandPermissions = map[string]Permission{
+	"/help":     PermBasic,
+	"/users":    PermBasic,
+	"/lobbies":  PermBasic,
+	"/join":     PermBasic,
+	"/sp":       PermBasic,
+	"/register": PermBasic,
+	"/login":    PermBasic,
+	"/banlist":  PermBasic,
+	"/history":  PermBasic,
+	"/search":   PermBasic,
+	"/reply":    PermChat,
+	"/edit":     PermChat,
+	"/delete":   PermChat,
+	"/thread":   PermChat,
+	"/threads":  PermBasic,
+	"/react":    PermChat,
+	"/unreact":  PermChat,
+	"/msg":      PermDirectMessage,
+	"/inbox":    PermDirectMessage,
+	"/dm":       PermDirectMessage,
+	"/dms":      PermDirectMessage,
+	"/tag":      PermTag,
+	"/create":   PermCreateLobby,
+	"/ai":       PermAI,
+	"/setai":    PermSetAI,
+	"/kick":     PermModerate,
+	"/ban":      PermModerate,
+	"/unban":    PermModerate,
+	"/mute":     PermModerate,
+	"/unmute":   PermModerate,
+	"/voice":    PermVoice,
+	"/devoice":  PermVoice,
+	"/op":       PermOp,
+	"/deop":     PermOp,
+	"/transfer": PermTransfer,
+
+	// /invite and /uninvite may name another lobby, so they check
+	// PermInvite there themselves
+	"/invite":      PermBasic,
+	"/uninvite":    PermBasic,
+	"/invite-only": PermOp,
+	"/accept":      PermBasic,
+	// /lobby without arguments shows the lobby; changes check PermManageLobby
+	"/lobby": PermBasic,
+	// /bot is for server operators, which it checks itself
+	"/bot":     PermBasic,
+	"/webhook": PermManageLobby,
+}
+
+// RoleIn resolves a client's effective role in a lobby. Server operators
+// rank as owners everywhere; guest names and unauthenticated holders of
+// registered names rank as guests regardless of any stored grant. Grants
+// above member, ownership included, only count for logged in accounts:
+// anyone can connect under a name nobody registered.
+func (h *CommandHandler) RoleIn(client *models.Client, lobbyName string) models.Role {
+	username, authenticated := h.ClientManager.Identity(client)
+	if h.Moderation.IsOperator(username, authenticated) {
+		return models.RoleOwner
+	}
+	registered := h.Accounts.IsRegistered(username)
+	if strings.HasPrefix(username, GuestPrefix) || (!authenticated && registered) {
+		return models.RoleGuest
+	}
+	role := h.LobbyManager.RoleOf(lobbyName, username)
+	if role > models.RoleMember && !(authenticated && registered) {
+		return models.RoleMember
+	}
+	return role
+}
+
+// isOperator reports whether a client is logged in as a server operator
+func (h *CommandHandler) isOperator(client *models.Client) bool {
+	return h.Moderation.IsOperator(h.ClientManager.Identity(client))
+}
+
+// isVerified reports whether a client is logged in to a registered account
+func (h *CommandHandler) isVerified(client *models.Client) bool {
+	username, authenticated := h.ClientManager.Identity(client)
+	return authenticated && h.Accounts.IsRegistered(username)
+}
+
+// HasPermission reports whether a client may perform an action in a lobby
+func (h *CommandHandler) HasPermission(client *models.Client, lobbyName string, perm Permission) bool {
+	return h.RoleIn(client, lobbyName) >= requiredRoles[perm]
+}
+
+// authorizeCommand checks the permission for a command in the client's
+// current lobby, telling the client when it is missing
+func (h *CommandHandler) authorizeCommand(conn net.Conn, client *models.Client, cmd string) bool {
+	name := strings.Fields(cmd)[0]
+	perm, known := commandPermissions[name]
+	if !known || h.HasPermission(client, client.CurrentLobby, perm) {
+		return true
+	}
+
+	conn.Write([]byte(ColorRed + fmt.Sprintf("You need to be %s or higher in '%s' to use %s.\n",
+		requiredRoles[perm], client.CurrentLobby, name) + ColorReset))
+	return false
+}
+
+// IsCommand reports whether name, such as "/history", is a chat command
+func IsCommand(name string) bool {
+	_, known := commandPermissions[name]
+	return known
+}
+
+// outranks reports whether actor holds a higher role than target in a lobby
+func (h *CommandHandler) outranks(actor, target *models.Client, lobbyName string) bool {
+	return h.RoleIn(actor, lobbyName) > h.RoleIn(target, lobbyName)
+}
+
+func (h *CommandHandler) handleOp(conn net.Conn, client *models.Client, cmd string) {
+	h.changeRole(conn, client, strings.TrimPrefix(cmd, "/op "), models.RoleOperator, "an operator")
+}
+
+func (h *CommandHandler) handleDeop(conn net.Conn, client *models.Client, cmd string) {
+	target := strings.TrimSpace(strings.TrimPrefix(cmd, "/deop "))
+	if h.LobbyManager.RoleOf(client.CurrentLobby, target) != models.RoleOperator {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("%s is not an operator here.\n", target) + ColorReset))
+		return
+	}
+	h.changeRole(conn, client, target, models.RoleMember, "a member")
+}
+
+func (h *CommandHandler) handleVoice(conn net.Conn, client *models.Client, cmd string) {
+	h.changeRole(conn, client, strings.TrimPrefix(cmd, "/voice "), models.RoleVoiced, "voiced")
+}
+
+func (h *CommandHandler) handleDevoice(conn net.Conn, client *models.Client, cmd string) {
+	target := strings.TrimSpace(strings.TrimPrefix(cmd, "/devoice "))
+	if h.LobbyManager.RoleOf(client.CurrentLobby, target) != models.RoleVoiced {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("%s is not voiced here.\n", target) + ColorReset))
+		return
+	}
+	h.changeRole(conn, client, target, models.RoleMember, "a member")
+}
+
+// changeRole sets a user's role in the client's current lobby. Nobody can
+// grant or take away a role at or above their own.
+func (h *CommandHandler) changeRole(conn net.Conn, client *models.Client, target string, role models.Role, label string) {
+	target = strings.TrimSpace(target)
+	if valid, errMsg := utils.IsValidUsername(target); !valid {
+		conn.Write([]byte(ColorRed + errMsg + "\n" + ColorReset))
+		return
+	}
+
+	lobbyName := client.CurrentLobby
+	if lobbyName == "general" {
+		conn.Write([]byte(ColorRed + "Roles can't be changed in the general lobby.\n" + ColorReset))
+		return
+	}
+
+	actorRole := h.RoleIn(client, lobbyName)
+	current := h.LobbyManager.RoleOf(lobbyName, target)
+	if current >= actorRole || role >= actorRole {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("You can't change %s's role.\n", target) + ColorReset))
+		return
+	}
+	if role > models.RoleMember && !h.Accounts.IsRegistered(target) {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("%s has to /register before they can be made %s.\n", target, label) + ColorReset))
+		return
+	}
+
+	if err := h.LobbyManager.SetRole(lobbyName, target, role); err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+
+	h.ClientManager.BroadcastToLobby(lobbyName,
+		fmt.Sprintf("%s%s made %s %s%s", ColorYellow, client.Username, target, label, ColorReset))
+}
+
+func (h *CommandHandler) handleTransfer(conn net.Conn, client *models.Client, cmd string) {
+	targetName := strings.TrimSpace(strings.TrimPrefix(cmd, "/transfer "))
+	target := h.ClientManager.GetClientByUsername(targetName)
+	if target == nil {
+		conn.Write([]byte(ColorRed + "User not found. The new owner must be online.\n" + ColorReset))
+		return
+	}
+	if h.RoleIn(target, client.CurrentLobby) == models.RoleGuest {
+		conn.Write([]byte(ColorRed + "Guests can't own lobbies.\n" + ColorReset))
+		return
+	}
+	if !h.isVerified(target) {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("%s has to /register or /login before they can own a lobby.\n", target.Username) + ColorReset))
+		return
+	}
+
+	if err := h.LobbyManager.TransferOwnership(client.CurrentLobby, target.Username); err != nil {
+		conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+		return
+	}
+
+	h.ClientManager.BroadcastToLobby(client.CurrentLobby,
+		fmt.Sprintf("%s%s transferred ownership of '%s' to %s%s",
+			ColorYellow, client.Username, client.CurrentLobby, target.Username, ColorReset))
+}
+
+// RoleBadge returns the IRC-style prefix shown next to a user's name
+func RoleBadge(role models.Role) string {
+	switch role {
+	case models.RoleOwner:
+		return "~"
+	case models.RoleOperator:
+		return "@"
+	case models.RoleVoiced:
+		return "+"
+	default:
+		return ""
+	}
+}
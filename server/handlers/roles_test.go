@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+
+	"chat-server/server/models"
+	"chat-server/server/storage"
+)
+
+func newTestHandler(t *testing.T) *CommandHandler {
+	t.Helper()
+	store := storage.NewMemoryStore()
+	cm := NewClientManager(store)
+	mm := NewModerationManager(store)
+	lm := NewLobbyManager(store, mm)
+	lm.CreateDefaultLobby()
+	return NewCommandHandler(cm, lm, NewAccountManager(store), mm, NewMailboxManager(store), NewDirectMessageManager(store))
+}
+
+// logIn registers each name and marks its connected client as logged in,
+// which lobby roles above member require
+func logIn(t *testing.T, h *CommandHandler, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := h.Accounts.Register(name, "secret-pass"); err != nil {
+			t.Fatalf("Register %s: %v", name, err)
+		}
+		if client := h.ClientManager.GetClientByUsername(name); client != nil {
+			h.ClientManager.SetAuthenticated(client)
+		}
+	}
+}
+
+func TestRoleIn(t *testing.T) {
+	h := newTestHandler(t)
+	h.LobbyManager.CreateLobby("coding", "", "Go talk", "alice", true, false)
+	h.LobbyManager.SetRole("coding", "bob", models.RoleOperator)
+	h.LobbyManager.SetRole("coding", "erin", models.RoleOperator)
+	logIn(t, h, "alice", "bob", "carol")
+	h.Moderation.SetOperators([]string{"root"})
+
+	tests := []struct {
+		client *models.Client
+		want   models.Role
+	}{
+		{&models.Client{Username: "alice", Authenticated: true}, models.RoleOwner},
+		{&models.Client{Username: "alice"}, models.RoleGuest},
+		{&models.Client{Username: "bob", Authenticated: true}, models.RoleOperator},
+		{&models.Client{Username: "erin"}, models.RoleMember},
+		{&models.Client{Username: "dave"}, models.RoleMember},
+		{&models.Client{Username: "guest-0042"}, models.RoleGuest},
+		{&models.Client{Username: "carol"}, models.RoleGuest},
+		{&models.Client{Username: "carol", Authenticated: true}, models.RoleMember},
+		{&models.Client{Username: "root", Authenticated: true}, models.RoleOwner},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s/%v", tc.client.Username, tc.client.Authenticated), func(t *testing.T) {
+			if got := h.RoleIn(tc.client, "coding"); got != tc.want {
+				t.Errorf("RoleIn(%s) = %s; want %s", tc.client.Username, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHasPermission(t *testing.T) {
+	h := newTestHandler(t)
+	h.LobbyManager.CreateLobby("coding", "", "Go talk", "alice", true, false)
+	h.LobbyManager.SetRole("coding", "bob", models.RoleOperator)
+	logIn(t, h, "alice", "bob")
+
+	owner := &models.Client{Username: "alice", Authenticated: true}
+	op := &models.Client{Username: "bob", Authenticated: true}
+	member := &models.Client{Username: "dave"}
+	guest := &models.Client{Username: "guest-0001"}
+
+	checks := []struct {
+		client *models.Client
+		perm   Permission
+		want   bool
+	}{
+		{guest, PermChat, true},
+		{guest, PermAI, false},
+		{member, PermAI, true},
+		{member, PermSetAI, false},
+		{op, PermModerate, true},
+		{op, PermOp, false},
+		{owner, PermTransfer, true},
+	}
+	for _, c := range checks {
+		if got := h.HasPermission(c.client, "coding", c.perm); got != c.want {
+			t.Errorf("HasPermission(%s, %d) = %v; want %v", c.client.Username, c.perm, got, c.want)
+		}
+	}
+}
+
+func TestTransferOwnership(t *testing.T) {
+	h := newTestHandler(t)
+	h.LobbyManager.CreateLobby("coding", "", "Go talk", "alice", true, false)
+
+	if err := h.LobbyManager.TransferOwnership("coding", "bob"); err != nil {
+		t.Fatalf("TransferOwnership: %v", err)
+	}
+	if got := h.LobbyManager.RoleOf("coding", "bob"); got != models.RoleOwner {
+		t.Errorf("new owner role = %s; want owner", got)
+	}
+	if got := h.LobbyManager.RoleOf("coding", "alice"); got != models.RoleOperator {
+		t.Errorf("previous owner role = %s; want operator", got)
+	}
+	if err := h.LobbyManager.SetRole("coding", "bob", models.RoleMember); err == nil {
+		t.Error("SetRole should refuse to demote the owner")
+	}
+	if err := h.LobbyManager.TransferOwnership("general", "bob"); err == nil {
+		t.Error("general should not be transferable")
+	}
+}
+
+func TestElevatedRolesNeedAccounts(t *testing.T) {
+	h := newTestHandler(t)
+	h.LobbyManager.CreateLobby("coding", "", "Go talk", "alice", true, false)
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	bob := h.ClientManager.GetClientByUsername("bob")
+	alice.CurrentLobby, bob.CurrentLobby = "coding", "coding"
+
+	h.HandleCommand(alice.Conn, "/lobby delete", alice)
+	aliceOut.waitFor(t, "Only the owner of 'coding' can change it.")
+	h.HandleCommand(bob.Conn, "/create mine --invite-only squatted", bob)
+	bobOut.waitFor(t, "Log in with /register or /login to create an invite-only lobby")
+	h.HandleCommand(bob.Conn, "/create mine squatted", bob)
+	bobOut.waitFor(t, "nobody owns this lobby")
+	if lobby, _ := h.LobbyManager.GetLobby("mine"); lobby.Owner != "" || lobby.Creator != "bob" {
+		t.Errorf("guest-created lobby has owner %q, creator %q", lobby.Owner, lobby.Creator)
+	}
+	if got := h.LobbyManager.RoleOf("mine", "bob"); got != models.RoleMember {
+		t.Errorf("bob's role in their unowned lobby = %s; want member", got)
+	}
+	reloaded := NewLobbyManager(h.LobbyManager.store, h.Moderation)
+	if err := reloaded.LoadFromStore(); err != nil {
+		t.Fatalf("LoadFromStore: %v", err)
+	}
+	if got := reloaded.RoleOf("mine", "bob"); got != models.RoleMember {
+		t.Errorf("bob's role after a restart = %s; want member", got)
+	}
+
+	logIn(t, h, "alice")
+	h.HandleCommand(alice.Conn, "/op bob", alice)
+	aliceOut.waitFor(t, "bob has to /register before they can be made an operator.")
+	h.HandleCommand(alice.Conn, "/transfer bob", alice)
+	aliceOut.waitFor(t, "bob has to /register or /login before they can own a lobby.")
+	if got := h.LobbyManager.RoleOf("coding", "bob"); got != models.RoleMember {
+		t.Errorf("bob's stored role = %s; want member", got)
+	}
+
+	logIn(t, h, "bob")
+	h.HandleCommand(alice.Conn, "/op bob", alice)
+	aliceOut.waitFor(t, "alice made bob an operator")
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"chat-server/server/models"
+)
+
+// thread is what the server tracks about one thread of a lobby
+type thread struct {
+	replies   []uint64
+	lastReply time.Time
+	lastUser  string
+	// members maps everyone who replied or followed the thread, plus the
+	// author of its first message, to whether they still receive replies
+	members map[string]bool
+	pending int // replies not yet announced in the lobby digest
+}
+
+// ThreadSummary describes a thread for /threads
+type ThreadSummary struct {
+	Root      uint64
+	Replies   int
+	LastReply time.Time
+	LastUser  string
+	Followers int
+}
+
+// ThreadManager keeps the replies and followers of every thread. Replies
+// themselves live in the lobby history; this is rebuilt from it on start,
+// while who followed or unfollowed a thread lasts until a restart.
+type ThreadManager struct {
+	threads map[string]map[uint64]*thread
+	mu      sync.Mutex
+}
+
+// NewThreadManager creates an empty thread manager
+func NewThreadManager() *ThreadManager {
+	return &ThreadManager{threads: make(map[string]map[uint64]*thread)}
+}
+
+// get returns a thread, creating it if needed; tm.mu must be held
+func (tm *ThreadManager) get(lobbyName string, root models.LobbyMessage) *thread {
+	if tm.threads[lobbyName] == nil {
+		tm.threads[lobbyName] = make(map[uint64]*thread)
+	}
+	t := tm.threads[lobbyName][root.ID]
+	if t == nil {
+		t = &thread{members: map[string]bool{root.Username: true}}
+		tm.threads[lobbyName][root.ID] = t
+	}
+	return t
+}
+
+// record adds a stored reply to the thread started by root. Replying
+// follows the thread again after an unfollow.
+func (tm *ThreadManager) record(lobbyName string, root models.LobbyMessage, reply models.LobbyMessage) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t := tm.get(lobbyName, root)
+	t.replies = append(t.replies, reply.ID)
+	t.lastReply = reply.Timestamp
+	t.lastUser = reply.Username
+	t.members[reply.Username] = true
+}
+
+// Follow makes username receive the replies of the thread started by root
+func (tm *ThreadManager) Follow(lobbyName string, root models.LobbyMessage, username string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.get(lobbyName, root).members[username] = true
+}
+
+// Unfollow stops username receiving a thread's replies and reports
+// whether they were following it
+func (tm *ThreadManager) Unfollow(lobbyName string, root uint64, username string) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t := tm.threads[lobbyName][root]
+	if t == nil || !t.members[username] {
+		return false
+	}
+	t.members[username] = false
+	return true
+}
+
+// Following reports whether username receives a thread's replies
+func (tm *ThreadManager) Following(lobbyName string, root uint64, username string) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t := tm.threads[lobbyName][root]
+	return t != nil && t.members[username]
+}
+
+// Replies returns the IDs of a thread's replies, oldest first
+func (tm *ThreadManager) Replies(lobbyName string, root uint64) []uint64 {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t := tm.threads[lobbyName][root]
+	if t == nil {
+		return nil
+	}
+	return append([]uint64(nil), t.replies...)
+}
+
+// ReplyCount returns how many replies a thread has
+func (tm *ThreadManager) ReplyCount(lobbyName string, root uint64) int {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if t := tm.threads[lobbyName][root]; t != nil {
+		return len(t.replies)
+	}
+	return 0
+}
+
+// Recipients returns everyone who receives a thread's replies
+func (tm *ThreadManager) Recipients(lobbyName string, root uint64) map[string]bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	recipients := make(map[string]bool)
+	if t := tm.threads[lobbyName][root]; t != nil {
+		for name, following := range t.members {
+			if following {
+				recipients[name] = true
+			}
+		}
+	}
+	return recipients
+}
+
+// addPending counts a reply towards the thread's next digest and reports
+// whether it is the first one since the last digest
+func (tm *ThreadManager) addPending(lobbyName string, root uint64) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t := tm.threads[lobbyName][root]
+	if t == nil {
+		return false
+	}
+	t.pending++
+	return t.pending == 1
+}
+
+// takePending returns and resets the number of replies since the last digest
+func (tm *ThreadManager) takePending(lobbyName string, root uint64) int {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t := tm.threads[lobbyName][root]
+	if t == nil {
+		return 0
+	}
+	n := t.pending
+	t.pending = 0
+	return n
+}
+
+// Active returns the threads of a lobby that have replies, most recently
+// active first
+func (tm *ThreadManager) Active(lobbyName string) []ThreadSummary {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	var summaries []ThreadSummary
+	for root, t := range tm.threads[lobbyName] {
+		if len(t.replies) == 0 {
+			continue
+		}
+		followers := 0
+		for _, following := range t.members {
+			if following {
+				followers++
+			}
+		}
+		summaries = append(summaries, ThreadSummary{
+			Root:      root,
+			Replies:   len(t.replies),
+			LastReply: t.lastReply,
+			LastUser:  t.lastUser,
+			Followers: followers,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].LastReply.After(summaries[j].LastReply)
+	})
+	return summaries
+}
+
+// renameLobby moves the threads of a lobby to its new name
+func (tm *ThreadManager) renameLobby(oldName, newName string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if threads, ok := tm.threads[oldName]; ok {
+		tm.threads[newName] = threads
+		delete(tm.threads, oldName)
+	}
+}
+
+// removeLobby forgets the threads of a deleted lobby
+func (tm *ThreadManager) removeLobby(lobbyName string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	delete(tm.threads, lobbyName)
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/utils"
+)
+
+// threadDigestDelay is how long replies to a thread are collected before
+// the lobby is told about them in one line
+var threadDigestDelay = 30 * time.Second
+
+// maxThreadsListed caps /threads
+const maxThreadsListed = 20
+
+// formatThreadCount renders the reply count shown under a thread's first
+// message, or "" if it has no replies
+func formatThreadCount(root uint64, replies int) string {
+	if replies == 0 {
+		return ""
+	}
+	return fmt.Sprintf("      %s💬 %d %s · /thread %d%s\n", ColorWhite, replies, replyWord(replies), root, ColorReset)
+}
+
+func replyWord(n int) string {
+	if n == 1 {
+		return "reply"
+	}
+	return "replies"
+}
+
+func (h *CommandHandler) handleThread(conn net.Conn, client *models.Client, cmd string) {
+	args := strings.TrimSpace(strings.TrimPrefix(cmd, "/thread"))
+	switch {
+	case args == "":
+		if client.CurrentThread != 0 {
+			conn.Write([]byte(fmt.Sprintf("You are posting in thread #%d. Use /thread close to return to the lobby.\n", client.CurrentThread)))
+			return
+		}
+		conn.Write([]byte(ColorRed + "Usage: /thread <id> [message] | /thread close | /thread unfollow <id>\n" + ColorReset))
+	case args == "close":
+		h.closeThread(conn, client)
+	case strings.HasPrefix(args, "unfollow"):
+		h.unfollowThread(conn, client, strings.TrimSpace(strings.TrimPrefix(args, "unfollow")))
+	default:
+		id, text, ok := parseMessageRef(args)
+		if !ok {
+			conn.Write([]byte(ColorRed + "Usage: /thread <id> [message] | /thread close | /thread unfollow <id>\n" + ColorReset))
+			return
+		}
+		root, ok := h.threadRoot(conn, client, id)
+		if !ok {
+			return
+		}
+		if text == "" {
+			h.openThread(conn, client, root)
+			return
+		}
+		if h.CheckMuted(conn, client) {
+			return
+		}
+		h.postThreadReply(client, root, text)
+	}
+}
+
+// threadRoot finds the message starting the thread that message id
+// belongs to; replies lead to the thread they are in
+func (h *CommandHandler) threadRoot(conn net.Conn, client *models.Client, id uint64) (models.LobbyMessage, bool) {
+	msg, ok := h.lookupMessage(conn, client, id)
+	if !ok || msg.Thread == 0 {
+		return msg, ok
+	}
+	return h.lookupMessage(conn, client, msg.Thread)
+}
+
+// openThread shows a thread, follows it and sends the client's plain
+// messages to it until /thread close
+func (h *CommandHandler) openThread(conn net.Conn, client *models.Client, root models.LobbyMessage) {
+	lobby := client.CurrentLobby
+	h.LobbyManager.Threads.Follow(lobby, root, client.Username)
+	h.ClientManager.SetThread(client, root.ID)
+
+	ids := h.LobbyManager.Threads.Replies(lobby, root.ID)
+	if len(ids) > maxHistoryLines {
+		ids = ids[len(ids)-maxHistoryLines:]
+	}
+	replies, err := h.LobbyManager.Messages(lobby, ids)
+	if err != nil {
+		conn.Write([]byte(ColorRed + "Could not load the thread.\n" + ColorReset))
+		return
+	}
+	out := ColorCyan + ColorBold + fmt.Sprintf("── Thread #%d in %s ──", root.ID, lobby) + ColorReset + "\n"
+	out += h.LobbyManager.FormatMessages(lobby, append([]models.LobbyMessage{root}, replies...), true)
+	out += ColorGreen + fmt.Sprintf("You are now posting in thread #%d and will get its replies. Use /thread close to return to the lobby.", root.ID) + ColorReset + "\n"
+	conn.Write([]byte(out))
+}
+
+func (h *CommandHandler) closeThread(conn net.Conn, client *models.Client) {
+	if client.CurrentThread == 0 {
+		conn.Write([]byte(ColorRed + "You are not in a thread.\n" + ColorReset))
+		return
+	}
+	root := client.CurrentThread
+	h.ClientManager.SetThread(client, 0)
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("Back in the main lobby. You still get replies from thread #%d; /thread unfollow %d to stop.", root, root) + ColorReset + "\n"))
+}
+
+func (h *CommandHandler) unfollowThread(conn net.Conn, client *models.Client, arg string) {
+	id, _, ok := parseMessageRef(arg)
+	if !ok {
+		conn.Write([]byte(ColorRed + "Usage: /thread unfollow <id>\n" + ColorReset))
+		return
+	}
+	if !h.LobbyManager.Threads.Unfollow(client.CurrentLobby, id, client.Username) {
+		conn.Write([]byte(ColorRed + fmt.Sprintf("You are not following thread #%d.\n", id) + ColorReset))
+		return
+	}
+	if client.CurrentThread == id {
+		h.ClientManager.SetThread(client, 0)
+	}
+	conn.Write([]byte(ColorGreen + fmt.Sprintf("You will no longer get replies from thread #%d.", id) + ColorReset + "\n"))
+}
+
+// PostToThread sends a plain message of a client in thread mode to its
+// thread. The caller has already applied mutes and rate limits.
+func (h *CommandHandler) PostToThread(client *models.Client, text string) {
+	root, ok := h.LobbyManager.Message(client.CurrentLobby, client.CurrentThread)
+	if !ok || root.Deleted {
+		h.ClientManager.Send(client, ColorRed+fmt.Sprintf("Thread #%d is gone; you are back in the main lobby.\n", client.CurrentThread)+ColorReset)
+		h.ClientManager.SetThread(client, 0)
+		return
+	}
+	h.postThreadReply(client, root, text)
+}
+
+// postThreadReply stores a reply, delivers it to the thread's followers in
+// the lobby and schedules the lobby digest
+func (h *CommandHandler) postThreadReply(client *models.Client, root models.LobbyMessage, text string) {
+	lobby := client.CurrentLobby
+	msg := h.LobbyManager.StoreThreadReply(lobby, client.UserProfile, client.Username, text, root)
+	h.sendToThread(lobby, root.ID, client.Username, formatLobbyMessage(msg, nil, false))
+
+	if h.LobbyManager.Threads.addPending(lobby, root.ID) {
+		time.AfterFunc(threadDigestDelay, func() { h.sendThreadDigest(lobby, root) })
+	}
+}
+
+// sendToThread sends text to the members of a lobby who get a thread's
+// replies, and to sender. Thread content never goes to the whole lobby.
+func (h *CommandHandler) sendToThread(lobby string, root uint64, sender, text string) {
+	rendered := "\r\033[K" + text + ColorCyan + "> " + ColorReset
+	recipients := h.LobbyManager.Threads.Recipients(lobby, root)
+	recipients[sender] = true
+	for _, member := range h.ClientManager.GetLobbyUsers(lobby) {
+		if recipients[member.Username] {
+			h.ClientManager.Send(member, rendered)
+		}
+	}
+}
+
+// sendThreadDigest tells the lobby how many replies a thread got since the
+// last digest
+func (h *CommandHandler) sendThreadDigest(lobby string, root models.LobbyMessage) {
+	n := h.LobbyManager.Threads.takePending(lobby, root.ID)
+	if n == 0 {
+		return
+	}
+	h.ClientManager.BroadcastToLobby(lobby, fmt.Sprintf("%s💬 %d new %s in thread #%d%s (%s: %s) · /thread %d to follow",
+		ColorCyan, n, replyWord(n), root.ID, ColorReset, root.Username, truncate(root.Text, quoteWidth), root.ID))
+}
+
+func (h *CommandHandler) showThreads(conn net.Conn, client *models.Client) {
+	lobby := client.CurrentLobby
+	threads := h.LobbyManager.Threads.Active(lobby)
+	if len(threads) == 0 {
+		conn.Write([]byte(fmt.Sprintf("No threads in '%s' yet. Start one with /thread <id> <message>.\n", lobby)))
+		return
+	}
+	if len(threads) > maxThreadsListed {
+		threads = threads[:maxThreadsListed]
+	}
+
+	ids := make([]uint64, len(threads))
+	for i, t := range threads {
+		ids[i] = t.Root
+	}
+	roots := make(map[uint64]models.LobbyMessage)
+	if msgs, err := h.LobbyManager.Messages(lobby, ids); err == nil {
+		for _, msg := range msgs {
+			roots[msg.ID] = msg
+		}
+	}
+
+	out := ColorCyan + ColorBold + fmt.Sprintf("Threads in %s:", lobby) + ColorReset + "\n"
+	for _, t := range threads {
+		snippet := "[message unavailable]"
+		if root, ok := roots[t.Root]; ok {
+			snippet = root.Username + ": " + truncate(root.Text, quoteWidth)
+			if root.Deleted {
+				snippet = "[message deleted]"
+			}
+		}
+		mark := " "
+		if h.LobbyManager.Threads.Following(lobby, t.Root, client.Username) {
+			mark = "★"
+		}
+		out += fmt.Sprintf("%s %s#%d%s %s\n     %d %s, last by %s %s\n",
+			mark, ColorYellow, t.Root, ColorReset, snippet,
+			t.Replies, replyWord(t.Replies), t.LastUser, utils.FormatTimeAgo(t.LastReply))
+	}
+	out += "★ = following. /thread <id> to open one.\n"
+	conn.Write([]byte(out))
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"chat-server/server/storage"
+)
+
+func TestThreads(t *testing.T) {
+	defer func(d time.Duration) { threadDigestDelay = d }(threadDigestDelay)
+	threadDigestDelay = 50 * time.Millisecond
+
+	h := newTestHandler(t)
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	carolOut := record(addPipeClient(t, h.ClientManager, "carol", false))
+	bob := h.ClientManager.GetClientByUsername("bob")
+	carol := h.ClientManager.GetClientByUsername("carol")
+
+	h.LobbyManager.StoreMessage("general", "", "alice", "should we move to Go 1.27?")
+	h.LobbyManager.StoreMessage("general", "", "carol", "lunch anyone?")
+
+	h.HandleCommand(bob.Conn, "/thread 1 yes, generics got better", bob)
+	aliceOut.waitFor(t, "[thread #1] \033[0myes, generics got better")
+	bobOut.waitFor(t, "yes, generics got better")
+	carolOut.waitFor(t, "💬 1 new reply in thread #1\033[0m (alice: should we move to Go 1.27?)")
+	carolOut.mu.Lock()
+	leaked := strings.Contains(carolOut.buf.String(), "generics got better")
+	carolOut.mu.Unlock()
+	if leaked {
+		t.Error("thread reply was sent to a user who does not follow the thread")
+	}
+
+	h.HandleCommand(carol.Conn, "/thread 3", carol)
+	carolOut.waitFor(t, "── Thread #1 in general ──")
+	carolOut.waitFor(t, "yes, generics got better")
+	carolOut.waitFor(t, "You are now posting in thread #1")
+	if carol.CurrentThread != 1 {
+		t.Fatalf("CurrentThread = %d, want 1", carol.CurrentThread)
+	}
+	h.PostToThread(carol, "only if CI is ready")
+	bobOut.waitFor(t, "only if CI is ready")
+	aliceOut.waitFor(t, "💬 1 new reply in thread #1")
+
+	h.HandleCommand(carol.Conn, "/threads", carol)
+	carolOut.waitFor(t, "★ \033[33m#1\033[0m alice: should we move to Go 1.27?")
+	carolOut.waitFor(t, "2 replies, last by carol")
+	h.HandleCommand(carol.Conn, "/thread close", carol)
+	carolOut.waitFor(t, "Back in the main lobby.")
+
+	msgs, _ := h.LobbyManager.History("general", 10)
+	if len(msgs) != 2 || msgs[0].ID != 1 || msgs[1].ID != 2 {
+		t.Errorf("History = %+v, want only messages 1 and 2", msgs)
+	}
+	h.HandleCommand(carol.Conn, "/history", carol)
+	carolOut.waitFor(t, "💬 2 replies · /thread 1")
+
+	if ctx := h.LobbyManager.GetLobbyContext("general"); strings.Contains(ctx, "CI is ready") {
+		t.Errorf("thread reply in AI context by default:\n%s", ctx)
+	}
+	h.LobbyManager.SetThreadContext(true)
+	if ctx := h.LobbyManager.GetLobbyContext("general"); !strings.Contains(ctx, "(in thread #1) carol: only if CI is ready") {
+		t.Errorf("thread reply missing from AI context:\n%s", ctx)
+	}
+
+	h.HandleCommand(bob.Conn, "/thread unfollow 1", bob)
+	bobOut.waitFor(t, "You will no longer get replies from thread #1.")
+	if h.LobbyManager.Threads.Recipients("general", 1)["bob"] {
+		t.Error("bob still receives replies after /thread unfollow")
+	}
+}
+
+func TestThreadEditAndReplyStayInThread(t *testing.T) {
+	h := newTestHandler(t)
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	carolOut := record(addPipeClient(t, h.ClientManager, "carol", false))
+	bob := h.ClientManager.GetClientByUsername("bob")
+	carol := h.ClientManager.GetClientByUsername("carol")
+
+	root := h.LobbyManager.StoreMessage("general", "", "alice", "release plan")
+	h.HandleCommand(bob.Conn, "/thread 1 ship friday", bob)
+	aliceOut.waitFor(t, "ship friday")
+
+	h.HandleCommand(bob.Conn, "/edit 2 ship monday", bob)
+	aliceOut.waitFor(t, "✎ bob edited #2:\033[0m ship monday")
+	bobOut.waitFor(t, "ship monday")
+
+	// Replying to a thread reply posts in the thread, without quoting it
+	// to the lobby
+	h.HandleCommand(carol.Conn, "/reply 2 monday works", carol)
+	aliceOut.waitFor(t, "monday works")
+	bobOut.waitFor(t, "monday works")
+	carolOut.waitFor(t, "monday works")
+	carolOut.mu.Lock()
+	leaked := strings.Contains(carolOut.buf.String(), "ship")
+	carolOut.mu.Unlock()
+	if leaked {
+		t.Error("thread reply or its edit reached a user outside the thread")
+	}
+	if replies := h.LobbyManager.Threads.Replies("general", root.ID); len(replies) != 2 {
+		t.Errorf("thread replies = %v; want the /reply in the thread", replies)
+	}
+	if msgs, _ := h.LobbyManager.History("general", 10); len(msgs) != 1 {
+		t.Errorf("lobby history = %+v; want only the thread's first message", msgs)
+	}
+}
+
+func TestThreadsSurviveRestart(t *testing.T) {
+	store := storage.NewMemoryStore()
+	lm := NewLobbyManager(store, NewModerationManager(store))
+	lm.CreateDefaultLobby()
+	root := lm.StoreMessage("general", "", "alice", "release plan")
+	lm.StoreThreadReply("general", "", "bob", "friday?", root)
+	lm.StoreMessage("general", "", "carol", "unrelated")
+	lm.StoreThreadReply("general", "", "carol", "monday", root)
+
+	lm = NewLobbyManager(store, NewModerationManager(store))
+	lm.CreateDefaultLobby()
+	if err := lm.LoadFromStore(); err != nil {
+		t.Fatalf("LoadFromStore: %v", err)
+	}
+	if got := lm.Threads.Replies("general", root.ID); len(got) != 2 || got[0] != 2 || got[1] != 4 {
+		t.Errorf("Replies = %v, want [2 4]", got)
+	}
+	recipients := lm.Threads.Recipients("general", root.ID)
+	if !recipients["alice"] || !recipients["bob"] || !recipients["carol"] {
+		t.Errorf("Recipients = %v, want alice, bob and carol", recipients)
+	}
+	if active := lm.Threads.Active("general"); len(active) != 1 || active[0].LastUser != "carol" {
+		t.Errorf("Active = %+v", active)
+	}
+}
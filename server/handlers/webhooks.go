@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/webhooks"
+)
+
+// maxDeadLetterList is the most failed deliveries /webhook failed shows
+const maxDeadLetterList = 50
+
+const webhookUsage = "Usage: /webhook [list] | add <url> <event,...|all> | remove <id> | test <id> | failed [n]\n"
+
+// handleWebhook lets a lobby's owner register URLs that are sent its
+// events, test them and see deliveries that failed
+func (h *CommandHandler) handleWebhook(conn net.Conn, client *models.Client, cmd string) {
+	lobby := client.CurrentLobby
+	args := strings.Fields(strings.TrimPrefix(cmd, "/webhook"))
+	if len(args) == 0 || (len(args) == 1 && args[0] == "list") {
+		h.showWebhooks(conn, lobby)
+		return
+	}
+
+	switch {
+	case args[0] == "add" && len(args) == 3:
+		events := strings.Split(args[2], ",")
+		if args[2] == "all" {
+			events = webhooks.Events
+		}
+		hook, err := webhooks.New(args[1], events, client.Username)
+		if err == nil && h.Webhooks != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err = h.Webhooks.CheckURL(ctx, hook.URL)
+			cancel()
+		}
+		if err == nil {
+			err = h.LobbyManager.AddWebhook(lobby, hook)
+		}
+		if err != nil {
+			conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+			return
+		}
+		conn.Write([]byte(ColorGreen + fmt.Sprintf("Added webhook %s for %s. Its signing secret, which won't be shown again:\n  %s\n",
+			hook.ID, strings.Join(hook.Events, ", "), hook.Secret) + ColorReset))
+		conn.Write([]byte(ColorCyan + fmt.Sprintf("Each delivery carries %s: sha256=<hex HMAC-SHA256 of the body>.\n",
+			webhooks.SignatureHeader) + ColorReset))
+	case args[0] == "remove" && len(args) == 2:
+		if err := h.LobbyManager.RemoveWebhook(lobby, args[1]); err != nil {
+			conn.Write([]byte(ColorRed + err.Error() + "\n" + ColorReset))
+			return
+		}
+		conn.Write([]byte(ColorGreen + fmt.Sprintf("Removed webhook %s.\n", args[1]) + ColorReset))
+	case args[0] == "test" && len(args) == 2:
+		if h.Webhooks == nil {
+			conn.Write([]byte(ColorRed + "Webhooks are not available on this server.\n" + ColorReset))
+			return
+		}
+		for _, hook := range h.LobbyManager.Webhooks(lobby) {
+			if hook.ID == args[1] {
+				h.Webhooks.Ping(lobby, hook, client.Username)
+				conn.Write([]byte(ColorGreen + fmt.Sprintf("Sent a ping to %s. If it fails, /webhook failed will show why.\n",
+					hook.URL) + ColorReset))
+				return
+			}
+		}
+		conn.Write([]byte(ColorRed + fmt.Sprintf("'%s' has no webhook %s\n", lobby, args[1]) + ColorReset))
+	case args[0] == "failed" && len(args) <= 2:
+		h.showDeadLetters(conn, lobby, args[1:])
+	default:
+		conn.Write([]byte(ColorRed + webhookUsage + ColorReset))
+	}
+}
+
+func (h *CommandHandler) showWebhooks(conn net.Conn, lobby string) {
+	hooks := h.LobbyManager.Webhooks(lobby)
+	msg := ColorCyan + fmt.Sprintf("\n=== Webhooks of '%s' (%d) ===\n", lobby, len(hooks)) + ColorReset
+	for _, hook := range hooks {
+		msg += fmt.Sprintf("  %s%s%s %s (%s) by %s\n",
+			ColorWhite, hook.ID, ColorReset, hook.URL, strings.Join(hook.Events, ", "), hook.By)
+	}
+	if len(hooks) == 0 {
+		msg += "  none; add one with /webhook add <url> <events>\n"
+	}
+	msg += "\n"
+	conn.Write([]byte(msg))
+}
+
+func (h *CommandHandler) showDeadLetters(conn net.Conn, lobby string, args []string) {
+	if h.Webhooks == nil {
+		conn.Write([]byte(ColorRed + "Webhooks are not available on this server.\n" + ColorReset))
+		return
+	}
+	limit := 10
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			conn.Write([]byte(ColorRed + webhookUsage + ColorReset))
+			return
+		}
+		limit = min(n, maxDeadLetterList)
+	}
+
+	letters, err := h.Webhooks.DeadLetters(lobby, limit)
+	if err != nil {
+		conn.Write([]byte(ColorRed + "Failed to load failed deliveries.\n" + ColorReset))
+		return
+	}
+	if len(letters) == 0 {
+		conn.Write([]byte(ColorCyan + fmt.Sprintf("No failed webhook deliveries in '%s'.\n", lobby) + ColorReset))
+		return
+	}
+	msg := ColorCyan + fmt.Sprintf("\n=== Failed webhook deliveries in '%s' (%d) ===\n", lobby, len(letters)) + ColorReset
+	for _, dl := range letters {
+		msg += fmt.Sprintf("  %s %s%s%s %s to %s after %d attempts: %s\n",
+			dl.Failed.Format("2006-01-02 15:04"), ColorWhite, dl.Webhook, ColorReset, dl.Event, dl.URL, dl.Attempts, dl.Error)
+	}
+	msg += "\n"
+	conn.Write([]byte(msg))
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"testing"
+	"time"
+
+	"chat-server/server/storage"
+	"chat-server/server/webhooks"
+)
+
+func TestWebhookCommand(t *testing.T) {
+	h := newTestHandler(t)
+	h.LobbyManager.CreateLobby("ops", "", "on-call", "alice", true, false)
+	aliceOut := record(addPipeClient(t, h.ClientManager, "alice", false))
+	bobOut := record(addPipeClient(t, h.ClientManager, "bob", false))
+	alice := h.ClientManager.GetClientByUsername("alice")
+	bob := h.ClientManager.GetClientByUsername("bob")
+	logIn(t, h, "alice")
+
+	pings := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		pings <- r.Header.Get(webhooks.EventHeader)
+	}))
+	defer srv.Close()
+	h.Webhooks = webhooks.NewDispatcher(h.LobbyManager.Webhooks, storage.NewMemoryStore())
+	h.Webhooks.Start()
+	defer h.Webhooks.Stop()
+
+	h.HandleCommand(alice.Conn, "/join ops", alice)
+	h.HandleCommand(bob.Conn, "/join ops", bob)
+	h.HandleCommand(bob.Conn, "/webhook add "+srv.URL+" all", bob)
+	bobOut.waitFor(t, "You need to be owner or higher in 'ops' to use /webhook.")
+
+	h.HandleCommand(alice.Conn, "/webhook add "+srv.URL+" join", alice)
+	aliceOut.waitFor(t, "webhooks can't be sent to 127.0.0.1")
+	settings := webhooks.DefaultSettings()
+	settings.AllowedNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	h.Webhooks.Configure(settings)
+
+	h.HandleCommand(alice.Conn, "/webhook add "+srv.URL+" join,mention", alice)
+	aliceOut.waitFor(t, "for join, mention. Its signing secret")
+	hooks := h.LobbyManager.Webhooks("ops")
+	if len(hooks) != 1 || hooks[0].URL != srv.URL || hooks[0].By != "alice" {
+		t.Fatalf("webhooks = %+v", hooks)
+	}
+	aliceOut.mu.Lock()
+	shown := regexp.MustCompile(`\n  ([0-9a-f]{48})\n`).FindStringSubmatch(aliceOut.buf.String())
+	aliceOut.mu.Unlock()
+	if shown == nil || shown[1] != hooks[0].Secret {
+		t.Errorf("the secret was not shown once added")
+	}
+
+	h.HandleCommand(alice.Conn, "/webhook test "+hooks[0].ID, alice)
+	aliceOut.waitFor(t, "Sent a ping to "+srv.URL)
+	select {
+	case event := <-pings:
+		if event != webhooks.EventPing {
+			t.Errorf("test delivery event = %q", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the test delivery never arrived")
+	}
+
+	h.HandleCommand(alice.Conn, "/webhook remove "+hooks[0].ID, alice)
+	aliceOut.waitFor(t, "Removed webhook "+hooks[0].ID+".")
+	if hooks := h.LobbyManager.Webhooks("ops"); len(hooks) != 0 {
+		t.Errorf("webhooks after remove = %+v", hooks)
+	}
+}
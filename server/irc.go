@@ -0,0 +1,596 @@
+package server
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"chat-server/server/ai"
+	"chat-server/server/handlers"
+	"chat-server/server/middleware"
+	"chat-server/server/models"
+	"chat-server/server/utils"
+)
+
+// ircServerName is the source of numerics and server notices, and the
+// host part of every user's IRC mask
+const ircServerName = "go-chat"
+
+// ircTextLimit is the longest text put in one IRC line, well under the
+// protocol's 512 bytes once the prefix and command are added
+const ircTextLimit = 400
+
+// HandleIRCConnection serves a client speaking IRC. Lobbies appear as
+// #channels and the AI as a user called AI; everything else the server
+// says arrives as NOTICEs. IRC clients share lobbies, DMs and commands
+// with everyone connected through HandleConnection.
+func (s *Server) HandleIRCConnection(conn net.Conn) {
+	ip := middleware.GetIP(conn)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("PANIC recovered in HandleIRCConnection: %v\nConnection: %s", r, conn.RemoteAddr())
+			conn.Write([]byte(ircLine("", "ERROR", "Server error occurred")))
+			conn.Close()
+		}
+	}()
+	if errMsg := s.admissionError(ip); errMsg != "" {
+		conn.Write([]byte(ircLine("", "ERROR", errMsg)))
+		conn.Close()
+		return
+	}
+
+	middleware.IncrementIPConnection(ip)
+	readTimeout, _ := s.currentSettings()
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	defer middleware.DecrementIPConnection(ip)
+	defer func() {
+		conn.Close()
+		s.leave(conn)
+	}()
+
+	is := &ircSession{s: s, conn: conn, ip: ip}
+	is.out = &ircConn{Conn: conn, session: is}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		readTimeout, _ := s.currentSettings()
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		msg, ok := parseIRC(scanner.Text())
+		if !ok {
+			continue
+		}
+		if !is.handle(msg) {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("IRC connection error:", err)
+	}
+}
+
+// ircMessage is one line received from an IRC client
+type ircMessage struct {
+	command string
+	params  []string
+}
+
+// parseIRC splits a line into its command and parameters, skipping any
+// tags and prefix
+func parseIRC(line string) (ircMessage, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line = strings.TrimLeft(line, " ")
+
+	var msg ircMessage
+	for line != "" {
+		if strings.HasPrefix(line, ":") && msg.command != "" {
+			msg.params = append(msg.params, line[1:])
+			break
+		}
+		word, rest, _ := strings.Cut(line, " ")
+		if msg.command == "" {
+			msg.command = strings.ToUpper(word)
+		} else if word != "" {
+			msg.params = append(msg.params, word)
+		}
+		line = strings.TrimLeft(rest, " ")
+	}
+	return msg, msg.command != ""
+}
+
+// param returns the i-th parameter, or "" if there are fewer
+func (m ircMessage) param(i int) string {
+	if i < len(m.params) {
+		return m.params[i]
+	}
+	return ""
+}
+
+// ircLine formats one IRC line. The last parameter is always sent as
+// trailing, so it may contain spaces.
+func ircLine(prefix, command string, params ...string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(command)
+	for i, p := range params {
+		p = strings.NewReplacer("\r", "", "\n", " ").Replace(p)
+		if i == len(params)-1 {
+			b.WriteString(" :" + p)
+		} else {
+			b.WriteString(" " + p)
+		}
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// ircMask returns the nick!user@host prefix of a chat user
+func ircMask(nick string) string {
+	return nick + "!" + strings.ToLower(nick) + "@" + ircServerName
+}
+
+// channelName returns the IRC channel of a lobby
+func channelName(lobby string) string {
+	return "#" + lobby
+}
+
+// lobbyName returns the lobby of an IRC channel, or "" if target isn't one
+func lobbyName(target string) string {
+	if strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&") {
+		return target[1:]
+	}
+	return ""
+}
+
+// ircText splits server output into lines short enough for IRC, dropping
+// blank ones
+func ircText(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t")
+		for len(line) > ircTextLimit {
+			cut := ircTextLimit
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			lines = append(lines, line[:cut])
+			line = line[cut:]
+		}
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// ircSession is the state of one IRC connection
+type ircSession struct {
+	s    *Server
+	conn net.Conn // the client's connection; queued output is written here
+	out  net.Conn // what handlers write to; text becomes NOTICEs
+	ip   string
+
+	// Registration
+	nick, user, pass string
+	client           *models.Client // nil until NICK and USER were accepted
+
+	// What the IRC client was last told its nick and channel are. Both
+	// can change under it, through /login or a kick, and are brought up
+	// to date before the next line is rendered.
+	mu      sync.Mutex
+	shown   string
+	channel string
+}
+
+// ircConn is the connection handlers see for an IRC client: whatever
+// they write is sent as NOTICEs from the server
+type ircConn struct {
+	net.Conn
+	session *ircSession
+}
+
+func (c *ircConn) Write(p []byte) (int, error) {
+	is := c.session
+	if _, err := c.Conn.Write(is.Render(is.client, models.Event{Type: models.EventNotice, Text: utils.StripANSI(string(p))})); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// reply sends a numeric reply to the client
+func (is *ircSession) reply(code string, params ...string) {
+	nick := is.nick
+	if is.client != nil {
+		nick = is.client.Username
+	} else if nick == "" {
+		nick = "*"
+	}
+	is.conn.Write([]byte(ircLine(ircServerName, code, append([]string{nick}, params...)...)))
+}
+
+// notice sends a NOTICE from the server to the client
+func (is *ircSession) notice(text string) {
+	is.out.Write([]byte(text))
+}
+
+// handle acts on one message and reports whether the connection stays open
+func (is *ircSession) handle(msg ircMessage) bool {
+	switch msg.command {
+	case "QUIT":
+		is.conn.Write([]byte(ircLine("", "ERROR", "Closing link: "+msg.param(0))))
+		return false
+	case "PING":
+		is.conn.Write([]byte(ircLine(ircServerName, "PONG", ircServerName, msg.param(0))))
+		return true
+	case "PONG":
+		return true
+	case "CAP":
+		// No capabilities are offered; answering LS lets clients that
+		// wait for it finish registering
+		if strings.ToUpper(msg.param(0)) == "LS" {
+			is.conn.Write([]byte(ircLine(ircServerName, "CAP", "*", "LS", "")))
+		}
+		return true
+	}
+	if is.client == nil {
+		return is.register(msg)
+	}
+
+	client := is.client
+	switch msg.command {
+	case "NICK":
+		is.reply("432", msg.param(0), "Nick changes are not supported; use /login or reconnect")
+	case "USER", "PASS":
+		is.reply("462", "You may not reregister")
+	case "JOIN":
+		is.join(msg)
+	case "PART":
+		is.part(msg)
+	case "PRIVMSG", "NOTICE":
+		is.privmsg(msg)
+	case "NAMES":
+		target := strings.Split(msg.param(0), ",")[0]
+		if target == "" {
+			target = channelName(client.CurrentLobby)
+		}
+		is.names(target)
+	case "LIST":
+		is.list()
+	case "TOPIC":
+		is.topic(msg)
+	case "WHO":
+		is.who(msg.param(0))
+	case "MODE":
+		is.mode(msg)
+	default:
+		// Anything else that names a chat command runs it, so /history 20
+		// or /react 3 +1 work from an IRC client that passes them through
+		name := "/" + strings.ToLower(msg.command)
+		if !handlers.IsCommand(name) {
+			is.reply("421", msg.command, "Unknown command")
+			break
+		}
+		is.s.handleInput(is.out, client, strings.TrimSpace(name+" "+strings.Join(msg.params, " ")))
+	}
+	return true
+}
+
+// register handles the messages allowed before registration and joins
+// the client to general once it has given a usable NICK and a USER
+func (is *ircSession) register(msg ircMessage) bool {
+	switch msg.command {
+	case "PASS":
+		is.pass = msg.param(0)
+	case "NICK":
+		nick := msg.param(0)
+		if nick == "" {
+			is.reply("431", "No nickname given")
+			return true
+		}
+		if errMsg := is.s.usernameError(nick); errMsg != "" {
+			code := "432"
+			if is.s.clientManager.IsUsernameTaken(nick) {
+				code = "433"
+			}
+			is.reply(code, nick, errMsg)
+			return true
+		}
+		is.nick = nick
+	case "USER":
+		if len(msg.params) < 4 {
+			is.reply("461", "USER", "Not enough parameters")
+			return true
+		}
+		is.user = msg.param(0)
+	default:
+		is.reply("451", "You have not registered")
+		return true
+	}
+	if is.nick == "" || is.user == "" {
+		return true
+	}
+	// The nick may have been taken while waiting for USER
+	if errMsg := is.s.usernameError(is.nick); errMsg != "" {
+		is.reply("433", is.nick, errMsg)
+		is.nick = ""
+		return true
+	}
+
+	is.client = is.s.newClient(is.conn, is.nick, is.ip)
+	is.client.Renderer = is
+	is.shown = is.nick
+	is.welcome()
+	is.s.join(is.out, is.client)
+	if is.pass != "" {
+		is.s.commandHandler.HandleCommand(is.out, "/login "+is.nick+" "+is.pass, is.client)
+	}
+	return true
+}
+
+// welcome sends the registration replies and the MOTD
+func (is *ircSession) welcome() {
+	is.reply("001", "Welcome to "+ircServerName+", "+is.nick)
+	is.reply("002", "Your host is "+ircServerName)
+	is.reply("004", ircServerName, "1.0", "o", "ik")
+	is.reply("005", "CHANTYPES=#", "PREFIX=(qov)~@+", "CHANMODES=,k,,i",
+		"NICKLEN="+strconv.Itoa(utils.UsernameLengthLimit()), "NETWORK="+ircServerName, "are supported by this server")
+
+	_, motd := is.s.currentSettings()
+	if motd = strings.TrimSpace(motd); motd == "" {
+		is.reply("422", "MOTD File is missing")
+		return
+	}
+	is.reply("375", "- "+ircServerName+" Message of the day -")
+	for _, line := range strings.Split(motd, "\n") {
+		is.reply("372", "- "+line)
+	}
+	is.reply("376", "End of /MOTD command")
+}
+
+// join switches lobbies. Lobbies hold one user at a time, so only the
+// first channel given is joined, and the client is parted from the one
+// it was in.
+func (is *ircSession) join(msg ircMessage) {
+	channel := strings.Split(msg.param(0), ",")[0]
+	lobby := lobbyName(channel)
+	if lobby == "" {
+		is.reply("403", channel, "No such channel")
+		return
+	}
+	if lobby == is.client.CurrentLobby {
+		return
+	}
+	key := strings.Split(msg.param(1), ",")[0]
+	is.s.handleInput(is.out, is.client, strings.TrimSpace("/join "+lobby+" "+key))
+}
+
+// part leaves a channel for general, which can't be left
+func (is *ircSession) part(msg ircMessage) {
+	lobby := lobbyName(strings.Split(msg.param(0), ",")[0])
+	switch {
+	case lobby != is.client.CurrentLobby:
+		is.reply("442", msg.param(0), "You're not on that channel")
+	case lobby == "general":
+		is.notice("You are always in a channel; join another one to leave #general.")
+	default:
+		is.s.handleInput(is.out, is.client, "/join general")
+	}
+}
+
+// privmsg posts to the client's lobby, asks the AI, or sends a /msg
+func (is *ircSession) privmsg(msg ircMessage) {
+	target, text := msg.param(0), msg.param(1)
+	if target == "" || text == "" {
+		is.reply("412", "No text to send")
+		return
+	}
+	if strings.HasPrefix(text, "\x01") {
+		action, ok := strings.CutPrefix(strings.Trim(text, "\x01"), "ACTION ")
+		if !ok {
+			return // other CTCP requests aren't answered
+		}
+		text = "* " + is.client.Username + " " + action
+	}
+
+	switch lobby := lobbyName(target); {
+	case lobby != "":
+		if lobby != is.client.CurrentLobby {
+			is.reply("404", target, "Cannot send to channel; you are in "+channelName(is.client.CurrentLobby))
+			return
+		}
+		is.s.handleInput(is.out, is.client, text)
+	case strings.EqualFold(target, handlers.AIUsername):
+		// NOTICEs must never trigger automatic replies
+		if msg.command == "PRIVMSG" {
+			is.s.handleInput(is.out, is.client, "/ai "+text)
+		}
+	default:
+		is.s.handleInput(is.out, is.client, "/msg "+target+" "+text)
+	}
+}
+
+// names lists the users of a lobby with their role prefixes
+func (is *ircSession) names(channel string) {
+	is.conn.Write([]byte(is.namesReply(is.client.Username, channel)))
+}
+
+// namesReply returns the NAMES reply for a channel, addressed to nick
+func (is *ircSession) namesReply(nick, channel string) string {
+	lobby := lobbyName(channel)
+	var names []string
+	for _, user := range is.s.clientManager.GetLobbyUsers(lobby) {
+		names = append(names, handlers.RoleBadge(is.s.commandHandler.RoleIn(user, lobby))+user.Username)
+	}
+	sort.Strings(names)
+	if ai.Available() && lobby != "" {
+		names = append(names, handlers.AIUsername)
+	}
+
+	var b strings.Builder
+	for len(names) > 0 {
+		n := min(len(names), 20)
+		b.WriteString(ircLine(ircServerName, "353", nick, "=", channel, strings.Join(names[:n], " ")))
+		names = names[n:]
+	}
+	b.WriteString(ircLine(ircServerName, "366", nick, channel, "End of /NAMES list"))
+	return b.String()
+}
+
+// list shows every lobby with its user count and description
+func (is *ircSession) list() {
+	lobbies := is.s.lobbyManager.Lobbies()
+	sort.Slice(lobbies, func(i, j int) bool { return lobbies[i].Name < lobbies[j].Name })
+	is.reply("321", "Channel", "Users  Name")
+	for _, lobby := range lobbies {
+		users := len(is.s.clientManager.GetLobbyUsers(lobby.Name))
+		is.reply("322", channelName(lobby.Name), strconv.Itoa(users), lobby.Desc)
+	}
+	is.reply("323", "End of /LIST")
+}
+
+// topic shows a lobby's description or, for its owner, changes it
+func (is *ircSession) topic(msg ircMessage) {
+	channel := msg.param(0)
+	lobby, exists := is.s.lobbyManager.GetLobby(lobbyName(channel))
+	if !exists {
+		is.reply("403", channel, "No such channel")
+		return
+	}
+	if len(msg.params) < 2 {
+		if lobby.Desc == "" {
+			is.reply("331", channel, "No topic is set")
+		} else {
+			is.reply("332", channel, lobby.Desc)
+		}
+		return
+	}
+	if lobby.Name != is.client.CurrentLobby {
+		is.reply("442", channel, "You're not on that channel")
+		return
+	}
+	is.s.handleInput(is.out, is.client, "/lobby desc "+msg.param(1))
+}
+
+// who describes the users of a channel, or one user
+func (is *ircSession) who(mask string) {
+	var users []*models.Client
+	if lobby := lobbyName(mask); lobby != "" {
+		users = is.s.clientManager.GetLobbyUsers(lobby)
+	} else if user := is.s.clientManager.GetClientByUsername(mask); user != nil {
+		users = append(users, user)
+	}
+	for _, user := range users {
+		flags := "H" + handlers.RoleBadge(is.s.commandHandler.RoleIn(user, user.CurrentLobby))
+		is.reply("352", channelName(user.CurrentLobby), strings.ToLower(user.Username), ircServerName,
+			ircServerName, user.Username, flags, "0 "+user.UserProfile)
+	}
+	is.reply("315", mask, "End of /WHO list")
+}
+
+// mode reports channel and user modes. Roles and lobby settings are
+// changed with the chat commands, not MODE.
+func (is *ircSession) mode(msg ircMessage) {
+	target := msg.param(0)
+	name := lobbyName(target)
+	if name == "" {
+		is.reply("221", "+")
+		return
+	}
+	lobby, exists := is.s.lobbyManager.GetLobby(name)
+	switch {
+	case !exists:
+		is.reply("403", target, "No such channel")
+	case len(msg.params) == 1:
+		modes := "+"
+		if lobby.InviteOnly {
+			modes += "i"
+		}
+		if lobby.IsPrivate {
+			modes += "k"
+		}
+		is.reply("324", target, modes)
+	case msg.param(1) == "b" || msg.param(1) == "+b":
+		is.reply("368", target, "End of channel ban list; see /banlist")
+	default:
+		is.notice("Modes can't be changed over IRC; use /op, /voice, /ban, /invite-only or /lobby.")
+	}
+}
+
+// Render turns an event into IRC lines for the client, first telling the
+// IRC client about any change of its nick or lobby
+func (is *ircSession) Render(client *models.Client, ev models.Event) []byte {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	var b strings.Builder
+	if client.Username != is.shown {
+		b.WriteString(ircLine(ircMask(is.shown), "NICK", client.Username))
+		is.shown = client.Username
+	}
+	if lobby := client.CurrentLobby; lobby != is.channel {
+		if is.channel != "" {
+			b.WriteString(ircLine(ircMask(client.Username), "PART", channelName(is.channel)))
+		}
+		is.channel = lobby
+		channel := channelName(lobby)
+		b.WriteString(ircLine(ircMask(client.Username), "JOIN", channel))
+		if l, _ := is.s.lobbyManager.GetLobby(lobby); l.Desc != "" {
+			b.WriteString(ircLine(ircServerName, "332", client.Username, channel, l.Desc))
+		}
+		b.WriteString(is.namesReply(client.Username, channel))
+	}
+
+	// IRC clients show what their user sent and joined themselves
+	own := ev.From == client.Username
+	switch ev.Type {
+	case models.EventMessage:
+		if !own {
+			writePrivmsg(&b, ircMask(ev.From), channelName(ev.Lobby), ev.Text)
+		}
+	case models.EventAIResponse:
+		writePrivmsg(&b, ircMask(handlers.AIUsername), channelName(ev.Lobby), ev.Text)
+	case models.EventDM:
+		if !own {
+			writePrivmsg(&b, ircMask(ev.From), client.Username, ev.Text)
+		}
+	case models.EventJoin:
+		if !own {
+			b.WriteString(ircLine(ircMask(ev.From), "JOIN", channelName(ev.Lobby)))
+		}
+	case models.EventLeave:
+		if !own {
+			b.WriteString(ircLine(ircMask(ev.From), "PART", channelName(ev.Lobby)))
+		}
+	case models.EventTopic:
+		b.WriteString(ircLine(ircMask(ev.From), "TOPIC", channelName(ev.Lobby), ev.Text))
+	default:
+		target := client.Username
+		if ev.Lobby != "" {
+			target = channelName(ev.Lobby)
+		}
+		for _, line := range ircText(ev.Text) {
+			b.WriteString(ircLine(ircServerName, "NOTICE", target, line))
+		}
+	}
+	return []byte(b.String())
+}
+
+// writePrivmsg adds a PRIVMSG, split into as many lines as it needs
+func writePrivmsg(b *strings.Builder, from, target, text string) {
+	for _, line := range ircText(text) {
+		b.WriteString(ircLine(from, "PRIVMSG", target, line))
+	}
+}
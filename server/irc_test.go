@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-server/server/config"
+	"chat-server/server/storage"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := NewServer(config.Default(), storage.NewMemoryStore())
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// ircClient is the client end of an IRC connection to a test server
+type ircClient struct {
+	conn  net.Conn
+	lines chan string
+}
+
+func dialIRC(t *testing.T, s *Server, nick string) *ircClient {
+	t.Helper()
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() { clientSide.Close() })
+	go s.HandleIRCConnection(serverSide)
+
+	c := &ircClient{conn: clientSide, lines: make(chan string, 100)}
+	go func() {
+		scanner := bufio.NewScanner(clientSide)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+		close(c.lines)
+	}()
+	c.send(t, "NICK "+nick)
+	c.send(t, "USER "+nick+" 0 * :"+nick)
+	c.expect(t, " 001 "+nick+" ")
+	c.expect(t, ":"+nick+"!"+nick+"@go-chat JOIN :#general")
+	return c
+}
+
+func (c *ircClient) send(t *testing.T, line string) {
+	t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		t.Fatalf("send %q: %v", line, err)
+	}
+}
+
+// expect reads lines until one contains want
+func (c *ircClient) expect(t *testing.T, want string) string {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				t.Fatalf("connection closed waiting for %q", want)
+			}
+			if strings.Contains(line, want) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("%q never arrived", want)
+		}
+	}
+}
+
+func TestParseIRC(t *testing.T) {
+	tests := []struct {
+		line    string
+		command string
+		params  []string
+	}{
+		{"NICK alice", "NICK", []string{"alice"}},
+		{"privmsg #general :hello there", "PRIVMSG", []string{"#general", "hello there"}},
+		{":alice!a@host JOIN #dev key\r", "JOIN", []string{"#dev", "key"}},
+		{"@time=now PING :token", "PING", []string{"token"}},
+		{"USER a 0 *  :Real Name", "USER", []string{"a", "0", "*", "Real Name"}},
+	}
+	for _, tc := range tests {
+		msg, ok := parseIRC(tc.line)
+		if !ok || msg.command != tc.command || !reflect.DeepEqual(msg.params, tc.params) {
+			t.Errorf("parseIRC(%q) = %q %q, want %q %q", tc.line, msg.command, msg.params, tc.command, tc.params)
+		}
+	}
+	if _, ok := parseIRC("   "); ok {
+		t.Error("parsed an empty line")
+	}
+}
+
+func TestIRCGateway(t *testing.T) {
+	s := newTestServer(t)
+	s.lobbyManager.CreateLobby("dev", "", "Build talk", "alice", true, false)
+
+	alice := dialIRC(t, s, "alice")
+	alice.send(t, "REGISTER hunter22")
+	alice.expect(t, "NOTICE alice :Registered 'alice'.")
+	bob := dialIRC(t, s, "bob")
+	alice.expect(t, ":bob!bob@go-chat JOIN :#general")
+
+	alice.send(t, "PING :lag-check")
+	alice.expect(t, "PONG go-chat :lag-check")
+
+	bob.send(t, "PRIVMSG #general :hello from irssi")
+	alice.expect(t, ":bob!bob@go-chat PRIVMSG #general :hello from irssi")
+	if msgs, _ := s.lobbyManager.History("general", 10); len(msgs) != 1 || msgs[0].Text != "hello from irssi" {
+		t.Errorf("general history = %+v", msgs)
+	}
+
+	bob.send(t, "PRIVMSG alice :psst")
+	alice.expect(t, ":bob!bob@go-chat PRIVMSG alice :psst")
+
+	alice.send(t, "NAMES #general")
+	alice.expect(t, "353 alice = #general :alice bob")
+
+	alice.send(t, "LIST")
+	alice.expect(t, "322 alice #dev 0 :Build talk")
+
+	alice.send(t, "JOIN #dev")
+	alice.expect(t, ":alice!alice@go-chat PART :#general")
+	alice.expect(t, ":alice!alice@go-chat JOIN :#dev")
+	alice.expect(t, "332 alice #dev :Build talk")
+	bob.expect(t, ":alice!alice@go-chat PART :#general")
+
+	bob.send(t, "PRIVMSG #dev :wrong room")
+	bob.expect(t, "404 bob #dev :Cannot send to channel")
+
+	// Chat commands pass through, and their output arrives as NOTICEs
+	alice.send(t, "TOPIC #dev :Builds and releases")
+	alice.expect(t, ":alice!alice@go-chat TOPIC #dev :Builds and releases")
+	bob.send(t, "HISTORY 5")
+	bob.expect(t, "NOTICE bob :=== Last 1 message")
+
+	bob.send(t, "QUIT :bye")
+	bob.expect(t, "ERROR :Closing link: bye")
+	deadline := time.Now().Add(time.Second)
+	for s.clientManager.IsUsernameTaken("bob") {
+		if time.Now().After(deadline) {
+			t.Fatal("bob is still connected after QUIT")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIRCNickInUse(t *testing.T) {
+	s := newTestServer(t)
+	dialIRC(t, s, "alice")
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	go s.HandleIRCConnection(serverSide)
+	c := &ircClient{conn: clientSide, lines: make(chan string, 10)}
+	go func() {
+		scanner := bufio.NewScanner(clientSide)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+	}()
+	c.send(t, "NICK alice")
+	c.expect(t, "433 * alice :Username already taken")
+	c.send(t, "NICK AI")
+	c.expect(t, "432 * AI :That username is reserved")
+	c.send(t, "JOIN #general")
+	c.expect(t, "451 * :You have not registered")
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"chat-server/server/handlers"
+	"chat-server/server/middleware"
+	"chat-server/server/models"
+	"chat-server/server/utils"
+)
+
+// protoJSON is the first line a client sends to switch its connection
+// from ANSI text to newline-delimited JSON
+const protoJSON = "PROTO json"
+
+// Event types only the JSON protocol sends
+const (
+	jsonHello     = "hello"      // the protocol is ready; the client should send hello
+	jsonLobbyList = "lobby_list" // answer to a lobbies command
+	jsonUserList  = "user_list"  // answer to a users command
+)
+
+// jsonCommand is one line from a JSON protocol client. Type picks what it
+// does and the other fields are its arguments:
+//
+//	hello    username, password or bot token (optional): join the chat
+//	message  text: post to the current lobby or thread
+//	dm       to, text: send a private message
+//	join     lobby, password or invitation token (optional): move to another lobby
+//	ai       text: ask the AI in the current lobby
+//	lobbies, users: list lobbies, or the users of the current lobby
+//	command  text: run any chat command, such as "/history 20"
+//	quit     disconnect
+type jsonCommand struct {
+	Type     string `json:"type"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Lobby    string `json:"lobby,omitempty"`
+	To       string `json:"to,omitempty"`
+	Text     string `json:"text,omitempty"`
+}
+
+// jsonEvent is one line sent to a JSON protocol client
+type jsonEvent struct {
+	Type      string      `json:"type"`
+	Lobby     string      `json:"lobby,omitempty"`
+	From      string      `json:"from,omitempty"`
+	To        string      `json:"to,omitempty"`
+	ID        uint64      `json:"id,omitempty"`
+	Text      string      `json:"text,omitempty"`
+	Lobbies   []jsonLobby `json:"lobbies,omitempty"`
+	Users     []jsonUser  `json:"users,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+type jsonLobby struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Access      string `json:"access"`
+	Users       int    `json:"users"`
+}
+
+type jsonUser struct {
+	Username string `json:"username"`
+	Profile  string `json:"profile"`
+	Role     string `json:"role"`
+	Bot      bool   `json:"bot,omitempty"`
+}
+
+// serveJSON runs a connection that asked for the JSON protocol. Its
+// commands go through the same handlers as typed ones; their output, and
+// everything broadcast to the client, arrives as JSON events.
+func (s *Server) serveJSON(conn net.Conn, scanner *bufio.Scanner, ip string) {
+	js := &jsonSession{s: s, conn: conn, ip: ip}
+	js.out = &jsonConn{Conn: conn, session: js}
+
+	// End the username prompt line so the first event starts a line
+	conn.Write([]byte("\n"))
+	js.send(jsonEvent{Type: jsonHello, Text: `Send {"type":"hello","username":"<name>"} to join`})
+
+	for scanner.Scan() {
+		readTimeout, _ := s.currentSettings()
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var cmd jsonCommand
+		if err := json.Unmarshal([]byte(line), &cmd); err != nil {
+			js.error("Invalid JSON: " + err.Error())
+			continue
+		}
+		if !js.handle(cmd) {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("JSON connection error:", err)
+	}
+}
+
+// jsonSession is the state of one JSON protocol connection
+type jsonSession struct {
+	s      *Server
+	conn   net.Conn // the client's connection; queued output is written here
+	out    net.Conn // what handlers write to; text becomes notice and error events
+	ip     string
+	client *models.Client // nil until hello was accepted
+}
+
+// jsonConn is the connection handlers see for a JSON client
+type jsonConn struct {
+	net.Conn
+	session *jsonSession
+}
+
+func (c *jsonConn) Write(p []byte) (int, error) {
+	ev := handlers.NoticeEvent(string(p))
+	ev.Text = utils.StripANSI(ev.Text)
+	ev.Timestamp = time.Now()
+	if line := c.session.Render(c.session.client, ev); line != nil {
+		if _, err := c.Conn.Write(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Render encodes an event as a JSON line
+func (js *jsonSession) Render(client *models.Client, ev models.Event) []byte {
+	text := strings.Trim(ev.Text, "\n")
+	if text == "" && (ev.Type == models.EventNotice || ev.Type == models.EventError) {
+		return nil
+	}
+	return encodeJSON(jsonEvent{
+		Type:      string(ev.Type),
+		Lobby:     ev.Lobby,
+		From:      ev.From,
+		To:        ev.To,
+		ID:        ev.ID,
+		Text:      text,
+		Timestamp: ev.Timestamp,
+	})
+}
+
+func encodeJSON(ev jsonEvent) []byte {
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+	line, _ := json.Marshal(ev)
+	return append(line, '\n')
+}
+
+// send writes an event straight to the client
+func (js *jsonSession) send(ev jsonEvent) {
+	js.conn.Write(encodeJSON(ev))
+}
+
+func (js *jsonSession) error(text string) {
+	js.send(jsonEvent{Type: string(models.EventError), Text: text})
+}
+
+// handle acts on one command and reports whether the connection stays open
+func (js *jsonSession) handle(cmd jsonCommand) bool {
+	if cmd.Type == "quit" {
+		return false
+	}
+	// Arguments are spliced into chat commands, so they must not carry
+	// another argument or line along
+	if strings.ContainsAny(cmd.Username+cmd.Password+cmd.Token+cmd.Lobby+cmd.To, " \r\n") ||
+		strings.ContainsAny(cmd.Text, "\r\n") {
+		js.error("Fields must not contain line breaks, and only text may contain spaces")
+		return true
+	}
+	if js.client == nil {
+		if cmd.Type != "hello" {
+			js.error(`Send {"type":"hello","username":"<name>"} first`)
+			return true
+		}
+		js.hello(cmd)
+		return true
+	}
+
+	client := js.client
+	switch cmd.Type {
+	case "hello":
+		js.error("Already joined as " + client.Username)
+	case "message":
+		if js.require(cmd.Text, "text") {
+			js.s.post(js.out, client, cmd.Text)
+		}
+	case "dm":
+		if js.require(cmd.To, "to") && js.require(cmd.Text, "text") {
+			js.s.handleInput(js.out, client, "/msg "+cmd.To+" "+cmd.Text)
+		}
+	case "join":
+		if !js.require(cmd.Lobby, "lobby") {
+			break
+		}
+		line := "/join " + cmd.Lobby
+		switch {
+		case cmd.Token != "":
+			line += " --token " + cmd.Token
+		case cmd.Password != "":
+			line += " " + cmd.Password
+		}
+		js.s.handleInput(js.out, client, line)
+	case "ai":
+		if js.require(cmd.Text, "text") {
+			js.s.handleInput(js.out, client, "/ai "+cmd.Text)
+		}
+	case "command":
+		if !strings.HasPrefix(cmd.Text, "/") {
+			js.error(`A command's text must start with "/"`)
+			break
+		}
+		js.s.handleInput(js.out, client, cmd.Text)
+	case "lobbies":
+		if js.allow() {
+			js.lobbies()
+		}
+	case "users":
+		if js.allow() {
+			js.users()
+		}
+	default:
+		js.error(fmt.Sprintf("Unknown command type %q", cmd.Type))
+	}
+	return true
+}
+
+// require reports whether a field was given, telling the client if not
+func (js *jsonSession) require(value, field string) bool {
+	if strings.TrimSpace(value) == "" {
+		js.error(fmt.Sprintf("%q is required", field))
+		return false
+	}
+	return true
+}
+
+// allow applies the command rate limit to commands that don't go through
+// the command handler
+func (js *jsonSession) allow() bool {
+	if ok, errMsg := middleware.CanSendMessage(js.client); !ok {
+		js.error(errMsg)
+		return false
+	}
+	middleware.RecordMessage(js.client)
+	return true
+}
+
+// hello joins the client to general under the username it asked for.
+// A bot's token is checked first, so a bot never joins unauthenticated.
+func (js *jsonSession) hello(cmd jsonCommand) {
+	if errMsg := js.s.usernameError(cmd.Username); errMsg != "" {
+		js.error(errMsg)
+		return
+	}
+	accounts := js.s.commandHandler.Accounts
+	if cmd.Token != "" && !accounts.AuthenticateBot(cmd.Username, cmd.Token) {
+		js.error("Invalid bot name or token")
+		return
+	}
+	js.client = js.s.newClient(js.conn, cmd.Username, js.ip)
+	js.client.Renderer = js
+	if cmd.Token != "" {
+		js.client.Authenticated = true
+		js.client.Bot = true
+	}
+	js.s.join(js.out, js.client)
+	if cmd.Password != "" {
+		js.s.commandHandler.HandleCommand(js.out, "/login "+cmd.Username+" "+cmd.Password, js.client)
+	}
+}
+
+// lobbies sends every lobby with its access and user count
+func (js *jsonSession) lobbies() {
+	lobbies := js.s.lobbyManager.Lobbies()
+	sort.Slice(lobbies, func(i, j int) bool { return lobbies[i].Name < lobbies[j].Name })
+	list := make([]jsonLobby, 0, len(lobbies))
+	for _, lobby := range lobbies {
+		list = append(list, jsonLobby{
+			Name:        lobby.Name,
+			Description: lobby.Desc,
+			Owner:       lobby.Owner,
+			Access:      handlers.LobbyAccess(lobby),
+			Users:       len(js.s.clientManager.GetLobbyUsers(lobby.Name)),
+		})
+	}
+	js.send(jsonEvent{Type: jsonLobbyList, Lobbies: list})
+}
+
+// users sends the users of the client's lobby with their roles
+func (js *jsonSession) users() {
+	lobby := js.client.CurrentLobby
+	users := js.s.clientManager.GetLobbyUsers(lobby)
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	list := make([]jsonUser, 0, len(users))
+	for _, user := range users {
+		list = append(list, jsonUser{
+			Username: user.Username,
+			Profile:  user.UserProfile,
+			Role:     js.s.commandHandler.RoleIn(user, lobby).String(),
+			Bot:      user.Bot,
+		})
+	}
+	js.send(jsonEvent{Type: jsonUserList, Lobby: lobby, Users: list})
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jsonClient is the client end of a JSON protocol connection to a test server
+type jsonClient struct {
+	conn   net.Conn
+	events chan jsonEvent
+}
+
+// dialJSON connects, switches to the JSON protocol and joins as username
+func dialJSON(t *testing.T, s *Server, username string) *jsonClient {
+	t.Helper()
+	c := startJSON(t, s)
+	c.send(t, jsonCommand{Type: "hello", Username: username})
+	c.expect(t, func(ev jsonEvent) bool { return ev.Type == "join" && ev.From == username })
+	return c
+}
+
+// startJSON connects and switches to the JSON protocol without joining
+func startJSON(t *testing.T, s *Server) *jsonClient {
+	t.Helper()
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() { clientSide.Close() })
+	go s.HandleConnection(serverSide)
+
+	c := &jsonClient{conn: clientSide, events: make(chan jsonEvent, 100)}
+	go func() {
+		// The welcome banner comes before the protocol is switched
+		scanner := bufio.NewScanner(clientSide)
+		for scanner.Scan() {
+			var ev jsonEvent
+			if json.Unmarshal(scanner.Bytes(), &ev) == nil {
+				c.events <- ev
+			}
+		}
+		close(c.events)
+	}()
+
+	clientSide.SetWriteDeadline(time.Now().Add(3 * time.Second))
+	if _, err := clientSide.Write([]byte(protoJSON + "\n")); err != nil {
+		t.Fatalf("send %s: %v", protoJSON, err)
+	}
+	c.expect(t, func(ev jsonEvent) bool { return ev.Type == jsonHello })
+	return c
+}
+
+func (c *jsonClient) send(t *testing.T, cmd jsonCommand) {
+	t.Helper()
+	line, _ := json.Marshal(cmd)
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Write(append(line, '\n')); err != nil {
+		t.Fatalf("send %s: %v", line, err)
+	}
+}
+
+// expect reads events until one matches
+func (c *jsonClient) expect(t *testing.T, match func(jsonEvent) bool) jsonEvent {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ev, ok := <-c.events:
+			if !ok {
+				t.Fatal("connection closed waiting for an event")
+			}
+			if match(ev) {
+				return ev
+			}
+		case <-timeout:
+			t.Fatal("expected event never arrived")
+		}
+	}
+}
+
+func TestJSONProtocol(t *testing.T) {
+	s := newTestServer(t)
+	alice := dialJSON(t, s, "alice")
+	bob := dialJSON(t, s, "bob")
+	alice.expect(t, func(ev jsonEvent) bool { return ev.Type == "join" && ev.From == "bob" })
+
+	bob.send(t, jsonCommand{Type: "message", Text: "/not a command"})
+	msg := alice.expect(t, func(ev jsonEvent) bool { return ev.Type == "message" })
+	if msg.From != "bob" || msg.Lobby != "general" || msg.ID != 1 || msg.Text != "/not a command" || msg.Timestamp.IsZero() {
+		t.Errorf("message event = %+v", msg)
+	}
+
+	bob.send(t, jsonCommand{Type: "dm", To: "alice", Text: "psst"})
+	dm := alice.expect(t, func(ev jsonEvent) bool { return ev.Type == "dm" })
+	if dm.From != "bob" || dm.To != "alice" || dm.Text != "psst" {
+		t.Errorf("dm event = %+v", dm)
+	}
+
+	alice.send(t, jsonCommand{Type: "users"})
+	users := alice.expect(t, func(ev jsonEvent) bool { return ev.Type == jsonUserList })
+	if len(users.Users) != 2 || users.Users[0].Username != "alice" || users.Users[1].Role != "member" {
+		t.Errorf("user_list = %+v", users)
+	}
+
+	alice.send(t, jsonCommand{Type: "lobbies"})
+	lobbies := alice.expect(t, func(ev jsonEvent) bool { return ev.Type == jsonLobbyList })
+	if len(lobbies.Lobbies) != 1 || lobbies.Lobbies[0].Name != "general" || lobbies.Lobbies[0].Users != 2 {
+		t.Errorf("lobby_list = %+v", lobbies)
+	}
+
+	alice.send(t, jsonCommand{Type: "command", Text: "/history 5"})
+	alice.expect(t, func(ev jsonEvent) bool {
+		return ev.Type == "notice" && strings.Contains(ev.Text, "/not a command")
+	})
+
+	alice.send(t, jsonCommand{Type: "join", Lobby: "nowhere"})
+	alice.expect(t, func(ev jsonEvent) bool { return ev.Type == "error" && strings.Contains(ev.Text, "does not exist") })
+
+	bob.send(t, jsonCommand{Type: "quit"})
+	alice.expect(t, func(ev jsonEvent) bool { return ev.Type == "leave" && ev.From == "bob" })
+}
+
+func TestJSONProtocolErrors(t *testing.T) {
+	s := newTestServer(t)
+	dialJSON(t, s, "alice")
+	c := startJSON(t, s)
+
+	c.conn.Write([]byte("{not json\n"))
+	c.expect(t, func(ev jsonEvent) bool { return ev.Type == "error" && strings.HasPrefix(ev.Text, "Invalid JSON") })
+
+	c.send(t, jsonCommand{Type: "message", Text: "hi"})
+	c.expect(t, func(ev jsonEvent) bool { return ev.Type == "error" && strings.Contains(ev.Text, "hello") })
+
+	c.send(t, jsonCommand{Type: "hello", Username: "alice"})
+	c.expect(t, func(ev jsonEvent) bool { return ev.Type == "error" && strings.Contains(ev.Text, "already taken") })
+
+	c.send(t, jsonCommand{Type: "hello", Username: "carol"})
+	c.expect(t, func(ev jsonEvent) bool { return ev.Type == "join" && ev.From == "carol" })
+
+	c.send(t, jsonCommand{Type: "dm", To: "alice extra", Text: "hi"})
+	c.expect(t, func(ev jsonEvent) bool { return ev.Type == "error" && strings.Contains(ev.Text, "spaces") })
+
+	c.send(t, jsonCommand{Type: "shout"})
+	c.expect(t, func(ev jsonEvent) bool { return ev.Type == "error" && strings.Contains(ev.Text, `"shout"`) })
+}
+
+func TestJSONBotHello(t *testing.T) {
+	s := newTestServer(t)
+	token, err := s.commandHandler.Accounts.CreateBot("deploybot", "root")
+	if err != nil {
+		t.Fatalf("CreateBot: %v", err)
+	}
+
+	c := startJSON(t, s)
+	c.send(t, jsonCommand{Type: "hello", Username: "deploybot", Token: "bot_wrong"})
+	c.expect(t, func(ev jsonEvent) bool { return ev.Type == "error" && strings.Contains(ev.Text, "Invalid bot") })
+	if s.clientManager.IsUsernameTaken("deploybot") {
+		t.Fatal("joined with a wrong token")
+	}
+
+	c.send(t, jsonCommand{Type: "hello", Username: "deploybot", Token: token})
+	c.expect(t, func(ev jsonEvent) bool { return ev.Type == "join" && ev.From == "deploybot" })
+	if bot := s.clientManager.GetClientByUsername("deploybot"); !bot.Bot || !bot.Authenticated {
+		t.Errorf("bot client = %+v", bot)
+	}
+	c.send(t, jsonCommand{Type: "users"})
+	users := c.expect(t, func(ev jsonEvent) bool { return ev.Type == jsonUserList })
+	if len(users.Users) != 1 || !users.Users[0].Bot {
+		t.Errorf("user_list = %+v", users)
+	}
+}
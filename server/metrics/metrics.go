@@ -0,0 +1,279 @@
+// Package metrics implements the counters, gauges and histograms the server
+// exposes on /metrics in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are latency buckets in seconds, from 100µs to 30s
+var DefaultBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30}
+
+// metric is anything a Registry can write out
+type metric interface {
+	describe() (name, help, kind string)
+	write(w io.Writer)
+}
+
+// Registry holds a set of uniquely named metrics
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// Default is the registry the package-level constructors register with
+var Default = NewRegistry()
+
+func (r *Registry) register(m metric) {
+	name, _, _ := m.describe()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.metrics[name]; exists {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.metrics[name] = m
+}
+
+// Write writes every metric, sorted by name, in the Prometheus text format
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		name, help, kind := m.describe()
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		m.write(w)
+	}
+}
+
+// Handler serves the registry over HTTP
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// Handler serves the default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Counter is a monotonically increasing count
+type Counter struct {
+	name, help string
+	value      atomic.Uint64
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	Default.register(c)
+	return c
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() { c.value.Add(1) }
+
+// Value returns the current count
+func (c *Counter) Value() uint64 { return c.value.Load() }
+
+func (c *Counter) describe() (string, string, string) { return c.name, c.help, "counter" }
+
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "%s %d\n", c.name, c.value.Load())
+}
+
+// CounterVec is a family of counters split by one label
+type CounterVec struct {
+	name, help, label string
+	mu                sync.RWMutex
+	values            map[string]*atomic.Uint64
+}
+
+// NewCounterVec creates and registers a counter family keyed by label
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, values: make(map[string]*atomic.Uint64)}
+	Default.register(c)
+	return c
+}
+
+// Inc adds one to the counter for value
+func (c *CounterVec) Inc(value string) {
+	c.mu.RLock()
+	v, ok := c.values[value]
+	c.mu.RUnlock()
+	if !ok {
+		c.mu.Lock()
+		if v, ok = c.values[value]; !ok {
+			v = new(atomic.Uint64)
+			c.values[value] = v
+		}
+		c.mu.Unlock()
+	}
+	v.Add(1)
+}
+
+// Value returns the current count for value
+func (c *CounterVec) Value(value string) uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if v, ok := c.values[value]; ok {
+		return v.Load()
+	}
+	return 0
+}
+
+func (c *CounterVec) describe() (string, string, string) { return c.name, c.help, "counter" }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, value := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, labelPair(c.label, value), c.values[value].Load())
+	}
+}
+
+// GaugeFunc is a gauge family whose values are computed at scrape time.
+// Until a source is set it reports nothing.
+type GaugeFunc struct {
+	name, help, label string
+	mu                sync.RWMutex
+	source            func() map[string]float64
+}
+
+// NewGaugeFunc creates and registers a gauge family keyed by label. An
+// empty label makes a single gauge read from the "" key of the source.
+func NewGaugeFunc(name, help, label string) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, label: label}
+	Default.register(g)
+	return g
+}
+
+// SetSource replaces the function the gauge is read from
+func (g *GaugeFunc) SetSource(source func() map[string]float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.source = source
+}
+
+func (g *GaugeFunc) describe() (string, string, string) { return g.name, g.help, "gauge" }
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.mu.RLock()
+	source := g.source
+	g.mu.RUnlock()
+	if source == nil {
+		return
+	}
+
+	values := source()
+	if g.label == "" {
+		fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(values[""]))
+		return
+	}
+	for _, value := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", g.name, labelPair(g.label, value), formatFloat(values[value]))
+	}
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates and registers a histogram with the given upper bounds
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	Default.register(h)
+	return h
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) describe() (string, string, string) { return h.name, h.help, "histogram" }
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelPair(label, value string) string {
+	return label + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
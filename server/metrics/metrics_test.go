@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q; want text/plain", ct)
+	}
+	return rec.Body.String()
+}
+
+func expectLines(t *testing.T, output string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, output)
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	c := NewCounter("test_events_total", "Events seen.")
+	c.Inc()
+	c.Inc()
+
+	v := NewCounterVec("test_requests_total", "Requests by result.", "result")
+	v.Inc("ok")
+	v.Inc("ok")
+	v.Inc(`say "hi"`)
+
+	expectLines(t, scrape(t),
+		"# HELP test_events_total Events seen.",
+		"# TYPE test_events_total counter",
+		"test_events_total 2",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{result="ok"} 2`,
+		`test_requests_total{result="say \"hi\""} 1`,
+	)
+	if got := v.Value("missing"); got != 0 {
+		t.Errorf("Value of unseen label = %d; want 0", got)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	g := NewGaugeFunc("test_users", "Users per room.", "room")
+	if out := scrape(t); strings.Contains(out, "test_users{") {
+		t.Errorf("gauge without a source reported values:\n%s", out)
+	}
+
+	g.SetSource(func() map[string]float64 { return map[string]float64{"b": 1, "a": 3} })
+	expectLines(t, scrape(t),
+		"# TYPE test_users gauge",
+		`test_users{room="a"} 3`,
+		`test_users{room="b"} 1`,
+	)
+
+	single := NewGaugeFunc("test_rooms", "Rooms.", "")
+	single.SetSource(func() map[string]float64 { return map[string]float64{"": 7} })
+	expectLines(t, scrape(t), "test_rooms 7")
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	expectLines(t, scrape(t),
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{le="0.1"} 2`,
+		`test_latency_seconds_bucket{le="1"} 3`,
+		`test_latency_seconds_bucket{le="+Inf"} 4`,
+		"test_latency_seconds_sum 3.65",
+		"test_latency_seconds_count 4",
+	)
+}
+
+func TestDuplicateNamePanics(t *testing.T) {
+	r := NewRegistry()
+	r.register(&Counter{name: "dup"})
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a duplicate name did not panic")
+		}
+	}()
+	r.register(&Counter{name: "dup"})
+}
+
+func TestOutputIsSorted(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRegistry()
+	r.register(&Counter{name: "b_total", help: "B."})
+	r.register(&Counter{name: "a_total", help: "A."})
+	r.Write(&buf)
+	if out := buf.String(); strings.Index(out, "a_total") > strings.Index(out, "b_total") {
+		t.Errorf("metrics not sorted by name:\n%s", out)
+	}
+}
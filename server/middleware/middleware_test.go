@@ -47,11 +47,15 @@ func TestCanSendMessage(t *testing.T) {
 	}
 
 	// Simulate sending max messages
+	rejected := rateLimited.Value("message")
 	c.MessageCount = MaxMessagesPerWindow
 	allowed, msg = CanSendMessage(c)
 	if allowed || !strings.Contains(msg, "Rate limited") {
 		t.Errorf("expected rate limited, got allowed=%v, msg=%q", allowed, msg)
 	}
+	if got := rateLimited.Value("message"); got != rejected+1 {
+		t.Errorf("expected rejection to be counted, got %d -> %d", rejected, got)
+	}
 
 	// Simulate window expiration
 	c.WindowStart = now.Add(-RateLimitWindow - time.Second)
@@ -68,6 +72,17 @@ func TestCanSendMessage(t *testing.T) {
 	}
 }
 
+func TestBotMessageLimit(t *testing.T) {
+	bot := &models.Client{Bot: true, WindowStart: time.Now(), MessageCount: MaxMessagesPerWindow}
+	if allowed, msg := CanSendMessage(bot); !allowed {
+		t.Errorf("bot limited at the user limit: %q", msg)
+	}
+	bot.MessageCount = BotMaxMessagesPerWindow
+	if allowed, _ := CanSendMessage(bot); allowed {
+		t.Error("bot allowed past its own limit")
+	}
+}
+
 func TestIPConnections(t *testing.T) {
 	ipConnections = make(map[string]int) // reset global state
 
@@ -7,31 +7,73 @@ import (
 	"sync"
 	"time"
 
+	"chat-server/server/metrics"
 	"chat-server/server/models"
 )
 
+// Default limits, used until Configure is called
 const (
-	MaxMessagesPerWindow = 5
-	RateLimitWindow      = 10 * time.Second
-	MaxConnectionsPerIP  = 10
+	MaxMessagesPerWindow    = 5
+	BotMaxMessagesPerWindow = 30
+	RateLimitWindow         = 10 * time.Second
+	MaxConnectionsPerIP     = 10
 )
 
+// Limits holds the active rate limits
+type Limits struct {
+	MaxMessagesPerWindow    int
+	BotMaxMessagesPerWindow int // replaces MaxMessagesPerWindow for bots
+	RateLimitWindow         time.Duration
+	MaxConnectionsPerIP     int
+}
+
 var (
 	ipConnections = make(map[string]int)
 	ipMutex       sync.RWMutex
+
+	limits = Limits{
+		MaxMessagesPerWindow:    MaxMessagesPerWindow,
+		BotMaxMessagesPerWindow: BotMaxMessagesPerWindow,
+		RateLimitWindow:         RateLimitWindow,
+		MaxConnectionsPerIP:     MaxConnectionsPerIP,
+	}
+	limitsMutex sync.RWMutex
+
+	rateLimited = metrics.NewCounterVec("chat_rate_limit_rejections_total",
+		"Messages and connections refused by the rate limiter, by kind.", "kind")
 )
 
-// CanSendMessage checks if client can send a message
+// Configure replaces the active rate limits
+func Configure(l Limits) {
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+	limits = l
+}
+
+func currentLimits() Limits {
+	limitsMutex.RLock()
+	defer limitsMutex.RUnlock()
+	return limits
+}
+
+// CanSendMessage checks if client can send a message. Bots, which post
+// in bursts, get a limit of their own.
 func CanSendMessage(c *models.Client) (bool, string) {
+	l := currentLimits()
 	now := time.Now()
+	max := l.MaxMessagesPerWindow
+	if c.Bot {
+		max = l.BotMaxMessagesPerWindow
+	}
 
-	if now.Sub(c.WindowStart) > RateLimitWindow {
+	if now.Sub(c.WindowStart) > l.RateLimitWindow {
 		c.MessageCount = 0
 		c.WindowStart = now
 	}
 
-	if c.MessageCount >= MaxMessagesPerWindow {
-		timeLeft := RateLimitWindow - now.Sub(c.WindowStart)
+	if c.MessageCount >= max {
+		rateLimited.Inc("message")
+		timeLeft := l.RateLimitWindow - now.Sub(c.WindowStart)
 		return false, fmt.Sprintf("Rate limited! Wait %.0f seconds.", timeLeft.Seconds())
 	}
 	return true, ""
@@ -56,8 +98,11 @@ func GetIP(conn net.Conn) string {
 func CanAcceptConnection(ip string) bool {
 	ipMutex.Lock()
 	defer ipMutex.Unlock()
-	count := ipConnections[ip]
-	return count < MaxConnectionsPerIP
+	if ipConnections[ip] >= currentLimits().MaxConnectionsPerIP {
+		rateLimited.Inc("connection")
+		return false
+	}
+	return true
 }
 
 // IncrementIPConnection increments IP connection count
@@ -5,44 +5,257 @@ import (
 	"time"
 )
 
+// Role is a user's standing in a lobby, ordered from least to most trusted
+type Role int
+
+const (
+	RoleGuest Role = iota
+	RoleMember
+	RoleVoiced
+	RoleOperator
+	RoleOwner
+)
+
+// String returns the role's display name
+func (r Role) String() string {
+	switch r {
+	case RoleGuest:
+		return "guest"
+	case RoleVoiced:
+		return "voiced"
+	case RoleOperator:
+		return "operator"
+	case RoleOwner:
+		return "owner"
+	default:
+		return "member"
+	}
+}
+
+// Who may join a lobby, as reported to JSON clients
+const (
+	AccessPublic     = "public"
+	AccessPrivate    = "private" // needs a password
+	AccessInviteOnly = "invite-only"
+	AccessArchived   = "archived"
+)
+
 // Lobby represents a chat room
 type Lobby struct {
 	Name      string
 	IsPrivate bool
 	Password  string
 	Creator   string
+	Owner     string
 	Desc      string
 	AIPrompt  string
+	Roles     map[string]Role // explicit voiced/operator grants by username
+
+	// Unowned lobbies were created by a user who wasn't logged in, so
+	// nobody holds the owner role until a server operator transfers it
+	Unowned bool
+
+	// InviteOnly lobbies admit only the owner, users with a role grant and
+	// users on the Allowlist. Being on the Allowlist also skips the password.
+	InviteOnly bool
+	Allowlist  map[string]bool
+	Invites    []Invite // pending invitations, each usable once
+
+	// Archived lobbies keep their history but nobody can post in them
+	Archived bool
+
+	Webhooks []Webhook // outgoing webhooks registered by the owner
+}
+
+// Invite lets one user join a lobby once before it expires. Only a hash
+// of the token is kept.
+type Invite struct {
+	Username  string
+	By        string
+	TokenHash string
+	Created   time.Time
+	Expires   time.Time
+}
+
+// Webhook posts a lobby's events of the chosen types to URL, signed with
+// Secret
+type Webhook struct {
+	ID      string
+	URL     string
+	Secret  string
+	Events  []string // event types, such as "message" or "mention"
+	By      string
+	Created time.Time
+}
+
+// DeadLetter is a webhook delivery that was given up on after its retries
+type DeadLetter struct {
+	ID       uint64
+	Webhook  string // the webhook's ID
+	URL      string
+	Event    string
+	Payload  []byte
+	Attempts int
+	Error    string // why the last attempt failed
+	Failed   time.Time
+}
+
+// Bot is an account for a program such as a CI notifier. It logs in with
+// a long-lived token, of which only a hash is kept.
+type Bot struct {
+	Name      string
+	TokenHash string
+	CreatedBy string
+	Created   time.Time
 }
 
 // Client represents a connected user
 type Client struct {
-	Username     string
-	UserProfile  string
-	CurrentLobby string
-	Conn         net.Conn
-	LastMessage  time.Time
-	MessageCount int
-	WindowStart  time.Time
+	Username      string
+	UserProfile   string
+	CurrentLobby  string
+	CurrentThread uint64 // root of the thread plain messages go to, or 0 for the lobby
+	Conn          net.Conn
+	LastMessage   time.Time
+	MessageCount  int
+	WindowStart   time.Time
+	Authenticated bool
+	IP            string
+
+	// KeyFingerprint is the SSH key the client connected with, or "" if
+	// it didn't connect over SSH
+	KeyFingerprint string
+
+	// Bot is set once the client logged in with a bot token
+	Bot bool
+
+	// Outbox holds pending writes for the client's writer goroutine.
+	// Done is closed once the client has been removed.
+	Outbox chan []byte
+	Done   chan struct{}
+
+	// Renderer encodes what the client is sent for frontends that don't
+	// use the ANSI terminal text, such as IRC; nil means ANSI
+	Renderer Renderer
+}
+
+// EventType says what an Event reports
+type EventType string
+
+const (
+	EventMessage    EventType = "message"     // a message posted to a lobby
+	EventJoin       EventType = "join"        // a user entered a lobby
+	EventLeave      EventType = "leave"       // a user left a lobby or disconnected
+	EventDM         EventType = "dm"          // a private message
+	EventAIResponse EventType = "ai_response" // one line of an AI reply
+	EventTopic      EventType = "topic"       // a lobby's description changed
+	EventNotice     EventType = "notice"      // any other server output
+	EventError      EventType = "error"       // a command or message was refused
+)
+
+// Event is something sent to a client, described in a form that frontends
+// other than the ANSI terminal can render
+type Event struct {
+	Type      EventType
+	Lobby     string // empty for events not tied to a lobby
+	From      string
+	To        string // recipient of a private message
+	ID        uint64 // stored message ID, or 0
+	Text      string // plain text without ANSI codes
+	Timestamp time.Time
+}
+
+// Renderer turns events into the bytes a client's protocol expects.
+// Render may return nil to send nothing.
+type Renderer interface {
+	Render(client *Client, ev Event) []byte
+}
+
+// Ban keeps a username or IP address out of a lobby, or out of the
+// whole server when Lobby is empty
+type Ban struct {
+	Target  string
+	IsIP    bool
+	Lobby   string
+	Reason  string
+	By      string
+	Created time.Time
+	Expires time.Time // zero for a permanent ban
+}
+
+// Expired reports whether a temporary ban has run out
+func (b *Ban) Expired() bool {
+	return !b.Expires.IsZero() && time.Now().After(b.Expires)
 }
 
 // LobbyMessage represents a message in a lobby
 type LobbyMessage struct {
+	ID          uint64 // assigned by the store, counts up within a lobby
 	Username    string
 	Text        string
 	UserProfile string
 	Timestamp   time.Time
+	ReplyTo     uint64    // ID of the message this one answers, if any
+	EditedAt    time.Time // zero unless the author changed the text
+	Deleted     bool      // the text is gone but the ID stays taken
+	Thread      uint64    // ID of the thread's first message for thread replies
+	Reactions   []Reaction
+}
+
+// Reaction is one emoji on a message and who added it, in the order
+// the emoji were first used
+type Reaction struct {
+	Emoji string
+	Users []string
+}
+
+// Mail is a direct message kept for a user who was offline when it was sent
+type Mail struct {
+	ID          uint64 // assigned by the store, counts up within a mailbox
+	From        string
+	FromProfile string
+	Text        string
+	Sent        time.Time
+	Read        bool
+}
+
+// DirectMessage is a private message between two users
+type DirectMessage struct {
+	ID          uint64 // assigned by the store, counts up within a conversation
+	From        string
+	To          string
+	FromProfile string
+	Text        string
+	Timestamp   time.Time
+}
+
+// DirectConversation is one user's view of their conversation with Peer
+type DirectConversation struct {
+	Peer     string
+	LastID   uint64
+	LastFrom string
+	LastText string
+	LastAt   time.Time
+	ReadID   uint64 // newest message the user has seen with /dm or replied after
+}
+
+// Unread returns how many messages arrived since the user last caught up
+func (c DirectConversation) Unread() int {
+	return int(c.LastID - c.ReadID)
 }
 
 // LobbyContext stores recent messages for context
 type LobbyContext struct {
 	RecentMessages []LobbyMessage
-	Mu             interface{} // sync.RWMutex
+	ThreadMessages []LobbyMessage // recent thread replies, kept apart from the main lobby
+	Mu             interface{}    // sync.RWMutex
 }
 
 // Message struct for broadcasting
 type Message struct {
+	ID        uint64 // the stored LobbyMessage's ID, or 0 if it was not stored
 	From      *Client
+	Lobby     string
 	Text      string
 	Timestamp time.Time
 }
@@ -0,0 +1,204 @@
+// Package search keeps an in-memory inverted index of lobby messages so
+// that /search does not have to scan the stored history
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"chat-server/server/models"
+)
+
+// Ref identifies a stored message
+type Ref struct {
+	Lobby string
+	ID    uint64
+}
+
+// entry is what the index remembers about a message besides its terms
+type entry struct {
+	username  string
+	timestamp time.Time
+	terms     []string
+}
+
+// Query selects messages containing every term. From and Lobby narrow the
+// results to one sender or one lobby; Allowed, if set, reports whether a
+// lobby may be searched at all.
+type Query struct {
+	Terms   []string
+	From    string
+	Lobby   string
+	Allowed func(lobby string) bool
+	Limit   int
+}
+
+// Index maps terms to the messages that contain them
+type Index struct {
+	mu       sync.RWMutex
+	postings map[string]map[Ref]struct{}
+	entries  map[Ref]*entry
+}
+
+// NewIndex creates an empty index
+func NewIndex() *Index {
+	return &Index{
+		postings: make(map[string]map[Ref]struct{}),
+		entries:  make(map[Ref]*entry),
+	}
+}
+
+// Tokenize splits text into lower-cased words, dropping punctuation and
+// duplicates
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]bool, len(words))
+	terms := words[:0]
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// Add indexes a message; adding an already indexed message replaces it
+func (ix *Index) Add(lobby string, msg models.LobbyMessage) {
+	ref := Ref{Lobby: lobby, ID: msg.ID}
+	e := &entry{
+		username:  strings.ToLower(msg.Username),
+		timestamp: msg.Timestamp,
+		terms:     Tokenize(msg.Text),
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(ref)
+	ix.entries[ref] = e
+	for _, term := range e.terms {
+		refs, ok := ix.postings[term]
+		if !ok {
+			refs = make(map[Ref]struct{})
+			ix.postings[term] = refs
+		}
+		refs[ref] = struct{}{}
+	}
+}
+
+// Remove drops a message from the index
+func (ix *Index) Remove(lobby string, id uint64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(Ref{Lobby: lobby, ID: id})
+}
+
+// RemoveLobby drops every message of a lobby
+func (ix *Index) RemoveLobby(lobby string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for ref := range ix.entries {
+		if ref.Lobby == lobby {
+			ix.remove(ref)
+		}
+	}
+}
+
+// remove drops ref from the index; ix.mu must be held
+func (ix *Index) remove(ref Ref) {
+	e, ok := ix.entries[ref]
+	if !ok {
+		return
+	}
+	delete(ix.entries, ref)
+	for _, term := range e.terms {
+		delete(ix.postings[term], ref)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+}
+
+// Len returns the number of indexed messages
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.entries)
+}
+
+// Search returns the messages matching q, newest first. It also returns
+// how many matched in total, which may exceed q.Limit. A query with no
+// words to look for and no sender matches nothing.
+func (ix *Index) Search(q Query) ([]Ref, int) {
+	var terms []string
+	for _, t := range q.Terms {
+		terms = append(terms, Tokenize(t)...)
+	}
+	from := strings.ToLower(q.From)
+	if len(terms) == 0 && from == "" {
+		return nil, 0
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	// Walk the rarest term's postings and check the others against it
+	var candidates map[Ref]struct{}
+	if len(terms) > 0 {
+		sort.Slice(terms, func(i, j int) bool {
+			return len(ix.postings[terms[i]]) < len(ix.postings[terms[j]])
+		})
+		candidates = ix.postings[terms[0]]
+	}
+
+	var matches []Ref
+	consider := func(ref Ref) {
+		e := ix.entries[ref]
+		if q.Lobby != "" && ref.Lobby != q.Lobby {
+			return
+		}
+		if from != "" && e.username != from {
+			return
+		}
+		for _, term := range terms[min(1, len(terms)):] {
+			if _, ok := ix.postings[term][ref]; !ok {
+				return
+			}
+		}
+		if q.Allowed != nil && !q.Allowed(ref.Lobby) {
+			return
+		}
+		matches = append(matches, ref)
+	}
+	if len(terms) > 0 {
+		for ref := range candidates {
+			consider(ref)
+		}
+	} else {
+		for ref := range ix.entries {
+			consider(ref)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := ix.entries[matches[i]], ix.entries[matches[j]]
+		if !a.timestamp.Equal(b.timestamp) {
+			return a.timestamp.After(b.timestamp)
+		}
+		if matches[i].Lobby != matches[j].Lobby {
+			return matches[i].Lobby < matches[j].Lobby
+		}
+		return matches[i].ID > matches[j].ID
+	})
+
+	total := len(matches)
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+	return matches, total
+}
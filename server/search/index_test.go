@@ -0,0 +1,80 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"chat-server/server/models"
+)
+
+func TestTokenize(t *testing.T) {
+	got := Tokenize("Deploy the API, then deploy-again! ÜBER 42")
+	want := []string{"deploy", "the", "api", "then", "again", "über", "42"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize = %q; want %q", got, want)
+	}
+}
+
+func TestIndexSearch(t *testing.T) {
+	ix := NewIndex()
+	start := time.Now()
+	sent := 0
+	add := func(lobby string, id uint64, user, text string) {
+		sent++
+		ix.Add(lobby, models.LobbyMessage{ID: id, Username: user, Text: text, Timestamp: start.Add(time.Duration(sent) * time.Second)})
+	}
+	add("general", 1, "alice", "the build is broken")
+	add("general", 2, "bob", "Build fixed, deploying now")
+	add("ops", 1, "alice", "deploying the build to prod")
+	add("ops", 2, "carol", "lunch?")
+
+	tests := []struct {
+		name  string
+		query Query
+		want  []Ref
+	}{
+		{"single term newest first", Query{Terms: []string{"build"}},
+			[]Ref{{"ops", 1}, {"general", 2}, {"general", 1}}},
+		{"all terms must match", Query{Terms: []string{"BUILD", "deploying"}},
+			[]Ref{{"ops", 1}, {"general", 2}}},
+		{"from", Query{Terms: []string{"build"}, From: "Alice"},
+			[]Ref{{"ops", 1}, {"general", 1}}},
+		{"from without terms", Query{From: "carol"}, []Ref{{"ops", 2}}},
+		{"only punctuation", Query{Terms: []string{"!!!", "?"}}, nil},
+		{"in", Query{Terms: []string{"build"}, Lobby: "general"},
+			[]Ref{{"general", 2}, {"general", 1}}},
+		{"allowed", Query{Terms: []string{"build"}, Allowed: func(l string) bool { return l != "ops" }},
+			[]Ref{{"general", 2}, {"general", 1}}},
+		{"unknown term", Query{Terms: []string{"build", "nope"}}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, total := ix.Search(tc.query)
+			if !reflect.DeepEqual(got, tc.want) || total != len(tc.want) {
+				t.Errorf("Search = %v (total %d); want %v", got, total, tc.want)
+			}
+		})
+	}
+
+	got, total := ix.Search(Query{Terms: []string{"build"}, Limit: 1})
+	if len(got) != 1 || total != 3 {
+		t.Errorf("Search with Limit 1 = %v (total %d); want 1 result of 3", got, total)
+	}
+}
+
+func TestIndexRemove(t *testing.T) {
+	ix := NewIndex()
+	ix.Add("general", models.LobbyMessage{ID: 1, Text: "old text"})
+	ix.Add("general", models.LobbyMessage{ID: 1, Text: "new text"})
+	ix.Add("ops", models.LobbyMessage{ID: 1, Text: "text"})
+
+	if got, _ := ix.Search(Query{Terms: []string{"old"}}); len(got) != 0 {
+		t.Errorf("re-adding a message kept its old terms: %v", got)
+	}
+	ix.Remove("general", 1)
+	ix.RemoveLobby("ops")
+	if got, _ := ix.Search(Query{Terms: []string{"text"}}); len(got) != 0 || ix.Len() != 0 {
+		t.Errorf("after removal Search = %v, Len = %d; want nothing", got, ix.Len())
+	}
+}
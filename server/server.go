@@ -5,46 +5,122 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"strings"
+	"sync"
 	"time"
 
+	"chat-server/server/config"
 	"chat-server/server/handlers"
 	"chat-server/server/middleware"
 	"chat-server/server/models"
+	"chat-server/server/storage"
 	"chat-server/server/utils"
+	"chat-server/server/webhooks"
 )
 
 // Server represents the chat server
 type Server struct {
 	clientManager  *handlers.ClientManager
 	lobbyManager   *handlers.LobbyManager
+	moderation     *handlers.ModerationManager
 	commandHandler *handlers.CommandHandler
+	webhooks       *webhooks.Dispatcher
 	messages       chan *models.Message
+
+	// Settings that Reload may change while clients are connected
+	mu             sync.RWMutex
+	readTimeout    time.Duration
+	motd           string
+	authorizedKeys string
 }
 
-// NewServer creates a new chat server instance
-func NewServer() *Server {
-	cm := handlers.NewClientManager()
-	lm := handlers.NewLobbyManager()
-	ch := handlers.NewCommandHandler(cm, lm)
+// NewServer creates a new chat server instance configured by cfg and backed by store
+func NewServer(cfg *config.Config, store storage.Store) *Server {
+	cm := handlers.NewClientManager(store)
+	mm := handlers.NewModerationManager(store)
+	lm := handlers.NewLobbyManager(store, mm)
+	am := handlers.NewAccountManager(store)
+	ch := handlers.NewCommandHandler(cm, lm, am, mm, handlers.NewMailboxManager(store),
+		handlers.NewDirectMessageManager(store))
+	wd := webhooks.NewDispatcher(lm.Webhooks, store)
+	cm.SetEventHook(wd.Publish)
+	ch.Webhooks = wd
 
-	return &Server{
+	s := &Server{
 		clientManager:  cm,
 		lobbyManager:   lm,
+		moderation:     mm,
 		commandHandler: ch,
+		webhooks:       wd,
 		messages:       make(chan *models.Message, 100),
 	}
+	s.Reload(cfg)
+	return s
+}
+
+// Reload applies the settings of cfg that can change without a restart:
+// outbox policy, operators, login grace period, AI queue limits, mailbox
+// quota, webhook retries, read timeout, MOTD and the SSH authorized keys
+// file.
+// Connected clients keep their session; new limits apply from their next
+// message, except the outbox size, which applies from their next
+// connection.
+func (s *Server) Reload(cfg *config.Config) {
+	policy, err := handlers.ParseSlowConsumerPolicy(cfg.Limits.SlowConsumerPolicy)
+	if err != nil {
+		log.Printf("%v, using drop-oldest", err)
+	}
+	s.clientManager.SetOutboxPolicy(cfg.Limits.OutboxSize, policy)
+	s.moderation.SetOperators(cfg.Server.Operators)
+	s.commandHandler.SetLoginGracePeriod(cfg.Limits.LoginGracePeriod)
+	s.commandHandler.SetAILimits(cfg.AI.MaxConcurrent, cfg.AI.MaxQueue)
+	s.commandHandler.Mailbox.SetQuota(cfg.Limits.MailboxQuota)
+	s.lobbyManager.SetThreadContext(cfg.AI.ThreadContext)
+	var allowed []netip.Prefix
+	for _, network := range cfg.Webhooks.AllowedNetworks {
+		if prefix, err := netip.ParsePrefix(network); err == nil {
+			allowed = append(allowed, prefix)
+		}
+	}
+	s.webhooks.Configure(webhooks.Settings{
+		MaxAttempts:     cfg.Webhooks.MaxAttempts,
+		Backoff:         cfg.Webhooks.Backoff,
+		Timeout:         cfg.Webhooks.Timeout,
+		AllowedNetworks: allowed,
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readTimeout = cfg.Server.ReadTimeout
+	s.motd = cfg.Server.MOTD
+	s.authorizedKeys = cfg.Server.SSHAuthorizedKeys
 }
 
-// Start starts the server components
-func (s *Server) Start() {
+func (s *Server) currentSettings() (readTimeout time.Duration, motd string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readTimeout, s.motd
+}
+
+// Start restores persisted state and starts the server components.
+// It must be called before any connection is handed to HandleConnection.
+func (s *Server) Start() error {
 	s.lobbyManager.CreateDefaultLobby()
+	if err := s.lobbyManager.LoadFromStore(); err != nil {
+		return err
+	}
+	if err := s.moderation.LoadFromStore(); err != nil {
+		return err
+	}
+	s.webhooks.Start()
 	go s.broadcastMessages()
 	go s.lobbyManager.CleanupInactiveContexts()
+	return nil
 }
 
 // HandleConnection handles a new client connection
-	func (s *Server) HandleConnection(conn net.Conn) {
+func (s *Server) HandleConnection(conn net.Conn) {
 	ip := middleware.GetIP(conn)
 	defer func() {
 		if r := recover(); r != nil {
@@ -53,24 +129,22 @@ func (s *Server) Start() {
 			conn.Close()
 		}
 	}()
-	if !middleware.CanAcceptConnection(ip) {
-		conn.Write([]byte(utils.ColorRed + "Too many connections from your IP. Try again later.\n" + utils.ColorReset))
+	if errMsg := s.admissionError(ip); errMsg != "" {
+		conn.Write([]byte(utils.ColorRed + errMsg + "\n" + utils.ColorReset))
 		conn.Close()
 		return
 	}
 
 	middleware.IncrementIPConnection(ip)
-	conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+	readTimeout, motd := s.currentSettings()
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
 	defer middleware.DecrementIPConnection(ip)
 
 	sendWelcomeBanner(conn)
+	sendMOTD(conn, motd)
 	defer func() {
 		conn.Close()
-		if client := s.clientManager.RemoveClient(conn); client != nil {
-			fmt.Printf("%s disconnected from the server\n", client.Username)
-			s.clientManager.BroadcastToLobby(client.CurrentLobby,
-				fmt.Sprintf("%s%s%s has left the lobby", utils.ColorRed, client.Username, utils.ColorReset))
-		}
+		s.leave(conn)
 	}()
 
 	scanner := bufio.NewScanner(conn)
@@ -82,85 +156,190 @@ func (s *Server) Start() {
 		if scanner.Scan() {
 			username = strings.TrimSpace(scanner.Text())
 		}
+		if username == protoJSON {
+			s.serveJSON(conn, scanner, ip)
+			return
+		}
 		if username == "" {
 			username = conn.RemoteAddr().String()
 		}
 
-		valid, errMsg := utils.IsValidUsername(username)
-		if !valid {
-			conn.Write([]byte(utils.ColorRed + errMsg + "\n" + utils.ColorReset))
-			continue
-		}
-
-		if !s.clientManager.IsUsernameTaken(username) {
+		errMsg := s.usernameError(username)
+		if errMsg == "" {
 			break
 		}
-		conn.Write([]byte(utils.ColorRed + "Username already taken, try another.\n" + utils.ColorReset))
+		conn.Write([]byte(utils.ColorRed + errMsg + "\n" + utils.ColorReset))
+	}
+
+	s.chat(conn, scanner, s.newClient(conn, username, ip))
+}
+
+// newClient creates the session of a user who connected from ip on conn
+// and chose username
+func (s *Server) newClient(conn net.Conn, username, ip string) *models.Client {
+	profile := s.clientManager.LoadProfile(username)
+	if profile == "" {
+		profile = "[@_@]"
 	}
 
-	newClient := &models.Client{
+	return &models.Client{
 		Conn:         conn,
 		Username:     username,
-		UserProfile:  "[@_@]",
+		UserProfile:  profile,
 		CurrentLobby: "general",
 		WindowStart:  time.Now(),
+		IP:           ip,
 	}
+}
 
-	s.clientManager.AddClient(conn, newClient)
-	fmt.Printf("%s connected to the server (lobby: general)\n", username)
-	s.clientManager.BroadcastToLobby("general",
-		fmt.Sprintf("%s%s%s has joined the lobby", utils.ColorGreen, username, utils.ColorReset))
-
-	recent := s.lobbyManager.GetRecentMessages(newClient.CurrentLobby, 5*time.Minute)
-	conn.Write([]byte(recent))
+// chat joins client and acts on each line scanner reads from conn until
+// the client disconnects
+func (s *Server) chat(conn net.Conn, scanner *bufio.Scanner, client *models.Client) {
+	s.join(conn, client)
 
 	// Read messages from client
 	for scanner.Scan() {
-	  conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+		readTimeout, _ := s.currentSettings()
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
 		text := strings.TrimSpace(scanner.Text())
 		if text == "" {
 			continue
 		}
-		if len(text) > utils.MaxMessageLength {
-			conn.Write([]byte(utils.ColorRed + fmt.Sprintf("Message too long (max %d chars)\n", utils.MaxMessageLength) + utils.ColorReset))
-			continue
-		}
+		s.handleInput(conn, client, text)
+	}
 
-		if strings.HasPrefix(text, "/") {
-			s.commandHandler.HandleCommand(conn, text, newClient)
-			continue
-		}
+	if err := scanner.Err(); err != nil {
+		log.Println("Connection error:", err)
+	}
+}
 
-		canSend, errMsg := middleware.CanSendMessage(newClient)
-		if !canSend {
-			conn.Write([]byte(utils.ColorRed + "⚠ " + errMsg + utils.ColorReset + "\n"))
-			continue
-		}
+// admissionError reports why a connection from ip is refused, or "" if
+// it may connect
+func (s *Server) admissionError(ip string) string {
+	if !middleware.CanAcceptConnection(ip) {
+		return "Too many connections from your IP. Try again later."
+	}
+	if ban := s.moderation.FindBan("", "", ip); ban != nil {
+		return "Your IP address is banned from this server."
+	}
+	return ""
+}
 
-		middleware.RecordMessage(newClient)
-		s.lobbyManager.StoreMessage(newClient.CurrentLobby, newClient.UserProfile, newClient.Username, text)
+// usernameError reports why username can't be chosen, or "" if it can
+func (s *Server) usernameError(username string) string {
+	if valid, errMsg := utils.IsValidUsername(username); !valid {
+		return errMsg
+	}
+	if strings.EqualFold(username, handlers.AIUsername) {
+		return "That username is reserved, try another."
+	}
+	if s.moderation.FindBan("", username, "") != nil {
+		return "That username is banned from this server."
+	}
+	if s.clientManager.IsUsernameTaken(username) {
+		return "Username already taken, try another."
+	}
+	return ""
+}
+
+// join adds a client that has chosen its name, announces it in its lobby
+// and catches it up on recent messages, mail and invitations, writing to
+// conn
+func (s *Server) join(conn net.Conn, client *models.Client) {
+	s.clientManager.AddClient(client.Conn, client)
+	fmt.Printf("%s connected to the server (lobby: %s)\n", client.Username, client.CurrentLobby)
+	s.clientManager.BroadcastEvent(models.Event{Type: models.EventJoin, Lobby: client.CurrentLobby, From: client.Username},
+		fmt.Sprintf("%s%s%s has joined the lobby", utils.ColorGreen, client.Username, utils.ColorReset))
+
+	recent := s.lobbyManager.GetRecentMessages(client.CurrentLobby, 5*time.Minute)
+	conn.Write([]byte(recent))
+
+	s.commandHandler.ReserveUsername(client)
+	s.commandHandler.DeliverMail(client)
+	s.commandHandler.DeliverInvites(client)
+}
+
+// leave removes the client connected on conn, if it got as far as
+// joining, and tells its lobby
+func (s *Server) leave(conn net.Conn) {
+	client := s.clientManager.RemoveClient(conn)
+	if client == nil {
+		return
+	}
+	s.commandHandler.StopAI(client)
+	fmt.Printf("%s disconnected from the server\n", client.Username)
+	s.clientManager.BroadcastEvent(models.Event{Type: models.EventLeave, Lobby: client.CurrentLobby, From: client.Username},
+		fmt.Sprintf("%s%s%s has left the lobby", utils.ColorRed, client.Username, utils.ColorReset))
+}
 
-		s.messages <- &models.Message{
-			From:      newClient,
-			Text:      text,
-			Timestamp: time.Now(),
+// handleInput acts on a line a client typed: a command, or a message for
+// its lobby or thread. Replies are written to conn.
+func (s *Server) handleInput(conn net.Conn, client *models.Client, text string) {
+	if strings.HasPrefix(text, "/") {
+		if !s.tooLong(conn, text) {
+			s.commandHandler.HandleCommand(conn, text, client)
 		}
+		return
 	}
+	s.post(conn, client, text)
+}
 
-	if err := scanner.Err(); err != nil {
-		log.Println("Connection error:", err)
+// tooLong tells the client on conn if text is over the length limit
+func (s *Server) tooLong(conn net.Conn, text string) bool {
+	if maxLen := utils.MessageLengthLimit(); len(text) > maxLen {
+		conn.Write([]byte(utils.ColorRed + fmt.Sprintf("Message too long (max %d chars)\n", maxLen) + utils.ColorReset))
+		return true
+	}
+	return false
+}
+
+// post sends text from client to its lobby or thread, even if it starts
+// with a slash. Replies are written to conn.
+func (s *Server) post(conn net.Conn, client *models.Client, text string) {
+	if s.tooLong(conn, text) || s.commandHandler.CheckMuted(conn, client) {
+		return
+	}
+
+	canSend, errMsg := middleware.CanSendMessage(client)
+	if !canSend {
+		conn.Write([]byte(utils.ColorRed + "⚠ " + errMsg + utils.ColorReset + "\n"))
+		return
+	}
+
+	middleware.RecordMessage(client)
+	if client.CurrentThread != 0 {
+		s.commandHandler.PostToThread(client, text)
+		return
+	}
+	lobby := client.CurrentLobby
+	stored := s.lobbyManager.StoreMessage(lobby, client.UserProfile, client.Username, text)
+
+	s.messages <- &models.Message{
+		ID:        stored.ID,
+		From:      client,
+		Lobby:     lobby,
+		Text:      text,
+		Timestamp: stored.Timestamp,
 	}
 }
 
 func (s *Server) broadcastMessages() {
-  defer func() {
+	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("PANIC in broadcastMessages: %v", r)
 		}
 	}()
 	for msg := range s.messages {
 		s.clientManager.BroadcastMessage(msg, func(profile, username, text, colorYellow, colorWhite, colorCyan, colorReset string) string {
-			return utils.FormatMessage(profile, username, text, colorYellow, colorWhite, colorCyan, colorReset, msg.Timestamp)
+			return utils.FormatMessage(msg.ID, profile, username, text, colorYellow, colorWhite, colorCyan, colorReset, msg.Timestamp)
+		})
+		s.webhooks.Publish(models.Event{
+			Type:      models.EventMessage,
+			Lobby:     msg.Lobby,
+			From:      msg.From.Username,
+			ID:        msg.ID,
+			Text:      msg.Text,
+			Timestamp: msg.Timestamp,
 		})
 	}
 }
@@ -202,15 +381,34 @@ func sendWelcomeBanner(conn net.Conn) {
 		"You're live! Start chatting now...\n\n" + utils.ColorReset
 	conn.Write([]byte(statusMsg))
 }
+
+// sendMOTD shows the message of the day, if one is configured
+func sendMOTD(conn net.Conn, motd string) {
+	motd = strings.TrimSpace(motd)
+	if motd == "" {
+		return
+	}
+	conn.Write([]byte(utils.ColorGold + utils.Bold + "    Message of the day" + utils.ColorReset + "\n"))
+	for _, line := range strings.Split(motd, "\n") {
+		conn.Write([]byte(utils.ColorWhite + "    " + line + utils.ColorReset + "\n"))
+	}
+	conn.Write([]byte("\n"))
+}
+
 func (s *Server) Shutdown() {
 	msg := utils.BuildColor("server is shutting Down GoodBye", "yellow")
 
 	allClients := s.clientManager.ClientsSnapshot()
 	for _, client := range allClients {
-		client.Conn.Write([]byte(msg))
+		if client.Renderer != nil {
+			client.Conn.Write(client.Renderer.Render(client, models.Event{Type: models.EventNotice, Text: "Server is shutting down. Goodbye"}))
+		} else {
+			client.Conn.Write([]byte(msg))
+		}
 		time.Sleep(50 * time.Millisecond)
 		client.Conn.Close()
 	}
 
 	close(s.messages)
+	s.webhooks.Stop()
 }
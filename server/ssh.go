@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"chat-server/server/middleware"
+	"chat-server/server/utils"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// sshSetupTimeout bounds the handshake and the wait for a shell request
+const sshSetupTimeout = 30 * time.Second
+
+// sshFingerprintExt carries the client's key fingerprint from
+// authentication to its session
+const sshFingerprintExt = "fingerprint"
+
+// ANSI output comes wrapped in a line clear and a trailing prompt, which
+// an SSH terminal draws itself
+var (
+	ansiLineStart = []byte("\r\033[K")
+	ansiPrompt    = []byte(utils.ColorCyan + "> " + utils.ColorReset)
+)
+
+// NewSSHConfig returns the configuration of the SSH frontend. Its host key
+// is read from hostKeyFile, where a new ed25519 key is saved if the file
+// doesn't exist yet.
+func (s *Server) NewSSHConfig(hostKeyFile string) (*ssh.ServerConfig, error) {
+	hostKey, err := loadHostKey(hostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: s.checkSSHKey,
+		ServerVersion:     "SSH-2.0-go-chat",
+	}
+	config.AddHostKey(hostKey)
+	return config, nil
+}
+
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, key, genErr := ed25519.GenerateKey(rand.Reader)
+		if genErr != nil {
+			return nil, fmt.Errorf("generate SSH host key: %w", genErr)
+		}
+		block, genErr := ssh.MarshalPrivateKey(key, "go-chat host key")
+		if genErr != nil {
+			return nil, fmt.Errorf("encode SSH host key: %w", genErr)
+		}
+		data = pem.EncodeToMemory(block)
+		if err = os.WriteFile(path, data, 0600); err == nil {
+			log.Printf("Generated SSH host key %s", path)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SSH host key %s: %w", path, err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse SSH host key %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// checkSSHKey lets a key in if the authorized keys file, when one is
+// configured, lists it, and the username asked for isn't locked to
+// another key
+func (s *Server) checkSSHKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	fingerprint := ssh.FingerprintSHA256(key)
+	if path := s.authorizedKeysFile(); path != "" {
+		ok, err := authorizedKey(path, key)
+		if err != nil {
+			log.Printf("Failed to read SSH authorized keys: %v", err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("key %s is not authorized", fingerprint)
+		}
+	}
+	if bound := s.commandHandler.Accounts.KeyFingerprint(meta.User()); bound != "" && bound != fingerprint {
+		return nil, fmt.Errorf("%s is locked to another key", meta.User())
+	}
+	return &ssh.Permissions{Extensions: map[string]string{sshFingerprintExt: fingerprint}}, nil
+}
+
+func (s *Server) authorizedKeysFile() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.authorizedKeys
+}
+
+// authorizedKey reports whether the authorized_keys file at path lists key.
+// The file is read on every attempt so edits apply without a reload.
+func authorizedKey(path string, key ssh.PublicKey) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	want := key.Marshal()
+	for len(data) > 0 {
+		allowed, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(allowed.Marshal(), want) {
+			return true, nil
+		}
+		data = rest
+	}
+	return false, nil
+}
+
+// HandleSSHConnection serves a client connecting over SSH. The SSH
+// username is the chat username: the first key to use a free name locks
+// it, and after that only that key may connect as it. A password account
+// is linked to a key by logging in with /login over SSH once.
+func (s *Server) HandleSSHConnection(conn net.Conn, config *ssh.ServerConfig) {
+	ip := middleware.GetIP(conn)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("PANIC recovered in HandleSSHConnection: %v\nConnection: %s", r, conn.RemoteAddr())
+			conn.Close()
+		}
+	}()
+	if errMsg := s.admissionError(ip); errMsg != "" {
+		log.Printf("Refused SSH connection from %s: %s", ip, errMsg)
+		conn.Close()
+		return
+	}
+
+	middleware.IncrementIPConnection(ip)
+	defer middleware.DecrementIPConnection(ip)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(sshSetupTimeout))
+	sconn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for extra := range channels {
+				extra.Reject(ssh.Prohibited, "only one session per connection")
+			}
+		}()
+		s.serveSSHSession(sconn, conn, channel, channelRequests, ip)
+		return
+	}
+}
+
+// serveSSHSession runs the chat in a session channel once the client asks
+// for a shell
+func (s *Server) serveSSHSession(sconn *ssh.ServerConn, conn net.Conn, channel ssh.Channel, requests <-chan *ssh.Request, ip string) {
+	t := &sshTerminal{Conn: conn, channel: channel}
+	defer t.Close()
+
+	shell := make(chan bool, 1)
+	go t.serveRequests(requests, shell)
+	if !<-shell {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	readTimeout, motd := s.currentSettings()
+	t.SetReadDeadline(time.Now().Add(readTimeout))
+	sendWelcomeBanner(t)
+	sendMOTD(t, motd)
+
+	username := sconn.User()
+	if errMsg := s.usernameError(username); errMsg != "" {
+		t.Write([]byte(utils.ColorRed + fmt.Sprintf("Can't join as '%s': %s\n", username, errMsg) +
+			"Reconnect with ssh <username>@<host> to pick another name.\n" + utils.ColorReset))
+		return
+	}
+
+	fingerprint := sconn.Permissions.Extensions[sshFingerprintExt]
+	client := s.newClient(t, username, ip)
+	client.KeyFingerprint = fingerprint
+	client.Authenticated = s.commandHandler.Accounts.ClaimKey(username, fingerprint)
+	defer s.leave(t)
+
+	s.chat(t, bufio.NewScanner(t), client)
+}
+
+// sshTerminal is the connection a chat session over SSH reads and writes.
+// With a pty, a term.Terminal edits input a line at a time and keeps the
+// prompt below incoming messages; without one, bytes pass through as they
+// would on a TCP connection. Deadlines apply to the underlying connection.
+type sshTerminal struct {
+	net.Conn
+	channel ssh.Channel
+	term    *term.Terminal // set before the shell starts, nil without a pty
+	pending []byte
+}
+
+// ptyRequest is the payload of a "pty-req" channel request (RFC 4254 6.2)
+type ptyRequest struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32
+	Modes         string
+}
+
+// windowChange is the payload of a "window-change" channel request
+type windowChange struct {
+	Columns, Rows uint32
+	Width, Height uint32
+}
+
+// serveRequests answers the session's requests, sending true on shell
+// when the client asks for a shell, or closing it if the session ends
+// before it does
+func (t *sshTerminal) serveRequests(requests <-chan *ssh.Request, shell chan<- bool) {
+	started := false
+	for req := range requests {
+		ok := false
+		switch req.Type {
+		case "pty-req":
+			var pty ptyRequest
+			if ok = !started && ssh.Unmarshal(req.Payload, &pty) == nil; ok {
+				t.term = term.NewTerminal(t.channel, string(ansiPrompt))
+				t.term.SetSize(int(pty.Columns), int(pty.Rows))
+			}
+		case "window-change":
+			var size windowChange
+			if ok = ssh.Unmarshal(req.Payload, &size) == nil && t.term != nil; ok {
+				t.term.SetSize(int(size.Columns), int(size.Rows))
+			}
+		case "shell":
+			if ok = !started; ok {
+				started = true
+				shell <- true
+			}
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+	if !started {
+		close(shell)
+	}
+}
+
+func (t *sshTerminal) Read(p []byte) (int, error) {
+	if t.term == nil {
+		return t.channel.Read(p)
+	}
+	if len(t.pending) == 0 {
+		line, err := t.term.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		t.pending = []byte(line + "\n")
+	}
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+func (t *sshTerminal) Write(p []byte) (int, error) {
+	if t.term == nil {
+		return t.channel.Write(p)
+	}
+	out := bytes.TrimSuffix(bytes.TrimPrefix(p, ansiLineStart), ansiPrompt)
+	if _, err := t.term.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the session and the SSH connection carrying it
+func (t *sshTerminal) Close() error {
+	t.channel.Close()
+	return t.Conn.Close()
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-server/server/utils"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSession is the client end of an interactive SSH session to a test server
+type sshSession struct {
+	stdin io.Writer
+	mu    sync.Mutex
+	out   bytes.Buffer
+}
+
+func newSSHKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func testSSHConfig(t *testing.T, s *Server) *ssh.ServerConfig {
+	t.Helper()
+	config, err := s.NewSSHConfig(filepath.Join(t.TempDir(), "host_key"))
+	if err != nil {
+		t.Fatalf("NewSSHConfig: %v", err)
+	}
+	return config
+}
+
+// dialSSH logs in as user with key and opens a shell with a pty
+func dialSSH(t *testing.T, s *Server, config *ssh.ServerConfig, user string, key ssh.Signer) (*sshSession, error) {
+	t.Helper()
+	// Both ends of SSH write before they read, so a net.Pipe would deadlock
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientSide.Close() })
+	serverSide, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.HandleSSHConnection(serverSide, config)
+
+	conn, chans, reqs, err := ssh.NewClientConn(clientSide, listener.Addr().String(), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := ssh.NewClient(conn, chans, reqs)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := session.RequestPty("xterm", 40, 120, ssh.TerminalModes{}); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+
+	ss := &sshSession{stdin: stdin}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := stdout.Read(buf)
+			ss.mu.Lock()
+			ss.out.Write(buf[:n])
+			ss.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ss, nil
+}
+
+func (ss *sshSession) send(t *testing.T, line string) {
+	t.Helper()
+	if _, err := ss.stdin.Write([]byte(line + "\r")); err != nil {
+		t.Fatalf("send %q: %v", line, err)
+	}
+}
+
+func (ss *sshSession) waitFor(t *testing.T, text string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		ss.mu.Lock()
+		found := strings.Contains(utils.StripANSI(ss.out.String()), text)
+		ss.mu.Unlock()
+		if found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	t.Fatalf("%q never arrived; got:\n%s", text, utils.StripANSI(ss.out.String()))
+}
+
+func waitForClient(t *testing.T, s *Server, username string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for s.clientManager.GetClientByUsername(username) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never joined", username)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSSHKeyLocksUsername(t *testing.T) {
+	s := newTestServer(t)
+	config := testSSHConfig(t, s)
+	aliceKey := newSSHKey(t)
+
+	alice, err := dialSSH(t, s, config, "alice", aliceKey)
+	if err != nil {
+		t.Fatalf("first connection as alice: %v", err)
+	}
+	alice.waitFor(t, "alice has joined the lobby")
+	waitForClient(t, s, "alice")
+	if c := s.clientManager.GetClientByUsername("alice"); !c.Authenticated {
+		t.Error("alice is not authenticated by her key")
+	}
+	if got, want := s.commandHandler.Accounts.KeyFingerprint("alice"), ssh.FingerprintSHA256(aliceKey.PublicKey()); got != want {
+		t.Errorf("alice is locked to %q; want %q", got, want)
+	}
+
+	alice.send(t, "hello over ssh")
+	alice.waitFor(t, "hello over ssh")
+	if msgs, _ := s.lobbyManager.History("general", 10); len(msgs) != 1 || msgs[0].Username != "alice" {
+		t.Errorf("general history = %+v", msgs)
+	}
+
+	if _, err := dialSSH(t, s, config, "alice", newSSHKey(t)); err == nil {
+		t.Error("another key connected as alice")
+	}
+}
+
+func TestSSHLinksPasswordAccount(t *testing.T) {
+	s := newTestServer(t)
+	config := testSSHConfig(t, s)
+	if err := s.commandHandler.Accounts.Register("bob", "secret99"); err != nil {
+		t.Fatal(err)
+	}
+	bobKey := newSSHKey(t)
+
+	bob, err := dialSSH(t, s, config, "bob", bobKey)
+	if err != nil {
+		t.Fatalf("connect as bob: %v", err)
+	}
+	bob.waitFor(t, "'bob' is a registered name")
+	bob.send(t, "/login bob secret99")
+	bob.waitFor(t, "Your SSH key now logs you in as 'bob'")
+	if got := s.commandHandler.Accounts.KeyFingerprint("bob"); got != ssh.FingerprintSHA256(bobKey.PublicKey()) {
+		t.Errorf("bob is locked to %q", got)
+	}
+}
+
+func TestSSHAuthorizedKeys(t *testing.T) {
+	s := newTestServer(t)
+	config := testSSHConfig(t, s)
+	allowed, other := newSSHKey(t), newSSHKey(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	data := "# chat members\n" + string(ssh.MarshalAuthorizedKey(allowed.PublicKey()))
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.authorizedKeys = path
+	s.mu.Unlock()
+
+	if _, err := dialSSH(t, s, config, "carol", other); err == nil {
+		t.Error("a key missing from authorized_keys connected")
+	}
+	carol, err := dialSSH(t, s, config, "carol", allowed)
+	if err != nil {
+		t.Fatalf("authorized key refused: %v", err)
+	}
+	carol.waitFor(t, "carol has joined the lobby")
+}
@@ -0,0 +1,694 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"chat-server/server/ai"
+	"chat-server/server/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	lobbiesBucket       = []byte("lobbies")
+	messagesBucket      = []byte("messages")
+	conversationsBucket = []byte("conversations")
+	profilesBucket      = []byte("profiles")
+	accountsBucket      = []byte("accounts")
+	sshKeysBucket       = []byte("ssh_keys")
+	botsBucket          = []byte("bots")
+	deadLettersBucket   = []byte("webhook_dead_letters")
+	bansBucket          = []byte("bans")
+	mailBucket          = []byte("mail")
+	lastSeenBucket      = []byte("last_seen")
+	directBucket        = []byte("direct_messages")
+	directConvBucket    = []byte("direct_conversations")
+)
+
+// BoltStore is a Store backed by an embedded bbolt database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens (or creates) the database file at path
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{lobbiesBucket, messagesBucket, conversationsBucket, profilesBucket, accountsBucket, sshKeysBucket, botsBucket, deadLettersBucket, bansBucket, mailBucket, lastSeenBucket, directBucket, directConvBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init store %s: %w", path, err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// SaveLobby inserts or replaces a lobby
+func (s *BoltStore) SaveLobby(lobby *models.Lobby) error {
+	return s.put(lobbiesBucket, []byte(lobby.Name), lobby)
+}
+
+// DeleteLobby removes a lobby and its history
+func (s *BoltStore) DeleteLobby(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(lobbiesBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(conversationsBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+		err := tx.Bucket(messagesBucket).DeleteBucket([]byte(name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		err = tx.Bucket(deadLettersBucket).DeleteBucket([]byte(name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// RenameLobby saves lobby under its new name and moves its history, AI
+// conversation and webhook dead letters there
+func (s *BoltStore) RenameLobby(oldName string, lobby *models.Lobby) error {
+	data, err := json.Marshal(lobby)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		oldKey, newKey := []byte(oldName), []byte(lobby.Name)
+		lobbies := tx.Bucket(lobbiesBucket)
+		if err := lobbies.Delete(oldKey); err != nil {
+			return err
+		}
+		if err := lobbies.Put(newKey, data); err != nil {
+			return err
+		}
+
+		conversations := tx.Bucket(conversationsBucket)
+		if conv := conversations.Get(oldKey); conv != nil {
+			if err := conversations.Put(newKey, append([]byte(nil), conv...)); err != nil {
+				return err
+			}
+			if err := conversations.Delete(oldKey); err != nil {
+				return err
+			}
+		}
+
+		if err := moveBucket(tx.Bucket(messagesBucket), oldKey, newKey); err != nil {
+			return err
+		}
+		return moveBucket(tx.Bucket(deadLettersBucket), oldKey, newKey)
+	})
+}
+
+// moveBucket renames the nested bucket oldKey of parent to newKey, keeping
+// its sequence so IDs carry on where they left off
+func moveBucket(parent *bolt.Bucket, oldKey, newKey []byte) error {
+	old := parent.Bucket(oldKey)
+	if old == nil {
+		return nil
+	}
+	moved, err := parent.CreateBucket(newKey)
+	if err != nil {
+		return err
+	}
+	if err := old.ForEach(func(k, v []byte) error { return moved.Put(k, v) }); err != nil {
+		return err
+	}
+	if err := moved.SetSequence(old.Sequence()); err != nil {
+		return err
+	}
+	return parent.DeleteBucket(oldKey)
+}
+
+// LoadLobbies returns every stored lobby
+func (s *BoltStore) LoadLobbies() ([]*models.Lobby, error) {
+	var lobbies []*models.Lobby
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(lobbiesBucket).ForEach(func(_, v []byte) error {
+			var lobby models.Lobby
+			if err := json.Unmarshal(v, &lobby); err != nil {
+				return err
+			}
+			lobbies = append(lobbies, &lobby)
+			return nil
+		})
+	})
+	return lobbies, err
+}
+
+// AppendMessage adds a message to a lobby's history and returns the ID
+// it was stored under. IDs count up from 1 within each lobby.
+func (s *BoltStore) AppendMessage(lobbyName string, msg models.LobbyMessage) (uint64, error) {
+	var id uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(messagesBucket).CreateBucketIfNotExists([]byte(lobbyName))
+		if err != nil {
+			return err
+		}
+		if id, err = b.NextSequence(); err != nil {
+			return err
+		}
+		msg.ID = id
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(id), data)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// LoadMessages returns up to limit of the most recent messages, oldest first
+func (s *BoltStore) LoadMessages(lobbyName string, limit int) ([]models.LobbyMessage, error) {
+	var msgs []models.LobbyMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messagesBucket).Bucket([]byte(lobbyName))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if limit > 0 && len(msgs) >= limit {
+				break
+			}
+			msg, err := decodeMessage(k, v)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		return nil
+	})
+
+	// Collected newest first, callers expect oldest first
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, err
+}
+
+// LoadMessagesSince returns up to limit of the oldest messages sent after since
+func (s *BoltStore) LoadMessagesSince(lobbyName string, since time.Time, limit int) ([]models.LobbyMessage, error) {
+	var msgs []models.LobbyMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messagesBucket).Bucket([]byte(lobbyName))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if limit > 0 && len(msgs) >= limit {
+				break
+			}
+			msg, err := decodeMessage(k, v)
+			if err != nil {
+				return err
+			}
+			if msg.Timestamp.After(since) {
+				msgs = append(msgs, msg)
+			}
+		}
+		return nil
+	})
+	return msgs, err
+}
+
+// LoadMessagesByID returns the messages stored under ids, skipping any
+// that do not exist, in the order given
+func (s *BoltStore) LoadMessagesByID(lobbyName string, ids []uint64) ([]models.LobbyMessage, error) {
+	var msgs []models.LobbyMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messagesBucket).Bucket([]byte(lobbyName))
+		if b == nil {
+			return nil
+		}
+
+		for _, id := range ids {
+			k := itob(id)
+			v := b.Get(k)
+			if v == nil {
+				continue
+			}
+			msg, err := decodeMessage(k, v)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		return nil
+	})
+	return msgs, err
+}
+
+// UpdateMessage replaces a stored message; unknown IDs are ignored
+func (s *BoltStore) UpdateMessage(lobbyName string, msg models.LobbyMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messagesBucket).Bucket([]byte(lobbyName))
+		if b == nil || b.Get(itob(msg.ID)) == nil {
+			return nil
+		}
+		return b.Put(itob(msg.ID), data)
+	})
+}
+
+// SaveConversation stores a snapshot of a lobby's AI conversation
+func (s *BoltStore) SaveConversation(lobbyName string, conv *ai.ConversationHistory) error {
+	return s.put(conversationsBucket, []byte(lobbyName), newConversationRecord(conv))
+}
+
+// DeleteConversation removes a lobby's AI conversation
+func (s *BoltStore) DeleteConversation(lobbyName string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(conversationsBucket).Delete([]byte(lobbyName))
+	})
+}
+
+// LoadConversations returns every stored AI conversation keyed by lobby
+func (s *BoltStore) LoadConversations() (map[string]*ai.ConversationHistory, error) {
+	result := make(map[string]*ai.ConversationHistory)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(conversationsBucket).ForEach(func(k, v []byte) error {
+			var record conversationRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			result[string(k)] = record.history()
+			return nil
+		})
+	})
+	return result, err
+}
+
+// SaveProfile stores a user's profile picture
+func (s *BoltStore) SaveProfile(username, profile string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(profilesBucket).Put([]byte(username), []byte(profile))
+	})
+}
+
+// LoadProfile returns a user's profile picture, or "" if none is stored
+func (s *BoltStore) LoadProfile(username string) (string, error) {
+	var profile string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		profile = string(tx.Bucket(profilesBucket).Get([]byte(username)))
+		return nil
+	})
+	return profile, err
+}
+
+// SaveAccount stores a password hash for a registered username
+func (s *BoltStore) SaveAccount(username, passwordHash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).Put([]byte(username), []byte(passwordHash))
+	})
+}
+
+// LoadAccount returns the password hash for a username, or "" if unregistered
+func (s *BoltStore) LoadAccount(username string) (string, error) {
+	var hash string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		hash = string(tx.Bucket(accountsBucket).Get([]byte(username)))
+		return nil
+	})
+	return hash, err
+}
+
+// SaveSSHKey locks a username to an SSH key fingerprint
+func (s *BoltStore) SaveSSHKey(username, fingerprint string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sshKeysBucket).Put([]byte(username), []byte(fingerprint))
+	})
+}
+
+// LoadSSHKey returns the SSH key fingerprint a username is locked to, or ""
+func (s *BoltStore) LoadSSHKey(username string) (string, error) {
+	var fingerprint string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		fingerprint = string(tx.Bucket(sshKeysBucket).Get([]byte(username)))
+		return nil
+	})
+	return fingerprint, err
+}
+
+// AppendDeadLetter records a failed webhook delivery, dropping the oldest
+// beyond MaxDeadLetters
+func (s *BoltStore) AppendDeadLetter(lobbyName string, dl models.DeadLetter) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(deadLettersBucket).CreateBucketIfNotExists([]byte(lobbyName))
+		if err != nil {
+			return err
+		}
+		if dl.ID, err = b.NextSequence(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(dl)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(itob(dl.ID), data); err != nil {
+			return err
+		}
+		if dl.ID <= MaxDeadLetters {
+			return nil
+		}
+		// IDs are sequential, so everything up to this one is too old
+		var stale [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= dl.ID-MaxDeadLetters; k, _ = c.Next() {
+			stale = append(stale, k)
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadDeadLetters returns up to limit of a lobby's most recent dead
+// letters, oldest first
+func (s *BoltStore) LoadDeadLetters(lobbyName string, limit int) ([]models.DeadLetter, error) {
+	var letters []models.DeadLetter
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deadLettersBucket).Bucket([]byte(lobbyName))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && (limit <= 0 || len(letters) < limit); k, v = c.Prev() {
+			var dl models.DeadLetter
+			if err := json.Unmarshal(v, &dl); err != nil {
+				return err
+			}
+			letters = append(letters, dl)
+		}
+		return nil
+	})
+	// Collected newest first
+	for i, j := 0, len(letters)-1; i < j; i, j = i+1, j-1 {
+		letters[i], letters[j] = letters[j], letters[i]
+	}
+	return letters, err
+}
+
+// SaveBot inserts or replaces a bot account
+func (s *BoltStore) SaveBot(bot *models.Bot) error {
+	return s.put(botsBucket, []byte(bot.Name), bot)
+}
+
+// LoadBot returns the bot called name, or nil if there is none
+func (s *BoltStore) LoadBot(name string) (*models.Bot, error) {
+	var bot *models.Bot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(botsBucket).Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		bot = &models.Bot{}
+		return json.Unmarshal(v, bot)
+	})
+	return bot, err
+}
+
+// DeleteBot removes a bot account
+func (s *BoltStore) DeleteBot(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(botsBucket).Delete([]byte(name))
+	})
+}
+
+// LoadBots returns every bot account
+func (s *BoltStore) LoadBots() ([]*models.Bot, error) {
+	var bots []*models.Bot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(botsBucket).ForEach(func(_, v []byte) error {
+			var bot models.Bot
+			if err := json.Unmarshal(v, &bot); err != nil {
+				return err
+			}
+			bots = append(bots, &bot)
+			return nil
+		})
+	})
+	return bots, err
+}
+
+// SaveBan inserts or replaces a ban
+func (s *BoltStore) SaveBan(ban *models.Ban) error {
+	return s.put(bansBucket, []byte(banKey(ban.Lobby, ban.Target)), ban)
+}
+
+// DeleteBan removes a ban
+func (s *BoltStore) DeleteBan(lobbyName, target string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bansBucket).Delete([]byte(banKey(lobbyName, target)))
+	})
+}
+
+// LoadBans returns every stored ban
+func (s *BoltStore) LoadBans() ([]*models.Ban, error) {
+	var bans []*models.Ban
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bansBucket).ForEach(func(_, v []byte) error {
+			var ban models.Ban
+			if err := json.Unmarshal(v, &ban); err != nil {
+				return err
+			}
+			bans = append(bans, &ban)
+			return nil
+		})
+	})
+	return bans, err
+}
+
+// AppendMail adds mail to a user's mailbox and returns its ID
+func (s *BoltStore) AppendMail(username string, mail models.Mail) (uint64, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(mailBucket).CreateBucketIfNotExists([]byte(username))
+		if err != nil {
+			return err
+		}
+		if mail.ID, err = b.NextSequence(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(mail)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(mail.ID), data)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return mail.ID, nil
+}
+
+// LoadMail returns a user's mailbox, oldest first
+func (s *BoltStore) LoadMail(username string) ([]models.Mail, error) {
+	var mails []models.Mail
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(mailBucket).Bucket([]byte(username))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var mail models.Mail
+			if err := json.Unmarshal(v, &mail); err != nil {
+				return err
+			}
+			mails = append(mails, mail)
+			return nil
+		})
+	})
+	return mails, err
+}
+
+// SaveMail replaces a stored mail; mail that has been deleted stays deleted
+func (s *BoltStore) SaveMail(username string, mail models.Mail) error {
+	data, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(mailBucket).Bucket([]byte(username))
+		if b == nil || b.Get(itob(mail.ID)) == nil {
+			return nil
+		}
+		return b.Put(itob(mail.ID), data)
+	})
+}
+
+// DeleteMail removes one mail from a user's mailbox
+func (s *BoltStore) DeleteMail(username string, id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(mailBucket).Bucket([]byte(username))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(itob(id))
+	})
+}
+
+// AppendDirectMessage stores a private message and returns its ID
+func (s *BoltStore) AppendDirectMessage(msg models.DirectMessage) (uint64, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(directBucket).CreateBucketIfNotExists([]byte(dmPairKey(msg.From, msg.To)))
+		if err != nil {
+			return err
+		}
+		if msg.ID, err = b.NextSequence(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(msg.ID), data)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return msg.ID, nil
+}
+
+// LoadDirectMessages returns up to limit of the most recent messages
+// between two users, oldest first
+func (s *BoltStore) LoadDirectMessages(userA, userB string, limit int) ([]models.DirectMessage, error) {
+	var msgs []models.DirectMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(directBucket).Bucket([]byte(dmPairKey(userA, userB)))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if limit > 0 && len(msgs) >= limit {
+				break
+			}
+			var msg models.DirectMessage
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		return nil
+	})
+
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, err
+}
+
+// SaveDirectConversation stores a user's summary of one conversation
+func (s *BoltStore) SaveDirectConversation(username string, conv models.DirectConversation) error {
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(directConvBucket).CreateBucketIfNotExists([]byte(username))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(conv.Peer), data)
+	})
+}
+
+// LoadDirectConversations returns a user's conversation summaries
+func (s *BoltStore) LoadDirectConversations(username string) ([]models.DirectConversation, error) {
+	var convs []models.DirectConversation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(directConvBucket).Bucket([]byte(username))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var conv models.DirectConversation
+			if err := json.Unmarshal(v, &conv); err != nil {
+				return err
+			}
+			convs = append(convs, conv)
+			return nil
+		})
+	})
+	return convs, err
+}
+
+// SaveLastSeen records when a username was last connected
+func (s *BoltStore) SaveLastSeen(username string, t time.Time) error {
+	return s.put(lastSeenBucket, []byte(username), t)
+}
+
+// LoadLastSeen returns when a username was last connected, or the zero time
+func (s *BoltStore) LoadLastSeen(username string) (time.Time, error) {
+	var t time.Time
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(lastSeenBucket).Get([]byte(username))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &t)
+	})
+	return t, err
+}
+
+// Close closes the database file
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// put JSON-encodes value and stores it under key in a top-level bucket
+func (s *BoltStore) put(bucket, key []byte, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put(key, data)
+	})
+}
+
+// itob encodes a sequence number as a sortable big-endian key
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// decodeMessage unmarshals a stored message; records written before
+// messages carried IDs take theirs from the key
+func decodeMessage(k, v []byte) (models.LobbyMessage, error) {
+	var msg models.LobbyMessage
+	if err := json.Unmarshal(v, &msg); err != nil {
+		return msg, err
+	}
+	msg.ID = binary.BigEndian.Uint64(k)
+	return msg, nil
+}
@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"chat-server/server/ai"
+	"chat-server/server/models"
+)
+
+// MemoryStore is a Store that keeps everything in process memory.
+// It is intended for tests and for running without a database file.
+type MemoryStore struct {
+	lobbies       map[string]models.Lobby
+	messages      map[string][]models.LobbyMessage
+	conversations map[string]conversationRecord
+	profiles      map[string]string
+	accounts      map[string]string
+	sshKeys       map[string]string
+	bots          map[string]models.Bot
+	deadLetters   map[string][]models.DeadLetter
+	deadLetterSeq uint64
+	bans          map[string]models.Ban
+	mail          map[string][]models.Mail
+	mailSeq       map[string]uint64
+	lastSeen      map[string]time.Time
+	direct        map[string][]models.DirectMessage
+	directConvs   map[string]map[string]models.DirectConversation
+	mu            sync.RWMutex
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		lobbies:       make(map[string]models.Lobby),
+		messages:      make(map[string][]models.LobbyMessage),
+		conversations: make(map[string]conversationRecord),
+		profiles:      make(map[string]string),
+		accounts:      make(map[string]string),
+		sshKeys:       make(map[string]string),
+		bots:          make(map[string]models.Bot),
+		deadLetters:   make(map[string][]models.DeadLetter),
+		bans:          make(map[string]models.Ban),
+		mail:          make(map[string][]models.Mail),
+		mailSeq:       make(map[string]uint64),
+		lastSeen:      make(map[string]time.Time),
+		direct:        make(map[string][]models.DirectMessage),
+		directConvs:   make(map[string]map[string]models.DirectConversation),
+	}
+}
+
+// SaveLobby inserts or replaces a lobby
+func (s *MemoryStore) SaveLobby(lobby *models.Lobby) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lobbies[lobby.Name] = *lobby
+	return nil
+}
+
+// DeleteLobby removes a lobby and its history
+func (s *MemoryStore) DeleteLobby(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.lobbies, name)
+	delete(s.messages, name)
+	delete(s.conversations, name)
+	delete(s.deadLetters, name)
+	return nil
+}
+
+// RenameLobby saves lobby under its new name and moves its history, AI
+// conversation and webhook dead letters there
+func (s *MemoryStore) RenameLobby(oldName string, lobby *models.Lobby) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.lobbies, oldName)
+	s.lobbies[lobby.Name] = *lobby
+	if msgs, ok := s.messages[oldName]; ok {
+		s.messages[lobby.Name] = msgs
+		delete(s.messages, oldName)
+	}
+	if conv, ok := s.conversations[oldName]; ok {
+		s.conversations[lobby.Name] = conv
+		delete(s.conversations, oldName)
+	}
+	if letters, ok := s.deadLetters[oldName]; ok {
+		s.deadLetters[lobby.Name] = letters
+		delete(s.deadLetters, oldName)
+	}
+	return nil
+}
+
+// LoadLobbies returns every stored lobby
+func (s *MemoryStore) LoadLobbies() ([]*models.Lobby, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lobbies := make([]*models.Lobby, 0, len(s.lobbies))
+	for _, lobby := range s.lobbies {
+		l := lobby
+		lobbies = append(lobbies, &l)
+	}
+	return lobbies, nil
+}
+
+// AppendMessage adds a message to a lobby's history and returns its ID
+func (s *MemoryStore) AppendMessage(lobbyName string, msg models.LobbyMessage) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := s.messages[lobbyName]
+	msg.ID = 1
+	if len(msgs) > 0 {
+		msg.ID = msgs[len(msgs)-1].ID + 1
+	}
+	s.messages[lobbyName] = append(msgs, msg)
+	return msg.ID, nil
+}
+
+// LoadMessages returns up to limit of the most recent messages, oldest first
+func (s *MemoryStore) LoadMessages(lobbyName string, limit int) ([]models.LobbyMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msgs := s.messages[lobbyName]
+	if limit > 0 && len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+	result := make([]models.LobbyMessage, len(msgs))
+	copy(result, msgs)
+	return result, nil
+}
+
+// LoadMessagesSince returns up to limit of the oldest messages sent after since
+func (s *MemoryStore) LoadMessagesSince(lobbyName string, since time.Time, limit int) ([]models.LobbyMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []models.LobbyMessage
+	for _, msg := range s.messages[lobbyName] {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		if msg.Timestamp.After(since) {
+			result = append(result, msg)
+		}
+	}
+	return result, nil
+}
+
+// LoadMessagesByID returns the messages stored under ids, skipping any
+// that do not exist, in the order given
+func (s *MemoryStore) LoadMessagesByID(lobbyName string, ids []uint64) ([]models.LobbyMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msgs := s.messages[lobbyName]
+	var result []models.LobbyMessage
+	for _, id := range ids {
+		i := sort.Search(len(msgs), func(i int) bool { return msgs[i].ID >= id })
+		if i < len(msgs) && msgs[i].ID == id {
+			result = append(result, msgs[i])
+		}
+	}
+	return result, nil
+}
+
+// UpdateMessage replaces a stored message; unknown IDs are ignored
+func (s *MemoryStore) UpdateMessage(lobbyName string, msg models.LobbyMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := s.messages[lobbyName]
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].ID >= msg.ID })
+	if i < len(msgs) && msgs[i].ID == msg.ID {
+		msgs[i] = msg
+	}
+	return nil
+}
+
+// SaveConversation stores a snapshot of a lobby's AI conversation
+func (s *MemoryStore) SaveConversation(lobbyName string, conv *ai.ConversationHistory) error {
+	record := newConversationRecord(conv)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversations[lobbyName] = record
+	return nil
+}
+
+// DeleteConversation removes a lobby's AI conversation
+func (s *MemoryStore) DeleteConversation(lobbyName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conversations, lobbyName)
+	return nil
+}
+
+// LoadConversations returns every stored AI conversation keyed by lobby
+func (s *MemoryStore) LoadConversations() (map[string]*ai.ConversationHistory, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]*ai.ConversationHistory, len(s.conversations))
+	for name, record := range s.conversations {
+		result[name] = record.history()
+	}
+	return result, nil
+}
+
+// SaveProfile stores a user's profile picture
+func (s *MemoryStore) SaveProfile(username, profile string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profiles[username] = profile
+	return nil
+}
+
+// LoadProfile returns a user's profile picture, or "" if none is stored
+func (s *MemoryStore) LoadProfile(username string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.profiles[username], nil
+}
+
+// SaveAccount stores a password hash for a registered username
+func (s *MemoryStore) SaveAccount(username, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts[username] = passwordHash
+	return nil
+}
+
+// LoadAccount returns the password hash for a username, or "" if unregistered
+func (s *MemoryStore) LoadAccount(username string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.accounts[username], nil
+}
+
+// SaveSSHKey locks a username to an SSH key fingerprint
+func (s *MemoryStore) SaveSSHKey(username, fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sshKeys[username] = fingerprint
+	return nil
+}
+
+// LoadSSHKey returns the SSH key fingerprint a username is locked to, or ""
+func (s *MemoryStore) LoadSSHKey(username string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sshKeys[username], nil
+}
+
+// AppendDeadLetter records a failed webhook delivery, dropping the oldest
+// beyond MaxDeadLetters
+func (s *MemoryStore) AppendDeadLetter(lobbyName string, dl models.DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadLetterSeq++
+	dl.ID = s.deadLetterSeq
+	letters := append(s.deadLetters[lobbyName], dl)
+	if len(letters) > MaxDeadLetters {
+		letters = letters[len(letters)-MaxDeadLetters:]
+	}
+	s.deadLetters[lobbyName] = letters
+	return nil
+}
+
+// LoadDeadLetters returns up to limit of a lobby's most recent dead
+// letters, oldest first
+func (s *MemoryStore) LoadDeadLetters(lobbyName string, limit int) ([]models.DeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	letters := s.deadLetters[lobbyName]
+	if limit > 0 && len(letters) > limit {
+		letters = letters[len(letters)-limit:]
+	}
+	result := make([]models.DeadLetter, len(letters))
+	copy(result, letters)
+	return result, nil
+}
+
+// SaveBot inserts or replaces a bot account
+func (s *MemoryStore) SaveBot(bot *models.Bot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bots[bot.Name] = *bot
+	return nil
+}
+
+// LoadBot returns the bot called name, or nil if there is none
+func (s *MemoryStore) LoadBot(name string) (*models.Bot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bot, ok := s.bots[name]
+	if !ok {
+		return nil, nil
+	}
+	return &bot, nil
+}
+
+// DeleteBot removes a bot account
+func (s *MemoryStore) DeleteBot(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bots, name)
+	return nil
+}
+
+// LoadBots returns every bot account
+func (s *MemoryStore) LoadBots() ([]*models.Bot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bots := make([]*models.Bot, 0, len(s.bots))
+	for _, bot := range s.bots {
+		b := bot
+		bots = append(bots, &b)
+	}
+	return bots, nil
+}
+
+// SaveBan inserts or replaces a ban
+func (s *MemoryStore) SaveBan(ban *models.Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[banKey(ban.Lobby, ban.Target)] = *ban
+	return nil
+}
+
+// DeleteBan removes a ban
+func (s *MemoryStore) DeleteBan(lobbyName, target string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bans, banKey(lobbyName, target))
+	return nil
+}
+
+// LoadBans returns every stored ban
+func (s *MemoryStore) LoadBans() ([]*models.Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bans := make([]*models.Ban, 0, len(s.bans))
+	for _, ban := range s.bans {
+		b := ban
+		bans = append(bans, &b)
+	}
+	return bans, nil
+}
+
+// AppendMail adds mail to a user's mailbox and returns its ID
+func (s *MemoryStore) AppendMail(username string, mail models.Mail) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mailSeq[username]++
+	mail.ID = s.mailSeq[username]
+	s.mail[username] = append(s.mail[username], mail)
+	return mail.ID, nil
+}
+
+// LoadMail returns a user's mailbox, oldest first
+func (s *MemoryStore) LoadMail(username string) ([]models.Mail, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]models.Mail, len(s.mail[username]))
+	copy(result, s.mail[username])
+	return result, nil
+}
+
+// SaveMail replaces a stored mail; mail that has been deleted stays deleted
+func (s *MemoryStore) SaveMail(username string, mail models.Mail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.mail[username] {
+		if m.ID == mail.ID {
+			s.mail[username][i] = mail
+		}
+	}
+	return nil
+}
+
+// DeleteMail removes one mail from a user's mailbox
+func (s *MemoryStore) DeleteMail(username string, id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mails := s.mail[username]
+	for i, m := range mails {
+		if m.ID == id {
+			s.mail[username] = append(mails[:i:i], mails[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// AppendDirectMessage stores a private message and returns its ID
+func (s *MemoryStore) AppendDirectMessage(msg models.DirectMessage) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := dmPairKey(msg.From, msg.To)
+	msg.ID = uint64(len(s.direct[key]) + 1)
+	s.direct[key] = append(s.direct[key], msg)
+	return msg.ID, nil
+}
+
+// LoadDirectMessages returns up to limit of the most recent messages
+// between two users, oldest first
+func (s *MemoryStore) LoadDirectMessages(userA, userB string, limit int) ([]models.DirectMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msgs := s.direct[dmPairKey(userA, userB)]
+	if limit > 0 && len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+	result := make([]models.DirectMessage, len(msgs))
+	copy(result, msgs)
+	return result, nil
+}
+
+// SaveDirectConversation stores a user's summary of one conversation
+func (s *MemoryStore) SaveDirectConversation(username string, conv models.DirectConversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.directConvs[username] == nil {
+		s.directConvs[username] = make(map[string]models.DirectConversation)
+	}
+	s.directConvs[username][conv.Peer] = conv
+	return nil
+}
+
+// LoadDirectConversations returns a user's conversation summaries
+func (s *MemoryStore) LoadDirectConversations(username string) ([]models.DirectConversation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var convs []models.DirectConversation
+	for _, conv := range s.directConvs[username] {
+		convs = append(convs, conv)
+	}
+	return convs, nil
+}
+
+// SaveLastSeen records when a username was last connected
+func (s *MemoryStore) SaveLastSeen(username string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen[username] = t
+	return nil
+}
+
+// LoadLastSeen returns when a username was last connected, or the zero time
+func (s *MemoryStore) LoadLastSeen(username string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastSeen[username], nil
+}
+
+// Close is a no-op for the in-memory store
+func (s *MemoryStore) Close() error {
+	return nil
+}
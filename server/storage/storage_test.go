@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"chat-server/server/ai"
+	"chat-server/server/models"
+)
+
+func openStores(t *testing.T) map[string]Store {
+	t.Helper()
+	bolt, err := OpenBolt(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatalf("OpenBolt: %v", err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"bolt":   bolt,
+	}
+}
+
+func TestStoreLobbies(t *testing.T) {
+	for name, store := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			lobby := &models.Lobby{
+				Name:     "coding",
+				Creator:  "alice",
+				Owner:    "alice",
+				Desc:     "Go talk",
+				AIPrompt: "be nice",
+				Roles:    map[string]models.Role{"bob": models.RoleOperator},
+			}
+			if err := store.SaveLobby(lobby); err != nil {
+				t.Fatalf("SaveLobby: %v", err)
+			}
+
+			lobbies, err := store.LoadLobbies()
+			if err != nil || len(lobbies) != 1 {
+				t.Fatalf("LoadLobbies = %v, %v; want 1 lobby", lobbies, err)
+			}
+			if !reflect.DeepEqual(lobbies[0], lobby) {
+				t.Errorf("LoadLobbies()[0] = %+v; want %+v", *lobbies[0], *lobby)
+			}
+
+			store.AppendMessage("coding", models.LobbyMessage{Username: "alice", Text: "hi"})
+			if err := store.DeleteLobby("coding"); err != nil {
+				t.Fatalf("DeleteLobby: %v", err)
+			}
+			lobbies, _ = store.LoadLobbies()
+			msgs, _ := store.LoadMessages("coding", 0)
+			if len(lobbies) != 0 || len(msgs) != 0 {
+				t.Errorf("after DeleteLobby got %d lobbies, %d messages; want 0, 0", len(lobbies), len(msgs))
+			}
+		})
+	}
+}
+
+func TestStoreRenameLobby(t *testing.T) {
+	for name, store := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store.SaveLobby(&models.Lobby{Name: "coding", Creator: "alice"})
+			store.AppendMessage("coding", models.LobbyMessage{Username: "alice", Text: "one"})
+			store.AppendMessage("coding", models.LobbyMessage{Username: "bob", Text: "two"})
+			store.SaveConversation("coding", &ai.ConversationHistory{LastActive: time.Now()})
+			store.AppendDeadLetter("coding", models.DeadLetter{Webhook: "a1", Event: "message"})
+
+			if err := store.RenameLobby("coding", &models.Lobby{Name: "golang", Creator: "alice"}); err != nil {
+				t.Fatalf("RenameLobby: %v", err)
+			}
+			lobbies, _ := store.LoadLobbies()
+			if len(lobbies) != 1 || lobbies[0].Name != "golang" {
+				t.Errorf("LoadLobbies = %+v, want only golang", lobbies)
+			}
+			if msgs, _ := store.LoadMessages("coding", 0); len(msgs) != 0 {
+				t.Errorf("old name still has %d messages", len(msgs))
+			}
+			msgs, _ := store.LoadMessages("golang", 0)
+			if len(msgs) != 2 || msgs[1].ID != 2 || msgs[1].Text != "two" {
+				t.Errorf("renamed history = %+v", msgs)
+			}
+			if id, _ := store.AppendMessage("golang", models.LobbyMessage{Text: "three"}); id != 3 {
+				t.Errorf("next ID after rename = %d, want 3", id)
+			}
+			convs, _ := store.LoadConversations()
+			if _, ok := convs["golang"]; !ok || len(convs) != 1 {
+				t.Errorf("conversations after rename = %v", convs)
+			}
+			if letters, _ := store.LoadDeadLetters("golang", 0); len(letters) != 1 || letters[0].Webhook != "a1" {
+				t.Errorf("dead letters after rename = %+v", letters)
+			}
+
+			// A new lobby under the old name starts without them
+			store.SaveLobby(&models.Lobby{Name: "coding", Creator: "bob"})
+			if letters, _ := store.LoadDeadLetters("coding", 0); len(letters) != 0 {
+				t.Errorf("new lobby inherited %d dead letters", len(letters))
+			}
+		})
+	}
+}
+
+func TestStoreMessages(t *testing.T) {
+	for name, store := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			for i, text := range []string{"one", "two", "three", "four"} {
+				msg := models.LobbyMessage{Username: "bob", Text: text, Timestamp: start.Add(time.Duration(i) * time.Minute)}
+				id, err := store.AppendMessage("general", msg)
+				if err != nil {
+					t.Fatalf("AppendMessage: %v", err)
+				}
+				if id != uint64(i+1) {
+					t.Errorf("AppendMessage(%q) returned ID %d; want %d", text, id, i+1)
+				}
+			}
+
+			msgs, err := store.LoadMessages("general", 2)
+			if err != nil {
+				t.Fatalf("LoadMessages: %v", err)
+			}
+			if len(msgs) != 2 || msgs[0].Text != "three" || msgs[1].Text != "four" {
+				t.Errorf("LoadMessages(2) = %+v; want [three four]", msgs)
+			}
+
+			msgs, _ = store.LoadMessages("general", 0)
+			if len(msgs) != 4 {
+				t.Errorf("LoadMessages(0) returned %d messages; want 4", len(msgs))
+			}
+
+			msgs, _ = store.LoadMessages("missing", 5)
+			if len(msgs) != 0 {
+				t.Errorf("LoadMessages on unknown lobby returned %d messages", len(msgs))
+			}
+
+			msgs, err = store.LoadMessagesSince("general", start, 2)
+			if err != nil {
+				t.Fatalf("LoadMessagesSince: %v", err)
+			}
+			if len(msgs) != 2 || msgs[0].Text != "two" || msgs[1].Text != "three" || msgs[0].ID != 2 {
+				t.Errorf("LoadMessagesSince(start, 2) = %+v; want [two three]", msgs)
+			}
+
+			msgs, err = store.LoadMessagesByID("general", []uint64{4, 9, 1})
+			if err != nil {
+				t.Fatalf("LoadMessagesByID: %v", err)
+			}
+			if len(msgs) != 2 || msgs[0].Text != "four" || msgs[1].Text != "one" {
+				t.Errorf("LoadMessagesByID(4, 9, 1) = %+v; want [four one]", msgs)
+			}
+
+			edited := msgs[0]
+			edited.Text, edited.EditedAt = "FOUR", time.Now()
+			if err := store.UpdateMessage("general", edited); err != nil {
+				t.Fatalf("UpdateMessage: %v", err)
+			}
+			store.UpdateMessage("general", models.LobbyMessage{ID: 9, Text: "ghost"})
+			msgs, _ = store.LoadMessages("general", 0)
+			if len(msgs) != 4 || msgs[3].Text != "FOUR" || msgs[3].EditedAt.IsZero() {
+				t.Errorf("after UpdateMessage history = %+v; want message 4 edited and nothing added", msgs)
+			}
+		})
+	}
+}
+
+func TestStoreConversationsProfilesAndAccounts(t *testing.T) {
+	for name, store := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			conv := &ai.ConversationHistory{
+				Messages:   []ai.Message{{Role: ai.RoleUser, Text: "hi"}},
+				LastActive: time.Now().Truncate(time.Second),
+			}
+			if err := store.SaveConversation("coding", conv); err != nil {
+				t.Fatalf("SaveConversation: %v", err)
+			}
+			convs, err := store.LoadConversations()
+			if err != nil || convs["coding"] == nil {
+				t.Fatalf("LoadConversations = %v, %v", convs, err)
+			}
+			if got := convs["coding"]; len(got.Messages) != 1 || !got.LastActive.Equal(conv.LastActive) {
+				t.Errorf("loaded conversation = %+v; want %+v", got, conv)
+			}
+			store.DeleteConversation("coding")
+			if convs, _ = store.LoadConversations(); len(convs) != 0 {
+				t.Errorf("conversation still present after DeleteConversation")
+			}
+
+			if p, _ := store.LoadProfile("alice"); p != "" {
+				t.Errorf("LoadProfile for unknown user = %q; want empty", p)
+			}
+			store.SaveProfile("alice", "(=^･^=)")
+			if p, _ := store.LoadProfile("alice"); p != "(=^･^=)" {
+				t.Errorf("LoadProfile = %q; want (=^･^=)", p)
+			}
+
+			if h, _ := store.LoadAccount("alice"); h != "" {
+				t.Errorf("LoadAccount for unregistered user = %q; want empty", h)
+			}
+			store.SaveAccount("alice", "$2a$10$hash")
+			if h, _ := store.LoadAccount("alice"); h != "$2a$10$hash" {
+				t.Errorf("LoadAccount = %q; want $2a$10$hash", h)
+			}
+
+			if fp, _ := store.LoadSSHKey("alice"); fp != "" {
+				t.Errorf("LoadSSHKey for unlocked user = %q; want empty", fp)
+			}
+			store.SaveSSHKey("alice", "SHA256:abc")
+			if fp, _ := store.LoadSSHKey("alice"); fp != "SHA256:abc" {
+				t.Errorf("LoadSSHKey = %q; want SHA256:abc", fp)
+			}
+
+			if bot, err := store.LoadBot("deploybot"); bot != nil || err != nil {
+				t.Errorf("LoadBot for unknown bot = %+v, %v; want nil", bot, err)
+			}
+			store.SaveBot(&models.Bot{Name: "deploybot", TokenHash: "abc", CreatedBy: "alice"})
+			if bot, _ := store.LoadBot("deploybot"); bot == nil || bot.TokenHash != "abc" || bot.CreatedBy != "alice" {
+				t.Errorf("LoadBot = %+v", bot)
+			}
+			if bots, _ := store.LoadBots(); len(bots) != 1 {
+				t.Errorf("LoadBots returned %d bots; want 1", len(bots))
+			}
+			store.DeleteBot("deploybot")
+			if bots, _ := store.LoadBots(); len(bots) != 0 {
+				t.Errorf("bot still present after DeleteBot")
+			}
+		})
+	}
+}
+
+func TestStoreMailAndLastSeen(t *testing.T) {
+	for name, store := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, text := range []string{"first", "second", "third"} {
+				if _, err := store.AppendMail("bob", models.Mail{From: "alice", Text: text}); err != nil {
+					t.Fatalf("AppendMail: %v", err)
+				}
+			}
+			mails, err := store.LoadMail("bob")
+			if err != nil || len(mails) != 3 || mails[0].Text != "first" || mails[2].ID != 3 {
+				t.Fatalf("LoadMail = %+v, %v; want first..third with IDs 1..3", mails, err)
+			}
+
+			mails[0].Read = true
+			store.SaveMail("bob", mails[0])
+			store.DeleteMail("bob", 2)
+			if id, _ := store.AppendMail("bob", models.Mail{Text: "fourth"}); id != 4 {
+				t.Errorf("AppendMail after a delete returned ID %d; want 4", id)
+			}
+			store.SaveMail("bob", models.Mail{ID: 2, Text: "resurrected"})
+
+			mails, _ = store.LoadMail("bob")
+			var got []string
+			for _, m := range mails {
+				got = append(got, m.Text)
+			}
+			if !reflect.DeepEqual(got, []string{"first", "third", "fourth"}) || !mails[0].Read || mails[1].Read {
+				t.Errorf("mailbox after update and delete = %+v", mails)
+			}
+
+			seen := time.Now().Truncate(time.Second)
+			store.SaveLastSeen("bob", seen)
+			if got, err := store.LoadLastSeen("bob"); err != nil || !got.Equal(seen) {
+				t.Errorf("LoadLastSeen = %v, %v; want %v", got, err, seen)
+			}
+			if got, _ := store.LoadLastSeen("nobody"); !got.IsZero() {
+				t.Errorf("LoadLastSeen for an unknown name = %v; want zero", got)
+			}
+		})
+	}
+}
+
+func TestStoreDirectMessages(t *testing.T) {
+	for name, store := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store.AppendDirectMessage(models.DirectMessage{From: "alice", To: "bob", Text: "hi bob"})
+			store.AppendDirectMessage(models.DirectMessage{From: "bob", To: "alice", Text: "hi alice"})
+			id, err := store.AppendDirectMessage(models.DirectMessage{From: "alice", To: "bob", Text: "lunch?"})
+			if err != nil || id != 3 {
+				t.Fatalf("AppendDirectMessage = %d, %v; want ID 3 shared by both directions", id, err)
+			}
+			store.AppendDirectMessage(models.DirectMessage{From: "alice", To: "carol", Text: "elsewhere"})
+
+			msgs, err := store.LoadDirectMessages("bob", "alice", 2)
+			if err != nil || len(msgs) != 2 || msgs[0].Text != "hi alice" || msgs[1].Text != "lunch?" {
+				t.Errorf("LoadDirectMessages(bob, alice, 2) = %+v, %v; want [hi alice, lunch?]", msgs, err)
+			}
+
+			conv := models.DirectConversation{Peer: "bob", LastID: 3, ReadID: 1}
+			store.SaveDirectConversation("alice", conv)
+			store.SaveDirectConversation("alice", models.DirectConversation{Peer: "carol", LastID: 1})
+			convs, err := store.LoadDirectConversations("alice")
+			if err != nil || len(convs) != 2 {
+				t.Fatalf("LoadDirectConversations = %+v, %v; want 2", convs, err)
+			}
+			for _, c := range convs {
+				if c.Peer == "bob" && c != conv {
+					t.Errorf("conversation with bob = %+v; want %+v", c, conv)
+				}
+			}
+		})
+	}
+}
+
+func TestBoltStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+
+	store, err := OpenBolt(path)
+	if err != nil {
+		t.Fatalf("OpenBolt: %v", err)
+	}
+	store.SaveLobby(&models.Lobby{Name: "ops", Creator: "carol"})
+	store.AppendMessage("ops", models.LobbyMessage{Username: "carol", Text: "deploying"})
+	store.SaveProfile("carol", "[忍]")
+	store.Close()
+
+	store, err = OpenBolt(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+
+	lobbies, _ := store.LoadLobbies()
+	msgs, _ := store.LoadMessages("ops", 10)
+	profile, _ := store.LoadProfile("carol")
+	if len(lobbies) != 1 || len(msgs) != 1 || profile != "[忍]" {
+		t.Errorf("after reopen got %d lobbies, %d messages, profile %q", len(lobbies), len(msgs), profile)
+	}
+}
+
+func TestStoreBans(t *testing.T) {
+	for name, store := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ban := &models.Ban{Target: "mallory", Lobby: "coding", Reason: "spam", By: "alice"}
+			if err := store.SaveBan(ban); err != nil {
+				t.Fatalf("SaveBan: %v", err)
+			}
+			store.SaveBan(&models.Ban{Target: "10.0.0.9", IsIP: true})
+
+			bans, err := store.LoadBans()
+			if err != nil || len(bans) != 2 {
+				t.Fatalf("LoadBans = %v, %v; want 2 bans", bans, err)
+			}
+
+			store.DeleteBan("coding", "mallory")
+			if bans, _ = store.LoadBans(); len(bans) != 1 || bans[0].Target != "10.0.0.9" {
+				t.Errorf("after DeleteBan got %v; want only the IP ban", bans)
+			}
+		})
+	}
+}
+
+func TestStoreDeadLetters(t *testing.T) {
+	for name, store := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < MaxDeadLetters+5; i++ {
+				dl := models.DeadLetter{Webhook: "a1", Event: "message", Attempts: i}
+				if err := store.AppendDeadLetter("ops", dl); err != nil {
+					t.Fatalf("AppendDeadLetter: %v", err)
+				}
+			}
+			store.AppendDeadLetter("dev", models.DeadLetter{Webhook: "b2"})
+
+			letters, err := store.LoadDeadLetters("ops", 0)
+			if err != nil || len(letters) != MaxDeadLetters {
+				t.Fatalf("LoadDeadLetters = %d letters, %v; want %d", len(letters), err, MaxDeadLetters)
+			}
+			if letters[0].Attempts != 5 || letters[len(letters)-1].Attempts != MaxDeadLetters+4 {
+				t.Errorf("kept attempts %d..%d; want the newest", letters[0].Attempts, letters[len(letters)-1].Attempts)
+			}
+			if recent, _ := store.LoadDeadLetters("ops", 2); len(recent) != 2 || recent[1].Attempts != MaxDeadLetters+4 {
+				t.Errorf("LoadDeadLetters with limit = %+v", recent)
+			}
+
+			store.DeleteLobby("ops")
+			if letters, _ := store.LoadDeadLetters("ops", 0); len(letters) != 0 {
+				t.Errorf("%d dead letters survived DeleteLobby", len(letters))
+			}
+			if letters, _ := store.LoadDeadLetters("dev", 0); len(letters) != 1 {
+				t.Errorf("another lobby's dead letters were dropped")
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"time"
+
+	"chat-server/server/ai"
+	"chat-server/server/models"
+)
+
+// MaxDeadLetters is how many failed webhook deliveries are kept per lobby
+const MaxDeadLetters = 100
+
+// Store persists lobbies, lobby history, AI conversations and user profiles
+// so that they survive a server restart
+type Store interface {
+	SaveLobby(lobby *models.Lobby) error
+	DeleteLobby(name string) error
+	// RenameLobby saves lobby under its new name and moves the history and
+	// AI conversation kept under oldName along with it
+	RenameLobby(oldName string, lobby *models.Lobby) error
+	LoadLobbies() ([]*models.Lobby, error)
+
+	// AppendMessage stores msg and returns its ID, unique within the lobby
+	AppendMessage(lobbyName string, msg models.LobbyMessage) (uint64, error)
+	// LoadMessages returns up to limit of the most recent messages, oldest
+	// first; limit <= 0 returns the whole history
+	LoadMessages(lobbyName string, limit int) ([]models.LobbyMessage, error)
+	// LoadMessagesSince returns up to limit of the oldest messages sent after since
+	LoadMessagesSince(lobbyName string, since time.Time, limit int) ([]models.LobbyMessage, error)
+	LoadMessagesByID(lobbyName string, ids []uint64) ([]models.LobbyMessage, error)
+	// UpdateMessage replaces the stored message with msg's ID, e.g. after
+	// an edit; it does nothing if there is no such message
+	UpdateMessage(lobbyName string, msg models.LobbyMessage) error
+
+	// SaveConversation read-locks conv while it is being serialized
+	SaveConversation(lobbyName string, conv *ai.ConversationHistory) error
+	DeleteConversation(lobbyName string) error
+	LoadConversations() (map[string]*ai.ConversationHistory, error)
+
+	SaveProfile(username, profile string) error
+	LoadProfile(username string) (string, error)
+
+	// SaveAccount stores a bcrypt password hash for a registered username
+	SaveAccount(username, passwordHash string) error
+	LoadAccount(username string) (string, error)
+	// SaveSSHKey locks a username to the fingerprint of an SSH public key
+	SaveSSHKey(username, fingerprint string) error
+	LoadSSHKey(username string) (string, error)
+
+	SaveBot(bot *models.Bot) error
+	// LoadBot returns the bot called name, or nil if there is none
+	LoadBot(name string) (*models.Bot, error)
+	DeleteBot(name string) error
+	LoadBots() ([]*models.Bot, error)
+
+	// AppendMail adds mail to a user's mailbox and returns its ID
+	AppendMail(username string, mail models.Mail) (uint64, error)
+	// LoadMail returns a user's mailbox, oldest first
+	LoadMail(username string) ([]models.Mail, error)
+	// SaveMail replaces a stored mail, e.g. to mark it read
+	SaveMail(username string, mail models.Mail) error
+	DeleteMail(username string, id uint64) error
+
+	// AppendDirectMessage stores a private message in the conversation of
+	// msg.From and msg.To and returns its ID within that conversation
+	AppendDirectMessage(msg models.DirectMessage) (uint64, error)
+	// LoadDirectMessages returns up to limit of the most recent messages
+	// between two users, oldest first; limit <= 0 returns them all
+	LoadDirectMessages(userA, userB string, limit int) ([]models.DirectMessage, error)
+	SaveDirectConversation(username string, conv models.DirectConversation) error
+	LoadDirectConversations(username string) ([]models.DirectConversation, error)
+
+	// SaveLastSeen records when a username was last connected
+	SaveLastSeen(username string, t time.Time) error
+	// LoadLastSeen returns the zero time for names never seen
+	LoadLastSeen(username string) (time.Time, error)
+
+	// AppendDeadLetter records a webhook delivery that was given up on,
+	// keeping the newest MaxDeadLetters of each lobby
+	AppendDeadLetter(lobbyName string, dl models.DeadLetter) error
+	// LoadDeadLetters returns up to limit of a lobby's most recent dead
+	// letters, oldest first
+	LoadDeadLetters(lobbyName string, limit int) ([]models.DeadLetter, error)
+
+	SaveBan(ban *models.Ban) error
+	DeleteBan(lobbyName, target string) error
+	LoadBans() ([]*models.Ban, error)
+
+	Close() error
+}
+
+// banKey identifies a ban by its scope and target
+func banKey(lobbyName, target string) string {
+	return lobbyName + "|" + target
+}
+
+// dmPairKey identifies the conversation between two users regardless of
+// who wrote first
+func dmPairKey(userA, userB string) string {
+	if userB < userA {
+		userA, userB = userB, userA
+	}
+	return userA + "\x00" + userB
+}
+
+// conversationRecord is the serialized form of an AI conversation
+type conversationRecord struct {
+	Messages   []ai.Message
+	LastActive time.Time
+}
+
+func newConversationRecord(conv *ai.ConversationHistory) conversationRecord {
+	conv.Mu.RLock()
+	defer conv.Mu.RUnlock()
+
+	messages := make([]ai.Message, len(conv.Messages))
+	copy(messages, conv.Messages)
+	return conversationRecord{Messages: messages, LastActive: conv.LastActive}
+}
+
+func (r conversationRecord) history() *ai.ConversationHistory {
+	return &ai.ConversationHistory{
+		Messages:   r.Messages,
+		LastActive: r.LastActive,
+	}
+}
@@ -1,5 +1,10 @@
 package utils
 
+import (
+	"regexp"
+	"strings"
+)
+
 const (
 	ColorReset   = "\033[0m"
 	ColorRed     = "\033[31m"
@@ -32,3 +37,11 @@ func BuildColor(text, color string) string {
 		return text
 	}
 }
+
+// ansiCodes matches terminal escape sequences such as colors and line clears
+var ansiCodes = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// StripANSI removes terminal escape sequences and carriage returns from s
+func StripANSI(s string) string {
+	return strings.ReplaceAll(ansiCodes.ReplaceAllString(s, ""), "\r", "")
+}
@@ -38,16 +38,39 @@ func FormatTimeAgo(t time.Time) string {
 	}
 }
 
-// FormatMessage formats a chat message for display
-func FormatMessage(senderProfile, username, text, colorYellow, colorWhite, colorCyan, colorReset string, timestamp time.Time) string {
-	timeAgo := FormatTimeAgo(timestamp)
-	return fmt.Sprintf("%s%s %s%s [%s%s%s]\n  %s╰─>%s %s\n",
+// TimestampLayout is how absolute message times are shown and parsed
+const TimestampLayout = "2006-01-02 15:04:05"
+
+// FormatTimestamp returns t in the server's local time using TimestampLayout
+func FormatTimestamp(t time.Time) string {
+	return t.Local().Format(TimestampLayout)
+}
+
+// FormatMessage formats a chat message for display. A non-zero id is
+// shown first so that users can refer to the message.
+func FormatMessage(id uint64, senderProfile, username, text, colorYellow, colorWhite, colorCyan, colorReset string, timestamp time.Time) string {
+	return formatMessage(id, senderProfile, username, text, colorYellow, colorWhite, colorCyan, colorReset, FormatTimeAgo(timestamp))
+}
+
+// FormatMessageAt is FormatMessage with an absolute timestamp instead of a
+// relative one, for history that may be days old
+func FormatMessageAt(id uint64, senderProfile, username, text, colorYellow, colorWhite, colorCyan, colorReset string, timestamp time.Time) string {
+	return formatMessage(id, senderProfile, username, text, colorYellow, colorWhite, colorCyan, colorReset, FormatTimestamp(timestamp))
+}
+
+func formatMessage(id uint64, senderProfile, username, text, colorYellow, colorWhite, colorCyan, colorReset, when string) string {
+	ref := ""
+	if id != 0 {
+		ref = fmt.Sprintf("%s#%d%s ", colorWhite, id, colorReset)
+	}
+	return fmt.Sprintf("%s%s%s %s%s [%s%s%s]\n  %s╰─>%s %s\n",
+		ref,
 		colorYellow,
 		senderProfile,
 		username,
 		colorReset,
 		colorWhite,
-		timeAgo,
+		when,
 		colorReset,
 		colorCyan,
 		colorReset,
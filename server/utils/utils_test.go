@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -51,3 +52,35 @@ func TestIsValidUsername(t *testing.T) {
 		})
 	}
 }
+
+func TestIsValidLobbyName(t *testing.T) {
+	for _, name := range []string{"golang", "team-2", "v1.2_notes"} {
+		if ok, msg := IsValidLobbyName(name); !ok {
+			t.Errorf("IsValidLobbyName(%q) = %q", name, msg)
+		}
+	}
+	for _, name := range []string{"", "a|b", "two words", "tab\there", "émoji", strings.Repeat("x", MaxLobbyNameLength+1)} {
+		if ok, _ := IsValidLobbyName(name); ok {
+			t.Errorf("IsValidLobbyName(%q) accepted", name)
+		}
+	}
+}
+
+func TestFormatMessageShowsID(t *testing.T) {
+	at := time.Date(2024, 5, 1, 9, 30, 0, 0, time.Local)
+	got := FormatMessageAt(42, "[@_@]", "alice", "hi", "", "", "", "", at)
+	want := "#42 [@_@] alice [2024-05-01 09:30:00]\n  ╰─> hi\n"
+	if got != want {
+		t.Errorf("FormatMessageAt = %q; want %q", got, want)
+	}
+	if got := FormatMessageAt(0, "[@_@]", "alice", "hi", "", "", "", "", at); got != want[len("#42 "):] {
+		t.Errorf("FormatMessageAt without an ID = %q", got)
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	in := "\r\033[K" + ColorBlue + ColorBold + "[LOBBY] " + ColorReset + "alice joined\n" + ColorCyan + "> " + ColorReset
+	if got, want := StripANSI(in), "[LOBBY] alice joined\n> "; got != want {
+		t.Errorf("StripANSI = %q; want %q", got, want)
+	}
+}
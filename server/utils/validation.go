@@ -1,20 +1,50 @@
 package utils
 
-import "fmt"
+import (
+	"fmt"
+	"sync/atomic"
+)
 
+// Default limits, used until SetLimits is called
 const (
-	MaxUsernameLength = 20
-	MinUsernameLength = 2
-	MaxMessageLength  = 1000
+	MaxUsernameLength  = 20
+	MinUsernameLength  = 2
+	MaxMessageLength   = 1000
+	MaxLobbyNameLength = 32
+)
+
+var (
+	maxUsernameLength atomic.Int64
+	maxMessageLength  atomic.Int64
 )
 
+func init() {
+	SetLimits(MaxUsernameLength, MaxMessageLength)
+}
+
+// SetLimits replaces the active username and message length limits
+func SetLimits(usernameLength, messageLength int) {
+	maxUsernameLength.Store(int64(usernameLength))
+	maxMessageLength.Store(int64(messageLength))
+}
+
+// UsernameLengthLimit returns the longest username a client may choose
+func UsernameLengthLimit() int {
+	return int(maxUsernameLength.Load())
+}
+
+// MessageLengthLimit returns the longest message a client may send
+func MessageLengthLimit() int {
+	return int(maxMessageLength.Load())
+}
+
 // IsValidUsername validates username format
 func IsValidUsername(username string) (bool, string) {
 	if len(username) < MinUsernameLength {
 		return false, fmt.Sprintf("Username too short (min %d characters)", MinUsernameLength)
 	}
-	if len(username) > MaxUsernameLength {
-		return false, fmt.Sprintf("Username too long (max %d characters)", MaxUsernameLength)
+	if maxLen := UsernameLengthLimit(); len(username) > maxLen {
+		return false, fmt.Sprintf("Username too long (max %d characters)", maxLen)
 	}
 	for _, ch := range username {
 		if !((ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') ||
@@ -24,3 +54,22 @@ func IsValidUsername(username string) (bool, string) {
 	}
 	return true, ""
 }
+
+// IsValidLobbyName validates a name for a new or renamed lobby. Stored
+// keys join lobby names to others with '|', so that is refused with
+// spaces and everything else outside letters, numbers, '-', '_' and '.'.
+func IsValidLobbyName(name string) (bool, string) {
+	if name == "" {
+		return false, "Lobby name can't be empty"
+	}
+	if len(name) > MaxLobbyNameLength {
+		return false, fmt.Sprintf("Lobby name too long (max %d characters)", MaxLobbyNameLength)
+	}
+	for _, ch := range name {
+		if !((ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') ||
+			(ch >= '0' && ch <= '9') || ch == '_' || ch == '-' || ch == '.') {
+			return false, "Lobby name can only contain letters, numbers, -, _ and ."
+		}
+	}
+	return true, ""
+}
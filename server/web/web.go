@@ -0,0 +1,48 @@
+package web
+
+import (
+	"embed"
+	"io/fs"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// NewHandler returns an http.Handler that serves the browser client at /
+// and upgrades requests on /ws to WebSocket connections. Each WebSocket is
+// handed to connect as a net.Conn, so browser users go through the same
+// chat loop as raw TCP users. connect must block until the session ends.
+func NewHandler(connect func(net.Conn)) http.Handler {
+	static, _ := fs.Sub(staticFiles, "static")
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	mux.Handle("/ws", websocket.Handler(func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.TextFrame
+		connect(&wsConn{Conn: ws, remote: remoteAddr(ws.Request())})
+	}))
+	return mux
+}
+
+// wsConn adapts a WebSocket to net.Conn. The embedded websocket.Conn
+// already implements net.Conn, but its RemoteAddr reports the page
+// origin, which would break per-IP connection limits.
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
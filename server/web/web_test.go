@@ -0,0 +1,57 @@
+package web
+
+import (
+	"bufio"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketAdapter(t *testing.T) {
+	remotes := make(chan string, 1)
+	srv := httptest.NewServer(NewHandler(func(conn net.Conn) {
+		remotes <- conn.RemoteAddr().String()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("echo: " + line))
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	ws, err := websocket.Dial(url, "", srv.URL)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	if _, err := ws.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var reply string
+	if err := websocket.Message.Receive(ws, &reply); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if reply != "echo: hello\n" {
+		t.Errorf("reply = %q; want %q", reply, "echo: hello\n")
+	}
+
+	if remote := <-remotes; !strings.HasPrefix(remote, "127.0.0.1:") {
+		t.Errorf("RemoteAddr = %q; want the client's 127.0.0.1 address", remote)
+	}
+}
+
+func TestServesBrowserClient(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(func(net.Conn) {}))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("GET /: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("GET / = %d %s; want 200 text/html", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
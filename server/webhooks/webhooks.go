@@ -0,0 +1,472 @@
+// Package webhooks delivers lobby events to the URLs lobby owners
+// register. Each delivery is a JSON POST signed with the webhook's secret.
+// Failed deliveries are retried with exponential backoff by a background
+// dispatcher, and those that keep failing are stored as dead letters.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"chat-server/server/metrics"
+	"chat-server/server/models"
+	"chat-server/server/storage"
+)
+
+// Event types a webhook can subscribe to
+const (
+	EventMessage    = "message"     // a message posted to the lobby
+	EventJoin       = "join"        // a user entered the lobby
+	EventLeave      = "leave"       // a user left the lobby or disconnected
+	EventMention    = "mention"     // a message that @mentions a user, once per user
+	EventAIResponse = "ai_response" // a complete AI reply
+)
+
+// EventPing is what a test delivery carries, whatever the webhook
+// subscribes to
+const EventPing = "ping"
+
+// Events lists every event type a webhook can subscribe to
+var Events = []string{EventMessage, EventJoin, EventLeave, EventMention, EventAIResponse}
+
+// Headers sent with every delivery
+const (
+	// SignatureHeader is "sha256=" followed by the hex HMAC-SHA256 of the
+	// body, keyed with the webhook's secret
+	SignatureHeader = "X-Chat-Signature"
+	EventHeader     = "X-Chat-Event"
+	// DeliveryHeader identifies a delivery; retries of it carry the same ID
+	DeliveryHeader = "X-Chat-Delivery"
+)
+
+// maxBackoff caps the wait between retries
+const maxBackoff = 5 * time.Minute
+
+// Size of the dispatcher's worker pool and delivery queue
+const (
+	workers   = 4
+	queueSize = 256
+)
+
+var (
+	deliveries = metrics.NewCounterVec("chat_webhook_deliveries_total",
+		"Webhook delivery attempts, by result.", "result")
+
+	mentionPattern = regexp.MustCompile(`@([A-Za-z0-9_-]+)`)
+
+	// errBlocked marks a delivery refused because its host resolved to
+	// an address webhooks may not reach
+	errBlocked = errors.New("address not allowed for webhooks")
+)
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	Event     string    `json:"event"`
+	Webhook   string    `json:"webhook"`
+	Lobby     string    `json:"lobby"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to,omitempty"` // the mentioned user, or who asked the AI
+	ID        uint64    `json:"id,omitempty"` // the message ID
+	Text      string    `json:"text,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Sign returns the SignatureHeader value for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the SignatureHeader value for body.
+// Receivers written in Go can use it to check a delivery.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// New returns a webhook posting events of the given types to rawURL, with
+// a fresh ID and secret
+func New(rawURL string, events []string, by string) (models.Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return models.Webhook{}, fmt.Errorf("the URL must start with http:// or https://")
+	}
+	if len(events) == 0 {
+		return models.Webhook{}, fmt.Errorf("choose at least one event")
+	}
+	for _, event := range events {
+		if !slices.Contains(Events, event) {
+			return models.Webhook{}, fmt.Errorf("unknown event %q; choose from %s", event, strings.Join(Events, ", "))
+		}
+	}
+	id, err := randomHex(4)
+	if err != nil {
+		return models.Webhook{}, fmt.Errorf("failed to create webhook")
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return models.Webhook{}, fmt.Errorf("failed to create webhook")
+	}
+	return models.Webhook{
+		ID:      id,
+		URL:     u.String(),
+		Secret:  secret,
+		Events:  slices.Compact(slices.Sorted(slices.Values(events))),
+		By:      by,
+		Created: time.Now(),
+	}, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Settings control how deliveries are retried
+type Settings struct {
+	MaxAttempts int           // attempts before a delivery becomes a dead letter
+	Backoff     time.Duration // wait before the first retry; it doubles after each
+	Timeout     time.Duration // how long one attempt may take
+
+	// AllowedNetworks exempts ranges from the check that keeps deliveries
+	// off loopback, link-local, private and unspecified addresses
+	AllowedNetworks []netip.Prefix
+}
+
+// DefaultSettings are used until Configure is called
+func DefaultSettings() Settings {
+	return Settings{MaxAttempts: 5, Backoff: 2 * time.Second, Timeout: 10 * time.Second}
+}
+
+// Dispatcher delivers events in the background. Publish never blocks: a
+// delivery that doesn't fit in the queue is dead-lettered straight away.
+type Dispatcher struct {
+	hooks  func(lobby string) []models.Webhook
+	store  storage.Store
+	client *http.Client
+	queue  chan *delivery
+
+	mu       sync.RWMutex
+	settings Settings
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// delivery is one event on its way to one webhook
+type delivery struct {
+	id       string
+	lobby    string
+	hook     models.Webhook
+	event    string
+	body     []byte
+	attempts int
+}
+
+// NewDispatcher returns a dispatcher that finds a lobby's webhooks with
+// hooks and keeps dead letters in store
+func NewDispatcher(hooks func(lobby string) []models.Webhook, store storage.Store) *Dispatcher {
+	d := &Dispatcher{
+		hooks:    hooks,
+		store:    store,
+		queue:    make(chan *delivery, queueSize),
+		settings: DefaultSettings(),
+		stop:     make(chan struct{}),
+	}
+	// No proxy, so the dialer sees every address a delivery connects to
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: d.control}
+	d.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        16,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		// A redirect could lead anywhere, so it counts as a failed delivery
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return d
+}
+
+// Configure replaces the retry settings; deliveries already waiting for a
+// retry keep their schedule
+func (d *Dispatcher) Configure(s Settings) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.settings = s
+}
+
+func (d *Dispatcher) currentSettings() Settings {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.settings
+}
+
+// CheckURL reports an error if the host of rawURL resolves to an address
+// webhooks may not reach. Deliveries are checked again as they connect,
+// in case the name is pointed somewhere else later.
+func (d *Dispatcher) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return fmt.Errorf("can't resolve %s", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if d.checkAddr(addr) != nil {
+			return fmt.Errorf("webhooks can't be sent to %s, which is a loopback, link-local or private address",
+				addr.Unmap())
+		}
+	}
+	return nil
+}
+
+// control vets each address the delivery client dials
+func (d *Dispatcher) control(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	return d.checkAddr(addrPort.Addr())
+}
+
+// checkAddr refuses addresses that would let a lobby owner reach the
+// server itself or the network behind it, unless they are allowed
+func (d *Dispatcher) checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, allowed := range d.currentSettings().AllowedNetworks {
+		if allowed.Contains(addr) {
+			return nil
+		}
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsMulticast() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%s: %w", addr, errBlocked)
+	}
+	return nil
+}
+
+// Start runs the delivery workers
+func (d *Dispatcher) Start() {
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+}
+
+// Stop waits for the deliveries in progress. Queued deliveries and those
+// waiting for a retry are dropped.
+func (d *Dispatcher) Stop() {
+	d.stopOnce.Do(func() { close(d.stop) })
+	d.wg.Wait()
+}
+
+// Publish queues ev for every webhook of its lobby that subscribes to its
+// type. A message also counts as a mention of each user it @mentions.
+func (d *Dispatcher) Publish(ev models.Event) {
+	var event string
+	switch ev.Type {
+	case models.EventMessage:
+		event = EventMessage
+	case models.EventJoin:
+		event = EventJoin
+	case models.EventLeave:
+		event = EventLeave
+	case models.EventAIResponse:
+		event = EventAIResponse
+	default:
+		return
+	}
+	if ev.Lobby == "" {
+		return
+	}
+	hooks := d.hooks(ev.Lobby)
+	if len(hooks) == 0 {
+		return
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+
+	var mentioned []string
+	if event == EventMessage {
+		for _, m := range mentionPattern.FindAllStringSubmatch(ev.Text, -1) {
+			if name := m[1]; name != ev.From && !slices.Contains(mentioned, name) {
+				mentioned = append(mentioned, name)
+			}
+		}
+	}
+
+	for _, hook := range hooks {
+		if slices.Contains(hook.Events, event) {
+			d.send(ev.Lobby, hook, payload(hook, event, ev, ev.To))
+		}
+		if slices.Contains(hook.Events, EventMention) {
+			for _, name := range mentioned {
+				d.send(ev.Lobby, hook, payload(hook, EventMention, ev, name))
+			}
+		}
+	}
+}
+
+func payload(hook models.Webhook, event string, ev models.Event, to string) Payload {
+	return Payload{
+		Event:     event,
+		Webhook:   hook.ID,
+		Lobby:     ev.Lobby,
+		From:      ev.From,
+		To:        to,
+		ID:        ev.ID,
+		Text:      ev.Text,
+		Timestamp: ev.Timestamp,
+	}
+}
+
+// Ping queues a test delivery to hook
+func (d *Dispatcher) Ping(lobby string, hook models.Webhook, by string) {
+	d.send(lobby, hook, Payload{
+		Event:     EventPing,
+		Webhook:   hook.ID,
+		Lobby:     lobby,
+		From:      by,
+		Text:      "Test delivery from go-chat",
+		Timestamp: time.Now(),
+	})
+}
+
+func (d *Dispatcher) send(lobby string, hook models.Webhook, p Payload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("Failed to encode webhook payload: %v", err)
+		return
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		log.Printf("Failed to create webhook delivery ID: %v", err)
+		return
+	}
+	d.enqueue(&delivery{id: id, lobby: lobby, hook: hook, event: p.Event, body: body})
+}
+
+func (d *Dispatcher) enqueue(del *delivery) {
+	select {
+	case <-d.stop:
+	case d.queue <- del:
+	default:
+		d.deadLetter(del, "delivery queue full")
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case del := <-d.queue:
+			d.attempt(del)
+		}
+	}
+}
+
+// attempt posts a delivery once and schedules a retry if it failed in a
+// way that might not happen again
+func (d *Dispatcher) attempt(del *delivery) {
+	settings := d.currentSettings()
+	del.attempts++
+	retry, err := d.post(del, settings.Timeout)
+	if err == nil {
+		deliveries.Inc("delivered")
+		return
+	}
+	if !retry || del.attempts >= settings.MaxAttempts {
+		d.deadLetter(del, err.Error())
+		return
+	}
+
+	deliveries.Inc("retried")
+	backoff := settings.Backoff << (del.attempts - 1)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	time.AfterFunc(backoff, func() { d.enqueue(del) })
+}
+
+// post sends a delivery, reporting whether a failure is worth retrying:
+// network errors, 429 and 5xx responses are; refused addresses and other
+// responses, redirects included, are not
+func (d *Dispatcher) post(del *delivery, timeout time.Duration) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.hook.URL, bytes.NewReader(del.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-chat-webhooks")
+	req.Header.Set(SignatureHeader, Sign(del.hook.Secret, del.body))
+	req.Header.Set(EventHeader, del.event)
+	req.Header.Set(DeliveryHeader, del.id)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return !errors.Is(err, errBlocked), err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("%s responded %s", del.hook.URL, resp.Status)
+}
+
+// DeadLetters returns up to limit of a lobby's most recent failed
+// deliveries, oldest first
+func (d *Dispatcher) DeadLetters(lobby string, limit int) ([]models.DeadLetter, error) {
+	return d.store.LoadDeadLetters(lobby, limit)
+}
+
+func (d *Dispatcher) deadLetter(del *delivery, reason string) {
+	deliveries.Inc("dead")
+	log.Printf("Webhook %s in %s gave up on a %s event after %d attempts: %s",
+		del.hook.ID, del.lobby, del.event, del.attempts, reason)
+	err := d.store.AppendDeadLetter(del.lobby, models.DeadLetter{
+		Webhook:  del.hook.ID,
+		URL:      del.hook.URL,
+		Event:    del.event,
+		Payload:  del.body,
+		Attempts: del.attempts,
+		Error:    reason,
+		Failed:   time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to save webhook dead letter: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-server/server/models"
+	"chat-server/server/storage"
+)
+
+// receiver is a webhook endpoint that fails its first fail requests with
+// status and records the deliveries it accepts
+type receiver struct {
+	t      *testing.T
+	secret string
+	status int
+
+	mu       sync.Mutex
+	fail     int
+	attempts map[string]int // delivery ID -> requests seen
+	got      chan Payload
+}
+
+func newReceiver(t *testing.T, secret string, fail, status int) (*receiver, string) {
+	r := &receiver{t: t, secret: secret, fail: fail, status: status,
+		attempts: map[string]int{}, got: make(chan Payload, 10)}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return r, srv.URL
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	if !Verify(r.secret, body, req.Header.Get(SignatureHeader)) {
+		r.t.Errorf("bad signature %q", req.Header.Get(SignatureHeader))
+	}
+	r.mu.Lock()
+	r.attempts[req.Header.Get(DeliveryHeader)]++
+	failing := r.fail > 0
+	r.fail--
+	r.mu.Unlock()
+	if failing {
+		w.WriteHeader(r.status)
+		return
+	}
+	var p Payload
+	if err := json.Unmarshal(body, &p); err != nil {
+		r.t.Errorf("payload: %v", err)
+	}
+	if req.Header.Get(EventHeader) != p.Event {
+		r.t.Errorf("%s = %q; payload event is %q", EventHeader, req.Header.Get(EventHeader), p.Event)
+	}
+	r.got <- p
+}
+
+func (r *receiver) next(t *testing.T) Payload {
+	t.Helper()
+	select {
+	case p := <-r.got:
+		return p
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delivery arrived")
+		return Payload{}
+	}
+}
+
+func newTestDispatcher(t *testing.T, hooks ...models.Webhook) (*Dispatcher, storage.Store) {
+	store := storage.NewMemoryStore()
+	d := NewDispatcher(func(lobby string) []models.Webhook {
+		if lobby == "general" {
+			return hooks
+		}
+		return nil
+	}, store)
+	d.Configure(Settings{MaxAttempts: 3, Backoff: 5 * time.Millisecond, Timeout: time.Second,
+		AllowedNetworks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}})
+	d.Start()
+	t.Cleanup(d.Stop)
+	return d, store
+}
+
+func TestNew(t *testing.T) {
+	hook, err := New("https://example.com/hook", []string{EventJoin, EventMessage}, "alice")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if len(hook.ID) != 8 || len(hook.Secret) != 48 || hook.By != "alice" {
+		t.Errorf("hook = %+v", hook)
+	}
+
+	for _, tc := range []struct {
+		url    string
+		events []string
+		want   string
+	}{
+		{"ftp://example.com", Events, "http:// or https://"},
+		{"https://", Events, "http:// or https://"},
+		{"https://example.com", nil, "at least one event"},
+		{"https://example.com", []string{"typing"}, "unknown event"},
+	} {
+		if _, err := New(tc.url, tc.events, "alice"); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("New(%q, %v) = %v; want %q", tc.url, tc.events, err, tc.want)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	body := []byte(`{"event":"ping"}`)
+	sig := Sign("secret", body)
+	if !strings.HasPrefix(sig, "sha256=") || !Verify("secret", body, sig) {
+		t.Errorf("Sign = %q does not verify", sig)
+	}
+	if Verify("other", body, sig) || Verify("secret", []byte(`{}`), sig) {
+		t.Error("Verify accepted a wrong secret or body")
+	}
+}
+
+func TestPublishFiltersEvents(t *testing.T) {
+	r, url := newReceiver(t, "s3cret", 0, 0)
+	d, _ := newTestDispatcher(t, models.Webhook{ID: "h1", URL: url, Secret: "s3cret",
+		Events: []string{EventMention, EventAIResponse}})
+
+	d.Publish(models.Event{Type: models.EventJoin, Lobby: "general", From: "bob"})
+	d.Publish(models.Event{Type: models.EventMessage, Lobby: "random", From: "bob", Text: "@alice elsewhere"})
+	d.Publish(models.Event{Type: models.EventMessage, Lobby: "general", From: "bob", ID: 7,
+		Text: "@alice and @carol, not @bob; @alice again"})
+
+	var mentioned []string
+	for range 2 {
+		p := r.next(t)
+		if p.Event != EventMention || p.Webhook != "h1" || p.Lobby != "general" || p.From != "bob" || p.ID != 7 {
+			t.Errorf("mention = %+v", p)
+		}
+		mentioned = append(mentioned, p.To)
+	}
+	if !(mentioned[0] == "alice" && mentioned[1] == "carol" || mentioned[0] == "carol" && mentioned[1] == "alice") {
+		t.Errorf("mentioned = %v; want alice and carol", mentioned)
+	}
+
+	d.Publish(models.Event{Type: models.EventAIResponse, Lobby: "general", From: "AI", To: "bob", Text: "42"})
+	if p := r.next(t); p.Event != EventAIResponse || p.To != "bob" || p.Text != "42" || p.Timestamp.IsZero() {
+		t.Errorf("ai_response = %+v", p)
+	}
+	select {
+	case p := <-r.got:
+		t.Errorf("unexpected delivery %+v", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRetryThenDeliver(t *testing.T) {
+	r, url := newReceiver(t, "s3cret", 2, http.StatusServiceUnavailable)
+	d, store := newTestDispatcher(t, models.Webhook{ID: "h1", URL: url, Secret: "s3cret", Events: Events})
+
+	d.Publish(models.Event{Type: models.EventMessage, Lobby: "general", From: "bob", Text: "hello"})
+	if p := r.next(t); p.Event != EventMessage || p.Text != "hello" {
+		t.Errorf("delivery = %+v", p)
+	}
+	r.mu.Lock()
+	for id, n := range r.attempts {
+		if n != 3 {
+			t.Errorf("delivery %s took %d requests; want 3 with the same ID", id, n)
+		}
+	}
+	r.mu.Unlock()
+	if letters, _ := store.LoadDeadLetters("general", 10); len(letters) != 0 {
+		t.Errorf("dead letters = %+v", letters)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	_, retried := newReceiver(t, "s3cret", 100, http.StatusBadGateway)
+	_, refused := newReceiver(t, "s3cret", 100, http.StatusNotFound)
+	d, _ := newTestDispatcher(t,
+		models.Webhook{ID: "retried", URL: retried, Secret: "s3cret", Events: []string{EventJoin}},
+		models.Webhook{ID: "refused", URL: refused, Secret: "s3cret", Events: []string{EventJoin}})
+
+	d.Publish(models.Event{Type: models.EventJoin, Lobby: "general", From: "bob"})
+
+	letters := waitForDeadLetters(t, d, 2)
+	attempts := map[string]int{}
+	for _, dl := range letters {
+		attempts[dl.Webhook] = dl.Attempts
+		var p Payload
+		if dl.Event != EventJoin || json.Unmarshal(dl.Payload, &p) != nil || p.From != "bob" || dl.Error == "" {
+			t.Errorf("dead letter = %+v", dl)
+		}
+	}
+	if attempts["retried"] != 3 || attempts["refused"] != 1 {
+		t.Errorf("attempts = %v; want 3 for a 502 and 1 for a 404", attempts)
+	}
+}
+
+// waitForDeadLetters polls until the general lobby has n dead letters
+func waitForDeadLetters(t *testing.T, d *Dispatcher, n int) []models.DeadLetter {
+	t.Helper()
+	var letters []models.DeadLetter
+	deadline := time.Now().Add(2 * time.Second)
+	for len(letters) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		letters, _ = d.DeadLetters("general", 10)
+	}
+	if len(letters) != n {
+		t.Fatalf("dead letters = %+v; want %d", letters, n)
+	}
+	return letters
+}
+
+func TestInternalAddressesRefused(t *testing.T) {
+	d := NewDispatcher(func(string) []models.Webhook { return nil }, storage.NewMemoryStore())
+	for _, rawURL := range []string{
+		"http://127.0.0.1:8080/metrics",
+		"http://[::1]/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.7/",
+		"http://192.168.1.1/",
+		"http://0.0.0.0/",
+		"http://[::ffff:127.0.0.1]/",
+	} {
+		if err := d.CheckURL(context.Background(), rawURL); err == nil {
+			t.Errorf("CheckURL(%q) accepted an internal address", rawURL)
+		}
+	}
+	if err := d.CheckURL(context.Background(), "https://93.184.215.14/hook"); err != nil {
+		t.Errorf("CheckURL of a public address = %v", err)
+	}
+
+	d.Configure(Settings{MaxAttempts: 1, Timeout: time.Second,
+		AllowedNetworks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}})
+	if err := d.CheckURL(context.Background(), "http://10.0.0.7/"); err != nil {
+		t.Errorf("CheckURL of an allowed network = %v", err)
+	}
+}
+
+func TestLoopbackDeliveryRefused(t *testing.T) {
+	r, url := newReceiver(t, "s3cret", 0, 0)
+	store := storage.NewMemoryStore()
+	hooks := []models.Webhook{{ID: "h1", URL: url, Secret: "s3cret", Events: Events}}
+	d := NewDispatcher(func(string) []models.Webhook { return hooks }, store)
+	d.Configure(Settings{MaxAttempts: 3, Backoff: 5 * time.Millisecond, Timeout: time.Second})
+	d.Start()
+	t.Cleanup(d.Stop)
+
+	d.Publish(models.Event{Type: models.EventJoin, Lobby: "general", From: "bob"})
+	letters := waitForDeadLetters(t, d, 1)
+	if letters[0].Attempts != 1 || !strings.Contains(letters[0].Error, "not allowed") {
+		t.Errorf("dead letter = %+v; want one refused attempt", letters[0])
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.attempts) != 0 {
+		t.Errorf("the loopback receiver was reached %d times", len(r.attempts))
+	}
+}
+
+func TestRedirectNotFollowed(t *testing.T) {
+	r, target := newReceiver(t, "s3cret", 0, 0)
+	redirector := httptest.NewServer(http.RedirectHandler(target, http.StatusFound))
+	t.Cleanup(redirector.Close)
+	d, _ := newTestDispatcher(t, models.Webhook{ID: "h1", URL: redirector.URL, Secret: "s3cret", Events: Events})
+
+	d.Publish(models.Event{Type: models.EventJoin, Lobby: "general", From: "bob"})
+	letters := waitForDeadLetters(t, d, 1)
+	if letters[0].Attempts != 1 || !strings.Contains(letters[0].Error, "302") {
+		t.Errorf("dead letter = %+v; want one attempt ending in a 302", letters[0])
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.attempts) != 0 {
+		t.Error("the redirect was followed")
+	}
+}